@@ -0,0 +1,8 @@
+//go:build goexperiment.jsonv2
+// +build goexperiment.jsonv2
+
+package main
+
+// Zoekt's Repository.UnmarshalJSON recurses forever with the encoding/json
+// of GOEXPERIMENT=jsonv2, so shards can't be loaded in tests built with it.
+const shardsUnloadable = "zoekt can't load shards with GOEXPERIMENT=jsonv2, run with GOEXPERIMENT=nojsonv2"
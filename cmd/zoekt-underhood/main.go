@@ -4,6 +4,7 @@ import (
 	//"context"
 	"flag"
 	"fmt"
+	"io"
 	//"html/template"
 	//"io/ioutil"
 	"log"
@@ -11,11 +12,12 @@ import (
 	"net/http/pprof"
 	"os"
 	"path/filepath"
-	//"strings"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/TreeTide/zoekt-underhood/web"
-	//"github.com/google/zoekt"
+	"github.com/google/zoekt"
 	//"github.com/google/zoekt/build"
 	"github.com/google/zoekt/shards"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -25,11 +27,14 @@ import (
 
 const logFormat = "2006-01-02T15-04-05.999999999Z07"
 
-func divertLogs(dir string, interval time.Duration) {
+// divertLogs writes the logs to a new file in dir every interval, and the
+// access log too, if not nil.
+func divertLogs(dir string, interval time.Duration, access *switchWriter) {
 	t := time.NewTicker(interval)
-	var last *os.File
+	var last, lastAccess *os.File
 	for {
-		nm := filepath.Join(dir, fmt.Sprintf("zoekt-underhood.%s.%d.log", time.Now().Format(logFormat), os.Getpid()))
+		now := time.Now().Format(logFormat)
+		nm := filepath.Join(dir, fmt.Sprintf("zoekt-underhood.%s.%d.log", now, os.Getpid()))
 		fmt.Fprintf(os.Stderr, "writing logs to %s\n", nm)
 
 		f, err := os.Create(nm)
@@ -44,21 +49,85 @@ func divertLogs(dir string, interval time.Duration) {
 
 		last = f
 
+		if access != nil {
+			nm := filepath.Join(dir, fmt.Sprintf("zoekt-underhood-access.%s.%d.log", now, os.Getpid()))
+			f, err := os.Create(nm)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "can't create output file %s: %v\n", nm, err)
+				os.Exit(2)
+			}
+			access.set(f)
+			lastAccess.Close()
+			lastAccess = f
+		}
+
 		<-t.C
 	}
 }
 
+// switchWriter writes to a writer that can be switched, like to the next
+// log file.
+type switchWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (s *switchWriter) Write(b []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.w.Write(b)
+}
+
+// set switches to w. Writes to the previous writer are done on return.
+func (s *switchWriter) set(w io.Writer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.w = w
+}
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "verify" {
+		verifyMain(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		replayMain(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "serve-all" {
+		serveAllMain(os.Args[2:])
+		return
+	}
+
 	logDir := flag.String("log_dir", "", "log to this directory rather than stderr.")
 	logRefresh := flag.Duration("log_refresh", 24*time.Hour, "if using --log_dir, start writing a new file this often.")
+	accessLog := flag.String("access_log", "", "log requests in this format (common, combined or json) to stdout, or to files next to the logs if using --log_dir.")
+	accessLogSample := flag.String("access_log_sample", "", "comma-separated path=fraction entries, logging only the fraction of requests to the path, like /api/suggest=0.1.")
 
 	listen := flag.String("listen", ":6080", "listen on this address.")
 	index := flag.String("index", "", "set index directory to use")
+	configFile := flag.String("config", "", "set path to JSON config file.")
+	skipEstimate := flag.Bool("skip_estimate", false, "skip the doc count estimate before xref searches by default.")
+	defaultCasing := flag.String("default_casing", "", "casing (yes, no or auto) of xref searches not giving one. Overrides the config.")
+	defaultMode := flag.String("default_mode", "", "mode (Lax, Boundary, Regexp or Raw) of xref searches not giving one. Overrides the config.")
+	disable := flag.String("disable", "", "comma-separated endpoints or features to disable, in addition to the config.")
+	highlightStyle := flag.String("highlight_style", "", "chroma style of syntax-highlighted source, enables format=html on /api/source. Overrides the config.")
+	repoDir := flag.String("repo_dir", "", "comma-separated directories of the bare git repos the index was built from, or repo=dir entries, enables /api/blame. Adds to the config.")
+	pools := flag.Int("pools", 1, "partition the shards by repo into this many searcher pools, for large hosts.")
+	warmup := flag.Bool("warmup", false, "before serving, list the repos and read the shards into the page cache, so the first queries are fast.")
+	warmupRepos := flag.String("warmup_repos", "", "comma-separated repos whose shards -warmup reads, all if empty.")
+	poolDir := flag.String("pool_dir", "", "directory for the pool directories with -pools, a temporary one if empty.")
+	recordFixtures := flag.String("record_fixtures", "", "development mode: record API requests and responses as fixtures into this directory, for the replay subcommand.")
 	enablePprof := flag.Bool("pprof", false, "set to enable remote profiling.")
 	sslCert := flag.String("ssl_cert", "", "set path to SSL .pem holding certificate.")
 	sslKey := flag.String("ssl_key", "", "set path to SSL .pem holding key.")
 	flag.Parse()
 
+	// Set if logging requests, to stdout until divertLogs switches it.
+	var access *switchWriter
+	if *accessLog != "" {
+		access = &switchWriter{w: os.Stdout}
+	}
 	if *logDir != "" {
 		if fi, err := os.Lstat(*logDir); err != nil || !fi.IsDir() {
 			log.Fatalf("%s is not a directory", *logDir)
@@ -66,7 +135,7 @@ func main() {
 		// We could do fdup acrobatics to also redirect
 		// stderr, but it is simpler and more portable for the
 		// caller to divert stderr output if necessary.
-		go divertLogs(*logDir, *logRefresh)
+		go divertLogs(*logDir, *logRefresh, access)
 	}
 
 	// Tune GOMAXPROCS to match Linux container CPU quota.
@@ -79,13 +148,69 @@ func main() {
 		log.Fatalf("%s is not a directory (for index)", *index)
 	}
 
-	searcher, err := shards.NewDirectorySearcher(*index)
+	var searcher zoekt.Searcher
+	var err error
+	if *pools > 1 {
+		var p *pooledSearcher
+		if p, err = newPooledSearcher(*index, *poolDir, *pools); err == nil {
+			go closeOnSignal(p)
+		}
+		searcher = p
+	} else {
+		searcher, err = shards.NewDirectorySearcher(*index)
+	}
 	if err != nil {
 		log.Fatal(err)
 	}
+	if *warmup {
+		var repos []string
+		if *warmupRepos != "" {
+			repos = strings.Split(*warmupRepos, ",")
+		}
+		if err := warmUp(searcher, *index, repos); err != nil {
+			log.Fatalf("Warming up: %v", err)
+		}
+	}
+
+	config := &web.Config{}
+	if *configFile != "" {
+		config, err = web.LoadConfig(*configFile)
+		if err != nil {
+			log.Fatalf("Loading config: %v", err)
+		}
+	}
+	if *skipEstimate {
+		config.Search.SkipEstimate = true
+	}
+	if *defaultCasing != "" {
+		config.Search.DefaultCasing = *defaultCasing
+	}
+	if *defaultMode != "" {
+		config.Search.DefaultMode = *defaultMode
+	}
+	if *highlightStyle != "" {
+		config.Source.HighlightStyle = *highlightStyle
+	}
+	if *repoDir != "" {
+		for _, d := range strings.Split(*repoDir, ",") {
+			if i := strings.Index(d, "="); i >= 0 {
+				if config.Blame.Repos == nil {
+					config.Blame.Repos = map[string]string{}
+				}
+				config.Blame.Repos[d[:i]] = d[i+1:]
+			} else {
+				config.Blame.RepoDirs = append(config.Blame.RepoDirs, d)
+			}
+		}
+	}
+	if *disable != "" {
+		config.Disabled = append(config.Disabled, strings.Split(*disable, ",")...)
+	}
 
 	s := &web.Server{
 		Searcher: searcher,
+		IndexDir: *index,
+		Config:   config,
 	}
 
 	handler, err := web.NewMux(s)
@@ -105,12 +230,32 @@ func main() {
 		handler.HandleFunc("/debug/events/", trace.Events)
 	}
 
+	var h http.Handler = handler
+	if *recordFixtures != "" {
+		if fi, err := os.Stat(*recordFixtures); err != nil || !fi.IsDir() {
+			log.Fatalf("%s is not a directory (for fixtures)", *recordFixtures)
+		}
+		log.Printf("recording fixtures into %s", *recordFixtures)
+		h = web.RecordFixtures(h, *recordFixtures)
+	}
+
+	if access != nil {
+		sample, err := web.ParseAccessLogSample(*accessLogSample)
+		if err != nil {
+			log.Fatal(err)
+		}
+		h, err = web.AccessLog(h, access, web.AccessLogOptions{Format: *accessLog, Sample: sample})
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	if *sslCert != "" || *sslKey != "" {
 		log.Printf("serving HTTPS on %s", *listen)
-		err = http.ListenAndServeTLS(*listen, *sslCert, *sslKey, handler)
+		err = http.ListenAndServeTLS(*listen, *sslCert, *sslKey, h)
 	} else {
 		log.Printf("serving HTTP on %s", *listen)
-		err = http.ListenAndServe(*listen, handler)
+		err = http.ListenAndServe(*listen, h)
 	}
 	log.Printf("ListenAndServe: %v", err)
 }
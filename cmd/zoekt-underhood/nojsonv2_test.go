@@ -0,0 +1,7 @@
+//go:build !goexperiment.jsonv2
+// +build !goexperiment.jsonv2
+
+package main
+
+// See jsonv2_test.go.
+const shardsUnloadable = ""
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/google/zoekt"
+	"github.com/google/zoekt/query"
+	"github.com/google/zoekt/shards"
+)
+
+// How often the pool directories are synced with the index directory.
+const poolSyncInterval = 10 * time.Second
+
+// pooledSearcher partitions the shards of an index directory into pools by
+// repo, each loaded by its own searcher, and merges their results. Keeping a
+// repo's shards together in a pool improves cache locality on large hosts.
+//
+// The pools are directories of symlinks to the shards, kept in sync with the
+// index directory. The searchers see the mtimes of the links, so links are
+// recreated when their shard changes, and each pool's searcher picks up
+// changes as usual (within poolSyncInterval).
+//
+// Each pool searches with the full match limits of the search options, as a
+// search scoped to a repo hits only its pool. The merged results are cut to
+// the total limits.
+type pooledSearcher struct {
+	indexDir string
+	poolDirs []string
+	pools    []zoekt.Searcher
+	stop     chan struct{}
+	// Removed on Close, if the pools are in a temporary directory.
+	tempDir string
+	// Size and mtime of the shard of each link, when linked. Only used by
+	// sync, which doesn't run concurrently.
+	linked map[string]linkStamp
+}
+
+type linkStamp struct {
+	size  int64
+	mtime time.Time
+}
+
+// newPooledSearcher loads the index in n pools. The pool directories are
+// created below poolDir, or a temporary directory if empty.
+func newPooledSearcher(indexDir, poolDir string, n int) (*pooledSearcher, error) {
+	p := &pooledSearcher{indexDir: indexDir, stop: make(chan struct{}), linked: map[string]linkStamp{}}
+	if poolDir == "" {
+		var err error
+		poolDir, err = ioutil.TempDir("", "zoekt-underhood-pools")
+		if err != nil {
+			return nil, err
+		}
+		p.tempDir = poolDir
+	}
+	for i := 0; i < n; i++ {
+		dir := filepath.Join(poolDir, fmt.Sprintf("pool-%d", i))
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			p.removeTempDir()
+			return nil, err
+		}
+		p.poolDirs = append(p.poolDirs, dir)
+	}
+	if err := p.sync(); err != nil {
+		p.removeTempDir()
+		return nil, err
+	}
+	for _, dir := range p.poolDirs {
+		s, err := shards.NewDirectorySearcher(dir)
+		if err != nil {
+			p.Close()
+			return nil, err
+		}
+		p.pools = append(p.pools, s)
+	}
+	// Each pool schedules searches on up to GOMAXPROCS shards at a time. Go
+	// can't pin goroutines to CPUs, so pools can only be told apart by the
+	// OS scheduler; running one process per NUMA node with a pool each (and
+	// taskset or numactl) gives actual affinity.
+	log.Printf("loaded index in %d pools, GOMAXPROCS %d", n, runtime.GOMAXPROCS(0))
+	go p.syncLoop()
+	return p, nil
+}
+
+// poolOf returns the pool of a shard file (or its .meta file). Shards are
+// named after their repo, like github.com%2Fgoogle%2Fzoekt_v16.00001.zoekt, so
+// shards of a repo share the pool.
+func (p *pooledSearcher) poolOf(shard string) int {
+	name := filepath.Base(shard)
+	if i := strings.LastIndex(name, "_v"); i > 0 {
+		name = name[:i]
+	}
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	return int(h.Sum32() % uint32(len(p.poolDirs)))
+}
+
+// sync links the shards of the index directory (and their .meta files) into
+// their pool directory, relinks those changed since linked, and removes links
+// of shards that are gone.
+func (p *pooledSearcher) sync() error {
+	indexDir, err := filepath.Abs(p.indexDir)
+	if err != nil {
+		return err
+	}
+	fis, err := ioutil.ReadDir(indexDir)
+	if err != nil {
+		return err
+	}
+	want := map[string]bool{}
+	for _, fi := range fis {
+		if !strings.HasSuffix(fi.Name(), ".zoekt") && !strings.HasSuffix(fi.Name(), ".zoekt.meta") {
+			continue
+		}
+		f := filepath.Join(indexDir, fi.Name())
+		link := filepath.Join(p.poolDirs[p.poolOf(f)], fi.Name())
+		want[link] = true
+		stamp := linkStamp{size: fi.Size(), mtime: fi.ModTime()}
+		if old, ok := p.linked[link]; ok && old == stamp {
+			continue
+		}
+		if err := relink(f, link); err != nil {
+			return err
+		}
+		p.linked[link] = stamp
+	}
+	for _, dir := range p.poolDirs {
+		links, err := filepath.Glob(filepath.Join(dir, "*.zoekt*"))
+		if err != nil {
+			return err
+		}
+		for _, link := range links {
+			if !want[link] {
+				if err := os.Remove(link); err != nil {
+					return err
+				}
+				delete(p.linked, link)
+			}
+		}
+	}
+	return nil
+}
+
+// relink points link to target by a new symlink, replacing any link there.
+// The new link has a new mtime, which the pool's searcher takes as a change.
+func relink(target, link string) error {
+	tmp := link + ".tmp"
+	os.Remove(tmp)
+	if err := os.Symlink(target, tmp); err != nil {
+		return err
+	}
+	return os.Rename(tmp, link)
+}
+
+func (p *pooledSearcher) syncLoop() {
+	t := time.NewTicker(poolSyncInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			if err := p.sync(); err != nil {
+				log.Printf("syncing pools: %v", err)
+			}
+		case <-p.stop:
+			return
+		}
+	}
+}
+
+// Search searches all pools concurrently, and merges the results ordered by
+// score.
+func (p *pooledSearcher) Search(ctx context.Context, q query.Q, opts *zoekt.SearchOptions) (*zoekt.SearchResult, error) {
+	start := time.Now()
+	results := make([]*zoekt.SearchResult, len(p.pools))
+	errs := make([]error, len(p.pools))
+	var wg sync.WaitGroup
+	for i, s := range p.pools {
+		wg.Add(1)
+		go func(i int, s zoekt.Searcher) {
+			defer wg.Done()
+			results[i], errs[i] = s.Search(ctx, q, opts)
+		}(i, s)
+	}
+	wg.Wait()
+
+	res := &zoekt.SearchResult{
+		RepoURLs:      map[string]string{},
+		LineFragments: map[string]string{},
+	}
+	for i, r := range results {
+		if errs[i] != nil {
+			return nil, errs[i]
+		}
+		res.Stats.Add(r.Stats)
+		res.Files = append(res.Files, r.Files...)
+		for k, v := range r.RepoURLs {
+			res.RepoURLs[k] = v
+		}
+		for k, v := range r.LineFragments {
+			res.LineFragments[k] = v
+		}
+	}
+	res.Duration = time.Since(start)
+	zoekt.SortFilesByScore(res.Files)
+	cutMerged(res, opts)
+	return res, nil
+}
+
+// cutMerged cuts the files of merged pool results, sorted by score, to the
+// total match limit and MaxDocDisplayCount of opts. Files cut for the match
+// limit count as skipped, like those Zoekt doesn't get to.
+func cutMerged(res *zoekt.SearchResult, opts *zoekt.SearchOptions) {
+	if limit := opts.TotalMaxMatchCount; limit > 0 {
+		matches := 0
+		for i := range res.Files {
+			if matches >= limit {
+				res.Stats.FilesSkipped += len(res.Files) - i
+				res.Files = res.Files[:i]
+				break
+			}
+			// File name only matches have no line matches.
+			if n := len(res.Files[i].LineMatches); n > 0 {
+				matches += n
+			} else {
+				matches++
+			}
+		}
+	}
+	if n := opts.MaxDocDisplayCount; n > 0 && len(res.Files) > n {
+		res.Files = res.Files[:n]
+	}
+}
+
+// List lists the repos of all pools.
+func (p *pooledSearcher) List(ctx context.Context, q query.Q, opts *zoekt.ListOptions) (*zoekt.RepoList, error) {
+	res := &zoekt.RepoList{}
+	for _, s := range p.pools {
+		l, err := s.List(ctx, q, opts)
+		if err != nil {
+			return nil, err
+		}
+		res.Repos = append(res.Repos, l.Repos...)
+		res.Crashes += l.Crashes
+		res.Stats.Add(&l.Stats)
+		if l.Minimal != nil {
+			if res.Minimal == nil {
+				res.Minimal = map[uint32]*zoekt.MinimalRepoListEntry{}
+			}
+			for k, v := range l.Minimal {
+				res.Minimal[k] = v
+			}
+		}
+	}
+	return res, nil
+}
+
+func (p *pooledSearcher) Close() {
+	close(p.stop)
+	for _, s := range p.pools {
+		s.Close()
+	}
+	p.removeTempDir()
+}
+
+// removeTempDir removes the pool directories, if temporary.
+func (p *pooledSearcher) removeTempDir() {
+	if p.tempDir == "" {
+		return
+	}
+	if err := os.RemoveAll(p.tempDir); err != nil {
+		log.Printf("removing pool directory: %v", err)
+	}
+}
+
+// closeOnSignal closes p and exits on SIGINT or SIGTERM, so temporary pool
+// directories don't pile up.
+func closeOnSignal(p *pooledSearcher) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	sig := <-sigs
+	log.Printf("closing pools on %v", sig)
+	p.Close()
+	os.Exit(1)
+}
+
+func (p *pooledSearcher) String() string {
+	return fmt.Sprintf("pooledSearcher(%s, %d pools)", p.indexDir, len(p.pools))
+}
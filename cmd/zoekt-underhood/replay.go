@@ -0,0 +1,137 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+
+	"github.com/TreeTide/zoekt-underhood/web"
+	"github.com/google/zoekt"
+	"github.com/google/zoekt/shards"
+)
+
+// replayMain implements the replay subcommand: it serves the requests of
+// fixtures recorded with -record_fixtures against an index, and compares the
+// responses with the recorded ones. Exits non-zero if any differ. With
+// -update, the fixtures are rewritten with the new responses instead.
+func replayMain(args []string) {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	index := fs.String("index", "", "set index directory to use, the one the fixtures were recorded with.")
+	configFile := fs.String("config", "", "set path to JSON config file, the one the fixtures were recorded with.")
+	fixtureDir := fs.String("fixtures", "", "directory of the recorded fixtures.")
+	update := fs.Bool("update", false, "rewrite the fixtures with the responses, rather than comparing.")
+	fs.Parse(args)
+
+	if *index == "" || *fixtureDir == "" {
+		log.Fatalf("Please specify index and fixture directories with -index and -fixtures")
+	}
+	fixtures, names, err := web.ReadFixtures(*fixtureDir)
+	if err != nil {
+		log.Fatalf("Reading fixtures: %v", err)
+	}
+	if len(fixtures) == 0 {
+		log.Fatalf("no fixtures in %s", *fixtureDir)
+	}
+
+	config := &web.Config{}
+	if *configFile != "" {
+		config, err = web.LoadConfig(*configFile)
+		if err != nil {
+			log.Fatalf("Loading config: %v", err)
+		}
+	}
+	handler, searcher, err := newReplayHandler(*index, config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer searcher.Close()
+
+	failures := 0
+	for i, f := range fixtures {
+		name := filepath.Base(names[i])
+		got := replayFixture(handler, &f)
+		if *update {
+			f.Response = got
+			if err := web.WriteFixture(names[i], &f); err != nil {
+				log.Fatalf("%s: %v", name, err)
+			}
+			continue
+		}
+		if diff := responseDiff(&f.Response, &got); diff != "" {
+			log.Printf("FAIL: %s (%s %s): %s", name, f.Request.Method, f.Request.URL, diff)
+			failures++
+		}
+	}
+
+	if *update {
+		log.Printf("updated %d fixture(s)", len(fixtures))
+		return
+	}
+	if failures > 0 {
+		log.Printf("%d of %d fixture(s) failed", failures, len(fixtures))
+		os.Exit(1)
+	}
+	log.Printf("all %d fixture(s) passed", len(fixtures))
+}
+
+// newReplayHandler returns the handler to replay fixtures with, serving the
+// index in indexDir, and its searcher to close when done.
+func newReplayHandler(indexDir string, config *web.Config) (http.Handler, zoekt.Searcher, error) {
+	// Loads the shards synchronously.
+	searcher, err := shards.NewDirectorySearcher(indexDir)
+	if err != nil {
+		return nil, nil, err
+	}
+	handler, err := web.NewMux(&web.Server{
+		Searcher: searcher,
+		IndexDir: indexDir,
+		Config:   config,
+	})
+	if err != nil {
+		searcher.Close()
+		return nil, nil, err
+	}
+	return handler, searcher, nil
+}
+
+// replayFixture serves the request of f, returning the response sanitized
+// like the recorded one.
+func replayFixture(handler http.Handler, f *web.Fixture) web.FixtureResponse {
+	req := httptest.NewRequest(f.Request.Method, f.Request.URL, nil)
+	for k, v := range f.Request.Header {
+		req.Header[k] = v
+	}
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return web.SanitizeFixtureResponse(rec.Code, rec.Header(), rec.Body.Bytes())
+}
+
+// responseDiff describes the first difference of responses, or returns "" if
+// they are the same.
+func responseDiff(want, got *web.FixtureResponse) string {
+	if want.Status != got.Status {
+		return fmt.Sprintf("status %d, want %d", got.Status, want.Status)
+	}
+	if !reflect.DeepEqual(want.Header, got.Header) {
+		return fmt.Sprintf("header %v, want %v", got.Header, want.Header)
+	}
+	if !reflect.DeepEqual(want.BodyBytes, got.BodyBytes) {
+		return fmt.Sprintf("binary body of %d bytes differs from the %d recorded", len(got.BodyBytes), len(want.BodyBytes))
+	}
+	if want.Body == got.Body {
+		return ""
+	}
+	wl, gl := strings.Split(want.Body, "\n"), strings.Split(got.Body, "\n")
+	for i := 0; i < len(wl) && i < len(gl); i++ {
+		if wl[i] != gl[i] {
+			return fmt.Sprintf("body line %d is %q, want %q", i+1, gl[i], wl[i])
+		}
+	}
+	return fmt.Sprintf("body has %d lines, want %d", len(gl), len(wl))
+}
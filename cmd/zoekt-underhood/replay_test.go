@@ -0,0 +1,135 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/TreeTide/zoekt-underhood/web"
+	"github.com/google/zoekt"
+	"github.com/google/zoekt/build"
+)
+
+var updateFixtures = flag.Bool("update", false, "rewrite the fixtures of testdata/fixtures with the responses, rather than comparing.")
+
+// buildTestIndex indexes testdata/repo into dir, as repo "testrepo".
+func buildTestIndex(t *testing.T, dir string) {
+	b, err := build.NewBuilder(build.Options{
+		IndexDir:     dir,
+		DisableCTags: true,
+		RepositoryDescription: zoekt.Repository{
+			Name:     "testrepo",
+			Branches: []zoekt.RepositoryBranch{{Name: "HEAD", Version: "0123456789abcdef0123456789abcdef01234567"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := filepath.Join("testdata", "repo")
+	err = filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+		if err != nil || fi.IsDir() {
+			return err
+		}
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		return b.AddFile(filepath.ToSlash(rel), content)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Finish(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestReplayFixtures replays testdata/fixtures against an index of
+// testdata/repo. Run with -update to rewrite them after an intended change
+// of the responses.
+func TestReplayFixtures(t *testing.T) {
+	if shardsUnloadable != "" {
+		t.Skip(shardsUnloadable)
+	}
+	fixtures, names, err := web.ReadFixtures(filepath.Join("testdata", "fixtures"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fixtures) == 0 {
+		t.Fatal("no fixtures in testdata/fixtures")
+	}
+
+	indexDir, err := ioutil.TempDir("", "zoekt-underhood-replay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(indexDir)
+	buildTestIndex(t, indexDir)
+	handler, searcher, err := newReplayHandler(indexDir, &web.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer searcher.Close()
+
+	for i := range fixtures {
+		f := &fixtures[i]
+		name := filepath.Base(names[i])
+		t.Run(name, func(t *testing.T) {
+			got := replayFixture(handler, f)
+			if *updateFixtures {
+				f.Response = got
+				if err := web.WriteFixture(names[i], f); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if diff := responseDiff(&f.Response, &got); diff != "" {
+				t.Errorf("%s %s: %s", f.Request.Method, f.Request.URL, diff)
+			}
+		})
+	}
+}
+
+func TestResponseDiff(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		want, got web.FixtureResponse
+		diff      string
+	}{
+		{
+			name: "same",
+			want: web.FixtureResponse{Status: 200, Body: "a\nb"},
+			got:  web.FixtureResponse{Status: 200, Body: "a\nb"},
+		},
+		{
+			name: "status",
+			want: web.FixtureResponse{Status: 200},
+			got:  web.FixtureResponse{Status: 404},
+			diff: "status 404, want 200",
+		},
+		{
+			name: "line",
+			want: web.FixtureResponse{Status: 200, Body: "a\nb"},
+			got:  web.FixtureResponse{Status: 200, Body: "a\nc"},
+			diff: `body line 2 is "c", want "b"`,
+		},
+		{
+			name: "length",
+			want: web.FixtureResponse{Status: 200, Body: "a\nb"},
+			got:  web.FixtureResponse{Status: 200, Body: "a"},
+			diff: "body has 1 lines, want 2",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if diff := responseDiff(&tc.want, &tc.got); diff != tc.diff {
+				t.Errorf("responseDiff() = %q, want %q", diff, tc.diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/TreeTide/zoekt-underhood/web"
+	"github.com/google/zoekt/build"
+	"github.com/google/zoekt/gitindex"
+	"github.com/google/zoekt/shards"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.uber.org/automaxprocs/maxprocs"
+)
+
+// BootstrapStatus is the response of /api/admin/bootstrap in serve-all mode.
+type BootstrapStatus struct {
+	// Completed fetch and index rounds.
+	Rounds  int       `json:"rounds"`
+	Running bool      `json:"running"`
+	Started time.Time `json:"started"`
+	// Zero before the first round completed.
+	LastRound time.Time `json:"lastRound"`
+	NextRound time.Time `json:"nextRound"`
+	// In the order given.
+	Repos []RepoStatus `json:"repos"`
+}
+
+type RepoStatus struct {
+	URL  string `json:"url"`
+	Name string `json:"name"`
+	// Zero if never succeeded.
+	LastFetch time.Time `json:"lastFetch"`
+	LastIndex time.Time `json:"lastIndex"`
+	// Of the last round, empty if it succeeded.
+	Error string `json:"error,omitempty"`
+}
+
+// supervisor keeps git mirrors of repos and an index of them up to date.
+type supervisor struct {
+	repoDir  string
+	indexDir string
+	branches []string
+	interval time.Duration
+
+	mu     sync.Mutex
+	status BootstrapStatus
+}
+
+// serveAllMain implements the serve-all subcommand: it clones the given git
+// repos, indexes them periodically, and serves the API on the index, so a
+// single container can run the whole setup.
+func serveAllMain(args []string) {
+	fs := flag.NewFlagSet("serve-all", flag.ExitOnError)
+	listen := fs.String("listen", ":6080", "listen on this address.")
+	dataDir := fs.String("data", "", "directory to keep the git repos (in repos/) and the index (in index/) in.")
+	reposFile := fs.String("repos", "", "file of git URLs to index, one per line, in addition to the arguments. Lines starting with # are ignored.")
+	interval := fs.Duration("interval", time.Hour, "fetch and reindex this often.")
+	branches := fs.String("branches", "HEAD", "comma-separated branches to index.")
+	configFile := fs.String("config", "", "set path to JSON config file.")
+	fs.Parse(args)
+
+	if *dataDir == "" {
+		log.Fatalf("Please specify data directory with -data")
+	}
+	urls := fs.Args()
+	if *reposFile != "" {
+		fromFile, err := readRepoURLs(*reposFile)
+		if err != nil {
+			log.Fatalf("Reading repos: %v", err)
+		}
+		urls = append(urls, fromFile...)
+	}
+	if len(urls) == 0 {
+		log.Fatalf("Please specify git URLs to index, as arguments or with -repos")
+	}
+
+	maxprocs.Set()
+
+	sv := &supervisor{
+		repoDir:  filepath.Join(*dataDir, "repos"),
+		indexDir: filepath.Join(*dataDir, "index"),
+		branches: strings.Split(*branches, ","),
+		interval: *interval,
+	}
+	sv.status.Started = time.Now()
+	for _, u := range urls {
+		name, err := repoName(u)
+		if err != nil {
+			log.Fatalf("Repo %q: %v", u, err)
+		}
+		sv.status.Repos = append(sv.status.Repos, RepoStatus{URL: u, Name: name})
+	}
+	for _, d := range []string{sv.repoDir, sv.indexDir} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// Picks up shards as they get written.
+	searcher, err := shards.NewDirectorySearcher(sv.indexDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	config := &web.Config{}
+	if *configFile != "" {
+		config, err = web.LoadConfig(*configFile)
+		if err != nil {
+			log.Fatalf("Loading config: %v", err)
+		}
+	}
+	// The clones are laid out as blame expects.
+	config.Blame.RepoDirs = append(config.Blame.RepoDirs, sv.repoDir)
+
+	s := &web.Server{
+		Searcher: searcher,
+		IndexDir: sv.indexDir,
+		Config:   config,
+	}
+	handler, err := web.NewMux(s)
+	if err != nil {
+		log.Fatal(err)
+	}
+	handler.Handle("/metrics", promhttp.Handler())
+	handler.HandleFunc("/api/admin/bootstrap", sv.serveStatus)
+
+	go sv.run()
+
+	log.Printf("serving HTTP on %s", *listen)
+	err = http.ListenAndServe(*listen, handler)
+	log.Printf("ListenAndServe: %v", err)
+}
+
+// readRepoURLs reads a file of git URLs.
+func readRepoURLs(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var res []string
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		l := strings.TrimSpace(sc.Text())
+		if l == "" || strings.HasPrefix(l, "#") {
+			continue
+		}
+		res = append(res, l)
+	}
+	return res, sc.Err()
+}
+
+// repoName derives the repo name from a git URL like zoekt-git-clone does, for
+// example github.com/google/zoekt.
+func repoName(gitURL string) (string, error) {
+	u, err := url.Parse(gitURL)
+	if err != nil {
+		return "", err
+	}
+	name := strings.TrimSuffix(strings.TrimSuffix(u.Host+u.Path, "/"), ".git")
+	name = strings.Trim(name, "/")
+	if name == "" || strings.Contains(name, "..") {
+		return "", fmt.Errorf("can't derive a repo name")
+	}
+	return name, nil
+}
+
+// run fetches and indexes the repos every interval, forever.
+func (sv *supervisor) run() {
+	for {
+		sv.mu.Lock()
+		sv.status.Running = true
+		n := len(sv.status.Repos)
+		sv.mu.Unlock()
+
+		for i := 0; i < n; i++ {
+			sv.mu.Lock()
+			st := sv.status.Repos[i]
+			sv.mu.Unlock()
+			sv.update(&st)
+			sv.mu.Lock()
+			sv.status.Repos[i] = st
+			sv.mu.Unlock()
+		}
+
+		now := time.Now()
+		sv.mu.Lock()
+		sv.status.Running = false
+		sv.status.Rounds++
+		sv.status.LastRound = now
+		sv.status.NextRound = now.Add(sv.interval)
+		sv.mu.Unlock()
+		time.Sleep(sv.interval)
+	}
+}
+
+// update fetches (or clones) and indexes a repo, recording the outcome in st.
+func (sv *supervisor) update(st *RepoStatus) {
+	gitDir, err := sv.fetch(st.URL, st.Name)
+	if err != nil {
+		log.Printf("fetching %s: %v", st.URL, err)
+		st.Error = "fetch: " + err.Error()
+		return
+	}
+	st.LastFetch = time.Now()
+
+	opts := build.Options{
+		IndexDir: sv.indexDir,
+	}
+	opts.RepositoryDescription.Name = st.Name
+	if err := gitindex.IndexGitRepo(gitindex.Options{
+		RepoDir:      gitDir,
+		Incremental:  true,
+		BuildOptions: opts,
+		Branches:     sv.branches,
+	}); err != nil {
+		log.Printf("indexing %s: %v", st.Name, err)
+		st.Error = "index: " + err.Error()
+		return
+	}
+	st.LastIndex = time.Now()
+	st.Error = ""
+}
+
+// fetch updates the bare clone of the repo, cloning it first if needed.
+// Returns the git dir.
+func (sv *supervisor) fetch(gitURL, name string) (string, error) {
+	gitDir := filepath.Join(sv.repoDir, filepath.FromSlash(name)+".git")
+	if _, err := os.Stat(gitDir); os.IsNotExist(err) {
+		_, err := gitindex.CloneRepo(filepath.Dir(gitDir), filepath.Base(name), gitURL, map[string]string{
+			"zoekt.name": name,
+		})
+		return gitDir, err
+	}
+	cmd := exec.Command("git", "--git-dir="+gitDir, "fetch", "--prune", "origin")
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	// Prevent prompting.
+	cmd.Stdin = &bytes.Buffer{}
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("%v: %s", err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	return gitDir, nil
+}
+
+func (sv *supervisor) serveStatus(w http.ResponseWriter, r *http.Request) {
+	sv.mu.Lock()
+	b, err := json.Marshal(sv.status)
+	sv.mu.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
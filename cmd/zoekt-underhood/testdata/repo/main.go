@@ -0,0 +1,11 @@
+package main
+
+import (
+	"fmt"
+
+	"example.com/testrepo/util"
+)
+
+func main() {
+	fmt.Println(util.Greeting("world"))
+}
@@ -0,0 +1,6 @@
+package util
+
+// Greeting returns a greeting of name.
+func Greeting(name string) string {
+	return "Hello, " + name + "!"
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"hash/crc64"
+	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/TreeTide/zoekt-underhood/web"
+	"github.com/google/zoekt"
+	"github.com/google/zoekt/query"
+	"github.com/google/zoekt/shards"
+)
+
+// verifier runs checks against an index, collecting the failures.
+type verifier struct {
+	searcher zoekt.Searcher
+	// Number of random files to fetch per repo.
+	sample int
+	rnd    *rand.Rand
+
+	failures []string
+}
+
+func (v *verifier) failf(format string, a ...interface{}) {
+	msg := fmt.Sprintf(format, a...)
+	log.Printf("FAIL: %s", msg)
+	v.failures = append(v.failures, msg)
+}
+
+// verifyMain implements the verify subcommand: it loads an index directory,
+// runs smoke queries and consistency checks, and exits non-zero on failure.
+// Meant as a gate before publishing a new index snapshot.
+func verifyMain(args []string) {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	index := fs.String("index", "", "set index directory to verify.")
+	queriesFile := fs.String("queries", "", "file of smoke queries, one per line: a Zoekt query, optionally followed by a tab and the minimum number of matching files (default 1). Lines starting with # are ignored.")
+	sample := fs.Int("sample", 3, "number of random files to fetch and checksum per repo.")
+	minRepos := fs.Int("min_repos", 1, "fail if fewer repos are indexed.")
+	seed := fs.Int64("seed", 0, "seed for picking random files, 0 for time-based.")
+	timeout := fs.Duration("timeout", 10*time.Minute, "fail if the checks take longer.")
+	fs.Parse(args)
+
+	if *index == "" {
+		log.Fatalf("Please specify index directory with -index")
+	}
+	shardFiles, err := filepath.Glob(filepath.Join(*index, "*.zoekt"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(shardFiles) == 0 {
+		log.Fatalf("no shards in %s", *index)
+	}
+	var queries []smokeQuery
+	if *queriesFile != "" {
+		queries, err = readSmokeQueries(*queriesFile)
+		if err != nil {
+			log.Fatalf("Reading queries: %v", err)
+		}
+	}
+	if *seed == 0 {
+		*seed = time.Now().UnixNano()
+	}
+
+	// Loads the shards synchronously.
+	searcher, err := shards.NewDirectorySearcher(*index)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer searcher.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	v := &verifier{
+		searcher: searcher,
+		sample:   *sample,
+		rnd:      rand.New(rand.NewSource(*seed)),
+	}
+	log.Printf("verifying %d shard(s) in %s (seed %d)", len(shardFiles), *index, *seed)
+	v.checkRepos(ctx, *minRepos)
+	for _, q := range queries {
+		v.checkQuery(ctx, q)
+	}
+	if ctx.Err() != nil {
+		v.failf("checks did not finish within %v", *timeout)
+	}
+
+	if len(v.failures) > 0 {
+		log.Printf("%d check(s) failed", len(v.failures))
+		os.Exit(1)
+	}
+	log.Printf("all checks passed")
+}
+
+// checkRepos checks that every repo (and branch) lists files, and that
+// randomly picked files can be fetched with content matching their checksum.
+func (v *verifier) checkRepos(ctx context.Context, minRepos int) {
+	q, err := query.Parse("r:")
+	if err != nil {
+		v.failf("parsing repo query: %v", err)
+		return
+	}
+	list, err := v.searcher.List(ctx, q, &zoekt.ListOptions{})
+	if err != nil {
+		v.failf("listing repos: %v", err)
+		return
+	}
+	if len(list.Repos) < minRepos {
+		v.failf("%d repo(s) indexed, want at least %d", len(list.Repos), minRepos)
+	}
+	for _, re := range list.Repos {
+		if ctx.Err() != nil {
+			return
+		}
+		r := re.Repository
+		if re.Stats.Documents == 0 {
+			v.failf("repo %s: no documents", r.Name)
+			continue
+		}
+		if len(r.Branches) == 0 {
+			v.checkRepoFiles(ctx, r.Name, "", re.Stats.Documents)
+		}
+		for _, b := range r.Branches {
+			v.checkRepoFiles(ctx, r.Name, b.Name, re.Stats.Documents)
+		}
+	}
+}
+
+func (v *verifier) checkRepoFiles(ctx context.Context, repo, branch string, numDocs int) {
+	name := repo
+	rq := "r:" + web.QuoteQueryString("^"+regexp.QuoteMeta(repo)+"$")
+	if branch != "" {
+		name += "@" + branch
+		// Note: matches branches containing the name, see onBranch.
+		rq += " branch:" + web.QuoteQueryString(branch)
+	}
+	n := numDocs + 1
+	files, err := v.search(ctx, rq, &zoekt.SearchOptions{
+		ShardMaxMatchCount:     n,
+		TotalMaxMatchCount:     n,
+		ShardMaxImportantMatch: n,
+		TotalMaxImportantMatch: n,
+		MaxDocDisplayCount:     n,
+	})
+	if err != nil {
+		v.failf("repo %s: listing files: %v", name, err)
+		return
+	}
+	paths := []string{}
+	for _, f := range files {
+		if f.Repository == repo && onBranch(&f, branch) {
+			paths = append(paths, f.FileName)
+		}
+	}
+	if len(paths) == 0 {
+		v.failf("repo %s: no files listed", name)
+		return
+	}
+
+	v.rnd.Shuffle(len(paths), func(i, j int) { paths[i], paths[j] = paths[j], paths[i] })
+	if len(paths) > v.sample {
+		paths = paths[:v.sample]
+	}
+	for _, p := range paths {
+		v.checkFile(ctx, repo, branch, rq, name, p)
+	}
+	log.Printf("repo %s: ok", name)
+}
+
+// onBranch tells if the file is on the branch, or true if branch is empty.
+func onBranch(f *zoekt.FileMatch, branch string) bool {
+	if branch == "" {
+		return true
+	}
+	for _, b := range f.Branches {
+		if b == branch {
+			return true
+		}
+	}
+	return false
+}
+
+// checkFile fetches the file and compares its content to the checksum.
+func (v *verifier) checkFile(ctx context.Context, repo, branch, repoQuery, name, path string) {
+	files, err := v.search(ctx, repoQuery+" case:yes f:"+web.QuoteQueryString("^"+regexp.QuoteMeta(path)+"$"), &zoekt.SearchOptions{
+		Whole: true,
+	})
+	if err != nil {
+		v.failf("file %s:%s: %v", name, path, err)
+		return
+	}
+	for _, f := range files {
+		if f.Repository != repo || f.FileName != path || !onBranch(&f, branch) {
+			continue
+		}
+		// Same as Zoekt's indexing computes.
+		h := crc64.New(crc64.MakeTable(crc64.ISO))
+		h.Write(f.Content)
+		if !bytes.Equal(h.Sum(nil), f.Checksum) {
+			v.failf("file %s:%s: content doesn't match checksum", name, path)
+		}
+		return
+	}
+	v.failf("file %s:%s: listed, but not fetchable", name, path)
+}
+
+func (v *verifier) checkQuery(ctx context.Context, sq smokeQuery) {
+	opts := &zoekt.SearchOptions{}
+	opts.SetDefaults()
+	files, err := v.search(ctx, sq.query, opts)
+	if err != nil {
+		v.failf("query %q: %v", sq.query, err)
+		return
+	}
+	if len(files) < sq.minFiles {
+		v.failf("query %q: %d matching file(s), want at least %d", sq.query, len(files), sq.minFiles)
+		return
+	}
+	log.Printf("query %q: ok (%d files)", sq.query, len(files))
+}
+
+func (v *verifier) search(ctx context.Context, rq string, opts *zoekt.SearchOptions) ([]zoekt.FileMatch, error) {
+	q, err := query.Parse(rq)
+	if err != nil {
+		return nil, err
+	}
+	opts.MaxWallTime = time.Minute
+	res, err := v.searcher.Search(ctx, q, opts)
+	if err != nil {
+		return nil, err
+	}
+	return res.Files, nil
+}
+
+type smokeQuery struct {
+	query    string
+	minFiles int
+}
+
+func readSmokeQueries(path string) ([]smokeQuery, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var res []smokeQuery
+	sc := bufio.NewScanner(f)
+	for line := 1; sc.Scan(); line++ {
+		l := sc.Text()
+		if strings.TrimSpace(l) == "" || strings.HasPrefix(l, "#") {
+			continue
+		}
+		sq := smokeQuery{query: l, minFiles: 1}
+		if i := strings.LastIndex(l, "\t"); i >= 0 {
+			n, err := strconv.Atoi(strings.TrimSpace(l[i+1:]))
+			if err != nil {
+				return nil, fmt.Errorf("line %d: bad minimum file count: %v", line, err)
+			}
+			sq.query, sq.minFiles = l[:i], n
+		}
+		if _, err := query.Parse(sq.query); err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		res = append(res, sq)
+	}
+	return res, sc.Err()
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/google/zoekt"
+	"github.com/google/zoekt/query"
+)
+
+// warmUp brings the index into memory, so the first queries after a start
+// don't wait for the disk: it lists the repos, and reads the shards of the
+// given repos (all if empty) into the page cache, which the searcher's mmaps
+// share.
+func warmUp(searcher zoekt.Searcher, indexDir string, repos []string) error {
+	start := time.Now()
+	result, err := searcher.List(context.Background(), &query.Const{Value: true}, &zoekt.ListOptions{})
+	if err != nil {
+		return err
+	}
+	log.Printf("warm-up: listed %d repos in %v", len(result.Repos), time.Since(start))
+
+	paths, err := warmupShards(indexDir, repos)
+	if err != nil {
+		return err
+	}
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var bytes int64
+	next := make(chan string)
+	for w := 0; w < runtime.GOMAXPROCS(0); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for p := range next {
+				n, err := touchFile(p)
+				if err != nil {
+					log.Printf("warm-up: reading %s: %v", p, err)
+				}
+				mu.Lock()
+				bytes += n
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, p := range paths {
+		next <- p
+	}
+	close(next)
+	wg.Wait()
+	log.Printf("warm-up: read %d shards (%d MiB) in %v", len(paths), bytes>>20, time.Since(start))
+	return nil
+}
+
+// warmupShards returns the paths of the shards in indexDir having any of the
+// repos, or all shards if repos is empty.
+func warmupShards(indexDir string, repos []string) ([]string, error) {
+	fis, err := ioutil.ReadDir(indexDir)
+	if err != nil {
+		return nil, err
+	}
+	wanted := map[string]bool{}
+	for _, r := range repos {
+		wanted[r] = true
+	}
+	var paths []string
+	for _, fi := range fis {
+		if filepath.Ext(fi.Name()) != ".zoekt" {
+			continue
+		}
+		p := filepath.Join(indexDir, fi.Name())
+		if len(wanted) == 0 {
+			paths = append(paths, p)
+			continue
+		}
+		rs, _, err := zoekt.ReadMetadataPath(p)
+		if err != nil {
+			// The searcher skips it too.
+			continue
+		}
+		for _, r := range rs {
+			if wanted[r.Name] {
+				paths = append(paths, p)
+				break
+			}
+		}
+	}
+	if len(wanted) > 0 && len(paths) == 0 {
+		log.Printf("warm-up: no shards of repos %v", repos)
+	}
+	return paths, nil
+}
+
+// touchFile reads the file at p, returning the bytes read.
+func touchFile(p string) (int64, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return io.Copy(ioutil.Discard, f)
+}
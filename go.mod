@@ -3,6 +3,7 @@ module github.com/TreeTide/zoekt-underhood
 go 1.13
 
 require (
+	github.com/alecthomas/chroma v0.10.0
 	github.com/google/zoekt v0.0.0-20211108135652-f8e8ada171c7
 	github.com/prometheus/client_golang v1.5.1
 	go.uber.org/automaxprocs v1.3.0
@@ -0,0 +1,191 @@
+package web
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Values of AccessLogOptions.Format.
+var accessLogFormats = []string{"common", "combined", "json"}
+
+// AccessLogOptions configure AccessLog.
+type AccessLogOptions struct {
+	// One of "common" (the default), "combined" (common with referer and
+	// user agent, like Apache and nginx) or "json" (one object per line).
+	Format string
+	// Fraction of requests logged, from 0 to 1, keyed by URL path like
+	// "/api/suggest". For endpoints with lots of traffic. Paths not listed
+	// are all logged.
+	Sample map[string]float64
+}
+
+// ParseAccessLogSample parses comma-separated path=fraction entries, like
+// "/api/suggest=0.1,/api/live-search=0", for AccessLogOptions.Sample.
+func ParseAccessLogSample(s string) (map[string]float64, error) {
+	res := map[string]float64{}
+	if s == "" {
+		return res, nil
+	}
+	for _, e := range strings.Split(s, ",") {
+		i := strings.LastIndex(e, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("access log sample %q: want path=fraction", e)
+		}
+		f, err := strconv.ParseFloat(e[i+1:], 64)
+		if err != nil || f < 0 || f > 1 {
+			return nil, fmt.Errorf("access log sample %q: want a fraction from 0 to 1", e)
+		}
+		res[e[:i]] = f
+	}
+	return res, nil
+}
+
+// accessLogEntry is a line of the "json" format.
+type accessLogEntry struct {
+	Time       string  `json:"time"`
+	Remote     string  `json:"remote"`
+	User       string  `json:"user,omitempty"`
+	Method     string  `json:"method"`
+	URL        string  `json:"url"`
+	Proto      string  `json:"proto"`
+	Status     int     `json:"status"`
+	Bytes      int64   `json:"bytes"`
+	DurationMs float64 `json:"durationMs"`
+	Referer    string  `json:"referer,omitempty"`
+	UserAgent  string  `json:"userAgent,omitempty"`
+	// Of the interactionHeader, see Server.instrument.
+	Interaction string `json:"interaction,omitempty"`
+}
+
+// AccessLog wraps h to write a line to out for each request served, once
+// done. Unlike the application log, it has all requests (not only those of
+// the API) in a format log analyzers understand, so traffic can be analyzed
+// without a fronting proxy. WebSocket sessions are logged when they end.
+func AccessLog(h http.Handler, out io.Writer, opts AccessLogOptions) (http.Handler, error) {
+	format := opts.Format
+	if format == "" {
+		format = "common"
+	}
+	if !containsString(accessLogFormats, format) {
+		return nil, fmt.Errorf("unknown access log format %q, want one of %v", format, strings.Join(accessLogFormats, ", "))
+	}
+	// Serializes writes, so lines don't interleave.
+	var mu sync.Mutex
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if f, ok := opts.Sample[r.URL.Path]; ok && rand.Float64() >= f {
+			h.ServeHTTP(w, r)
+			return
+		}
+		start := time.Now()
+		aw := &accessLogWriter{ResponseWriter: w, status: http.StatusOK}
+		h.ServeHTTP(aw, r)
+		line := accessLogLine(format, r, aw, start)
+		mu.Lock()
+		_, err := io.WriteString(out, line)
+		mu.Unlock()
+		if err != nil {
+			log.Printf("writing access log: %v", err)
+		}
+	}), nil
+}
+
+// accessLogLine formats the line of a request, ending with a newline.
+func accessLogLine(format string, r *http.Request, w *accessLogWriter, start time.Time) string {
+	remote := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(remote); err == nil {
+		remote = host
+	}
+	user, _, _ := r.BasicAuth()
+	if format == "json" {
+		b, err := json.Marshal(accessLogEntry{
+			Time:        start.Format(time.RFC3339Nano),
+			Remote:      remote,
+			User:        user,
+			Method:      r.Method,
+			URL:         r.URL.RequestURI(),
+			Proto:       r.Proto,
+			Status:      w.status,
+			Bytes:       w.bytes,
+			DurationMs:  float64(time.Since(start)) / float64(time.Millisecond),
+			Referer:     r.Referer(),
+			UserAgent:   r.UserAgent(),
+			Interaction: r.Header.Get(interactionHeader),
+		})
+		if err != nil {
+			// Can't happen, the entry only has strings and numbers.
+			return fmt.Sprintf("{\"error\":%q}\n", err.Error())
+		}
+		return string(b) + "\n"
+	}
+	if user == "" {
+		user = "-"
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s - %s [%s] %s %d %d", remote, user, start.Format("02/Jan/2006:15:04:05 -0700"),
+		strconv.Quote(r.Method+" "+r.URL.RequestURI()+" "+r.Proto), w.status, w.bytes)
+	if format == "combined" {
+		fmt.Fprintf(&b, " %s %s", accessLogQuote(r.Referer()), accessLogQuote(r.UserAgent()))
+	}
+	b.WriteByte('\n')
+	return b.String()
+}
+
+// accessLogQuote quotes a header value, or returns "-" if it is empty, like
+// Apache does.
+func accessLogQuote(v string) string {
+	if v == "" {
+		return "-"
+	}
+	return strconv.Quote(v)
+}
+
+// accessLogWriter passes a response through, noting its status and size.
+type accessLogWriter struct {
+	http.ResponseWriter
+	status      int
+	bytes       int64
+	wroteHeader bool
+}
+
+func (w *accessLogWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *accessLogWriter) Write(b []byte) (int, error) {
+	w.wroteHeader = true
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+func (w *accessLogWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack passes through to the underlying writer, for WebSocket endpoints.
+// The session is logged with the status of the upgrade.
+func (w *accessLogWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("response writer %T can't be hijacked", w.ResponseWriter)
+	}
+	w.wroteHeader = true
+	w.status = http.StatusSwitchingProtocols
+	return h.Hijack()
+}
@@ -0,0 +1,40 @@
+package web
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseAccessLogSample(t *testing.T) {
+	for _, tc := range []struct {
+		in      string
+		want    map[string]float64
+		wantErr bool
+	}{
+		{in: "", want: map[string]float64{}},
+		{in: "/api/suggest=0.1", want: map[string]float64{"/api/suggest": 0.1}},
+		{in: "/api/suggest=0.1,/api/live-search=0", want: map[string]float64{"/api/suggest": 0.1, "/api/live-search": 0}},
+		{in: "/a=b=1", want: map[string]float64{"/a=b": 1}},
+		{in: "/api/suggest", wantErr: true},
+		{in: "/api/suggest=x", wantErr: true},
+		{in: "/api/suggest=1.5", wantErr: true},
+		{in: "/api/suggest=-0.1", wantErr: true},
+		{in: "/a=0.5,", wantErr: true},
+	} {
+		t.Run(tc.in, func(t *testing.T) {
+			got, err := ParseAccessLogSample(tc.in)
+			if tc.wantErr {
+				if err == nil {
+					t.Errorf("got %v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,420 @@
+package web
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/zoekt"
+	"github.com/google/zoekt/query"
+)
+
+// Above this many files an archive is refused.
+const maxArchiveFiles = 100000
+
+// Archives estimated above this size need confirmation, unless configured
+// otherwise (see ArchiveConfig).
+const defaultArchiveConfirmBytes = 256 << 20
+
+// Content is fetched in chunks of this many files, with at most this many
+// chunks fetched (or waiting to be written) at a time.
+const (
+	archiveChunkFiles   = 100
+	archiveFetchWorkers = 4
+)
+
+// Zoekt doesn't keep file times, so entries get a fixed one. This keeps the
+// archive (and its ETag) stable for the same content. Zip can't go earlier.
+var archiveModTime = time.Date(1980, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// UhArchiveEstimate is the response of /api/archive with estimate=1.
+type UhArchiveEstimate struct {
+	Ticket string `json:"ticket"`
+	Files  int    `json:"files"`
+	// Uncompressed size, extrapolated from the average file size in the repo.
+	EstimatedBytes int64 `json:"estimatedBytes"`
+	// If set, downloading the archive needs confirm=1.
+	ConfirmRequired bool `json:"confirmRequired"`
+}
+
+func (s *Server) serveArchive(w http.ResponseWriter, r *http.Request) {
+	if err := s.serveArchiveErr(w, r); err != nil {
+		writeError(w, err)
+	}
+}
+
+// serveArchiveErr streams the indexed files under a directory as a tar.gz or
+// zip archive, reconstructed from the content in the index. The filter
+// parameter restricts the files like for /api/filetree.
+//
+// With estimate=1, only the size estimate is returned. Large archives need
+// confirm=1, so these are not downloaded by accident.
+func (s *Server) serveArchiveErr(w http.ResponseWriter, r *http.Request) error {
+	log.Printf("request: %v", r.URL)
+	tickets, ok := r.URL.Query()["ticket"]
+	if !ok || len(tickets) > 1 {
+		return errorf(ErrParamMissing, "expected ticket parameter")
+	}
+	t, err := s.parseTicket(r.Context(), tickets[0])
+	if err != nil {
+		return err
+	}
+	if t.repo == "" {
+		return errorf(ErrTicketFormat, "Expected a repo or directory ticket")
+	}
+
+	format := "tar.gz"
+	if fs, ok := r.URL.Query()["format"]; ok {
+		format = fs[0]
+		if format != "tar.gz" && format != "zip" {
+			return errorf(ErrParamInvalid, "unknown format %q, want one of tar.gz, zip", format)
+		}
+	}
+
+	filter, err := parsePathFilter(r.URL.Query()["filter"])
+	if err != nil {
+		return errorf(ErrParamInvalid, "%v", err)
+	}
+
+	ctx := r.Context()
+	root, err := s.treeCache.get(t.repoSpec(), func() (*pathNode, error) {
+		return s.loadPathTrie(ctx, t)
+	})
+	if err != nil {
+		return err
+	}
+	node := root.lookup(t.path)
+	if node == nil || node.isFile {
+		return errorf(ErrNotFound, "Not a directory: %v", tickets[0])
+	}
+	// The query can't apply the filter, so it matches all these files.
+	numUnfiltered := len(node.files(t.path, unlimitedDepth))
+	if !filter.empty() {
+		node = node.filtered(t.path, filter)
+	}
+	paths := []string{}
+	if node != nil {
+		paths = node.files(t.path, unlimitedDepth)
+	}
+	if len(paths) > maxArchiveFiles {
+		return errorf(ErrLimitExceeded, "%d files below %v, at most %d can be archived", len(paths), tickets[0], maxArchiveFiles)
+	}
+
+	est, err := s.archiveEstimate(ctx, t, len(paths))
+	if err != nil {
+		return err
+	}
+	if es, ok := r.URL.Query()["estimate"]; ok && es[0] == "1" {
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		w.WriteHeader(http.StatusOK)
+		return json.NewEncoder(w).Encode(est)
+	}
+	if cs, ok := r.URL.Query()["confirm"]; est.ConfirmRequired && !(ok && cs[0] == "1") {
+		return errorf(ErrConfirmRequired, "Archive of %d files, about %d bytes, needs confirm=1", est.Files, est.EstimatedBytes)
+	}
+
+	// Only names and checksums for the ETag here, content is fetched in chunks
+	// while writing.
+	files, err := s.archiveFiles(ctx, t, paths, numUnfiltered)
+	if err != nil {
+		return err
+	}
+
+	name := path.Base(t.repo)
+	if t.path != "" {
+		name = path.Base(t.path)
+	}
+	etag := archiveETag(files, format)
+	if format == "zip" {
+		w.Header().Set("Content-Type", "application/zip")
+	} else {
+		w.Header().Set("Content-Type", "application/gzip")
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name+"."+format))
+	w.Header().Set("ETag", etag)
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return nil
+	}
+	// Note: Content-Length is not known up front, since the archive is
+	// compressed while streaming.
+	w.WriteHeader(http.StatusOK)
+	if r.Method == http.MethodHead {
+		return nil
+	}
+
+	// Too late to report errors in the response from here on, but clients
+	// notice the archive is cut.
+	var aw archiveWriter
+	if format == "zip" {
+		aw = newZipWriter(w)
+	} else {
+		aw = newTarGzWriter(w)
+	}
+	err = s.fetchArchiveContents(ctx, t, files, func(f *zoekt.FileMatch) error {
+		return aw.add(entryName(name, t.path, f.FileName), f.Content)
+	})
+	if err == nil {
+		err = aw.close()
+	}
+	if err != nil {
+		log.Printf("writing archive of %v: %v", tickets[0], err)
+	}
+	return nil
+}
+
+// archiveEstimate estimates the size of an archive of numFiles files below the
+// path of t.
+func (s *Server) archiveEstimate(ctx context.Context, t ticket, numFiles int) (UhArchiveEstimate, error) {
+	st, err := s.repoStats(ctx, t.repo)
+	if err != nil {
+		return UhArchiveEstimate{}, err
+	}
+	est := UhArchiveEstimate{
+		Ticket: s.dirTicket(t.repo, t.branch, t.path),
+		Files:  numFiles,
+	}
+	if st.Documents > 0 {
+		est.EstimatedBytes = st.ContentBytes * int64(numFiles) / int64(st.Documents)
+	}
+	limit := s.Config.Archive.ConfirmBytes
+	if limit == 0 {
+		limit = defaultArchiveConfirmBytes
+	}
+	est.ConfirmRequired = limit > 0 && est.EstimatedBytes > limit
+	return est, nil
+}
+
+// archiveFiles lists the files at paths in the repo of t, sorted by name,
+// without content. numUnfiltered is the number of all files below the path of
+// t.
+func (s *Server) archiveFiles(ctx context.Context, t ticket, paths []string, numUnfiltered int) ([]*zoekt.FileMatch, error) {
+	if len(paths) == 0 {
+		return nil, nil
+	}
+	want := map[string]bool{}
+	for _, p := range paths {
+		want[p] = true
+	}
+
+	rq := archiveRepoQuery(t)
+	if t.path != "" {
+		rq += " f:" + QuoteQueryString("^"+regexp.QuoteMeta(t.path+"/"))
+	}
+	matched, err := s.archiveSearch(ctx, t, rq, numUnfiltered, false)
+	if err != nil {
+		return nil, err
+	}
+	files := []*zoekt.FileMatch{}
+	for _, f := range matched {
+		if want[f.FileName] {
+			files = append(files, f)
+		}
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].FileName < files[j].FileName
+	})
+	return files, nil
+}
+
+func archiveRepoQuery(t ticket) string {
+	return "case:yes " + branchAtoms(t)
+}
+
+// archiveSearch returns the files in the repo of t matching rq, which is
+// expected to match at most n files.
+func (s *Server) archiveSearch(ctx context.Context, t ticket, rq string, n int, withContent bool) ([]*zoekt.FileMatch, error) {
+	log.Printf("query: %v", rq)
+	q, err := query.Parse(rq)
+	if err != nil {
+		return nil, errorf(ErrQueryParse, "%v (query: %v)", err, rq)
+	}
+	n++
+	sOpts := zoekt.SearchOptions{
+		MaxWallTime:            60 * time.Second,
+		Whole:                  withContent,
+		ShardMaxMatchCount:     n,
+		TotalMaxMatchCount:     n,
+		ShardMaxImportantMatch: n,
+		TotalMaxImportantMatch: n,
+		MaxDocDisplayCount:     n,
+	}
+	result, err := s.Searcher.Search(ctx, q, &sOpts)
+	if err != nil {
+		return nil, err
+	}
+	files := []*zoekt.FileMatch{}
+	for i := range result.Files {
+		if f := &result.Files[i]; t.matchesFile(f) {
+			files = append(files, f)
+		}
+	}
+	return files, nil
+}
+
+// fetchArchiveContents fetches the content of files in chunks, several in
+// parallel, and calls emit with each file in order. Stops at the first error.
+func (s *Server) fetchArchiveContents(ctx context.Context, t ticket, files []*zoekt.FileMatch, emit func(*zoekt.FileMatch) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type chunkResult struct {
+		files map[string]*zoekt.FileMatch
+		err   error
+	}
+	var chunks [][]*zoekt.FileMatch
+	for i := 0; i < len(files); i += archiveChunkFiles {
+		end := i + archiveChunkFiles
+		if end > len(files) {
+			end = len(files)
+		}
+		chunks = append(chunks, files[i:end])
+	}
+	results := make([]chan chunkResult, len(chunks))
+	for i := range results {
+		results[i] = make(chan chunkResult, 1)
+	}
+
+	// A slot is taken before fetching a chunk and freed once it is written,
+	// which also bounds the content held in memory.
+	slots := make(chan struct{}, archiveFetchWorkers)
+	go func() {
+		for i, chunk := range chunks {
+			select {
+			case slots <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			go func(i int, chunk []*zoekt.FileMatch) {
+				names := make([]string, len(chunk))
+				for j, f := range chunk {
+					names[j] = regexp.QuoteMeta(f.FileName)
+				}
+				rq := archiveRepoQuery(t) + " f:" + QuoteQueryString("^(?:"+strings.Join(names, "|")+")$")
+				fetched, err := s.archiveSearch(ctx, t, rq, len(chunk), true)
+				res := chunkResult{files: map[string]*zoekt.FileMatch{}, err: err}
+				for _, f := range fetched {
+					res.files[f.FileName] = f
+				}
+				results[i] <- res
+			}(i, chunk)
+		}
+	}()
+
+	for i, chunk := range chunks {
+		var res chunkResult
+		select {
+		case res = <-results[i]:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if res.err != nil {
+			return res.err
+		}
+		for _, f := range chunk {
+			fetched, ok := res.files[f.FileName]
+			if !ok {
+				return fmt.Errorf("%v vanished from the index", f.FileName)
+			}
+			if err := emit(fetched); err != nil {
+				return err
+			}
+		}
+		<-slots
+	}
+	return nil
+}
+
+// archiveETag derives an ETag from the names and checksums of the files, which
+// must be sorted by name.
+func archiveETag(files []*zoekt.FileMatch, format string) string {
+	h := sha1.New()
+	for _, f := range files {
+		fmt.Fprintf(h, "%s\x00%x\n", f.FileName, f.Checksum)
+	}
+	return `"` + hex.EncodeToString(h.Sum(nil)) + "-" + format + `"`
+}
+
+// entryName returns the archive entry name of file under the archived dir,
+// prefixed with the archive name.
+func entryName(name, dir, file string) string {
+	if dir == "" {
+		return name + "/" + file
+	}
+	return name + "/" + file[len(dir)+1:]
+}
+
+// archiveWriter writes the entries of an archive format.
+type archiveWriter interface {
+	add(name string, content []byte) error
+	// Finishes the archive, without closing the underlying writer.
+	close() error
+}
+
+type tarGzWriter struct {
+	gz *gzip.Writer
+	tw *tar.Writer
+}
+
+func newTarGzWriter(w io.Writer) *tarGzWriter {
+	gz := gzip.NewWriter(w)
+	return &tarGzWriter{gz: gz, tw: tar.NewWriter(gz)}
+}
+
+func (a *tarGzWriter) add(name string, content []byte) error {
+	if err := a.tw.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    int64(len(content)),
+		ModTime: archiveModTime,
+	}); err != nil {
+		return err
+	}
+	_, err := a.tw.Write(content)
+	return err
+}
+
+func (a *tarGzWriter) close() error {
+	if err := a.tw.Close(); err != nil {
+		return err
+	}
+	return a.gz.Close()
+}
+
+type zipWriter struct {
+	zw *zip.Writer
+}
+
+func newZipWriter(w io.Writer) *zipWriter {
+	return &zipWriter{zw: zip.NewWriter(w)}
+}
+
+func (a *zipWriter) add(name string, content []byte) error {
+	fw, err := a.zw.CreateHeader(&zip.FileHeader{
+		Name:     name,
+		Method:   zip.Deflate,
+		Modified: archiveModTime,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = fw.Write(content)
+	return err
+}
+
+func (a *zipWriter) close() error {
+	return a.zw.Close()
+}
@@ -0,0 +1,94 @@
+package web
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+
+	"github.com/google/zoekt"
+	"github.com/google/zoekt/query"
+)
+
+// Max matches counted for file tree badges. Beyond, counts are lower bounds,
+// flagged by FileTree.BadgesIncomplete.
+const maxBadgeMatches = 100000
+
+// checkSavedQueries tells if the configured saved queries parse.
+func checkSavedQueries(queries map[string]string) error {
+	for id, rq := range queries {
+		if _, err := query.Parse(rq); err != nil {
+			return fmt.Errorf("saved query %q: %v", id, err)
+		}
+	}
+	return nil
+}
+
+// badgeCounts runs the saved query id, and counts its matches below each node
+// of the file tree at t. Within a repo the counts are keyed by path (files and
+// directories below t.path), else by repoSpec of each repo (and branch).
+// Files not passing filter are not counted. Also tells if the counts are
+// incomplete.
+func (s *Server) badgeCounts(ctx context.Context, id string, t ticket, filter *pathFilter) (map[string]int, bool, error) {
+	saved, ok := s.Config.SavedQueries[id]
+	if !ok {
+		return nil, false, errorf(ErrParamInvalid, "unknown saved query %q", id)
+	}
+	rq := "(" + saved + ")"
+	if t.repo != "" {
+		rq += " " + branchAtoms(t)
+		if t.path != "" {
+			rq += " f:" + QuoteQueryString("^"+regexp.QuoteMeta(t.path+"/"))
+		}
+	}
+	log.Printf("query: %v", rq)
+	q, err := query.Parse(rq)
+	if err != nil {
+		return nil, false, errorf(ErrQueryParse, "%v (query: %v)", err, rq)
+	}
+	sOpts := zoekt.SearchOptions{
+		MaxWallTime:            s.maxWallTime(ctx),
+		ShardMaxMatchCount:     maxBadgeMatches,
+		TotalMaxMatchCount:     maxBadgeMatches,
+		ShardMaxImportantMatch: maxBadgeMatches,
+		TotalMaxImportantMatch: maxBadgeMatches,
+	}
+	result, err := s.search(ctx, q, &sOpts)
+	if err != nil {
+		return nil, false, err
+	}
+
+	counts := map[string]int{}
+	for i := range result.Files {
+		f := &result.Files[i]
+		n := 0
+		for _, lm := range f.LineMatches {
+			n += len(lm.LineFragments)
+		}
+		if t.repo == "" {
+			if len(f.Branches) == 0 {
+				counts[f.Repository] += n
+			}
+			for _, b := range f.Branches {
+				counts[(&ticket{repo: f.Repository, branch: b}).repoSpec()] += n
+			}
+			continue
+		}
+		if !t.matchesFile(f) || !filter.match(f.FileName) {
+			continue
+		}
+		// Add to the file and each directory above it.
+		p := f.FileName
+		for {
+			counts[p] += n
+			i := strings.LastIndexByte(p, '/')
+			if i < 0 {
+				break
+			}
+			p = p[:i]
+		}
+	}
+	incomplete := result.Stats.FilesSkipped > 0 || result.Stats.ShardsSkipped > 0
+	return counts, incomplete, nil
+}
@@ -0,0 +1,199 @@
+package web
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Max time a git blame may run.
+const blameTimeout = 30 * time.Second
+
+// UhBlame is the response of /api/blame.
+type UhBlame struct {
+	Ticket string `json:"ticket"`
+	// Commit (or branch, if the index has no versions) that was blamed.
+	Revision string `json:"revision"`
+	// One per line of the file, in order.
+	Lines []UhBlameLine `json:"lines"`
+}
+
+// UhBlameLine tells the commit that last changed a line.
+type UhBlameLine struct {
+	Commit string    `json:"commit"`
+	Author string    `json:"author"`
+	Email  string    `json:"email"`
+	Date   time.Time `json:"date"`
+	// First line of the commit message.
+	Summary string `json:"summary"`
+}
+
+// repoDirs locates the git repos the index was built from.
+type repoDirs struct {
+	// Base directories, holding the repos like zoekt-mirror-* lays them out.
+	bases []string
+	// Keyed by repo name.
+	repos map[string]string
+}
+
+func newRepoDirs(c BlameConfig) *repoDirs {
+	return &repoDirs{bases: c.RepoDirs, repos: c.Repos}
+}
+
+func (d *repoDirs) empty() bool {
+	return len(d.bases) == 0 && len(d.repos) == 0
+}
+
+// gitDir returns the git directory of repo, or "" if not found.
+func (d *repoDirs) gitDir(repo string) string {
+	if dir, ok := d.repos[repo]; ok {
+		return dir
+	}
+	for _, base := range d.bases {
+		for _, dir := range []string{repo + ".git", repo} {
+			dir = filepath.Join(base, filepath.FromSlash(dir))
+			if fi, err := os.Stat(dir); err == nil && fi.IsDir() {
+				return dir
+			}
+		}
+	}
+	return ""
+}
+
+func (s *Server) serveBlame(w http.ResponseWriter, r *http.Request) {
+	if err := s.serveBlameErr(w, r); err != nil {
+		writeError(w, err)
+	}
+}
+
+// serveBlameErr runs git blame for a file, at the commit it was indexed from.
+// Needs the git repos the index was built from, see BlameConfig.
+func (s *Server) serveBlameErr(w http.ResponseWriter, r *http.Request) error {
+	log.Printf("request: %v", r.URL)
+	tickets, ok := r.URL.Query()["ticket"]
+	if !ok || len(tickets) > 1 {
+		return errorf(ErrParamMissing, "expected ticket parameter")
+	}
+	t, err := s.parseTicket(r.Context(), tickets[0])
+	if err != nil {
+		return err
+	}
+	if !t.complete() {
+		return errorf(ErrTicketFormat, "Expected a file ticket, with repo and path")
+	}
+
+	// Looking the file up first also makes sure the repo name (which becomes
+	// part of a path) is an indexed one.
+	f, err := s.indexedFile(r.Context(), t, false)
+	if err != nil {
+		return err
+	}
+	dir := s.repoDirs.gitDir(f.Repository)
+	if dir == "" {
+		return errorf(ErrNotFound, "No git repo found for %v", f.Repository)
+	}
+	rev := f.Version
+	if rev == "" {
+		rev = t.branch
+	}
+	if rev == "" {
+		rev = firstBranch(f.Branches)
+	}
+	if rev == "" || rev == "HEAD" {
+		rev = "HEAD"
+	} else if strings.HasPrefix(rev, "-") {
+		return errorf(ErrInternal, "Unexpected revision %q", rev)
+	}
+
+	lines, err := gitBlame(r.Context(), dir, rev, f.FileName)
+	if err != nil {
+		return err
+	}
+	res := UhBlame{
+		Ticket:   s.fileTicket(t.repo, t.branch, t.path),
+		Revision: rev,
+		Lines:    lines,
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	return json.NewEncoder(w).Encode(res)
+}
+
+// gitBlame runs git blame on the file at path in the git dir, as of rev.
+func gitBlame(ctx context.Context, dir, rev, path string) ([]UhBlameLine, error) {
+	ctx, cancel := context.WithTimeout(ctx, blameTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "git", "--git-dir="+dir, "blame", "--porcelain", rev, "--", path)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, errorf(ErrInternal, "git blame of %v at %v: %v: %s", path, rev, err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	return parseBlamePorcelain(out)
+}
+
+// parseBlamePorcelain parses the output of git blame --porcelain. Commit
+// details are only given on the first line from the commit, so these are kept
+// around.
+func parseBlamePorcelain(out []byte) ([]UhBlameLine, error) {
+	commits := map[string]*UhBlameLine{}
+	lines := []UhBlameLine{}
+	var cur *UhBlameLine
+	sc := bufio.NewScanner(bytes.NewReader(out))
+	sc.Buffer(nil, 16<<20)
+	for sc.Scan() {
+		l := sc.Text()
+		if strings.HasPrefix(l, "\t") {
+			// The content of the line, ends the entry.
+			if cur == nil {
+				return nil, fmt.Errorf("unexpected blame output: content without header")
+			}
+			lines = append(lines, *cur)
+			cur = nil
+			continue
+		}
+		key, value := l, ""
+		if i := strings.IndexByte(l, ' '); i >= 0 {
+			key, value = l[:i], l[i+1:]
+		}
+		if cur == nil {
+			// Header: <commit> <original line> <final line> [<lines in group>]
+			c, ok := commits[key]
+			if !ok {
+				c = &UhBlameLine{Commit: key}
+				commits[key] = c
+			}
+			cur = c
+			continue
+		}
+		switch key {
+		case "author":
+			cur.Author = value
+		case "author-mail":
+			cur.Email = strings.TrimSuffix(strings.TrimPrefix(value, "<"), ">")
+		case "author-time":
+			secs, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("unexpected blame output: author-time %q", value)
+			}
+			cur.Date = time.Unix(secs, 0).UTC()
+		case "summary":
+			cur.Summary = value
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return lines, nil
+}
@@ -0,0 +1,90 @@
+package web
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseBlamePorcelain(t *testing.T) {
+	const (
+		c1 = "1111111111111111111111111111111111111111"
+		c2 = "2222222222222222222222222222222222222222"
+	)
+	first := UhBlameLine{
+		Commit:  c1,
+		Author:  "Ann Author",
+		Email:   "ann@example.com",
+		Date:    time.Unix(1600000000, 0).UTC(),
+		Summary: "Add the file",
+	}
+	second := UhBlameLine{
+		Commit:  c2,
+		Author:  "Bo Other",
+		Email:   "bo@example.com",
+		Date:    time.Unix(1700000000, 0).UTC(),
+		Summary: "Fix the middle",
+	}
+	for _, tc := range []struct {
+		name string
+		out  string
+		want []UhBlameLine
+	}{
+		{name: "empty", out: "", want: []UhBlameLine{}},
+		{
+			name: "repeated commit",
+			out: c1 + " 1 1 1\n" +
+				"author Ann Author\n" +
+				"author-mail <ann@example.com>\n" +
+				"author-time 1600000000\n" +
+				"author-tz +0100\n" +
+				"committer Ann Author\n" +
+				"summary Add the file\n" +
+				"filename a.go\n" +
+				"\tpackage a\n" +
+				c2 + " 2 2 1\n" +
+				"author Bo Other\n" +
+				"author-mail <bo@example.com>\n" +
+				"author-time 1700000000\n" +
+				"summary Fix the middle\n" +
+				"previous " + c1 + " a.go\n" +
+				"filename a.go\n" +
+				"\t// fixed\n" +
+				// Details of a commit are only given on its first line.
+				c1 + " 3 3\n" +
+				"\tfunc A() {}\n",
+			want: []UhBlameLine{first, second, first},
+		},
+		{
+			name: "tab in content",
+			out: c1 + " 1 1 1\n" +
+				"author Ann Author\n" +
+				"author-mail <ann@example.com>\n" +
+				"author-time 1600000000\n" +
+				"summary Add the file\n" +
+				"\t\tindented\n",
+			want: []UhBlameLine{first},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := parseBlamePorcelain([]byte(tc.out))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("parseBlamePorcelain() = %+v, want %+v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestParseBlamePorcelainErrors(t *testing.T) {
+	for _, out := range []string{
+		"\tcontent without header\n",
+		"1111111111111111111111111111111111111111 1 1 1\nauthor-time soon\n\tx\n",
+	} {
+		if _, err := parseBlamePorcelain([]byte(out)); err == nil {
+			t.Errorf("parseBlamePorcelain(%q) succeeded, want an error", out)
+		}
+	}
+}
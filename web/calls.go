@@ -0,0 +1,133 @@
+package web
+
+import (
+	"crypto/sha1"
+	"net/http"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Languages calling functions as "(f args)", rather than "f(args)".
+var lispLanguages = map[string]bool{
+	"Clojure":     true,
+	"Common Lisp": true,
+	"Emacs Lisp":  true,
+	"Racket":      true,
+	"Scheme":      true,
+}
+
+// Languages where function application is juxtaposition ("f x"), so calls
+// can't be told from other references by the text around them.
+var juxtapositionLanguages = map[string]bool{
+	"Elm":        true,
+	"F#":         true,
+	"Haskell":    true,
+	"Idris":      true,
+	"OCaml":      true,
+	"PureScript": true,
+}
+
+// Keywords that make "name(" a definition rather than a call.
+var definitionKeywords = map[string]bool{
+	"def":      true,
+	"fn":       true,
+	"fun":      true,
+	"func":     true,
+	"function": true,
+	"sub":      true,
+}
+
+// xrefCalls tells if the request asks for call site detection, with
+// calls=yes|no. On by default.
+func xrefCalls(r *http.Request) (bool, error) {
+	cs, ok := r.URL.Query()["calls"]
+	if !ok {
+		return true, nil
+	}
+	switch cs[0] {
+	case "yes":
+		return true, nil
+	case "no":
+		return false, nil
+	}
+	return false, errorf(ErrParamInvalid, "unknown calls %q, want one of yes, no", cs[0])
+}
+
+// callGroups picks the snippets of sites where an occurrence looks like a
+// function call, grouped like xref results. Also returns the number of such
+// lines.
+//
+// This is a textual heuristic: an occurrence followed by "(" is a call,
+// unless preceded by a definition keyword like "func". In Lisps, it must be
+// preceded by "(" instead. Only returned snippets are considered, see
+// SearchConfig.MaxSnippetsPerFile.
+func callGroups(sites []fileSites) ([]UhSiteGroup, int) {
+	var calls []fileSites
+	count := 0
+	for _, fs := range sites {
+		if juxtapositionLanguages[fs.language] {
+			continue
+		}
+		var snippets []UhSnippet
+		h := sha1.New()
+		for _, sn := range fs.snippets {
+			if isCallSnippet(sn, fs.language) {
+				snippets = append(snippets, sn)
+				h.Write([]byte(sn.Text))
+			}
+		}
+		if len(snippets) == 0 {
+			continue
+		}
+		count += len(snippets)
+		fs.snippets = snippets
+		fs.totalMatches = len(snippets)
+		fs.snippetsHash = h.Sum(nil)
+		calls = append(calls, fs)
+	}
+	return siteGroups(calls), count
+}
+
+// isCallSnippet tells if any occurrence of the snippet looks like a call.
+func isCallSnippet(sn UhSnippet, language string) bool {
+	for _, sp := range sn.OccurrenceSpans {
+		from, to := sp.From.Ch, sp.To.Ch
+		if from < 0 || to > len(sn.Text) || from > to {
+			continue
+		}
+		before := strings.TrimRightFunc(sn.Text[:from], unicode.IsSpace)
+		after := strings.TrimLeftFunc(sn.Text[to:], unicode.IsSpace)
+		if lispLanguages[language] {
+			if strings.HasSuffix(before, "(") {
+				return true
+			}
+			continue
+		}
+		if !strings.HasPrefix(after, "(") {
+			continue
+		}
+		if definitionKeywords[lastWord(before)] {
+			continue
+		}
+		// Go methods, "func (r *T) name(".
+		if strings.HasPrefix(strings.TrimSpace(before), "func (") && strings.HasSuffix(before, ")") {
+			continue
+		}
+		return true
+	}
+	return false
+}
+
+// lastWord returns the trailing identifier-like word of s, if any.
+func lastWord(s string) string {
+	i := len(s)
+	for i > 0 {
+		r, size := utf8.DecodeLastRuneInString(s[:i])
+		if !(r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)) {
+			break
+		}
+		i -= size
+	}
+	return s[i:]
+}
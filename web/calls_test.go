@@ -0,0 +1,44 @@
+package web
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestIsCallSnippet(t *testing.T) {
+	for _, tc := range []struct {
+		text, ident, language string
+		want                  bool
+	}{
+		{text: "\tx := parse(s)", ident: "parse", language: "Go", want: true},
+		{text: "\tp.parse (s)", ident: "parse", language: "Go", want: true},
+		{text: "\tvar f = parse", ident: "parse", language: "Go", want: false},
+		{text: "func parse(s string) error {", ident: "parse", language: "Go", want: false},
+		{text: "func (p *parser) parse(s string) error {", ident: "parse", language: "Go", want: false},
+		{text: "func (p *parser) run() { p.parse(s) }", ident: "parse", language: "Go", want: true},
+		// The declaration is skipped, the call in the body is not.
+		{text: "func (p *parser) parse() { parse(0) }", ident: "parse", language: "Go", want: true},
+		{text: "def parse(s):", ident: "parse", language: "Python", want: false},
+		{text: "(parse s)", ident: "parse", language: "Clojure", want: true},
+		{text: "(map parse xs)", ident: "parse", language: "Clojure", want: false},
+	} {
+		t.Run(tc.text, func(t *testing.T) {
+			sn := UhSnippet{Text: tc.text}
+			for i := 0; ; {
+				j := strings.Index(tc.text[i:], tc.ident)
+				if j < 0 {
+					break
+				}
+				i += j
+				sn.OccurrenceSpans = append(sn.OccurrenceSpans, CmRange{
+					From: CmPoint{Ch: i},
+					To:   CmPoint{Ch: i + len(tc.ident)},
+				})
+				i += len(tc.ident)
+			}
+			if got := isCallSnippet(sn, tc.language); got != tc.want {
+				t.Errorf("isCallSnippet(%q, %s) = %v, want %v", tc.text, tc.language, got, tc.want)
+			}
+		})
+	}
+}
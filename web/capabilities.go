@@ -0,0 +1,115 @@
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+)
+
+// Names of optional features that can be disabled via Config.Disabled, in
+// addition to endpoint names.
+const (
+	// Passing the selection to Zoekt as-is, with mode=Raw in search-xref.
+	featureRawSearch = "raw-search"
+)
+
+var knownFeatures = []string{featureRawSearch}
+
+// endpoint is an API route that can be disabled by its name.
+type endpoint struct {
+	name    string
+	pattern string
+	handler http.HandlerFunc
+}
+
+// Capabilities describes what this server instance offers, so clients can
+// hide UI for disabled functionality.
+type Capabilities struct {
+	Version string `json:"version"`
+	// Keyed by endpoint name (the path without the /api/ prefix).
+	Endpoints map[string]bool `json:"endpoints"`
+	// Keyed by feature name, see knownFeatures.
+	Features map[string]bool `json:"features"`
+	// See Config.TicketScheme. "custom" if the server was set up with its own
+	// TicketCodec.
+	TicketScheme string `json:"ticketScheme"`
+	// Names of the search profiles, see SearchProfile.
+	Profiles       []string `json:"profiles"`
+	DefaultProfile string   `json:"defaultProfile"`
+	// Of search-xref requests omitting the casing and mode parameters.
+	DefaultCasing string `json:"defaultCasing"`
+	DefaultMode   string `json:"defaultMode"`
+	// Names of the transformers of format=rendered source requests.
+	Transformers []string `json:"transformers"`
+	// Repos covered by Kythe, with semantic decors and xrefs. Sorted.
+	KytheRepos []string `json:"kytheRepos"`
+}
+
+// setDisabled records the disabled endpoints and features, checking that all
+// names are known.
+func (s *Server) setDisabled(endpoints []endpoint, disabled []string) error {
+	known := map[string]bool{}
+	for _, e := range endpoints {
+		known[e.name] = true
+	}
+	for _, f := range knownFeatures {
+		known[f] = true
+	}
+	s.disabled = map[string]bool{}
+	for _, d := range disabled {
+		if !known[d] {
+			return fmt.Errorf("can't disable unknown endpoint or feature %q", d)
+		}
+		s.disabled[d] = true
+	}
+	return nil
+}
+
+// handle registers the endpoint on mux, or a stub responding with ErrDisabled
+// if it is disabled.
+func (s *Server) handle(mux *http.ServeMux, e endpoint) {
+	if !s.disabled[e.name] {
+		mux.HandleFunc(e.pattern, s.instrument(e.name, e.handler))
+		return
+	}
+	log.Printf("endpoint %v disabled", e.name)
+	mux.HandleFunc(e.pattern, func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, errorf(ErrDisabled, "Endpoint %v is disabled on this server", e.name))
+	})
+}
+
+func (s *Server) serveCapabilities(w http.ResponseWriter, r *http.Request) {
+	c := Capabilities{
+		Version:        s.Version,
+		Endpoints:      map[string]bool{},
+		Features:       map[string]bool{},
+		Profiles:       s.profileNames(),
+		DefaultProfile: s.defaultProfile,
+		DefaultCasing:  s.defaultCasing(),
+		DefaultMode:    s.defaultMode(),
+		Transformers:   s.transformers.names(),
+		KytheRepos:     s.kythe.repoNames(),
+	}
+	for _, e := range s.endpoints {
+		c.Endpoints[e.name] = !s.disabled[e.name]
+	}
+	for _, f := range knownFeatures {
+		c.Features[f] = !s.disabled[f]
+	}
+	switch s.TicketCodec.(type) {
+	case DefaultTicketCodec:
+		c.TicketScheme = "default"
+	case KytheTicketCodec:
+		c.TicketScheme = "kythe"
+	case SourcegraphTicketCodec:
+		c.TicketScheme = "sourcegraph"
+	default:
+		c.TicketScheme = "custom"
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(c); err != nil {
+		log.Printf("encoding capabilities: %v", err)
+	}
+}
@@ -0,0 +1,269 @@
+package web
+
+import (
+	"encoding/json"
+	"os"
+)
+
+// Config holds deployment-specific settings, usually loaded from a JSON file
+// (see LoadConfig). The zero value is a valid config with default behavior.
+type Config struct {
+	Archive ArchiveConfig `json:"archive"`
+
+	Blame BlameConfig `json:"blame"`
+
+	Display DisplayConfig `json:"display"`
+
+	Generated GeneratedConfig `json:"generated"`
+
+	Kythe KytheConfig `json:"kythe"`
+
+	Search SearchConfig `json:"search"`
+
+	Source SourceConfig `json:"source"`
+
+	Usage UsageConfig `json:"usage"`
+
+	// Format of tickets: "default" (repo:path, the default), "kythe"
+	// (kythe://repo?path=path) or "sourcegraph" (repo/-/blob/path). See the
+	// TicketCodec implementations.
+	TicketScheme string `json:"ticketScheme"`
+
+	// Descriptions and tags of repos for /api/search-repos, keyed by repo
+	// name. Repos without an entry use the zoekt.description and zoekt.tags
+	// git config they were indexed with.
+	RepoMetadata map[string]RepoMetadata `json:"repoMetadata"`
+
+	// Files added to the file tree, usually links to derived artifacts. See
+	// Server.VirtualFiles for ones with content.
+	VirtualFiles []VirtualFile `json:"virtualFiles"`
+
+	// Zoekt queries keyed by ID, like {"todos": "TODO case:yes"}. The file tree
+	// counts the matches of one below each node with badge_query=<ID>.
+	SavedQueries map[string]string `json:"savedQueries"`
+
+	// Time budget of a request, like "10s" (the default). Split into deadlines
+	// of the request stages, see stageShares. Applies to the "interactive"
+	// profile, and others not setting their own.
+	RequestBudget string `json:"requestBudget"`
+
+	// Search profiles keyed by name, adding to or overriding the built-in
+	// "interactive", "thorough" and "ci" ones (see builtinProfiles).
+	Profiles map[string]SearchProfile `json:"profiles"`
+
+	// Profile of requests without a profile parameter. Defaults to
+	// "interactive".
+	DefaultProfile string `json:"defaultProfile"`
+
+	// Names of endpoints (the path without the /api/ prefix, like
+	// "search-xref") or optional features (like "raw-search") to disable.
+	// Requests to them get ERR_DISABLED.
+	Disabled []string `json:"disabled"`
+}
+
+// DisplayConfig controls how files are named in search results.
+type DisplayConfig struct {
+	// Go text/template strings rendering UhDisplayedFile.DisplayName, keyed by
+	// repo name. The "*" key applies to repos without their own entry. The
+	// template can refer to .Repo, .Alias, .Branch and .Path.
+	//
+	// Example: "{{.Alias}} › {{.Path}}"
+	//
+	// If no template applies, the file ticket is displayed.
+	Templates map[string]string `json:"templates"`
+
+	// Shorter or friendlier repo names, keyed by repo name. Available in
+	// templates as .Alias, which defaults to the repo name as displayed (see
+	// RepoNames).
+	Aliases map[string]string `json:"aliases"`
+
+	// Rewrite repo names for the file tree, tickets and display names. The
+	// first rule whose pattern matches applies. Tickets of either the
+	// rewritten or the original name resolve to the repo.
+	RepoNames []RepoNameRule `json:"repoNames"`
+}
+
+// RepoNameRule rewrites the names of matching repos to a name within an
+// optional namespace. Shown as "namespace / name" in the file tree, and as
+// "namespace/name" in tickets.
+//
+// Example: {"pattern": "^github\\.com/([^/]+)/(.+)$", "namespace": "$1", "name": "$2"}
+// shows github.com/org/project as "org / project".
+type RepoNameRule struct {
+	// Regexp matched against the Zoekt repo name.
+	Pattern string `json:"pattern"`
+	// Templates expanded with the submatches of the pattern, like "$1" (see
+	// regexp.Expand). An empty namespace means none.
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+}
+
+// GeneratedConfig tells which files are generated, so the file tree can flag
+// them (see FileTree.OnlyGenerated). A file is generated if either its path or
+// its content matches.
+type GeneratedConfig struct {
+	// Path globs (see compileGlob), like "**/*.pb.go" or "bazel-out/".
+	Paths []string `json:"paths"`
+
+	// Regexps matched case-sensitively against file content, like
+	// `^// Code generated .* DO NOT EDIT\.$`.
+	ContentMarkers []string `json:"contentMarkers"`
+}
+
+// SearchConfig tunes search result shaping.
+type SearchConfig struct {
+	// Caps on the snippets returned per file in xref replies. Zero means no
+	// limit. The remaining matches can be fetched from /api/file-matches.
+	MaxSnippetsPerFile     int `json:"maxSnippetsPerFile"`
+	MaxSnippetBytesPerFile int `json:"maxSnippetBytesPerFile"`
+
+	// Cap on the snippet text of an xref reply, in bytes (32 MiB by default,
+	// negative for no limit). Files found after it's reached come without
+	// snippets, which bounds the memory of replies to huge searches.
+	MaxSnippetBytesPerReply int `json:"maxSnippetBytesPerReply"`
+
+	// Skip the document count estimate pre-search of xref queries by default,
+	// using Zoekt's default match limits instead. Can be overridden per
+	// request with estimate=yes|no.
+	SkipEstimate bool `json:"skipEstimate"`
+
+	// Casing ("yes", "no" or "auto") and mode ("Lax", "Boundary", "Regexp" or
+	// "Raw") of xref searches not giving the casing and mode parameters.
+	// Default to "auto" and "Lax".
+	DefaultCasing string `json:"defaultCasing"`
+	DefaultMode   string `json:"defaultMode"`
+
+	// Size of the cache of xref search results, kept across requests, in
+	// number of searches (200 by default, negative to disable). Entries
+	// expire after XrefCacheTTL, like "5m" (the default), or when the index
+	// changes.
+	XrefCacheEntries int    `json:"xrefCacheEntries"`
+	XrefCacheTTL     string `json:"xrefCacheTTL"`
+
+	// Expression ordering xref results, see rankexpr.go for the language and
+	// the available signals. Empty means the default order: files of the
+	// request's repo first, then by Zoekt score.
+	RankExpr string `json:"rankExpr"`
+
+	// Priority tier ("gold", "silver" or "bronze") of repos, keyed by repo
+	// name. Unlisted repos are silver. Higher tiers come first in xref results
+	// (after the request's own repo), and gold repos get larger per-shard
+	// match budgets, so their matches are less likely to be cut. Useful to
+	// favor upstream repos over forks and mirrors.
+	RepoPriorities map[string]string `json:"repoPriorities"`
+
+	// Canonical repo of fork or mirror repos, keyed by fork repo name. In xref
+	// results, files of forks identical to a file of the canonical repo are
+	// collapsed under that file (see UhFileSites.ForkFiles), unless the
+	// request has forks=expand.
+	Forks map[string]string `json:"forks"`
+
+	// Regexps of repo names, most preferred first, picking which of the
+	// files with the same content in xref results is the canonical copy. The
+	// others are marked as duplicates of it (see UhFileSites.IsDupOf). Among
+	// equally preferred repos, those not in Forks and of higher tiers win,
+	// then the one listed first.
+	CanonicalRepos []string `json:"canonicalRepos"`
+
+	// Also treat repos as forks if most of their matching files in an xref
+	// result are identical. The canonical one is picked by tier, then by
+	// number of matching files.
+	InferForks bool `json:"inferForks"`
+
+	// Path globs (see parsePathFilter, "!" excludes) of test files, which
+	// xref results flag (see UhFileSites.IsTest) and can return apart with
+	// tests=separate. Empty means common conventions, like "_test." or
+	// "Test*.java" names and files below test/, tests/ or spec/.
+	TestPaths []string `json:"testPaths"`
+
+	// Paths excluded from xref results, like "vendor/" or "node_modules/"
+	// (matching at any depth) or "/third_party/" (only at the repo root).
+	// Requests can add more with the exclude parameter, or drop these with
+	// exclude_defaults=no.
+	ExcludePaths []string `json:"excludePaths"`
+}
+
+// SourceConfig tunes /api/source responses.
+type SourceConfig struct {
+	// Content above this many bytes is cut in format=json responses, which
+	// then have the truncated flag set. Zero means no limit.
+	MaxJSONBytes int `json:"maxJsonBytes"`
+
+	// Chroma style (like "github" or "monokai") of the syntax-highlighted
+	// format=html responses. Empty disables format=html, since highlighting
+	// large files is costly.
+	HighlightStyle string `json:"highlightStyle"`
+
+	// Time limit of rendering a file with format=rendered, like "2s" (the
+	// default).
+	RenderTimeout string `json:"renderTimeout"`
+}
+
+// KytheConfig points to a Kythe server, whose serving table is consulted for
+// /api/decor and for search-xref requests with a target, for the repos it
+// covers. Others, and requests Kythe fails, are served by Zoekt.
+type KytheConfig struct {
+	// Base URL of the HTTP API of the Kythe server, like
+	// "http://localhost:8080" for Kythe's http_server. Empty disables Kythe.
+	URL string `json:"url"`
+
+	// Corpora of the repos covered, keyed by repo. Kythe data is of a single
+	// revision, so applies to all branches of a repo.
+	Corpora map[string]KytheCorpus `json:"corpora"`
+
+	// Time limit of Kythe requests, like "2s" (the default).
+	Timeout string `json:"timeout"`
+}
+
+// KytheCorpus locates the files of a repo in Kythe.
+type KytheCorpus struct {
+	// Empty means the repo name.
+	Corpus string `json:"corpus"`
+	Root   string `json:"root"`
+}
+
+// ArchiveConfig controls downloads of /api/archive.
+type ArchiveConfig struct {
+	// Archives estimated to be larger than this many bytes need confirmation
+	// (see /api/archive). Zero means 256 MiB, negative to never require it.
+	ConfirmBytes int64 `json:"confirmBytes"`
+}
+
+// BlameConfig locates the git repos the index was built from, for
+// /api/blame. The endpoint is disabled if none are configured.
+type BlameConfig struct {
+	// Directories holding bare repos, with repo "github.com/a/b" at
+	// github.com/a/b.git (as laid out by zoekt-mirror-*) or github.com/a/b
+	// below one of them.
+	RepoDirs []string `json:"repoDirs"`
+
+	// Git directories keyed by repo name, taking precedence over RepoDirs.
+	Repos map[string]string `json:"repos"`
+}
+
+// UsageConfig controls the usage summary, see /api/admin/usage-summary.
+type UsageConfig struct {
+	// If set, the usage summary is also written to this file periodically.
+	SummaryFile string `json:"summaryFile"`
+
+	// How often to write SummaryFile, like "1h" (the default).
+	SummaryInterval string `json:"summaryInterval"`
+}
+
+// LoadConfig reads a JSON config file. Unknown fields are rejected, so typos
+// don't silently go unnoticed.
+func LoadConfig(path string) (*Config, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	c := &Config{}
+	if err := dec.Decode(c); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
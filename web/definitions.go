@@ -0,0 +1,76 @@
+package web
+
+import (
+	"context"
+	"log"
+	"net/http"
+
+	"github.com/google/zoekt/query"
+)
+
+// Files searched for definitions of the selection of xref requests.
+const maxDefinitionFiles = 50
+
+// definitionsQuery returns the query finding definitions of the selection of
+// an xref request, as symbols (from ctags, at indexing) matching it. Empty for
+// the Regexp and Raw modes, which don't search for an identifier.
+func (s *Server) definitionsQuery(r *http.Request) (string, error) {
+	selection, casing, mode, err := s.xrefParams(r)
+	if err != nil {
+		return "", err
+	}
+	if selection == "" || mode != "Lax" && mode != "Boundary" {
+		return "", nil
+	}
+	sel := escapeLiteralQuery(selection)
+	if mode == "Boundary" {
+		sel = "\\b" + sel + "\\b"
+	}
+	return "case:" + casing + " sym:" + sel, nil
+}
+
+// definitions searches the definitions query dq, grouping files by their
+// lines like xref results. Without symbols in the index, this finds nothing.
+// Also returns why the search was cut short, like appendSearches.
+func (s *Server) definitions(ctx context.Context, dq string) ([]UhSiteGroup, string, error) {
+	log.Printf("query: %v", dq)
+	q, err := query.Parse(dq)
+	if err != nil {
+		return nil, "", errorf(ErrQueryParse, "%v (query: %v)", err, dq)
+	}
+	// The estimate is skipped: symbol matches are few, and cheap to find.
+	lim, err := s.searchLimits(ctx, q, false, maxDefinitionFiles)
+	if err != nil {
+		return nil, "", err
+	}
+	sites := []fileSites{}
+	_, partial, err := s.searchFileSites(ctx, q, &lim.opts, nil, &sites)
+	if err != nil {
+		return nil, "", err
+	}
+	return siteGroups(sites), partial, nil
+}
+
+// siteGroups groups files with the same lines (snippetsHash), keeping the
+// order of the files otherwise.
+func siteGroups(sites []fileSites) []UhSiteGroup {
+	groups := map[string]int{}
+	gs := []UhSiteGroup{}
+	for _, fs := range sites {
+		f := UhFileSites{
+			ContainingFile: fs.containingFile,
+			Snippets:       fs.snippets,
+			TotalMatches:   fs.totalMatches,
+			IsTest:         fs.isTest,
+			Score:          fs.score,
+		}
+		h := string(fs.snippetsHash)
+		if i, ok := groups[h]; ok {
+			gs[i].Files = append(gs[i].Files, f)
+			continue
+		}
+		groups[h] = len(gs)
+		gs = append(gs, UhSiteGroup{Files: []UhFileSites{f}})
+	}
+	return gs
+}
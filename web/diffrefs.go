@@ -0,0 +1,309 @@
+package web
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/google/zoekt"
+	"github.com/google/zoekt/query"
+)
+
+// Max size of a posted diff.
+const maxDiffBytes = 4 << 20
+
+// Max distinct identifiers searched for per diff. Further ones are dropped,
+// flagged by UhDiffRefs.Truncated.
+const maxDiffIdentifiers = 200
+
+// Shorter identifiers are too common to be worth searching.
+const minDiffIdentifierLen = 3
+
+// Example files returned per identifier.
+const diffRefExamples = 3
+
+var (
+	hunkHeaderRE = regexp.MustCompile(`^@@ -(\d+)(?:,(\d+))? \+(\d+)(?:,(\d+))? @@`)
+	identifierRE = regexp.MustCompile(`[A-Za-z_][A-Za-z0-9_]*`)
+)
+
+// UhDiffRefs is the response of /api/diff-refs.
+type UhDiffRefs struct {
+	// In the order of the diff.
+	Hunks []UhHunkRefs `json:"hunks"`
+	// True if the diff had too many identifiers, and some were not searched.
+	Truncated bool `json:"truncated"`
+}
+
+// UhHunkRefs lists the identifiers a hunk adds or removes, with their
+// references in the index.
+type UhHunkRefs struct {
+	// Path in the new version of the file (the old one, if deleted).
+	File string `json:"file"`
+	// The @@ line of the hunk.
+	Header   string `json:"header"`
+	OldStart int    `json:"oldStart"`
+	OldLines int    `json:"oldLines"`
+	NewStart int    `json:"newStart"`
+	NewLines int    `json:"newLines"`
+	// Sorted by name.
+	Identifiers []UhIdentifierRefs `json:"identifiers"`
+}
+
+// UhIdentifierRefs tells the references of an identifier in the index.
+type UhIdentifierRefs struct {
+	Name string `json:"name"`
+	// "added" if only on added lines of the hunk, "removed" if only on removed
+	// ones.
+	Change  string `json:"change"`
+	Files   int    `json:"files"`
+	Matches int    `json:"matches"`
+	// True if the search hit limits, so the counts are lower bounds.
+	Incomplete bool              `json:"incomplete"`
+	Examples   []UhDisplayedFile `json:"examples"`
+}
+
+// diffHunk is a parsed hunk of a unified diff.
+type diffHunk struct {
+	file               string
+	header             string
+	oldStart, oldLines int
+	newStart, newLines int
+	// Lines not seen yet while parsing.
+	oldLeft, newLeft int
+	added, removed   map[string]bool
+}
+
+func (s *Server) serveDiffRefs(w http.ResponseWriter, r *http.Request) {
+	if err := s.serveDiffRefsErr(w, r); err != nil {
+		writeError(w, err)
+	}
+}
+
+// serveDiffRefsErr finds the references of identifiers a posted unified diff
+// adds or removes, per hunk. Meant for review bots, to point out removed
+// symbols still in use. The optional ticket parameter restricts the search to
+// a repo.
+func (s *Server) serveDiffRefsErr(w http.ResponseWriter, r *http.Request) error {
+	log.Printf("request: %v", r.URL)
+	if r.Method != http.MethodPost {
+		return errorf(ErrParamMissing, "expected a unified diff POSTed as the request body")
+	}
+	scope := ""
+	if tickets, ok := r.URL.Query()["ticket"]; ok {
+		t, err := s.parseTicket(r.Context(), tickets[0])
+		if err != nil {
+			return err
+		}
+		if t.repo == "" || t.path != "" {
+			return errorf(ErrTicketFormat, "Expected a repo ticket")
+		}
+		scope = branchAtoms(t)
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxDiffBytes))
+	if err != nil {
+		return errorf(ErrLimitExceeded, "diff is larger than %d bytes", maxDiffBytes)
+	}
+	hunks, err := parseUnifiedDiff(body)
+	if err != nil {
+		return errorf(ErrParamInvalid, "%v", err)
+	}
+
+	ctx, done := s.stage(r.Context(), stageSearch)
+	defer done()
+	res := UhDiffRefs{Hunks: []UhHunkRefs{}}
+	searched := map[string]bool{}
+	for _, h := range hunks {
+		hr := UhHunkRefs{
+			File:        h.file,
+			Header:      h.header,
+			OldStart:    h.oldStart,
+			OldLines:    h.oldLines,
+			NewStart:    h.newStart,
+			NewLines:    h.newLines,
+			Identifiers: []UhIdentifierRefs{},
+		}
+		for _, change := range []struct {
+			name   string
+			idents map[string]bool
+			other  map[string]bool
+		}{
+			{"added", h.added, h.removed},
+			{"removed", h.removed, h.added},
+		} {
+			for ident := range change.idents {
+				if change.other[ident] {
+					// Only moved around within the hunk.
+					continue
+				}
+				if !searched[ident] && len(searched) >= maxDiffIdentifiers {
+					res.Truncated = true
+					continue
+				}
+				searched[ident] = true
+				// Repeated identifiers are answered by the search memo.
+				ir, err := s.identifierRefs(ctx, ident, scope)
+				if err != nil {
+					return err
+				}
+				ir.Change = change.name
+				hr.Identifiers = append(hr.Identifiers, ir)
+			}
+		}
+		sort.Slice(hr.Identifiers, func(i, j int) bool {
+			return hr.Identifiers[i].Name < hr.Identifiers[j].Name
+		})
+		res.Hunks = append(res.Hunks, hr)
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	return json.NewEncoder(w).Encode(res)
+}
+
+// identifierRefs counts the whole-word, case-sensitive matches of ident in
+// scope (the whole index if empty), matching its branches exactly.
+func (s *Server) identifierRefs(ctx context.Context, ident, scope string) (UhIdentifierRefs, error) {
+	rq := "case:yes \\b" + ident + "\\b"
+	if scope != "" {
+		rq = scope + " " + rq
+	}
+	log.Printf("query: %v", rq)
+	q, err := query.Parse(rq)
+	if err != nil {
+		return UhIdentifierRefs{}, errorf(ErrQueryParse, "%v (query: %v)", err, rq)
+	}
+	q = exactBranches(q)
+	sOpts := zoekt.SearchOptions{
+		MaxWallTime: s.maxWallTime(ctx),
+	}
+	sOpts.SetDefaults()
+	result, err := s.search(ctx, q, &sOpts)
+	if err != nil {
+		return UhIdentifierRefs{}, err
+	}
+	ir := UhIdentifierRefs{
+		Name:       ident,
+		Files:      result.Stats.FileCount,
+		Matches:    result.Stats.MatchCount,
+		Incomplete: result.Stats.FilesSkipped > 0 || result.Stats.ShardsSkipped > 0,
+		Examples:   []UhDisplayedFile{},
+	}
+	for i := range result.Files {
+		if i >= diffRefExamples {
+			break
+		}
+		ir.Examples = append(ir.Examples, s.displayedFile(result, &result.Files[i]))
+	}
+	return ir, nil
+}
+
+// parseUnifiedDiff parses the hunks of a unified diff (as output by git diff
+// or diff -u), collecting the identifiers on added and removed lines.
+func parseUnifiedDiff(diff []byte) ([]diffHunk, error) {
+	var hunks []diffHunk
+	oldFile, newFile := "", ""
+	var cur *diffHunk
+	sc := bufio.NewScanner(bytes.NewReader(diff))
+	sc.Buffer(nil, maxDiffBytes)
+	for sc.Scan() {
+		l := sc.Text()
+		switch {
+		case strings.HasPrefix(l, "--- ") && (cur == nil || hunkDone(cur)):
+			oldFile = diffPath(l[len("--- "):])
+			cur = nil
+		case strings.HasPrefix(l, "+++ ") && cur == nil:
+			newFile = diffPath(l[len("+++ "):])
+		case strings.HasPrefix(l, "@@"):
+			m := hunkHeaderRE.FindStringSubmatch(l)
+			if m == nil {
+				return nil, errorf(ErrParamInvalid, "malformed hunk header %q", l)
+			}
+			file := newFile
+			if file == "" {
+				file = oldFile
+			}
+			if file == "" {
+				return nil, errorf(ErrParamInvalid, "hunk without file header: %q", l)
+			}
+			h := diffHunk{
+				file:     file,
+				header:   l,
+				oldStart: atoiDefault(m[1], 1),
+				oldLines: atoiDefault(m[2], 1),
+				newStart: atoiDefault(m[3], 1),
+				newLines: atoiDefault(m[4], 1),
+				added:    map[string]bool{},
+				removed:  map[string]bool{},
+			}
+			h.oldLeft, h.newLeft = h.oldLines, h.newLines
+			hunks = append(hunks, h)
+			cur = &hunks[len(hunks)-1]
+		case cur == nil:
+			// Headers like "diff --git" or "index".
+		case strings.HasPrefix(l, "+"):
+			addIdentifiers(cur.added, l[1:])
+			cur.newLeft--
+		case strings.HasPrefix(l, "-"):
+			addIdentifiers(cur.removed, l[1:])
+			cur.oldLeft--
+		case strings.HasPrefix(l, " ") || l == "":
+			cur.oldLeft--
+			cur.newLeft--
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return hunks, nil
+}
+
+// hunkDone tells if all lines of the hunk were seen, so a "--- " line starts
+// the next file rather than removing a line starting with "-- ".
+func hunkDone(h *diffHunk) bool {
+	return h.oldLeft <= 0 && h.newLeft <= 0
+}
+
+// diffPath returns the path of a ---/+++ header, without the a/ or b/ prefix
+// git adds. Empty for /dev/null.
+func diffPath(p string) string {
+	if i := strings.IndexByte(p, '\t'); i >= 0 {
+		// Timestamp of diff -u.
+		p = p[:i]
+	}
+	if p == "/dev/null" {
+		return ""
+	}
+	if strings.HasPrefix(p, "a/") || strings.HasPrefix(p, "b/") {
+		p = p[2:]
+	}
+	return p
+}
+
+func addIdentifiers(idents map[string]bool, line string) {
+	for _, id := range identifierRE.FindAllString(line, -1) {
+		if len(id) >= minDiffIdentifierLen {
+			idents[id] = true
+		}
+	}
+}
+
+func atoiDefault(s string, def int) int {
+	if s == "" {
+		return def
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return def
+	}
+	return n
+}
@@ -0,0 +1,119 @@
+package web
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestParseUnifiedDiff(t *testing.T) {
+	type hunk struct {
+		file               string
+		oldStart, oldLines int
+		newStart, newLines int
+		added, removed     []string
+	}
+	for _, tc := range []struct {
+		name string
+		diff string
+		want []hunk
+	}{
+		{
+			name: "git",
+			diff: "diff --git a/x.go b/x.go\n" +
+				"index 123..456 100644\n" +
+				"--- a/x.go\n" +
+				"+++ b/x.go\n" +
+				"@@ -1,3 +1,3 @@ func main() {\n" +
+				" keep()\n" +
+				"-oldCall(arg)\n" +
+				"+newCall(arg)\n" +
+				" keep()\n",
+			want: []hunk{{file: "x.go", oldStart: 1, oldLines: 3, newStart: 1, newLines: 3, added: []string{"arg", "newCall"}, removed: []string{"arg", "oldCall"}}},
+		},
+		{
+			name: "removed line starting with --",
+			diff: "--- a/q.sql\n" +
+				"+++ b/q.sql\n" +
+				"@@ -1,2 +1,1 @@\n" +
+				"--- dropped comment\n" +
+				" select\n" +
+				"--- a/y.go\n" +
+				"+++ b/y.go\n" +
+				"@@ -5 +5 @@\n" +
+				"-before\n" +
+				"+after\n",
+			want: []hunk{
+				{file: "q.sql", oldStart: 1, oldLines: 2, newStart: 1, newLines: 1, removed: []string{"comment", "dropped"}},
+				{file: "y.go", oldStart: 5, oldLines: 1, newStart: 5, newLines: 1, added: []string{"after"}, removed: []string{"before"}},
+			},
+		},
+		{
+			name: "added line starting with ++",
+			diff: "--- a/c.c\n" +
+				"+++ b/c.c\n" +
+				"@@ -1,0 +1,1 @@\n" +
+				"+++counter;\n",
+			want: []hunk{{file: "c.c", oldStart: 1, oldLines: 0, newStart: 1, newLines: 1, added: []string{"counter"}}},
+		},
+		{
+			name: "deleted file",
+			diff: "--- a/gone.go\n" +
+				"+++ /dev/null\n" +
+				"@@ -1 +0,0 @@\n" +
+				"-package gone\n",
+			want: []hunk{{file: "gone.go", oldStart: 1, oldLines: 1, newStart: 0, newLines: 0, removed: []string{"gone", "package"}}},
+		},
+		{
+			name: "diff -u timestamps, short identifiers",
+			diff: "--- old/z.txt\t2020-01-01 00:00:00\n" +
+				"+++ new/z.txt\t2020-01-02 00:00:00\n" +
+				"@@ -1 +1 @@\n" +
+				"-a bc def\n" +
+				"+a bc ghi\n",
+			want: []hunk{{file: "new/z.txt", oldStart: 1, oldLines: 1, newStart: 1, newLines: 1, added: []string{"ghi"}, removed: []string{"def"}}},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			hunks, err := parseUnifiedDiff([]byte(tc.diff))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := []hunk{}
+			for _, h := range hunks {
+				got = append(got, hunk{
+					file:     h.file,
+					oldStart: h.oldStart,
+					oldLines: h.oldLines,
+					newStart: h.newStart,
+					newLines: h.newLines,
+					added:    sortedKeys(h.added),
+					removed:  sortedKeys(h.removed),
+				})
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("parseUnifiedDiff() = %+v, want %+v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestParseUnifiedDiffErrors(t *testing.T) {
+	for _, diff := range []string{
+		"--- a/x\n+++ b/x\n@@ bad @@\n",
+		"@@ -1 +1 @@\n-a\n+b\n",
+	} {
+		if _, err := parseUnifiedDiff([]byte(diff)); err == nil {
+			t.Errorf("parseUnifiedDiff(%q) succeeded, want an error", diff)
+		}
+	}
+}
+
+func sortedKeys(m map[string]bool) []string {
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,71 @@
+package web
+
+import (
+	"fmt"
+	"strings"
+	"text/template"
+)
+
+// displayNamer renders display names of result files based on DisplayConfig.
+type displayNamer struct {
+	templates map[string]*template.Template
+	aliases   map[string]string
+	// Renders the fallback.
+	fileTicket func(repo, branch, path string) string
+	// The default alias.
+	repoDisplay func(repo string) string
+}
+
+// displayVars are the fields available in display templates.
+type displayVars struct {
+	Repo   string
+	Alias  string
+	Branch string
+	Path   string
+}
+
+func newDisplayNamer(c DisplayConfig, fileTicket func(repo, branch, path string) string, repoDisplay func(repo string) string) (*displayNamer, error) {
+	d := &displayNamer{
+		templates:   map[string]*template.Template{},
+		aliases:     c.Aliases,
+		fileTicket:  fileTicket,
+		repoDisplay: repoDisplay,
+	}
+	for repo, text := range c.Templates {
+		t, err := template.New(repo).Parse(text)
+		if err != nil {
+			return nil, fmt.Errorf("display template for %q: %v", repo, err)
+		}
+		d.templates[repo] = t
+	}
+	return d, nil
+}
+
+// name returns the display name for the file at path in repo (and branch, if
+// not empty). Falls back to the ticket if there's no applicable template, or
+// the template fails to execute.
+func (d *displayNamer) name(repo, branch, path string) string {
+	fallback := d.fileTicket(repo, branch, path)
+
+	tmpl, ok := d.templates[repo]
+	if !ok {
+		tmpl, ok = d.templates["*"]
+	}
+	if !ok {
+		return fallback
+	}
+	alias, ok := d.aliases[repo]
+	if !ok {
+		alias = d.repoDisplay(repo)
+	}
+	var b strings.Builder
+	if err := tmpl.Execute(&b, displayVars{
+		Repo:   repo,
+		Alias:  alias,
+		Branch: branch,
+		Path:   path,
+	}); err != nil {
+		return fallback
+	}
+	return b.String()
+}
@@ -0,0 +1,87 @@
+package web
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"strconv"
+)
+
+// writeXrefReply writes the reply as json.NewEncoder(w).Encode would, but
+// encodes the site groups one at a time, so the encoded reply of large
+// results is never held in memory as a whole.
+//
+// Only the encoding is streamed: the groups themselves are built from all
+// files up front, as grouping, ranking and fork collapsing need them all.
+// Their size is bounded by SearchConfig.MaxSnippetBytesPerReply instead.
+func writeXrefReply(w io.Writer, reply *UhXRefReply) error {
+	bw := bufio.NewWriter(w)
+	bw.WriteString(`{"refs":`)
+	if err := writeSiteGroups(bw, reply.Refs); err != nil {
+		return err
+	}
+	if len(reply.TestRefs) > 0 {
+		bw.WriteString(`,"testRefs":`)
+		if err := writeSiteGroups(bw, reply.TestRefs); err != nil {
+			return err
+		}
+	}
+	bw.WriteString(`,"refCounts":`)
+	if err := writeJSON(bw, reply.RefCounts); err != nil {
+		return err
+	}
+	bw.WriteString(`,"definitions":`)
+	if err := writeSiteGroups(bw, reply.Definitions); err != nil {
+		return err
+	}
+	bw.WriteString(`,"calls":`)
+	if err := writeSiteGroups(bw, reply.Calls); err != nil {
+		return err
+	}
+	bw.WriteString(`,"callCount":`)
+	bw.WriteString(strconv.Itoa(reply.CallCount))
+	if reply.Partial {
+		bw.WriteString(`,"partial":true,"partialReason":`)
+		if err := writeJSON(bw, reply.PartialReason); err != nil {
+			return err
+		}
+	}
+	if reply.Backend != "" {
+		bw.WriteString(`,"backend":`)
+		if err := writeJSON(bw, reply.Backend); err != nil {
+			return err
+		}
+	}
+	bw.WriteString(`,"declarations":`)
+	if err := writeJSON(bw, reply.Declarations); err != nil {
+		return err
+	}
+	bw.WriteString("}\n")
+	return bw.Flush()
+}
+
+func writeSiteGroups(bw *bufio.Writer, gs []UhSiteGroup) error {
+	if gs == nil {
+		_, err := bw.WriteString("null")
+		return err
+	}
+	bw.WriteByte('[')
+	for i := range gs {
+		if i > 0 {
+			bw.WriteByte(',')
+		}
+		if err := writeJSON(bw, &gs[i]); err != nil {
+			return err
+		}
+	}
+	return bw.WriteByte(']')
+}
+
+func writeJSON(bw *bufio.Writer, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = bw.Write(b)
+	return err
+}
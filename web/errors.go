@@ -0,0 +1,103 @@
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+)
+
+// ErrorCode is a machine-readable identifier of a failure, included in JSON
+// error responses so clients can react to (or localize) specific failures
+// without parsing the message.
+type ErrorCode string
+
+const (
+	// A required parameter is missing, or given too many times.
+	ErrParamMissing ErrorCode = "ERR_PARAM_MISSING"
+	// A parameter value is malformed.
+	ErrParamInvalid ErrorCode = "ERR_PARAM_INVALID"
+	// A ticket is not in the expected format (for example lacks a path).
+	ErrTicketFormat ErrorCode = "ERR_TICKET_FORMAT"
+	// Unknown value of the casing parameter.
+	ErrCasingInvalid ErrorCode = "ERR_CASING_INVALID"
+	// Unknown value of the mode parameter.
+	ErrModeInvalid ErrorCode = "ERR_MODE_INVALID"
+	// A parameter value is above the allowed limit.
+	ErrLimitExceeded ErrorCode = "ERR_LIMIT_EXCEEDED"
+	// The request is costly, and needs to be repeated with confirm=1.
+	ErrConfirmRequired ErrorCode = "ERR_CONFIRM_REQUIRED"
+	// The (constructed) Zoekt query failed to parse.
+	ErrQueryParse ErrorCode = "ERR_QUERY_PARSE"
+	// The selection of a mode=Regexp search is not a valid regexp. The error
+	// carries the syntax details.
+	ErrRegexpSyntax ErrorCode = "ERR_REGEXP_SYNTAX"
+	// The requested file or directory is not in the index.
+	ErrNotFound ErrorCode = "ERR_NOT_FOUND"
+	// A format=rendered source request failed in the transformer of the
+	// file, like on malformed content or taking too long.
+	ErrRenderFailed ErrorCode = "ERR_RENDER_FAILED"
+	// The endpoint or feature is disabled by the server config.
+	ErrDisabled ErrorCode = "ERR_DISABLED"
+	// Anything else, for example a failing Zoekt search.
+	ErrInternal ErrorCode = "ERR_INTERNAL"
+)
+
+// status returns the HTTP status to respond with for the code.
+func (c ErrorCode) status() int {
+	switch c {
+	case ErrNotFound:
+		return http.StatusNotFound
+	case ErrDisabled:
+		return http.StatusForbidden
+	case ErrRenderFailed:
+		return http.StatusUnprocessableEntity
+	case ErrInternal:
+		return http.StatusInternalServerError
+	default:
+		return http.StatusBadRequest
+	}
+}
+
+// apiError is an error carrying an ErrorCode.
+type apiError struct {
+	Code    ErrorCode `json:"code"`
+	Message string    `json:"message"`
+	// Set for ErrRegexpSyntax.
+	Syntax *UhSyntaxError `json:"syntax,omitempty"`
+}
+
+func (e *apiError) Error() string {
+	return e.Message
+}
+
+func errorf(code ErrorCode, format string, a ...interface{}) error {
+	return &apiError{
+		Code:    code,
+		Message: fmt.Sprintf(format, a...),
+	}
+}
+
+// writeError responds with a JSON-encoded error. Errors not created by errorf
+// are reported as ErrInternal.
+//
+// Note: if the handler already started writing the response, the status can't
+// be changed anymore, so errors should be detected before that.
+func writeError(w http.ResponseWriter, err error) {
+	e, ok := err.(*apiError)
+	if !ok {
+		e = &apiError{
+			Code:    ErrInternal,
+			Message: err.Error(),
+		}
+	}
+	log.Printf("error: %v: %v", e.Code, e.Message)
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(e.Code.status())
+	json.NewEncoder(w).Encode(struct {
+		Error *apiError `json:"error"`
+	}{
+		Error: e,
+	})
+}
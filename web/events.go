@@ -0,0 +1,240 @@
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/zoekt"
+)
+
+// The index directory is checked for changed shards this often, while
+// clients are listening.
+const indexPollInterval = 5 * time.Second
+
+// An SSE comment is sent this often, so proxies don't time out idle streams.
+const eventsKeepAlive = 30 * time.Second
+
+// Events of a poll queued for a client at most. Clients too slow to keep up
+// miss events, which is logged.
+const eventsQueue = 16
+
+// UhIndexEvent is the data of an "index" event of /api/events, telling that
+// the index of a repo changed.
+type UhIndexEvent struct {
+	// As displayed, see DisplayConfig.RepoNames.
+	Repo string `json:"repo"`
+	// Of the top level file tree entries of the repo, one per branch, to
+	// refresh. Tickets of files of the repo are stale too.
+	Tickets []string `json:"tickets"`
+	// True if the repo is no longer in the index.
+	Removed bool `json:"removed"`
+}
+
+// indexChange is a repo whose shards changed, see indexWatcher.
+type indexChange struct {
+	repo    *zoekt.Repository
+	removed bool
+}
+
+// indexWatcher polls the shards of the index directory, by size and mtime
+// (see readShards), and tells subscribers about the repos of changed shards.
+// It only polls while there are subscribers.
+type indexWatcher struct {
+	dir string
+
+	mu   sync.Mutex
+	subs map[chan []indexChange]bool
+	// Closed to stop polling, nil if not polling.
+	stop chan struct{}
+}
+
+func newIndexWatcher(dir string) *indexWatcher {
+	return &indexWatcher{dir: dir, subs: map[chan []indexChange]bool{}}
+}
+
+// subscribe returns a channel getting the changes of each poll finding
+// some, and the function to unsubscribe with.
+func (w *indexWatcher) subscribe() (<-chan []indexChange, func()) {
+	ch := make(chan []indexChange, eventsQueue)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.subs[ch] = true
+	if w.stop == nil {
+		w.stop = make(chan struct{})
+		go w.poll(w.stop)
+	}
+	return ch, func() {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		delete(w.subs, ch)
+		if len(w.subs) == 0 && w.stop != nil {
+			close(w.stop)
+			w.stop = nil
+		}
+	}
+}
+
+// poll scans the index directory until stop is closed. The first scan is the
+// baseline, so subscribers only hear about later changes.
+func (w *indexWatcher) poll(stop chan struct{}) {
+	shards, _ := w.scan(nil)
+	t := time.NewTicker(indexPollInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+		}
+		var changes []indexChange
+		shards, changes = w.scan(shards)
+		if len(changes) == 0 {
+			continue
+		}
+		w.mu.Lock()
+		for ch := range w.subs {
+			select {
+			case ch <- changes:
+			default:
+				log.Printf("events: client too slow, dropped %d index change(s)", len(changes))
+			}
+		}
+		w.mu.Unlock()
+	}
+}
+
+// scan reads the shards of the index directory, reading the metadata of
+// those not in prev (or changed since). Returns the shards, and the changed
+// repos: those of new or changed shards, and those no longer in any shard.
+func (w *indexWatcher) scan(prev map[string]shardInfo) (map[string]shardInfo, []indexChange) {
+	if w.dir == "" {
+		return prev, nil
+	}
+	shards, err := readShards(w.dir, prev)
+	if err != nil {
+		log.Printf("events: reading index directory: %v", err)
+		return prev, nil
+	}
+	// Keyed by repo name.
+	updated := map[string]*zoekt.Repository{}
+	for _, sh := range shards {
+		// Unreadable shards, like ones being written, are read again at the
+		// next poll.
+		if sh.fresh && sh.err == nil {
+			for _, r := range sh.repos {
+				updated[r.Name] = r
+			}
+		}
+	}
+	if prev == nil {
+		return shards, nil
+	}
+
+	present := map[string]bool{}
+	for _, sh := range shards {
+		for _, r := range sh.repos {
+			present[r.Name] = true
+		}
+	}
+	removed := map[string]*zoekt.Repository{}
+	for name, sh := range prev {
+		// Unreadable shards are likely being rewritten.
+		if cur, ok := shards[name]; ok && cur.err != nil {
+			continue
+		}
+		for _, r := range sh.repos {
+			if !present[r.Name] {
+				removed[r.Name] = r
+			}
+		}
+	}
+	var changes []indexChange
+	for _, r := range updated {
+		changes = append(changes, indexChange{repo: r})
+	}
+	for _, r := range removed {
+		changes = append(changes, indexChange{repo: r, removed: true})
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].repo.Name < changes[j].repo.Name
+	})
+	return shards, changes
+}
+
+func (s *Server) serveEvents(w http.ResponseWriter, r *http.Request) {
+	if err := s.serveEventsErr(w, r); err != nil {
+		writeError(w, err)
+	}
+}
+
+// serveEventsErr streams server-sent events until the client goes away: an
+// "index" event (see UhIndexEvent) for each repo whose index is rebuilt,
+// added or removed, so clients can refresh file trees and open files.
+// Changes are noticed within indexPollInterval.
+func (s *Server) serveEventsErr(w http.ResponseWriter, r *http.Request) error {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return errorf(ErrInternal, "streaming not supported by the response writer")
+	}
+	changes, unsubscribe := s.indexWatcher.subscribe()
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// Keeps nginx from buffering the stream.
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	if _, err := fmt.Fprint(w, ": listening for index changes\n\n"); err != nil {
+		return nil
+	}
+	flusher.Flush()
+
+	t := time.NewTicker(eventsKeepAlive)
+	defer t.Stop()
+	for {
+		var err error
+		select {
+		case <-r.Context().Done():
+			return nil
+		case <-t.C:
+			_, err = fmt.Fprint(w, ": keepalive\n\n")
+		case cs := <-changes:
+			for _, c := range cs {
+				if err = s.writeIndexEvent(w, c); err != nil {
+					break
+				}
+			}
+		}
+		if err != nil {
+			// The client is gone, too late for an error response.
+			return nil
+		}
+		flusher.Flush()
+	}
+}
+
+// writeIndexEvent writes the event of a change.
+func (s *Server) writeIndexEvent(w http.ResponseWriter, c indexChange) error {
+	e := UhIndexEvent{
+		Repo:    s.repoNamer.display(c.repo.Name),
+		Tickets: []string{},
+		Removed: c.removed,
+	}
+	if len(c.repo.Branches) == 0 {
+		e.Tickets = append(e.Tickets, s.dirTicket(c.repo.Name, "", ""))
+	}
+	for _, b := range c.repo.Branches {
+		e.Tickets = append(e.Tickets, s.dirTicket(c.repo.Name, b.Name, ""))
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: index\ndata: %s\n\n", data)
+	return err
+}
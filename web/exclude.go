@@ -0,0 +1,55 @@
+package web
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// excludeAtoms converts path exclusions to negated f: atoms. An exclusion like
+// "vendor/" matches at any depth, while "/vendor/" only matches at the repo
+// root. Without a trailing slash it also matches files, like "/Makefile".
+func excludeAtoms(excludes []string) string {
+	var atoms []string
+	for _, e := range excludes {
+		if e == "" || e == "/" {
+			continue
+		}
+		if strings.HasPrefix(e, "/") {
+			atoms = append(atoms, "-f:"+QuoteQueryString("^"+regexp.QuoteMeta(e[1:])))
+			continue
+		}
+		q := regexp.QuoteMeta(e)
+		atoms = append(atoms, "-f:"+QuoteQueryString("^"+q), "-f:"+QuoteQueryString("/"+q))
+	}
+	return strings.Join(atoms, " ")
+}
+
+// xrefExcludes returns the path exclusions of an xref request: the configured
+// ones (unless exclude_defaults=no) and those of the exclude parameters, which
+// are comma-separated.
+func (s *Server) xrefExcludes(r *http.Request) ([]string, error) {
+	var res []string
+	useDefaults := true
+	if ds, ok := r.URL.Query()["exclude_defaults"]; ok {
+		switch ds[0] {
+		case "yes":
+			useDefaults = true
+		case "no":
+			useDefaults = false
+		default:
+			return nil, errorf(ErrParamInvalid, "unknown exclude_defaults %q, want one of yes, no", ds[0])
+		}
+	}
+	if useDefaults {
+		res = append(res, s.Config.Search.ExcludePaths...)
+	}
+	for _, spec := range r.URL.Query()["exclude"] {
+		for _, e := range strings.Split(spec, ",") {
+			if e = strings.TrimSpace(e); e != "" {
+				res = append(res, e)
+			}
+		}
+	}
+	return res, nil
+}
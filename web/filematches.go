@@ -0,0 +1,124 @@
+package web
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/google/zoekt"
+	"github.com/google/zoekt/query"
+)
+
+// Default and max page size of /api/file-matches.
+const (
+	defaultFileMatchesLimit = 100
+	maxFileMatchesLimit     = 1000
+)
+
+// UhFileMatches is a page of the matching lines of a single file.
+type UhFileMatches struct {
+	Snippets     []UhSnippet `json:"snippets"`
+	TotalMatches int         `json:"totalMatches"`
+	// Offset of the first snippet among all matches.
+	Offset int `json:"offset"`
+}
+
+func (s *Server) serveFileMatches(w http.ResponseWriter, r *http.Request) {
+	if err := s.serveFileMatchesErr(w, r); err != nil {
+		writeError(w, err)
+	}
+}
+
+// serveFileMatchesErr returns matches of a search-xref query (taking the same
+// selection, casing and mode parameters) in a single file, to page through
+// matches beyond the snippet quota. Matches are in the same order as in the
+// xref reply, so offset can continue where the xref snippets ended.
+func (s *Server) serveFileMatchesErr(w http.ResponseWriter, r *http.Request) error {
+	log.Printf("request: %v", r.URL)
+	tickets, ok := r.URL.Query()["ticket"]
+	if !ok || len(tickets) > 1 {
+		return errorf(ErrParamMissing, "expected ticket parameter")
+	}
+	tick, err := s.parseTicket(r.Context(), tickets[0])
+	if err != nil {
+		return err
+	}
+	if !tick.complete() {
+		return errorf(ErrTicketFormat, "Expected a file ticket, with repo and path")
+	}
+
+	offset, err := intParam(r, "offset", 0)
+	if err != nil {
+		return err
+	}
+	limit, err := intParam(r, "limit", defaultFileMatchesLimit)
+	if err != nil {
+		return err
+	}
+	if limit > maxFileMatchesLimit {
+		return errorf(ErrLimitExceeded, "limit %d is above max %d", limit, maxFileMatchesLimit)
+	}
+
+	rq, err := s.xrefQuery(r)
+	if err != nil {
+		return err
+	}
+	// Parenthesized, so a Raw mode query can't escape the file restriction.
+	rq = "(" + rq + ") " + fileAtoms(tick)
+	log.Printf("query: %v", rq)
+
+	q, err := query.Parse(rq)
+	if err != nil {
+		return errorf(ErrQueryParse, "%v (query: %v)", err, rq)
+	}
+
+	ctx, done := s.stage(r.Context(), stageSearch)
+	sOpts := zoekt.SearchOptions{
+		MaxWallTime: s.maxWallTime(ctx),
+	}
+	sOpts.SetDefaults()
+
+	result, err := s.Searcher.Search(ctx, q, &sOpts)
+	done()
+	if err != nil {
+		return err
+	}
+
+	res := UhFileMatches{
+		Snippets: []UhSnippet{},
+		Offset:   offset,
+	}
+	for i := range result.Files {
+		f := &result.Files[i]
+		if !tick.matchesFile(f) || f.FileName != tick.path {
+			continue
+		}
+		res.TotalMatches = len(f.LineMatches)
+		for j := offset; j < len(f.LineMatches) && j < offset+limit; j++ {
+			snippet := lineSnippet(f.LineMatches[j])
+			snippet.UpstreamURL = s.snippetURL(result, f, f.LineMatches[j])
+			snippet.Permalink = s.snippetPermalink(f, f.LineMatches[j])
+			res.Snippets = append(res.Snippets, snippet)
+		}
+		break
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	return json.NewEncoder(w).Encode(res)
+}
+
+// intParam returns the non-negative integer query parameter name, or def if
+// not present.
+func intParam(r *http.Request, name string, def int) (int, error) {
+	vs, ok := r.URL.Query()[name]
+	if !ok {
+		return def, nil
+	}
+	v, err := strconv.Atoi(vs[0])
+	if err != nil || v < 0 {
+		return 0, errorf(ErrParamInvalid, "expected non-negative integer %v, got %q", name, vs[0])
+	}
+	return v, nil
+}
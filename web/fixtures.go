@@ -0,0 +1,231 @@
+package web
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// Fixture is a recorded API request and its response, for replaying against
+// later versions of the server. See RecordFixtures.
+type Fixture struct {
+	Request  FixtureRequest  `json:"request"`
+	Response FixtureResponse `json:"response"`
+}
+
+type FixtureRequest struct {
+	Method string `json:"method"`
+	// Path and query.
+	URL string `json:"url"`
+	// Only the fixtureHeaders.
+	Header http.Header `json:"header,omitempty"`
+}
+
+type FixtureResponse struct {
+	Status int `json:"status"`
+	// Without the volatile headers, see fixtureVolatileHeaders.
+	Header http.Header `json:"header"`
+	// The body if valid UTF-8, with JSON normalized by NormalizeFixtureBody.
+	Body string `json:"body,omitempty"`
+	// The body otherwise, like of archives.
+	BodyBytes []byte `json:"bodyBytes,omitempty"`
+}
+
+// Request headers kept in fixtures. Others, like cookies, are dropped.
+var fixtureHeaders = []string{"Accept", interactionHeader}
+
+// Response headers not kept in fixtures, as they differ between runs.
+var fixtureVolatileHeaders = []string{"Date", "Server-Timing"}
+
+// JSON object keys whose values differ between runs, zeroed in fixtures.
+// Mostly timings of zoekt.Stats.
+var fixtureVolatileKeys = map[string]bool{
+	"Duration":              true,
+	"Wait":                  true,
+	"MatchTreeConstruction": true,
+	"MatchTreeSearch":       true,
+	"generated":             true,
+}
+
+// RecordFixtures wraps the API handler h to write a Fixture file to dir for
+// each /api/ request it serves, named by endpoint and a hash of the request.
+// Repeated requests overwrite their file. Admin endpoints, WebSocket
+// sessions and event streams are not recorded.
+//
+// Meant for development: the responses of a known index are recorded as
+// golden files, and the replay subcommand of zoekt-underhood checks a server
+// against them.
+func RecordFixtures(h http.Handler, dir string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		endpoint := strings.TrimPrefix(r.URL.Path, "/api/")
+		// WebSocket sessions and event streams aren't request-response, so
+		// can't be replayed.
+		if endpoint == r.URL.Path || strings.HasPrefix(endpoint, "admin/") || endpoint == "events" || r.Header.Get("Upgrade") != "" {
+			h.ServeHTTP(w, r)
+			return
+		}
+		rw := &recordingWriter{ResponseWriter: w, status: http.StatusOK}
+		h.ServeHTTP(rw, r)
+
+		f := Fixture{
+			Request: FixtureRequest{
+				Method: r.Method,
+				URL:    r.URL.RequestURI(),
+			},
+			Response: FixtureResponse{Status: rw.status},
+		}
+		for _, k := range fixtureHeaders {
+			if v := r.Header[http.CanonicalHeaderKey(k)]; len(v) > 0 {
+				if f.Request.Header == nil {
+					f.Request.Header = http.Header{}
+				}
+				f.Request.Header[http.CanonicalHeaderKey(k)] = v
+			}
+		}
+		f.Response.Header, f.Response.Body, f.Response.BodyBytes = fixtureResponse(w.Header(), rw.body.Bytes())
+		if err := writeFixture(dir, endpoint, &f); err != nil {
+			log.Printf("recording fixture of %v: %v", r.URL, err)
+		}
+	})
+}
+
+// fixtureResponse sanitizes response headers and body for a fixture.
+func fixtureResponse(header http.Header, body []byte) (http.Header, string, []byte) {
+	h := header.Clone()
+	for _, k := range fixtureVolatileHeaders {
+		h.Del(k)
+	}
+	// Announces the trailers, which are in the header by now.
+	h.Del("Trailer")
+	if !utf8.Valid(body) {
+		return h, "", body
+	}
+	if strings.HasPrefix(h.Get("Content-Type"), "application/json") {
+		return h, NormalizeFixtureBody(body), nil
+	}
+	return h, string(body), nil
+}
+
+// NormalizeFixtureBody returns JSON with the fixtureVolatileKeys zeroed, and
+// indented for readable diffs. Bodies that aren't JSON are returned as-is.
+func NormalizeFixtureBody(body []byte) string {
+	var out bytes.Buffer
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	// Some endpoints stream multiple values.
+	for {
+		var v interface{}
+		if err := dec.Decode(&v); err == io.EOF && out.Len() > 0 {
+			break
+		} else if err != nil {
+			return string(body)
+		}
+		b, err := json.MarshalIndent(zeroVolatileKeys(v), "", "  ")
+		if err != nil {
+			return string(body)
+		}
+		out.Write(b)
+		out.WriteByte('\n')
+	}
+	return out.String()
+}
+
+func zeroVolatileKeys(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, e := range v {
+			if fixtureVolatileKeys[k] {
+				v[k] = nil
+			} else {
+				v[k] = zeroVolatileKeys(e)
+			}
+		}
+	case []interface{}:
+		for i, e := range v {
+			v[i] = zeroVolatileKeys(e)
+		}
+	}
+	return v
+}
+
+func writeFixture(dir, endpoint string, f *Fixture) error {
+	h := sha1.Sum([]byte(f.Request.Method + " " + f.Request.URL))
+	name := fmt.Sprintf("%s-%x.json", strings.ReplaceAll(endpoint, "/", "_"), h[:6])
+	return WriteFixture(filepath.Join(dir, name), f)
+}
+
+// WriteFixture writes a fixture file, like for updating it after an intended
+// change of the response.
+func WriteFixture(path string, f *Fixture) error {
+	b, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append(b, '\n'), 0644)
+}
+
+// ReadFixtures reads the fixtures recorded into dir, ordered by file name.
+// Also returns the file names.
+func ReadFixtures(dir string) ([]Fixture, []string, error) {
+	names, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, nil, err
+	}
+	sort.Strings(names)
+	fixtures := make([]Fixture, len(names))
+	for i, name := range names {
+		b, err := ioutil.ReadFile(name)
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := json.Unmarshal(b, &fixtures[i]); err != nil {
+			return nil, nil, fmt.Errorf("%s: %v", name, err)
+		}
+	}
+	return fixtures, names, nil
+}
+
+// SanitizeFixtureResponse converts a response like RecordFixtures does, so
+// it can be compared with a recorded one.
+func SanitizeFixtureResponse(status int, header http.Header, body []byte) FixtureResponse {
+	res := FixtureResponse{Status: status}
+	res.Header, res.Body, res.BodyBytes = fixtureResponse(header, body)
+	return res
+}
+
+// recordingWriter passes a response through, keeping a copy.
+type recordingWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	body        bytes.Buffer
+}
+
+func (w *recordingWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *recordingWriter) Write(b []byte) (int, error) {
+	w.wroteHeader = true
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *recordingWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
@@ -0,0 +1,175 @@
+package web
+
+import (
+	"sort"
+)
+
+// Fork inference thresholds, see forkMap. Two repos are taken as forks of each
+// other if they share at least this many identical matching files, and those
+// are at least this fraction of the matching files of either repo.
+const (
+	minInferredForkFiles = 3
+	minInferredForkRatio = 0.8
+)
+
+// forkMap returns the canonical repo of the fork repos among the sites, keyed
+// by fork repo. Forks come from Search.Forks of the config, and if
+// Search.InferForks is set, from the overlap of file checksums in the sites.
+//
+// The repo of the request (queryRepo) is never taken as a fork, since the user
+// is looking at it.
+func (s *Server) forkMap(sites []fileSites, queryRepo string) map[string]string {
+	canon := map[string]string{}
+	for fork, c := range s.Config.Search.Forks {
+		canon[fork] = c
+	}
+	if s.Config.Search.InferForks {
+		for fork, c := range s.inferForks(sites, queryRepo) {
+			if _, ok := canon[fork]; !ok {
+				canon[fork] = c
+			}
+		}
+	}
+	// Resolve chains, so each fork maps to a repo that is not a fork itself.
+	for fork := range canon {
+		c := canon[fork]
+		for i := 0; i < len(canon); i++ {
+			next, ok := canon[c]
+			if !ok || next == fork {
+				break
+			}
+			c = next
+		}
+		canon[fork] = c
+	}
+	delete(canon, queryRepo)
+	return canon
+}
+
+// inferForks pairs up repos having mostly identical matching files, and
+// returns the canonical repo of the lesser of each pair. The preferred repo
+// is canonical if in a pair, otherwise the one with higher tier, then more
+// matching files, then name.
+func (s *Server) inferForks(sites []fileSites, preferred string) map[string]string {
+	fileCount := map[string]int{}
+	reposByChecksum := map[string][]string{}
+	for _, fs := range sites {
+		t, err := s.knownTicket(fs.containingFile.FileTicket)
+		if err != nil {
+			continue
+		}
+		fileCount[t.repo]++
+		k := string(fs.fileChecksum)
+		reposByChecksum[k] = appendUnique(reposByChecksum[k], t.repo)
+	}
+
+	type pair struct{ a, b string }
+	shared := map[pair]int{}
+	for _, repos := range reposByChecksum {
+		sort.Strings(repos)
+		for i := range repos {
+			for j := i + 1; j < len(repos); j++ {
+				shared[pair{repos[i], repos[j]}]++
+			}
+		}
+	}
+
+	better := func(a, b string) bool {
+		if a == preferred || b == preferred {
+			return a == preferred
+		}
+		if ta, tb := s.repoTiers.tier(a), s.repoTiers.tier(b); ta != tb {
+			return ta > tb
+		}
+		if fileCount[a] != fileCount[b] {
+			return fileCount[a] > fileCount[b]
+		}
+		return a < b
+	}
+	canon := map[string]string{}
+	for p, n := range shared {
+		if n < minInferredForkFiles {
+			continue
+		}
+		if float64(n) < minInferredForkRatio*float64(fileCount[p.a]) ||
+			float64(n) < minInferredForkRatio*float64(fileCount[p.b]) {
+			continue
+		}
+		fork, c := p.b, p.a
+		if better(fork, c) {
+			fork, c = c, fork
+		}
+		if prev, ok := canon[fork]; !ok || better(c, prev) {
+			canon[fork] = c
+		}
+	}
+	return canon
+}
+
+func appendUnique(xs []string, x string) []string {
+	for _, y := range xs {
+		if y == x {
+			return xs
+		}
+	}
+	return append(xs, x)
+}
+
+// collapseForks moves file sites of forks under the file site of the same file
+// in the canonical repo, if that is among the sites too. The same file means
+// identical content, or the same path with identical matching lines.
+//
+// Returns the remaining sites in their original order, and the number of
+// collapsed ones.
+func (s *Server) collapseForks(sites []fileSites, canon map[string]string) ([]fileSites, int) {
+	if len(canon) == 0 {
+		return sites, 0
+	}
+	type pathKey struct{ repo, path, snippetsHash string }
+	type sumKey struct{ repo, checksum string }
+	byPath := map[pathKey]int{}
+	bySum := map[sumKey]int{}
+	tickets := make([]ticket, len(sites))
+	for i, fs := range sites {
+		t, _ := s.knownTicket(fs.containingFile.FileTicket)
+		tickets[i] = t
+		if _, isFork := canon[t.repo]; isFork {
+			continue
+		}
+		pk := pathKey{t.repo, t.path, string(fs.snippetsHash)}
+		if _, ok := byPath[pk]; !ok {
+			byPath[pk] = i
+		}
+		sk := sumKey{t.repo, string(fs.fileChecksum)}
+		if _, ok := bySum[sk]; !ok {
+			bySum[sk] = i
+		}
+	}
+
+	collapsed := make([]bool, len(sites))
+	n := 0
+	for i, fs := range sites {
+		c, isFork := canon[tickets[i].repo]
+		if !isFork {
+			continue
+		}
+		target, ok := bySum[sumKey{c, string(fs.fileChecksum)}]
+		if !ok {
+			target, ok = byPath[pathKey{c, tickets[i].path, string(fs.snippetsHash)}]
+		}
+		if !ok {
+			continue
+		}
+		sites[target].forkFiles = append(sites[target].forkFiles, fs.containingFile)
+		collapsed[i] = true
+		n++
+	}
+
+	res := make([]fileSites, 0, len(sites)-n)
+	for i, fs := range sites {
+		if !collapsed[i] {
+			res = append(res, fs)
+		}
+	}
+	return res, n
+}
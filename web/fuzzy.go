@@ -0,0 +1,133 @@
+package web
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+func (s *Server) serveFileSearch(w http.ResponseWriter, r *http.Request) {
+	if err := s.serveFileSearchErr(w, r); err != nil {
+		writeError(w, err)
+	}
+}
+
+// serveFileSearchErr finds files whose path contains the characters of the q
+// parameter in order, though not necessarily adjacent (like "qryparse" for
+// "query/parse.go"), ranked by fuzzy match quality. Backs "open file by name"
+// palettes.
+func (s *Server) serveFileSearchErr(w http.ResponseWriter, r *http.Request) error {
+	log.Printf("request: %v", r.URL)
+	qs, ok := r.URL.Query()["q"]
+	if !ok || len(qs) > 1 {
+		return errorf(ErrParamMissing, "expected q parameter")
+	}
+	pattern := strings.Join(strings.Fields(qs[0]), "")
+	if pattern == "" {
+		return errorf(ErrParamInvalid, "expected non-empty q parameter")
+	}
+	if utf8.RuneCountInString(pattern) > maxFuzzyPatternLen {
+		return errorf(ErrLimitExceeded, "q is longer than %d characters", maxFuzzyPatternLen)
+	}
+	limit, err := intParam(r, "limit", defaultSearchFilesLimit)
+	if err != nil {
+		return err
+	}
+	if limit > maxSearchFilesLimit {
+		return errorf(ErrLimitExceeded, "limit %d is above max %d", limit, maxSearchFilesLimit)
+	}
+
+	// Zoekt narrows down to paths having the characters in order, which is
+	// cheap as it only looks at file names. Scoring happens here.
+	var re strings.Builder
+	for i, c := range pattern {
+		if i > 0 {
+			re.WriteString(".*")
+		}
+		re.WriteString(escapeLiteralQuery(string(c)))
+	}
+	rq := "case:no f:" + re.String()
+	hits, err := s.searchFileNames(r, rq, limit, func(p string) (float64, bool) {
+		return fuzzyScore(pattern, p)
+	})
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	return json.NewEncoder(w).Encode(UhFileSearchReply{
+		Files: hits,
+	})
+}
+
+// Longer patterns make the regexp costly, and are not typed by hand anyway.
+const maxFuzzyPatternLen = 64
+
+// fuzzyScore scores how well pattern matches p as a case-insensitive
+// subsequence. Matches at word starts (after separators or at camelCase
+// humps) and consecutive matches are rewarded, gaps are penalized. Matches
+// within the base name are preferred. Returns false if pattern is not a
+// subsequence of p.
+func fuzzyScore(pattern, p string) (float64, bool) {
+	pat := []rune(strings.ToLower(pattern))
+	path := []rune(p)
+	baseStart := 0
+	for i, c := range path {
+		if c == '/' {
+			baseStart = i + 1
+		}
+	}
+
+	// Try matching within the base name first, then the full path.
+	if sc, ok := subsequenceScore(pat, path, baseStart); ok {
+		return sc + 20 - float64(len(path))/100, true
+	}
+	if sc, ok := subsequenceScore(pat, path, 0); ok {
+		return sc - float64(len(path))/100, true
+	}
+	return 0, false
+}
+
+// subsequenceScore greedily matches pat (lowercase) in path from index start.
+func subsequenceScore(pat []rune, path []rune, start int) (float64, bool) {
+	score := 0.0
+	j := 0
+	last := -1
+	for i := start; i < len(path) && j < len(pat); i++ {
+		if unicode.ToLower(path[i]) != pat[j] {
+			continue
+		}
+		score++
+		if isWordStart(path, i) {
+			score += 5
+		}
+		if last >= 0 {
+			if i == last+1 {
+				score += 3
+			} else {
+				score -= 0.1 * float64(i-last-1)
+			}
+		}
+		last = i
+		j++
+	}
+	return score, j == len(pat)
+}
+
+// isWordStart tells if path[i] starts a path component, a word separated by
+// punctuation, or a camelCase hump.
+func isWordStart(path []rune, i int) bool {
+	if i == 0 {
+		return true
+	}
+	prev := path[i-1]
+	switch prev {
+	case '/', '.', '_', '-', ' ':
+		return true
+	}
+	return unicode.IsLower(prev) && unicode.IsUpper(path[i])
+}
@@ -0,0 +1,53 @@
+package web
+
+import (
+	"fmt"
+	"regexp/syntax"
+
+	"github.com/google/zoekt/query"
+)
+
+// generatedMatcher classifies files as generated, based on GeneratedConfig.
+type generatedMatcher struct {
+	paths   *pathFilter
+	markers []query.Q
+}
+
+func newGeneratedMatcher(c GeneratedConfig) (*generatedMatcher, error) {
+	paths, err := parsePathFilter(c.Paths)
+	if err != nil {
+		return nil, fmt.Errorf("generated paths: %v", err)
+	}
+	g := &generatedMatcher{paths: paths}
+	for _, m := range c.ContentMarkers {
+		// Same flags as Zoekt's query parser uses.
+		re, err := syntax.Parse(m, syntax.ClassNL|syntax.PerlX|syntax.UnicodeGroups)
+		if err != nil {
+			return nil, fmt.Errorf("generated content marker %q: %v", m, err)
+		}
+		g.markers = append(g.markers, &query.Regexp{
+			Regexp:        re,
+			Content:       true,
+			CaseSensitive: true,
+		})
+	}
+	return g, nil
+}
+
+// matchPath tells if the path is generated based on the path globs alone.
+func (g *generatedMatcher) matchPath(p string) bool {
+	// Only exclusions would select everything otherwise.
+	if len(g.paths.include) == 0 {
+		return false
+	}
+	return g.paths.match(p)
+}
+
+// markerQuery returns a query matching the content of generated files, or nil
+// if there are no content markers configured.
+func (g *generatedMatcher) markerQuery() query.Q {
+	if len(g.markers) == 0 {
+		return nil
+	}
+	return query.NewOr(g.markers...)
+}
@@ -0,0 +1,104 @@
+package web
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// compileGlob converts a path glob to a regexp. In the glob "*" matches within
+// a path component, "**" across components and "?" a single character.
+//
+// Like in .gitignore, patterns without a slash match against the base name,
+// so "*.go" matches Go files in any directory. A trailing slash matches
+// everything below such directories, so "vendor/" matches "a/vendor/b.go".
+func compileGlob(glob string) (*regexp.Regexp, error) {
+	if glob == "" || glob == "/" {
+		return nil, fmt.Errorf("empty glob")
+	}
+	if strings.HasSuffix(glob, "/") {
+		glob = strings.TrimSuffix(glob, "/")
+		if !strings.Contains(glob, "/") {
+			glob = "**/" + glob
+		}
+		glob += "/**"
+	}
+	var r strings.Builder
+	r.WriteString("^")
+	if !strings.Contains(glob, "/") {
+		r.WriteString("(?:.*/)?")
+	}
+	for i := 0; i < len(glob); i++ {
+		c := glob[i]
+		switch {
+		case strings.HasPrefix(glob[i:], "**/"):
+			r.WriteString("(?:.*/)?")
+			i += 2
+		case strings.HasPrefix(glob[i:], "**"):
+			r.WriteString(".*")
+			i++
+		case c == '*':
+			r.WriteString("[^/]*")
+		case c == '?':
+			r.WriteString("[^/]")
+		default:
+			r.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	r.WriteString("$")
+	return regexp.Compile(r.String())
+}
+
+// pathFilter selects paths by globs. A path is selected if it matches any of
+// the include globs (or there are none), and none of the exclude globs.
+type pathFilter struct {
+	include []*regexp.Regexp
+	exclude []*regexp.Regexp
+}
+
+// parsePathFilter parses comma-separated globs, where globs prefixed with "!"
+// are exclusions.
+func parsePathFilter(specs []string) (*pathFilter, error) {
+	f := &pathFilter{}
+	for _, spec := range specs {
+		for _, g := range strings.Split(spec, ",") {
+			g = strings.TrimSpace(g)
+			if g == "" {
+				continue
+			}
+			exclude := strings.HasPrefix(g, "!")
+			g = strings.TrimPrefix(g, "!")
+			re, err := compileGlob(g)
+			if err != nil {
+				return nil, fmt.Errorf("bad glob %q: %v", g, err)
+			}
+			if exclude {
+				f.exclude = append(f.exclude, re)
+			} else {
+				f.include = append(f.include, re)
+			}
+		}
+	}
+	return f, nil
+}
+
+func (f *pathFilter) empty() bool {
+	return len(f.include) == 0 && len(f.exclude) == 0
+}
+
+func (f *pathFilter) match(p string) bool {
+	for _, re := range f.exclude {
+		if re.MatchString(p) {
+			return false
+		}
+	}
+	if len(f.include) == 0 {
+		return true
+	}
+	for _, re := range f.include {
+		if re.MatchString(p) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,211 @@
+package web
+
+import (
+	"bufio"
+	"context"
+	"log"
+	"net/http"
+	"regexp"
+	"regexp/syntax"
+	"strconv"
+	"sync"
+
+	"github.com/google/zoekt"
+	"github.com/google/zoekt/query"
+)
+
+// Most matching lines /api/grep returns. If reached, the X-Grep-Incomplete
+// trailer is set.
+const maxGrepMatches = 100000
+
+// Longer grep patterns are rejected.
+const maxGrepPatternLen = 1000
+
+func (s *Server) serveGrep(w http.ResponseWriter, r *http.Request) {
+	if err := s.serveGrepErr(w, r); err != nil {
+		writeError(w, err)
+	}
+}
+
+// serveGrepErr searches the whole index like `grep -rn` would a checkout of
+// all repos, writing "repo/path:line:content" lines as matches come in. The
+// pattern parameter is a literal string, or a (Go syntax) regexp with E=1.
+// Other grep options: i=1 to ignore case, w=1 to match whole words, and
+// include=<glob> (repeatable or comma-separated) to search only matching
+// files, with base name globs like "*.go", or skip them with "!<glob>".
+//
+// The X-Grep-Incomplete trailer is "true" if limits were hit, so not all
+// matches were written.
+func (s *Server) serveGrepErr(w http.ResponseWriter, r *http.Request) error {
+	log.Printf("request: %v", r.URL)
+	params := r.URL.Query()
+	patterns, ok := params["pattern"]
+	if !ok || patterns[0] == "" {
+		return errorf(ErrParamMissing, "Expected pattern parameter")
+	}
+	pattern := patterns[0]
+	if len(pattern) > maxGrepPatternLen {
+		return errorf(ErrLimitExceeded, "pattern is longer than %d bytes", maxGrepPatternLen)
+	}
+	flag := func(name string) (bool, error) {
+		vs, ok := params[name]
+		if !ok {
+			return false, nil
+		}
+		switch vs[0] {
+		case "1":
+			return true, nil
+		case "0":
+			return false, nil
+		}
+		return false, errorf(ErrParamInvalid, "unknown %v %q, want one of 0, 1", name, vs[0])
+	}
+	extended, err := flag("E")
+	if err != nil {
+		return err
+	}
+	ignoreCase, err := flag("i")
+	if err != nil {
+		return err
+	}
+	words, err := flag("w")
+	if err != nil {
+		return err
+	}
+	include, err := parsePathFilter(params["include"])
+	if err != nil {
+		return errorf(ErrParamInvalid, "%v", err)
+	}
+	q, err := grepQuery(pattern, extended, ignoreCase, words, include)
+	if err != nil {
+		return err
+	}
+	log.Printf("query: %v", q)
+
+	ctx, done := s.stage(r.Context(), stageSearch)
+	defer done()
+	sOpts := zoekt.SearchOptions{
+		MaxWallTime:            s.maxWallTime(ctx),
+		ShardMaxMatchCount:     maxGrepMatches,
+		TotalMaxMatchCount:     maxGrepMatches,
+		ShardMaxImportantMatch: maxGrepMatches,
+		TotalMaxImportantMatch: maxGrepMatches,
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=UTF-8")
+	w.Header().Set("Trailer", "X-Grep-Incomplete")
+	w.WriteHeader(http.StatusOK)
+	gw := &grepWriter{w: bufio.NewWriter(w)}
+	gw.flusher, _ = w.(http.Flusher)
+	if err := s.streamSearch(ctx, q, &sOpts, gw.send); err != nil {
+		// Too late for an error response.
+		log.Printf("grep %q: %v", pattern, err)
+		gw.incomplete = true
+	}
+	w.Header().Set("X-Grep-Incomplete", strconv.FormatBool(gw.incomplete))
+	return gw.w.Flush()
+}
+
+// grepQuery builds the Zoekt query of grep options. Patterns are used as
+// query.Q values rather than query strings, so they need no escaping.
+func grepQuery(pattern string, extended, ignoreCase, words bool, include *pathFilter) (query.Q, error) {
+	expr := pattern
+	if !extended {
+		expr = regexp.QuoteMeta(pattern)
+	}
+	if words {
+		expr = `\b(?:` + expr + `)\b`
+	}
+	re, err := syntax.Parse(expr, syntax.Perl)
+	if err != nil {
+		return nil, errorf(ErrQueryParse, "pattern %q can't be searched: %v", pattern, err)
+	}
+	qs := []query.Q{&query.Regexp{Regexp: re, Content: true, CaseSensitive: !ignoreCase}}
+	var files []query.Q
+	for _, g := range include.include {
+		fre, err := syntax.Parse(g.String(), syntax.Perl)
+		if err != nil {
+			return nil, errorf(ErrInternal, "glob regexp %v: %v", g, err)
+		}
+		files = append(files, &query.Regexp{Regexp: fre, FileName: true, CaseSensitive: true})
+	}
+	if len(files) > 0 {
+		qs = append(qs, query.NewOr(files...))
+	}
+	for _, g := range include.exclude {
+		fre, err := syntax.Parse(g.String(), syntax.Perl)
+		if err != nil {
+			return nil, errorf(ErrInternal, "glob regexp %v: %v", g, err)
+		}
+		qs = append(qs, &query.Not{Child: &query.Regexp{Regexp: fre, FileName: true, CaseSensitive: true}})
+	}
+	return query.Simplify(query.NewAnd(qs...)), nil
+}
+
+// streamSearch runs a search, passing results to send as they come in if the
+// Searcher can stream them, or all at once otherwise. send is not called
+// concurrently.
+func (s *Server) streamSearch(ctx context.Context, q query.Q, opts *zoekt.SearchOptions, send func(*zoekt.SearchResult)) error {
+	st, ok := s.Searcher.(zoekt.Streamer)
+	if !ok {
+		result, err := s.Searcher.Search(ctx, q, opts)
+		if err != nil {
+			return err
+		}
+		send(result)
+		return nil
+	}
+	var mu sync.Mutex
+	return st.StreamSearch(ctx, q, opts, senderFunc(func(result *zoekt.SearchResult) {
+		mu.Lock()
+		defer mu.Unlock()
+		send(result)
+	}))
+}
+
+// senderFunc adapts a function to zoekt.Sender.
+type senderFunc func(*zoekt.SearchResult)
+
+func (f senderFunc) Send(result *zoekt.SearchResult) {
+	f(result)
+}
+
+// grepWriter writes search results as grep output.
+type grepWriter struct {
+	w *bufio.Writer
+	// Nil if the response can't be flushed early.
+	flusher http.Flusher
+	lines   int
+	// Set if limits were hit.
+	incomplete bool
+}
+
+func (g *grepWriter) send(result *zoekt.SearchResult) {
+	if result.Stats.FilesSkipped > 0 || result.Stats.ShardsSkipped > 0 {
+		g.incomplete = true
+	}
+	for _, f := range result.Files {
+		for _, l := range f.LineMatches {
+			if l.FileName {
+				continue
+			}
+			if g.lines >= maxGrepMatches {
+				g.incomplete = true
+				return
+			}
+			g.lines++
+			g.w.WriteString(f.Repository)
+			g.w.WriteByte('/')
+			g.w.WriteString(f.FileName)
+			g.w.WriteByte(':')
+			g.w.WriteString(strconv.Itoa(l.LineNumber))
+			g.w.WriteByte(':')
+			g.w.Write(l.Line)
+			g.w.WriteByte('\n')
+		}
+	}
+	if len(result.Files) > 0 && g.flusher != nil {
+		g.w.Flush()
+		g.flusher.Flush()
+	}
+}
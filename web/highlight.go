@@ -0,0 +1,83 @@
+package web
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/alecthomas/chroma"
+	"github.com/alecthomas/chroma/formatters/html"
+	"github.com/alecthomas/chroma/lexers"
+	"github.com/alecthomas/chroma/styles"
+	"github.com/google/zoekt"
+)
+
+// highlighter renders source as syntax-highlighted HTML.
+type highlighter struct {
+	style     *chroma.Style
+	formatter *html.Formatter
+}
+
+// newHighlighter returns a highlighter using the named chroma style, or nil if
+// the name is empty.
+func newHighlighter(style string) (*highlighter, error) {
+	if style == "" {
+		return nil, nil
+	}
+	st, ok := styles.Registry[style]
+	if !ok {
+		return nil, fmt.Errorf("unknown highlight style %q", style)
+	}
+	return &highlighter{
+		style: st,
+		// Inline styles, so clients don't need a stylesheet. Line numbers link
+		// to anchors like #L12.
+		formatter: html.New(
+			html.WithLineNumbers(true),
+			html.LinkableLineNumbers(true, "L"),
+			html.TabWidth(4),
+		),
+	}, nil
+}
+
+// lexer picks a lexer by the language Zoekt detected, falling back to the
+// file name, then to plain text.
+func (h *highlighter) lexer(f *zoekt.FileMatch) chroma.Lexer {
+	l := lexers.Get(f.Language)
+	if l == nil {
+		l = lexers.Match(f.FileName)
+	}
+	if l == nil {
+		l = lexers.Fallback
+	}
+	return chroma.Coalesce(l)
+}
+
+// writeSourceHTML responds with f as a syntax-highlighted HTML fragment. The
+// highlighter must be set.
+func (s *Server) writeSourceHTML(w http.ResponseWriter, r *http.Request, f *zoekt.FileMatch) error {
+	etag := contentETag(f.Checksum, "html")
+	w.Header().Set("Content-Type", "text/html; charset=UTF-8")
+	w.Header().Set("ETag", etag)
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return nil
+	}
+
+	h := s.highlighter
+	it, err := h.lexer(f).Tokenise(nil, string(f.Content))
+	if err != nil {
+		return err
+	}
+	var b bytes.Buffer
+	if err := h.formatter.Format(&b, h.style, it); err != nil {
+		return err
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(b.Len()))
+	w.WriteHeader(http.StatusOK)
+	if r.Method != http.MethodHead {
+		w.Write(b.Bytes())
+	}
+	return nil
+}
@@ -0,0 +1,441 @@
+package web
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/google/zoekt"
+)
+
+// Default of KytheConfig.Timeout.
+const defaultKytheTimeout = 2 * time.Second
+
+// Bytes of a Kythe reply at most.
+const maxKytheReplyBytes = 64 << 20
+
+// kytheClient calls the HTTP API of a Kythe server (like Kythe's
+// http_server), for the repos covered by its serving table. Requests are
+// JSON-encoded protos of kythe.proto.xref, see xrefs.proto of Kythe.
+type kytheClient struct {
+	baseURL string
+	timeout time.Duration
+	client  *http.Client
+	// Keyed by repo.
+	corpora map[string]KytheCorpus
+	// Repo of each corpus, keyed by corpus and root joined with "\x00".
+	repos map[string]string
+}
+
+// newKytheClient returns the client configured by c, or nil if disabled.
+func newKytheClient(c KytheConfig) (*kytheClient, error) {
+	if c.URL == "" {
+		return nil, nil
+	}
+	k := &kytheClient{
+		baseURL: strings.TrimSuffix(c.URL, "/"),
+		timeout: defaultKytheTimeout,
+		client:  &http.Client{},
+		corpora: map[string]KytheCorpus{},
+		repos:   map[string]string{},
+	}
+	if c.Timeout != "" {
+		d, err := time.ParseDuration(c.Timeout)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("kythe timeout %q: want a positive duration like \"2s\"", c.Timeout)
+		}
+		k.timeout = d
+	}
+	if len(c.Corpora) == 0 {
+		return nil, fmt.Errorf("kythe: no corpora configured")
+	}
+	for repo, corpus := range c.Corpora {
+		if corpus.Corpus == "" {
+			corpus.Corpus = repo
+		}
+		key := corpus.Corpus + "\x00" + corpus.Root
+		if other, ok := k.repos[key]; ok {
+			return nil, fmt.Errorf("kythe: repos %q and %q map to the same corpus and root", other, repo)
+		}
+		k.corpora[repo] = corpus
+		k.repos[key] = repo
+	}
+	return k, nil
+}
+
+// covers tells if the repo has Kythe data. Nil-safe.
+func (k *kytheClient) covers(repo string) bool {
+	if k == nil {
+		return false
+	}
+	_, ok := k.corpora[repo]
+	return ok
+}
+
+// repoNames returns the covered repos, sorted. Nil-safe.
+func (k *kytheClient) repoNames() []string {
+	names := []string{}
+	if k == nil {
+		return names
+	}
+	for repo := range k.corpora {
+		names = append(names, repo)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// fileTicket returns the Kythe ticket of a file of a covered repo. Fields are
+// in the canonical order, as the serving table is keyed by tickets.
+func (k *kytheClient) fileTicket(repo, path string) string {
+	c := k.corpora[repo]
+	t := "kythe://" + kytheEscape(c.Corpus) + "?path=" + kytheEscape(path)
+	if c.Root != "" {
+		t += "?root=" + kytheEscape(c.Root)
+	}
+	return t
+}
+
+// file returns the repo and path of a Kythe file ticket, or false if its
+// corpus is not of a configured repo.
+func (k *kytheClient) file(ticket string) (string, string, bool) {
+	p, err := KytheTicketCodec{}.Decode(ticket)
+	if err != nil || p.Path == "" {
+		return "", "", false
+	}
+	// Note: the codec reads the root as the branch.
+	repo, ok := k.repos[p.Repo+"\x00"+p.Branch]
+	return repo, p.Path, ok
+}
+
+// call POSTs req to the method of the Kythe API, and decodes the reply.
+func (k *kytheClient) call(ctx context.Context, method string, req, reply interface{}) (err error) {
+	defer func() {
+		outcome := "ok"
+		if err != nil {
+			outcome = "error"
+		}
+		metricKytheRequests.WithLabelValues(method, outcome).Inc()
+	}()
+	ctx, cancel := context.WithTimeout(ctx, k.timeout)
+	defer cancel()
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	hreq, err := http.NewRequest(http.MethodPost, k.baseURL+"/"+method, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	hreq.Header.Set("Content-Type", "application/json")
+	res, err := k.client.Do(hreq.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	b, err := ioutil.ReadAll(&limitedReader{res.Body, maxKytheReplyBytes})
+	if err != nil {
+		return err
+	}
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("kythe %s: %s: %s", method, res.Status, bytes.TrimSpace(b))
+	}
+	// Depending on the server, fields are in proto (snake_case) or JSON
+	// (lowerCamelCase) names. Decoded as the latter.
+	var v interface{}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return fmt.Errorf("kythe %s: %v", method, err)
+	}
+	b, err = json.Marshal(camelKeys(v))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, reply)
+}
+
+// limitedReader fails reads past n bytes, unlike io.LimitedReader, which
+// would silently cut the reply.
+type limitedReader struct {
+	r io.Reader
+	n int
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	l.n -= n
+	if l.n < 0 {
+		return n, fmt.Errorf("reply above %d bytes", maxKytheReplyBytes)
+	}
+	return n, err
+}
+
+// camelKeys renames snake_case object keys to lowerCamelCase. Other keys,
+// like the tickets keying maps, are kept.
+func camelKeys(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		res := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			res[snakeToCamel(k)] = camelKeys(e)
+		}
+		return res
+	case []interface{}:
+		for i, e := range v {
+			v[i] = camelKeys(e)
+		}
+	}
+	return v
+}
+
+func snakeToCamel(k string) string {
+	if !strings.Contains(k, "_") {
+		return k
+	}
+	for _, c := range k {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '_') {
+			return k
+		}
+	}
+	parts := strings.Split(k, "_")
+	for i := 1; i < len(parts); i++ {
+		if parts[i] != "" {
+			parts[i] = strings.ToUpper(parts[i][:1]) + parts[i][1:]
+		}
+	}
+	return strings.Join(parts, "")
+}
+
+// Messages of kythe.proto.xref, with the fields used.
+type kythePoint struct {
+	ByteOffset int `json:"byteOffset"`
+	// 1-based.
+	LineNumber int `json:"lineNumber"`
+	// In bytes.
+	ColumnOffset int `json:"columnOffset"`
+}
+
+type kytheSpan struct {
+	Start kythePoint `json:"start"`
+	End   kythePoint `json:"end"`
+}
+
+type kytheAnchor struct {
+	Ticket string    `json:"ticket"`
+	Kind   string    `json:"kind"`
+	Parent string    `json:"parent"`
+	Span   kytheSpan `json:"span"`
+	// The line of the anchor.
+	Snippet     string    `json:"snippet"`
+	SnippetSpan kytheSpan `json:"snippetSpan"`
+}
+
+type kytheDecorationsReply struct {
+	SourceText []byte `json:"sourceText"`
+	Reference  []struct {
+		TargetTicket     string    `json:"targetTicket"`
+		Kind             string    `json:"kind"`
+		Span             kytheSpan `json:"span"`
+		TargetDefinition string    `json:"targetDefinition"`
+	} `json:"reference"`
+	// Keyed by anchor ticket.
+	DefinitionLocations map[string]kytheAnchor `json:"definitionLocations"`
+}
+
+type kytheRelatedAnchor struct {
+	Anchor kytheAnchor `json:"anchor"`
+}
+
+type kytheXRefsReply struct {
+	// Keyed by the requested ticket.
+	CrossReferences map[string]struct {
+		Definition []kytheRelatedAnchor `json:"definition"`
+		Reference  []kytheRelatedAnchor `json:"reference"`
+	} `json:"crossReferences"`
+}
+
+// UhDecor is a semantic reference in a file, found by Kythe.
+type UhDecor struct {
+	Span CmRange `json:"dSpan"`
+	// Kythe ticket of the referenced node, for the target parameter of
+	// search-xref.
+	Target string `json:"dTarget"`
+	// Kythe edge kind, like "/kythe/edge/ref/call".
+	Kind string `json:"dKind"`
+	// Where the target is defined, if known and in a repo of the index.
+	Definition *UhLocation `json:"dDefinition,omitempty"`
+}
+
+// UhLocation is a span in a file.
+type UhLocation struct {
+	FileTicket string  `json:"lFileTicket"`
+	Span       CmRange `json:"lSpan"`
+}
+
+// decors returns the decors of a file of a covered repo.
+func (s *Server) decors(ctx context.Context, repo, path string) ([]UhDecor, error) {
+	k := s.kythe
+	var reply kytheDecorationsReply
+	if err := k.call(ctx, "decorations", map[string]interface{}{
+		"location":           map[string]interface{}{"ticket": k.fileTicket(repo, path)},
+		"references":         true,
+		"target_definitions": true,
+		"source_text":        true,
+	}, &reply); err != nil {
+		return nil, err
+	}
+	lines := bytes.Split(reply.SourceText, []byte("\n"))
+	decors := []UhDecor{}
+	for _, ref := range reply.Reference {
+		d := UhDecor{
+			Span:   kytheRange(ref.Span, lines),
+			Target: ref.TargetTicket,
+			Kind:   ref.Kind,
+		}
+		if a, ok := reply.DefinitionLocations[ref.TargetDefinition]; ok {
+			if repo, path, ok := k.file(a.Parent); ok {
+				d.Definition = &UhLocation{
+					FileTicket: s.fileTicket(repo, "", path),
+					Span:       kytheRange(a.Span, snippetLines(a)),
+				}
+			}
+		}
+		decors = append(decors, d)
+	}
+	return decors, nil
+}
+
+// snippetLines returns lines for kytheRange to convert the span of the
+// anchor with, which only has its own line. Others are left empty.
+func snippetLines(a kytheAnchor) [][]byte {
+	n := a.SnippetSpan.Start.LineNumber
+	if n < 1 || a.Snippet == "" {
+		return nil
+	}
+	lines := make([][]byte, n)
+	lines[n-1] = []byte(a.Snippet)
+	return lines
+}
+
+// kytheRange converts a span, counting characters within the lines of the
+// file. Columns beyond the known lines are taken as characters.
+func kytheRange(sp kytheSpan, lines [][]byte) CmRange {
+	return CmRange{From: kytheCmPoint(sp.Start, lines), To: kytheCmPoint(sp.End, lines)}
+}
+
+func kytheCmPoint(p kythePoint, lines [][]byte) CmPoint {
+	line := p.LineNumber - 1
+	if line < 0 || line >= len(lines) || len(lines[line]) == 0 {
+		return CmPoint{Line: line, Ch: p.ColumnOffset}
+	}
+	text := lines[line]
+	if p.ColumnOffset <= len(text) {
+		return CmPoint{Line: line, Ch: utf8.RuneCount(text[:p.ColumnOffset])}
+	}
+	return CmPoint{Line: line, Ch: utf8.RuneCount(text) + p.ColumnOffset - len(text)}
+}
+
+// kytheXrefs looks up the definitions and references of the Kythe node
+// target, as search results to convert with toFileSites. Anchors in files
+// outside the configured repos are left out.
+func (s *Server) kytheXrefs(ctx context.Context, target string, maxFiles int) (defs, refs *zoekt.SearchResult, err error) {
+	var reply kytheXRefsReply
+	if err := s.kythe.call(ctx, "xrefs", map[string]interface{}{
+		"ticket":          []string{target},
+		"definition_kind": "ALL_DEFINITIONS",
+		"reference_kind":  "ALL_REFERENCES",
+		"snippets":        "DEFAULT",
+		"page_size":       maxFiles * 10,
+	}, &reply); err != nil {
+		return nil, nil, err
+	}
+	set := reply.CrossReferences[target]
+	return s.kytheResult(set.Definition, maxFiles), s.kytheResult(set.Reference, maxFiles), nil
+}
+
+// kytheResult converts anchors to a search result, with a file match of
+// each file (up to maxFiles, in order of appearance), and a line match of
+// each snippet line.
+func (s *Server) kytheResult(anchors []kytheRelatedAnchor, maxFiles int) *zoekt.SearchResult {
+	// Anchors of each file, keyed by line number.
+	byFile := map[string]map[int][]kytheAnchor{}
+	var order []string
+	for _, ra := range anchors {
+		a := ra.Anchor
+		if _, _, ok := s.kythe.file(a.Parent); !ok {
+			continue
+		}
+		if byFile[a.Parent] == nil {
+			if len(order) >= maxFiles {
+				continue
+			}
+			byFile[a.Parent] = map[int][]kytheAnchor{}
+			order = append(order, a.Parent)
+		}
+		n := a.SnippetSpan.Start.LineNumber
+		byFile[a.Parent][n] = append(byFile[a.Parent][n], a)
+	}
+
+	result := &zoekt.SearchResult{RepoURLs: map[string]string{}}
+	for _, parent := range order {
+		repo, path, _ := s.kythe.file(parent)
+		// Kythe has no content checksums, so each file gets a distinct one,
+		// for no two to be taken as duplicates.
+		sum := sha1.Sum([]byte(parent))
+		f := zoekt.FileMatch{
+			Repository: repo,
+			FileName:   path,
+			Checksum:   sum[:],
+		}
+		for n, as := range byFile[parent] {
+			l := zoekt.LineMatch{
+				Line:       []byte(as[0].Snippet),
+				LineNumber: n,
+			}
+			for _, a := range as {
+				l.LineFragments = append(l.LineFragments, kytheFragment(a, len(l.Line)))
+			}
+			f.LineMatches = append(f.LineMatches, l)
+		}
+		sort.Slice(f.LineMatches, func(i, j int) bool {
+			return f.LineMatches[i].LineNumber < f.LineMatches[j].LineNumber
+		})
+		result.Files = append(result.Files, f)
+	}
+	return result
+}
+
+// kytheFragment returns the span of the anchor within its snippet line of
+// lineLen bytes. Spans reaching past the line are cut at its ends.
+func kytheFragment(a kytheAnchor, lineLen int) zoekt.LineFragmentMatch {
+	start := a.Span.Start.ByteOffset - a.SnippetSpan.Start.ByteOffset
+	end := a.Span.End.ByteOffset - a.SnippetSpan.Start.ByteOffset
+	if start < 0 {
+		start = 0
+	}
+	if start > lineLen {
+		start = lineLen
+	}
+	if end > lineLen || end < start {
+		end = lineLen
+	}
+	return zoekt.LineFragmentMatch{LineOffset: start, MatchLength: end - start}
+}
+
+// kytheDefinitions groups the definitions found by kytheXrefs like those
+// found by Zoekt.
+func (s *Server) kytheDefinitions(defs *zoekt.SearchResult) []UhSiteGroup {
+	sites := []fileSites{}
+	for i := range defs.Files {
+		sites = append(sites, s.toFileSites(defs, &defs.Files[i], false))
+	}
+	return siteGroups(sites)
+}
@@ -0,0 +1,27 @@
+package web
+
+import (
+	"testing"
+)
+
+func TestSnakeToCamel(t *testing.T) {
+	for _, tc := range []struct {
+		in, want string
+	}{
+		{"ticket", "ticket"},
+		{"alreadyCamel", "alreadyCamel"},
+		{"cross_references", "crossReferences"},
+		{"definition_kind_2", "definitionKind2"},
+		{"trailing_", "trailing"},
+		{"double__under", "doubleUnder"},
+		{"_leading", "Leading"},
+		{"Mixed_Case", "Mixed_Case"},
+		{"with-dash_x", "with-dash_x"},
+	} {
+		t.Run(tc.in, func(t *testing.T) {
+			if got := snakeToCamel(tc.in); got != tc.want {
+				t.Errorf("snakeToCamel(%q) = %q, want %q", tc.in, got, tc.want)
+			}
+		})
+	}
+}
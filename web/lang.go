@@ -0,0 +1,32 @@
+package web
+
+import (
+	"net/http"
+	"strings"
+)
+
+// xrefLangAtoms returns the query atoms restricting an xref search to the
+// languages of the comma-separated lang parameters, like lang=go,python, or ""
+// if not restricted. Names are Zoekt (linguist) language names or aliases.
+func xrefLangAtoms(r *http.Request) (string, error) {
+	var atoms []string
+	for _, spec := range r.URL.Query()["lang"] {
+		for _, l := range strings.Split(spec, ",") {
+			l = strings.TrimSpace(l)
+			if l == "" {
+				continue
+			}
+			if strings.ContainsAny(l, " \t\n()\"") {
+				return "", errorf(ErrParamInvalid, "malformed lang %q", l)
+			}
+			atoms = append(atoms, "lang:"+l)
+		}
+	}
+	switch len(atoms) {
+	case 0:
+		return "", nil
+	case 1:
+		return atoms[0], nil
+	}
+	return "(" + strings.Join(atoms, " or ") + ")", nil
+}
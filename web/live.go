@@ -0,0 +1,191 @@
+package web
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// Files of each live search reply at most, fewer if the profile says so.
+// Enough to fill the results as the user types, fast.
+const liveSearchMaxFiles = 50
+
+// Bytes of a client message at most. Selections are short.
+const liveSearchMaxMessage = 16 << 10
+
+// UhLiveQuery is a client message of /api/live-search.
+type UhLiveQuery struct {
+	// Echoed in the reply, so the client can tell which query it answers.
+	ID int `json:"id"`
+	// Like the selection parameter of search-xref.
+	Selection string `json:"selection"`
+}
+
+// UhLiveReply is a server message of /api/live-search, answering the query
+// of the same ID. Either Reply or Error is set.
+type UhLiveReply struct {
+	ID    int             `json:"id"`
+	Reply json.RawMessage `json:"reply,omitempty"`
+	Error *apiError       `json:"error,omitempty"`
+}
+
+// serveLiveSearch serves xref searches over a WebSocket, for searching as
+// the user types. The parameters of the upgrade request apply to all
+// searches, like those of search-xref (casing, mode, scope, ticket, profile
+// and so on), except selection, which each UhLiveQuery message carries. Each
+// is answered by an UhLiveReply with the search-xref reply, limited to the
+// top files.
+//
+// A query arriving while the previous one is searched cancels that, and
+// queries arriving meanwhile are dropped except the last one. So only the
+// latest selection is searched, however fast the user types.
+func (s *Server) serveLiveSearch(w http.ResponseWriter, r *http.Request) {
+	profile, err := s.requestProfile(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	deadline, err := requestDeadline(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	profile = profile.withDeadline(deadline)
+	if profile.maxFiles > liveSearchMaxFiles {
+		p := *profile
+		p.maxFiles = liveSearchMaxFiles
+		profile = &p
+	}
+	base := r.URL.Query()
+	// Note: no Handshake, so any origin is accepted. The searches are read
+	// only, like the rest of the API.
+	websocket.Server{Handler: func(ws *websocket.Conn) {
+		ws.MaxPayloadBytes = liveSearchMaxMessage
+		s.liveSession(ws, r, base, profile, deadline)
+	}}.ServeHTTP(w, r)
+}
+
+// liveSession runs the searches of a live-search connection, until the
+// client closes it.
+func (s *Server) liveSession(ws *websocket.Conn, r *http.Request, base url.Values, profile *searchProfile, deadline time.Duration) {
+	ctx, cancelSession := context.WithCancel(r.Context())
+	defer cancelSession()
+
+	// Holds the latest query not searched yet, if any.
+	pending := make(chan UhLiveQuery, 1)
+	var mu sync.Mutex
+	// Of the search running, if any.
+	var cancelSearch context.CancelFunc
+	go func() {
+		defer cancelSession()
+		for {
+			var q UhLiveQuery
+			if err := websocket.JSON.Receive(ws, &q); err != nil {
+				return
+			}
+			mu.Lock()
+			if cancelSearch != nil {
+				cancelSearch()
+			}
+			mu.Unlock()
+			// Only this goroutine sends, so the send can't block after
+			// draining.
+			select {
+			case <-pending:
+				metricLiveQueries.WithLabelValues("superseded").Inc()
+			default:
+			}
+			pending <- q
+		}
+	}()
+
+	for {
+		var q UhLiveQuery
+		select {
+		case <-ctx.Done():
+			return
+		case q = <-pending:
+		}
+		searchCtx, cancel := context.WithCancel(ctx)
+		mu.Lock()
+		cancelSearch = cancel
+		mu.Unlock()
+		reply := s.liveSearch(searchCtx, r, base, profile, deadline, q)
+		mu.Lock()
+		cancelSearch = nil
+		mu.Unlock()
+		superseded := searchCtx.Err() != nil
+		cancel()
+		if superseded {
+			metricLiveQueries.WithLabelValues("superseded").Inc()
+			continue
+		}
+		metricLiveQueries.WithLabelValues("answered").Inc()
+		if err := websocket.JSON.Send(ws, reply); err != nil {
+			log.Printf("live-search: sending reply: %v", err)
+			return
+		}
+	}
+}
+
+// liveSearch answers a live-search query, running it like a search-xref
+// request with the base parameters. A non-zero deadline applies to the query.
+func (s *Server) liveSearch(ctx context.Context, r *http.Request, base url.Values, profile *searchProfile, deadline time.Duration, q UhLiveQuery) *UhLiveReply {
+	params := url.Values{}
+	for k, v := range base {
+		params[k] = v
+	}
+	params.Set("selection", q.Selection)
+	u := *r.URL
+	u.RawQuery = params.Encode()
+
+	start := time.Now()
+	ctx, _ = withStageTimings(withProfile(withSearchMemo(ctx), profile), start, profile.budget)
+	if deadline > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, deadline)
+		defer cancel()
+	}
+	req := r.WithContext(ctx)
+	req.URL = &u
+
+	var w bufferWriter
+	reply := &UhLiveReply{ID: q.ID}
+	if err := s.serveSearchXrefErr(&w, req); err != nil {
+		e, ok := err.(*apiError)
+		if !ok {
+			e = &apiError{Code: ErrInternal, Message: err.Error()}
+		}
+		log.Printf("error: %v: %v", e.Code, e.Message)
+		reply.Error = e
+		return reply
+	}
+	reply.Reply = w.body.Bytes()
+	return reply
+}
+
+// bufferWriter is a http.ResponseWriter keeping the body in memory.
+type bufferWriter struct {
+	header http.Header
+	body   bytes.Buffer
+}
+
+func (w *bufferWriter) Header() http.Header {
+	if w.header == nil {
+		w.header = http.Header{}
+	}
+	return w.header
+}
+
+func (w *bufferWriter) Write(b []byte) (int, error) {
+	return w.body.Write(b)
+}
+
+func (w *bufferWriter) WriteHeader(int) {}
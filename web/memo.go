@@ -0,0 +1,54 @@
+package web
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/google/zoekt"
+	"github.com/google/zoekt/query"
+)
+
+type searchMemoKey struct{}
+
+// searchMemo remembers the Zoekt searches of a request, so passes needing the
+// same files (and their content or line matches) don't query again.
+type searchMemo struct {
+	mu      sync.Mutex
+	results map[string]*zoekt.SearchResult
+}
+
+// withSearchMemo returns a context memoizing searches done via Server.search.
+func withSearchMemo(ctx context.Context) context.Context {
+	return context.WithValue(ctx, searchMemoKey{}, &searchMemo{results: map[string]*zoekt.SearchResult{}})
+}
+
+// search runs a Zoekt search, or returns the result of the same search done
+// earlier in the request. The result is shared, so must not be modified.
+//
+// MaxWallTime is not part of the key: it is what's left of the request's
+// budget, so differs between otherwise same searches.
+func (s *Server) search(ctx context.Context, q query.Q, opts *zoekt.SearchOptions) (*zoekt.SearchResult, error) {
+	memo, ok := ctx.Value(searchMemoKey{}).(*searchMemo)
+	if !ok {
+		return s.Searcher.Search(ctx, q, opts)
+	}
+	keyOpts := *opts
+	keyOpts.MaxWallTime = 0
+	key := fmt.Sprintf("%v\x00%+v", q, keyOpts)
+	memo.mu.Lock()
+	result, ok := memo.results[key]
+	memo.mu.Unlock()
+	if ok {
+		metricSearchMemoHits.Inc()
+		return result, nil
+	}
+	result, err := s.Searcher.Search(ctx, q, opts)
+	if err != nil {
+		return nil, err
+	}
+	memo.mu.Lock()
+	memo.results[key] = result
+	memo.mu.Unlock()
+	return result, nil
+}
@@ -0,0 +1,182 @@
+package web
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/google/zoekt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	metricRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "underhood_requests_total",
+		Help: "Number of API requests, by endpoint and client-reported UI interaction.",
+	}, []string{"endpoint", "interaction"})
+
+	metricRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "underhood_request_duration_seconds",
+		Help:    "Latency of API requests, by endpoint and client-reported UI interaction.",
+		Buckets: prometheus.ExponentialBuckets(0.005, 2, 14),
+	}, []string{"endpoint", "interaction"})
+
+	metricSearchMemoHits = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "underhood_search_memo_hits_total",
+		Help: "Zoekt searches answered from an earlier identical search of the same request.",
+	})
+
+	metricXrefCacheRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "underhood_xref_cache_requests_total",
+		Help: "Lookups of xref searches in the cache across requests, by result (hit or miss).",
+	}, []string{"result"})
+
+	metricXrefPartial = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "underhood_xref_partial_replies_total",
+		Help: "Xref replies with partial results, by reason (timeout or canceled).",
+	}, []string{"reason"})
+
+	metricRenderTimeouts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "underhood_render_timeouts_total",
+		Help: "Format=rendered source requests given up on for taking too long, by transformer.",
+	}, []string{"transformer"})
+
+	metricLiveQueries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "underhood_live_search_queries_total",
+		Help: "Queries of live-search connections, by outcome (answered, or superseded by a later query).",
+	}, []string{"outcome"})
+
+	metricKytheRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "underhood_kythe_requests_total",
+		Help: "Requests to the Kythe server, by API method and outcome (ok or error).",
+	}, []string{"method", "outcome"})
+
+	metricLossySnippets = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "underhood_snippets_invalid_utf8_total",
+		Help: "Snippets of lines with invalid UTF-8, returned with U+FFFD replacements.",
+	})
+
+	// Below by the match limits chosen: "default" if the estimate was skipped,
+	// otherwise "small-corpus" or "large-corpus" based on its outcome, or
+	// "empty-corpus" if no documents were in scope so the search was skipped.
+
+	metricEstimateDocs = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "underhood_xref_estimated_docs",
+		Help:    "Documents to consider according to the xref estimate pre-search.",
+		Buckets: prometheus.ExponentialBuckets(100, 4, 10),
+	})
+
+	metricXrefSearchDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "underhood_xref_search_duration_seconds",
+		Help:    "Duration of the main xref search, by match limits chosen.",
+		Buckets: prometheus.ExponentialBuckets(0.005, 2, 14),
+	}, []string{"limits"})
+
+	metricXrefFilesSkipped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "underhood_xref_files_skipped_total",
+		Help: "Candidate files not examined by xref searches due to match limits, by match limits chosen.",
+	}, []string{"limits"})
+
+	metricXrefFiles = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "underhood_xref_files_total",
+		Help: "Files with matches found by xref searches, by match limits chosen.",
+	}, []string{"limits"})
+)
+
+// Header the UI sets to tell which interaction (like "tree-expand", "hover" or
+// "xref-click") triggered the request.
+const interactionHeader = "X-Underhood-Interaction"
+
+// Max distinct interaction labels, to bound metric cardinality in face of
+// misbehaving clients. Further values are counted as "other".
+const maxInteractions = 50
+
+var interactionRE = regexp.MustCompile(`^[a-z0-9-]{1,32}$`)
+
+// interactions tracks the interaction label values seen so far.
+type interactions struct {
+	mu   sync.Mutex
+	seen map[string]bool
+}
+
+// label returns the metric label value for the header value h.
+func (is *interactions) label(h string) string {
+	if h == "" {
+		return "none"
+	}
+	if !interactionRE.MatchString(h) {
+		return "other"
+	}
+	is.mu.Lock()
+	defer is.mu.Unlock()
+	if is.seen == nil {
+		is.seen = map[string]bool{}
+	}
+	if !is.seen[h] {
+		if len(is.seen) >= maxInteractions {
+			return "other"
+		}
+		is.seen[h] = true
+	}
+	return h
+}
+
+// instrument wraps an endpoint handler to record its latency, attributed to
+// the UI interaction reported by the client, and its usage. The handler runs
+// with the search profile of the request (see SearchProfile), and its stages
+// (see Server.stage) are reported in the Server-Timing header, and end by the
+// deadline_ms parameter, if given. Responses warn about shards left out of
+// searches (see shardChecker).
+func (s *Server) instrument(name string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		interaction := s.interactions.label(r.Header.Get(interactionHeader))
+		start := time.Now()
+		s.usage.record(name, r, start)
+		profile, err := s.requestProfile(r)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		deadline, err := requestDeadline(r)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		profile = profile.withDeadline(deadline)
+		if warning := s.shardCheck.warning(); warning != "" {
+			w.Header().Set(warningHeader, warning)
+		}
+		ctx, timings := withStageTimings(withProfile(withSearchMemo(r.Context()), profile), start, profile.budget)
+		// Searches running past the deadline are canceled, freeing the
+		// shards. WebSocket sessions apply it per query instead, see
+		// liveSearch.
+		if deadline > 0 && r.Header.Get("Upgrade") == "" {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, deadline)
+			defer cancel()
+		}
+		h(&timingWriter{ResponseWriter: w, timings: timings}, r.WithContext(ctx))
+		took := time.Since(start)
+		log.Printf("served %v in %v (interaction: %v)", name, took, interaction)
+		metricRequests.WithLabelValues(name, interaction).Inc()
+		metricRequestDuration.WithLabelValues(name, interaction).Observe(took.Seconds())
+	}
+}
+
+// recordSearchLimits logs and records the outcome of an xref search, so the
+// effect of the limits chosen (see appendSearches) can be assessed. numdocs is
+// the estimate, if it ran.
+func recordSearchLimits(limits string, numdocs int, st *zoekt.Stats) {
+	log.Printf("search stats: limits %v, estimated docs %d; files %d, matches %d, files skipped %d, shards skipped %d, took %v",
+		limits, numdocs, st.FileCount, st.MatchCount, st.FilesSkipped, st.ShardsSkipped, st.Duration)
+	if limits != limitsDefault {
+		metricEstimateDocs.Observe(float64(numdocs))
+	}
+	metricXrefSearchDuration.WithLabelValues(limits).Observe(st.Duration.Seconds())
+	metricXrefFilesSkipped.WithLabelValues(limits).Add(float64(st.FilesSkipped))
+	metricXrefFiles.WithLabelValues(limits).Add(float64(st.FileCount))
+}
@@ -0,0 +1,466 @@
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/zoekt"
+)
+
+// apiDoc describes an endpoint for the OpenAPI document. Response schemas are
+// derived from the Go types, so they stay in sync with the handlers.
+type apiDoc struct {
+	summary string
+	// GET unless set.
+	method string
+	params []apiParam
+	// Of the JSON response, nil if the endpoint responds otherwise.
+	response reflect.Type
+	// Media type of non-JSON responses.
+	mediaType string
+}
+
+type apiParam struct {
+	name string
+	// OpenAPI type: "string" (if empty) or "integer".
+	typ         string
+	required    bool
+	description string
+	// Values allowed, if limited.
+	enum []string
+}
+
+// Parameters of most endpoints, see instrument.
+var commonParams = []apiParam{
+	{name: "profile", description: "Search profile, see /api/capabilities."},
+	{name: "deadline_ms", typ: "integer", description: "Time the client waits at most, in milliseconds. Searches stop by then."},
+}
+
+// Values of flag parameters.
+var yesNo = []string{"yes", "no"}
+
+// Parameters restricting the files of xref queries, see xrefScopeAtoms and
+// excludeAtoms.
+var (
+	scopeParam = apiParam{name: "scope", description: "all (the default), current-repo, repos=a,b,c, dir for the directory of the ticket's file, dir=N for it and N levels of subdirectories, or dir=any for all of them."}
+	// Both exclude parameters.
+	excludeParams = []apiParam{
+		{name: "exclude", description: "Comma-separated path prefixes to leave out, like vendor/ at any depth, or /Makefile at the repo root."},
+		{name: "exclude_defaults", enum: yesNo, description: "no to not leave out the paths configured by the server."},
+	}
+)
+
+// Parameters of search-xref, also taken by endpoints running xref queries.
+var xrefParams = append([]apiParam{
+	{name: "selection", required: true, description: "Text to find references of."},
+	{name: "casing", enum: xrefCasings},
+	{name: "mode", enum: xrefModes},
+	{name: "ticket", description: "Ticket of the file the selection is from, for scope."},
+	scopeParam,
+	{name: "lang", description: "Comma-separated languages to search in."},
+}, excludeParams...)
+
+// apiDocs are the docs of the endpoints, keyed by endpoint name. NewMux fails
+// for endpoints without one.
+var apiDocs = map[string]apiDoc{
+	"filetree": {
+		summary: "Lists the repos, or the files and directories below a ticket.",
+		params: []apiParam{
+			{name: "top", description: "Ticket of the repo or directory to list, the repos if empty."},
+			{name: "depth", typ: "integer", description: "Levels to list children of."},
+			{name: "full", enum: []string{"1"}, description: "Lists all levels."},
+			{name: "filter", description: "Path globs of the files to keep."},
+			{name: "badge_query", description: "Saved query to count matches of."},
+		},
+		response: reflect.TypeOf(FileTree{}),
+	},
+	"source": {
+		summary: "Returns the content of a file, as text unless format says otherwise.",
+		params: []apiParam{
+			{name: "ticket", required: true},
+			{name: "format", enum: []string{"text", "json", "html", "rendered"}, description: "json responds with UhSource."},
+		},
+		response: reflect.TypeOf(UhSource{}),
+	},
+	"decor": {
+		summary:  "Returns the semantic references in a file, if Kythe covers its repo.",
+		params:   []apiParam{{name: "ticket"}},
+		response: reflect.TypeOf(UhDecors{}),
+	},
+	"search-xref": {
+		summary: "Finds references and definitions of the selection.",
+		params: append(xrefParams[:len(xrefParams):len(xrefParams)],
+			apiParam{name: "target", description: "Kythe ticket of the node to find references of, from a decor."},
+			apiParam{name: "estimate", enum: yesNo},
+			apiParam{name: "forks", enum: []string{"collapse", "expand"}},
+			apiParam{name: "tests", enum: []string{"mixed", "separate"}},
+			apiParam{name: "sort", enum: []string{"score", "path", "repo", "match-count"}},
+			apiParam{name: "calls", enum: yesNo},
+		),
+		response: reflect.TypeOf(UhXRefReply{}),
+	},
+	"live-search": {
+		summary: "Runs xref searches over a WebSocket, exchanging UhLiveQuery and UhLiveReply messages.",
+		params: []apiParam{
+			{name: "casing", enum: xrefCasings},
+			{name: "mode", enum: xrefModes},
+			{name: "ticket"},
+			{name: "scope"},
+		},
+		mediaType: "application/octet-stream",
+	},
+	"suggest": {
+		summary: "Completes a prefix to symbol names.",
+		params: []apiParam{
+			{name: "prefix", required: true},
+			{name: "limit", typ: "integer"},
+			{name: "casing", enum: xrefCasings},
+			{name: "ticket"},
+			{name: "scope"},
+			{name: "lang"},
+		},
+		response: reflect.TypeOf(UhSuggestions{}),
+	},
+	"events": {
+		summary:   "Streams an \"index\" server-sent event, with an UhIndexEvent, for each repo whose index changes.",
+		mediaType: "text/event-stream",
+	},
+	"file-matches": {
+		summary: "Pages through the matches of an xref query in a file.",
+		params: append(xrefParams[:len(xrefParams):len(xrefParams)],
+			apiParam{name: "offset", typ: "integer"},
+			apiParam{name: "limit", typ: "integer"},
+		),
+		response: reflect.TypeOf(UhFileMatches{}),
+	},
+	"search-files": {
+		summary: "Finds files by path terms.",
+		params: []apiParam{
+			{name: "q", required: true},
+			{name: "limit", typ: "integer"},
+		},
+		response: reflect.TypeOf(UhFileSearchReply{}),
+	},
+	"search-repos": {
+		summary: "Finds repos by name terms.",
+		params: []apiParam{
+			{name: "q", required: true},
+			{name: "limit", typ: "integer"},
+		},
+		response: reflect.TypeOf(UhRepoSearchReply{}),
+	},
+	"filesearch": {
+		summary: "Finds files by fuzzy matching their paths.",
+		params: []apiParam{
+			{name: "q", required: true},
+			{name: "limit", typ: "integer"},
+		},
+		response: reflect.TypeOf(UhFileSearchReply{}),
+	},
+	"archive": {
+		summary: "Downloads the files below a ticket as an archive, or estimates its size.",
+		params: []apiParam{
+			{name: "ticket", required: true},
+			{name: "format", enum: []string{"tar.gz", "zip"}},
+			{name: "filter", description: "Path globs of the files to include."},
+			{name: "estimate", enum: []string{"1"}, description: "Responds with UhArchiveEstimate."},
+			{name: "confirm", enum: []string{"1"}, description: "Confirms downloading a large archive."},
+		},
+		response: reflect.TypeOf(UhArchiveEstimate{}),
+	},
+	"outline": {
+		summary:  "Lists the symbols of a file.",
+		params:   []apiParam{{name: "ticket", required: true}},
+		response: reflect.TypeOf(UhOutline{}),
+	},
+	"blame": {
+		summary:  "Returns the commit of each line of a file.",
+		params:   []apiParam{{name: "ticket", required: true}},
+		response: reflect.TypeOf(UhBlame{}),
+	},
+	"diff-refs": {
+		summary:  "Finds references to the identifiers changed by a unified diff, POSTed as the body.",
+		method:   http.MethodPost,
+		params:   []apiParam{{name: "ticket", description: "Ticket of the repo the diff is of."}},
+		response: reflect.TypeOf(UhDiffRefs{}),
+	},
+	"refgraph": {
+		summary: "Returns the graph of references to a symbol, between files or directories.",
+		params: append([]apiParam{
+			{name: "symbol", required: true},
+			{name: "ticket", description: "Ticket of the file the symbol is from, for scope."},
+			scopeParam,
+			{name: "group", enum: []string{"file", "dir", "repo"}},
+			{name: "format", enum: []string{"json", "dot"}},
+		}, excludeParams...),
+		response: reflect.TypeOf(UhRefGraph{}),
+	},
+	"resolve": {
+		summary:  "Resolves a permalink to the file and line it points to.",
+		params:   []apiParam{{name: "permalink", required: true}},
+		response: reflect.TypeOf(UhResolved{}),
+	},
+	"zoekt": {
+		summary: "Runs a Zoekt query as-is, returning the Zoekt result.",
+		params: []apiParam{
+			{name: "q", required: true},
+			{name: "num", typ: "integer"},
+			{name: "context", typ: "integer"},
+			{name: "estimate", enum: yesNo},
+			{name: "whole", enum: []string{"1"}},
+		},
+		response: reflect.TypeOf(zoekt.SearchResult{}),
+	},
+	"grep": {
+		summary: "Searches a pattern, streaming the matching lines like grep.",
+		params: []apiParam{
+			{name: "pattern", required: true},
+			{name: "E", enum: []string{"0", "1"}, description: "Extended regexp."},
+			{name: "i", enum: []string{"0", "1"}, description: "Ignore case."},
+			{name: "w", enum: []string{"0", "1"}, description: "Whole words."},
+			{name: "include", description: "Path globs of the files to search."},
+		},
+		mediaType: "text/plain",
+	},
+	"admin/usage-summary": {
+		summary:  "Summarizes the usage of the server.",
+		response: reflect.TypeOf(UsageSummary{}),
+	},
+	"admin/index": {
+		summary:  "Lists the shards of the index, and the ones that can't be searched.",
+		response: reflect.TypeOf(UhIndexStatus{}),
+	},
+}
+
+// buildOpenAPI returns the OpenAPI 3 document of the enabled endpoints.
+func (s *Server) buildOpenAPI() ([]byte, error) {
+	sg := &schemaGen{schemas: map[string]interface{}{}}
+	paths := map[string]interface{}{}
+	for _, e := range s.endpoints {
+		doc, ok := apiDocs[e.name]
+		if !ok {
+			return nil, fmt.Errorf("endpoint %q has no API doc", e.name)
+		}
+		if s.disabled[e.name] {
+			continue
+		}
+		params := []interface{}{}
+		for _, p := range append(doc.params[:len(doc.params):len(doc.params)], commonParams...) {
+			params = append(params, p.spec())
+		}
+		method := strings.ToLower(doc.method)
+		if method == "" {
+			method = "get"
+		}
+		paths[e.pattern] = map[string]interface{}{
+			method: map[string]interface{}{
+				"operationId": e.name,
+				"summary":     doc.summary,
+				"parameters":  params,
+				"responses": map[string]interface{}{
+					"200":     sg.response(doc),
+					"default": sg.errorResponse(),
+				},
+			},
+		}
+	}
+	paths["/api/capabilities"] = map[string]interface{}{
+		"get": map[string]interface{}{
+			"operationId": "capabilities",
+			"summary":     "Describes what this server offers.",
+			"responses": map[string]interface{}{
+				"200": sg.response(apiDoc{response: reflect.TypeOf(Capabilities{})}),
+			},
+		},
+	}
+	// Message types of live-search and events, for client generators.
+	for _, t := range []reflect.Type{reflect.TypeOf(UhLiveQuery{}), reflect.TypeOf(UhLiveReply{}), reflect.TypeOf(UhIndexEvent{})} {
+		sg.schema(t)
+	}
+
+	version := s.Version
+	if version == "" {
+		version = "dev"
+	}
+	return json.MarshalIndent(map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":   "zoekt-underhood",
+			"version": version,
+		},
+		"paths":      paths,
+		"components": map[string]interface{}{"schemas": sg.schemas},
+	}, "", "  ")
+}
+
+// serveOpenAPI serves the OpenAPI document, for client generators.
+func (s *Server) serveOpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write(s.openAPI)
+}
+
+func (p apiParam) spec() map[string]interface{} {
+	typ := p.typ
+	if typ == "" {
+		typ = "string"
+	}
+	schema := map[string]interface{}{"type": typ}
+	if len(p.enum) > 0 {
+		schema["enum"] = p.enum
+	}
+	res := map[string]interface{}{
+		"name":     p.name,
+		"in":       "query",
+		"required": p.required,
+		"schema":   schema,
+	}
+	if p.description != "" {
+		res["description"] = p.description
+	}
+	return res
+}
+
+// schemaGen derives JSON schemas from Go types the way encoding/json encodes
+// them. Named structs go to the component schemas, and are referenced.
+type schemaGen struct {
+	// Keyed by component name.
+	schemas map[string]interface{}
+}
+
+func (g *schemaGen) response(doc apiDoc) map[string]interface{} {
+	content := map[string]interface{}{}
+	if doc.response != nil {
+		content["application/json"] = map[string]interface{}{"schema": g.schema(doc.response)}
+	}
+	if doc.mediaType != "" {
+		content[doc.mediaType] = map[string]interface{}{"schema": map[string]interface{}{"type": "string"}}
+	}
+	return map[string]interface{}{"description": "OK", "content": content}
+}
+
+// errorResponse is the response of writeError.
+func (g *schemaGen) errorResponse() map[string]interface{} {
+	envelope := reflect.TypeOf(struct {
+		Error *apiError `json:"error"`
+	}{})
+	return map[string]interface{}{
+		"description": "Error, with a code telling what went wrong.",
+		"content": map[string]interface{}{
+			"application/json": map[string]interface{}{"schema": g.schema(envelope)},
+		},
+	}
+}
+
+var (
+	timeType       = reflect.TypeOf(time.Time{})
+	rawMessageType = reflect.TypeOf(json.RawMessage{})
+)
+
+// schema returns the schema of values of t.
+func (g *schemaGen) schema(t reflect.Type) map[string]interface{} {
+	switch t {
+	case timeType:
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case rawMessageType:
+		// Any JSON.
+		return map[string]interface{}{}
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		s := g.schema(t.Elem())
+		if _, ok := s["$ref"]; ok {
+			return map[string]interface{}{"allOf": []interface{}{s}, "nullable": true}
+		}
+		s["nullable"] = true
+		return s
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return map[string]interface{}{"type": "integer", "format": "int32"}
+	case reflect.Int64, reflect.Uint64:
+		return map[string]interface{}{"type": "integer", "format": "int64"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]interface{}{"type": "string", "format": "byte"}
+		}
+		return map[string]interface{}{"type": "array", "items": g.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": g.schema(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return g.structSchema(t)
+		}
+		name := t.Name()
+		if t.PkgPath() != reflect.TypeOf(Server{}).PkgPath() {
+			// Like "zoekt.FileMatch".
+			name = t.String()
+		}
+		if _, ok := g.schemas[name]; !ok {
+			// Set first, for recursive types.
+			g.schemas[name] = nil
+			g.schemas[name] = g.structSchema(t)
+		}
+		return map[string]interface{}{"$ref": "#/components/schemas/" + name}
+	}
+	// Interfaces, and others not encodable.
+	return map[string]interface{}{}
+}
+
+// structSchema returns the schema of the JSON object of struct type t.
+func (g *schemaGen) structSchema(t reflect.Type) map[string]interface{} {
+	props := map[string]interface{}{}
+	var required []string
+	g.fields(t, props, &required)
+	res := map[string]interface{}{"type": "object", "properties": props}
+	if len(required) > 0 {
+		sort.Strings(required)
+		res["required"] = required
+	}
+	return res
+}
+
+// fields adds the properties of the fields of t, following embedded structs.
+func (g *schemaGen) fields(t reflect.Type, props map[string]interface{}, required *[]string) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, opts := tag, ""
+		if j := strings.Index(tag, ","); j >= 0 {
+			name, opts = tag[:j], tag[j:]
+		}
+		if f.Anonymous && name == "" {
+			ft := f.Type
+			if ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				g.fields(ft, props, required)
+				continue
+			}
+		}
+		if f.PkgPath != "" {
+			// Unexported.
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		props[name] = g.schema(f.Type)
+		if !strings.Contains(opts, ",omitempty") {
+			*required = append(*required, name)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package web
+
+import (
+	"net/http"
+	"sort"
+)
+
+// Orders of xref results selectable with the sort parameter.
+const (
+	sortScore      = "score"
+	sortPath       = "path"
+	sortRepo       = "repo"
+	sortMatchCount = "match-count"
+)
+
+// xrefSort returns the order of the sort parameter, or "" for the default
+// order (see serveSearchXrefErr and SearchConfig.RankExpr).
+func xrefSort(r *http.Request) (string, error) {
+	ss, ok := r.URL.Query()["sort"]
+	if !ok {
+		return "", nil
+	}
+	switch ss[0] {
+	case sortScore, sortPath, sortRepo, sortMatchCount:
+		return ss[0], nil
+	}
+	return "", errorf(ErrParamInvalid, "unknown sort %q, want one of score, path, repo, match-count", ss[0])
+}
+
+// sortFileSites orders the file sites: by descending Zoekt score, by path
+// (then repo), by repo (then path), or by descending number of matching
+// lines. Ties keep the existing order.
+func (s *Server) sortFileSites(sites []fileSites, order string) {
+	tickets := make([]ticket, len(sites))
+	for i, fs := range sites {
+		tickets[i], _ = s.knownTicket(fs.containingFile.FileTicket)
+	}
+	idx := make([]int, len(sites))
+	for i := range idx {
+		idx[i] = i
+	}
+	sort.SliceStable(idx, func(i, j int) bool {
+		a, b := idx[i], idx[j]
+		ta, tb := tickets[a], tickets[b]
+		switch order {
+		case sortScore:
+			return sites[a].score > sites[b].score
+		case sortPath:
+			if ta.path != tb.path {
+				return ta.path < tb.path
+			}
+			return ta.repo < tb.repo
+		case sortRepo:
+			if ta.repo != tb.repo {
+				return ta.repo < tb.repo
+			}
+			return ta.path < tb.path
+		case sortMatchCount:
+			return sites[a].totalMatches > sites[b].totalMatches
+		}
+		return false
+	})
+	sorted := make([]fileSites, len(sites))
+	for i, k := range idx {
+		sorted[i] = sites[k]
+	}
+	copy(sites, sorted)
+}
@@ -0,0 +1,137 @@
+package web
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"unicode/utf8"
+
+	"github.com/google/zoekt"
+	"github.com/google/zoekt/query"
+)
+
+// Above this many symbols an outline is cut.
+const maxOutlineSymbols = 10000
+
+// UhOutline is the response of /api/outline.
+type UhOutline struct {
+	Ticket string `json:"ticket"`
+	// In order of appearance in the file.
+	Symbols []UhSymbol `json:"symbols"`
+	// True if there were more than maxOutlineSymbols symbols.
+	Truncated bool `json:"truncated"`
+}
+
+// UhSymbol is a symbol as extracted by ctags at indexing.
+type UhSymbol struct {
+	Name string `json:"name"`
+	// Like "function" or "type", depending on the ctags parser of the
+	// language.
+	Kind string `json:"kind"`
+	// Enclosing symbol, if any, like the class of a method.
+	Parent     string `json:"parent"`
+	ParentKind string `json:"parentKind"`
+	// Span of the name. Unlike in snippets, Ch is in characters.
+	Span CmRange `json:"span"`
+}
+
+func (s *Server) serveOutline(w http.ResponseWriter, r *http.Request) {
+	if err := s.serveOutlineErr(w, r); err != nil {
+		writeError(w, err)
+	}
+}
+
+// serveOutlineErr lists the symbols of a file, which Zoekt stores if the index
+// was built with ctags. Files without symbols get an empty outline.
+func (s *Server) serveOutlineErr(w http.ResponseWriter, r *http.Request) error {
+	log.Printf("request: %v", r.URL)
+	tickets, ok := r.URL.Query()["ticket"]
+	if !ok || len(tickets) > 1 {
+		return errorf(ErrParamMissing, "expected ticket parameter")
+	}
+	t, err := s.parseTicket(r.Context(), tickets[0])
+	if err != nil {
+		return err
+	}
+	if !t.complete() {
+		return errorf(ErrTicketFormat, "Expected a file ticket, with repo and path")
+	}
+
+	// Matches every symbol at its start.
+	rq := "case:yes " + fileAtoms(t) + " sym:^."
+	log.Printf("query: %v", rq)
+	q, err := query.Parse(rq)
+	if err != nil {
+		return errorf(ErrQueryParse, "%v (query: %v)", err, rq)
+	}
+	n := maxOutlineSymbols + 1
+	sOpts := zoekt.SearchOptions{
+		MaxWallTime:            s.maxWallTime(r.Context()),
+		ShardMaxMatchCount:     n,
+		TotalMaxMatchCount:     n,
+		ShardMaxImportantMatch: n,
+		TotalMaxImportantMatch: n,
+	}
+	result, err := s.Searcher.Search(r.Context(), q, &sOpts)
+	if err != nil {
+		return err
+	}
+
+	res := UhOutline{
+		Ticket:  s.fileTicket(t.repo, t.branch, t.path),
+		Symbols: []UhSymbol{},
+	}
+	for i := range result.Files {
+		f := &result.Files[i]
+		if !t.matchesFile(f) || f.FileName != t.path {
+			continue
+		}
+		for _, l := range f.LineMatches {
+			for _, frag := range l.LineFragments {
+				if frag.SymbolInfo == nil {
+					continue
+				}
+				res.Symbols = append(res.Symbols, outlineSymbol(l, frag))
+			}
+		}
+	}
+	sort.SliceStable(res.Symbols, func(i, j int) bool {
+		a, b := res.Symbols[i].Span.From, res.Symbols[j].Span.From
+		if a.Line != b.Line {
+			return a.Line < b.Line
+		}
+		return a.Ch < b.Ch
+	})
+	if len(res.Symbols) > maxOutlineSymbols {
+		res.Symbols = res.Symbols[:maxOutlineSymbols]
+		res.Truncated = true
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	return json.NewEncoder(w).Encode(res)
+}
+
+// outlineSymbol converts the symbol match frag of line l.
+func outlineSymbol(l zoekt.LineMatch, frag zoekt.LineFragmentMatch) UhSymbol {
+	sym := frag.SymbolInfo
+	start := frag.LineOffset
+	end := start + len(sym.Sym)
+	if end > len(l.Line) {
+		// Symbol name not verbatim in the line, shouldn't happen.
+		end = len(l.Line)
+	}
+	lineNum := l.LineNumber - 1
+	from := utf8.RuneCount(l.Line[:start])
+	return UhSymbol{
+		Name:       sym.Sym,
+		Kind:       sym.Kind,
+		Parent:     sym.Parent,
+		ParentKind: sym.ParentKind,
+		Span: CmRange{
+			From: CmPoint{Line: lineNum, Ch: from},
+			To:   CmPoint{Line: lineNum, Ch: from + utf8.RuneCount(l.Line[start:end])},
+		},
+	}
+}
@@ -0,0 +1,41 @@
+package web
+
+import (
+	"context"
+
+	"github.com/google/zoekt"
+)
+
+// Values of UhXRefReply.PartialReason.
+const (
+	// The time budget of the profile (or the search stage) ran out.
+	partialTimeout = "timeout"
+	// The request was canceled, like by the client going away.
+	partialCanceled = "canceled"
+)
+
+// cutShort returns why a search with opts, having stats st, stopped before
+// reaching its match limits, or "" if it didn't. Zoekt returns what it found
+// when MaxWallTime passes, skipping the shards not yet searched.
+func cutShort(ctx context.Context, opts *zoekt.SearchOptions, st *zoekt.Stats) string {
+	if reason := ctxCutShort(ctx); reason != "" {
+		return reason
+	}
+	if st.ShardsSkipped > 0 || opts.MaxWallTime > 0 && st.Duration >= opts.MaxWallTime {
+		return partialTimeout
+	}
+	return ""
+}
+
+// ctxCutShort returns why ctx is done, or "" if it isn't. Searches failing
+// with ctx done have their earlier results returned as partial ones.
+func ctxCutShort(ctx context.Context) string {
+	switch ctx.Err() {
+	case nil:
+		return ""
+	case context.DeadlineExceeded:
+		return partialTimeout
+	default:
+		return partialCanceled
+	}
+}
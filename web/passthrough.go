@@ -0,0 +1,102 @@
+package web
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/google/zoekt"
+)
+
+// Files returned by /api/zoekt unless the num parameter says otherwise, and
+// the most it may ask for.
+const (
+	defaultZoektFiles = 500
+	maxZoektFiles     = 5000
+)
+
+// Most context lines /api/zoekt returns around line matches.
+const maxZoektContextLines = 10
+
+func (s *Server) serveZoekt(w http.ResponseWriter, r *http.Request) {
+	if err := s.serveZoektErr(w, r); err != nil {
+		writeError(w, err)
+	}
+}
+
+// serveZoektErr runs the Zoekt query of the q parameter as-is, and returns
+// the native zoekt.SearchResult, for scripts using the server as a general
+// search API. Match limits are chosen like for xref searches (see
+// searchLimits).
+//
+// Options: num (files to return), estimate=yes|no (like for search-xref),
+// whole=1 (return file contents) and context (lines around matches).
+func (s *Server) serveZoektErr(w http.ResponseWriter, r *http.Request) error {
+	log.Printf("request: %v", r.URL)
+	qs, ok := r.URL.Query()["q"]
+	if !ok {
+		return errorf(ErrParamMissing, "Expected q parameter")
+	}
+	q, rq, err := parseUserQuery("q", qs[0], func(q string) string { return q })
+	if err != nil {
+		return err
+	}
+	log.Printf("query: %v", rq)
+
+	num, err := intParam(r, "num", defaultZoektFiles)
+	if err != nil {
+		return err
+	}
+	if num < 1 || num > maxZoektFiles {
+		return errorf(ErrLimitExceeded, "num must be between 1 and %d", maxZoektFiles)
+	}
+	contextLines, err := intParam(r, "context", 0)
+	if err != nil {
+		return err
+	}
+	if contextLines > maxZoektContextLines {
+		return errorf(ErrLimitExceeded, "context must be at most %d", maxZoektContextLines)
+	}
+	estimate := !s.Config.Search.SkipEstimate
+	if es, ok := r.URL.Query()["estimate"]; ok {
+		switch es[0] {
+		case "yes":
+			estimate = true
+		case "no":
+			estimate = false
+		default:
+			return errorf(ErrParamInvalid, "unknown estimate %q, want one of yes, no", es[0])
+		}
+	}
+
+	ctx, done := s.stage(r.Context(), stageSearch)
+	lim, err := s.searchLimits(ctx, q, estimate, num)
+	if err != nil {
+		done()
+		return err
+	}
+	result := &zoekt.SearchResult{Stats: lim.estimateStats}
+	if lim.name != limitsEmptyCorpus {
+		sOpts := lim.opts
+		sOpts.Whole = r.URL.Query().Get("whole") == "1"
+		sOpts.NumContextLines = contextLines
+		result, err = s.search(ctx, q, &sOpts)
+	}
+	done()
+	if err != nil {
+		return err
+	}
+
+	_, done = s.stage(r.Context(), stageEncode)
+	var buf bytes.Buffer
+	err = json.NewEncoder(&buf).Encode(result)
+	done()
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	_, err = buf.WriteTo(w)
+	return err
+}
@@ -0,0 +1,153 @@
+package web
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/google/zoekt"
+)
+
+// Permalink resolution outcomes, see UhResolved.Status.
+const (
+	// The line is still at its place.
+	resolvedExact = "exact"
+	// The line was found elsewhere in the file, nearest to its old place.
+	resolvedMoved = "moved"
+	// The line is gone. The old line number is returned, clamped to the file.
+	resolvedLost = "lost"
+)
+
+// UhResolved is the response of /api/resolve.
+type UhResolved struct {
+	Ticket string `json:"ticket"`
+	// 1-based line number in the current version of the file.
+	Line   int    `json:"line"`
+	Status string `json:"status"`
+	// The current content of the line.
+	Text string `json:"text"`
+}
+
+// permalink is a decoded snippet permalink token.
+type permalink struct {
+	ticket string
+	// 1-based.
+	line int
+	hash string
+}
+
+// lineHash hashes the content of a line, ignoring surrounding whitespace so
+// reindenting doesn't lose it.
+func lineHash(line []byte) string {
+	h := sha1.Sum(bytes.TrimSpace(line))
+	return hex.EncodeToString(h[:8])
+}
+
+// snippetPermalink returns the permalink token of the line of a file in a
+// search result. Tokens are opaque to clients.
+func (s *Server) snippetPermalink(f *zoekt.FileMatch, l zoekt.LineMatch) string {
+	p := s.fileTicket(f.Repository, "", f.FileName) + "\n" + strconv.Itoa(l.LineNumber) + "\n" + lineHash(l.Line)
+	return base64.RawURLEncoding.EncodeToString([]byte(p))
+}
+
+func parsePermalink(token string) (permalink, error) {
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return permalink{}, errorf(ErrParamInvalid, "malformed permalink %q", token)
+	}
+	parts := strings.Split(string(b), "\n")
+	if len(parts) != 3 {
+		return permalink{}, errorf(ErrParamInvalid, "malformed permalink %q", token)
+	}
+	line, err := strconv.Atoi(parts[1])
+	if err != nil || line < 1 {
+		return permalink{}, errorf(ErrParamInvalid, "malformed permalink %q", token)
+	}
+	return permalink{ticket: parts[0], line: line, hash: parts[2]}, nil
+}
+
+func (s *Server) serveResolve(w http.ResponseWriter, r *http.Request) {
+	if err := s.serveResolveErr(w, r); err != nil {
+		writeError(w, err)
+	}
+}
+
+// serveResolveErr re-anchors a snippet permalink (see
+// UhSnippet.Permalink) in the current version of the file, after reindexing
+// shifted or changed lines.
+func (s *Server) serveResolveErr(w http.ResponseWriter, r *http.Request) error {
+	log.Printf("request: %v", r.URL)
+	tokens, ok := r.URL.Query()["permalink"]
+	if !ok {
+		return errorf(ErrParamMissing, "Expected permalink parameter")
+	}
+	p, err := parsePermalink(tokens[0])
+	if err != nil {
+		return err
+	}
+	t, err := s.parseTicket(r.Context(), p.ticket)
+	if err != nil {
+		return err
+	}
+	if !t.complete() {
+		return errorf(ErrTicketFormat, "Expected a file ticket, with repo and path")
+	}
+	ctx, done := s.stage(r.Context(), stageFetch)
+	f, err := s.indexedFile(ctx, t, true)
+	done()
+	if err != nil {
+		return err
+	}
+
+	lines := bytes.Split(bytes.TrimSuffix(f.Content, []byte("\n")), []byte("\n"))
+	res := UhResolved{
+		Ticket: p.ticket,
+		Line:   reanchorLine(lines, p.line, p.hash),
+		Status: resolvedLost,
+	}
+	switch {
+	case p.line <= len(lines) && lineHash(lines[p.line-1]) == p.hash:
+		res.Status = resolvedExact
+	case res.Line > 0:
+		res.Status = resolvedMoved
+	default:
+		res.Line = p.line
+		if res.Line > len(lines) {
+			res.Line = len(lines)
+		}
+	}
+	res.Text = string(lines[res.Line-1])
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	return json.NewEncoder(w).Encode(res)
+}
+
+// reanchorLine returns the 1-based number of the line with the hash nearest
+// to line, or 0 if none has it. Ties go to the earlier line.
+func reanchorLine(lines [][]byte, line int, hash string) int {
+	best := 0
+	for i, l := range lines {
+		n := i + 1
+		if lineHash(l) != hash {
+			continue
+		}
+		if best == 0 || abs(n-line) < abs(best-line) {
+			best = n
+		}
+	}
+	return best
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
@@ -0,0 +1,30 @@
+package web
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestReanchorLine(t *testing.T) {
+	lines := bytes.Split([]byte("a\nx := 1\nb\n\tx := 1  \nc\nd\nx := 1\ne"), []byte("\n"))
+	for _, tc := range []struct {
+		name   string
+		line   int
+		anchor string
+		want   int
+	}{
+		{name: "in place", line: 2, anchor: "x := 1", want: 2},
+		{name: "moved down", line: 1, anchor: "x := 1", want: 2},
+		{name: "nearest, ignoring indentation", line: 5, anchor: "x := 1", want: 4},
+		{name: "tie goes to the earlier", line: 3, anchor: "x := 1", want: 2},
+		{name: "past the end", line: 20, anchor: "x := 1", want: 7},
+		{name: "unique", line: 7, anchor: "a", want: 1},
+		{name: "gone", line: 2, anchor: "y := 2", want: 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := reanchorLine(lines, tc.line, lineHash([]byte(tc.anchor))); got != tc.want {
+				t.Errorf("reanchorLine(%d, %q) = %d, want %d", tc.line, tc.anchor, got, tc.want)
+			}
+		})
+	}
+}
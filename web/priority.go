@@ -0,0 +1,133 @@
+package web
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+)
+
+// Repo priority tiers, see SearchConfig.RepoPriorities. Higher is better.
+const (
+	tierBronze = iota
+	tierSilver
+	tierGold
+)
+
+var tierNames = map[string]int{
+	"bronze": tierBronze,
+	"silver": tierSilver,
+	"gold":   tierGold,
+}
+
+// Gold repos get this many times the per-shard match budget of the rest.
+const goldBudgetFactor = 4
+
+// repoTiers assigns priority tiers to repos.
+type repoTiers struct {
+	tiers map[string]int
+	// Sorted, for a stable query.
+	gold []string
+}
+
+func newRepoTiers(priorities map[string]string) (*repoTiers, error) {
+	t := &repoTiers{tiers: map[string]int{}}
+	for repo, name := range priorities {
+		tier, ok := tierNames[name]
+		if !ok {
+			return nil, fmt.Errorf("repo priority of %q: unknown tier %q, want one of gold, silver, bronze", repo, name)
+		}
+		t.tiers[repo] = tier
+		if tier == tierGold {
+			t.gold = append(t.gold, repo)
+		}
+	}
+	sort.Strings(t.gold)
+	return t, nil
+}
+
+// tier returns the tier of the repo. Repos not configured are silver.
+func (t *repoTiers) tier(repo string) int {
+	if tier, ok := t.tiers[repo]; ok {
+		return tier
+	}
+	return tierSilver
+}
+
+// goldAtom returns a Zoekt query atom matching exactly the gold repos, or ""
+// if there are none.
+func (t *repoTiers) goldAtom() string {
+	if len(t.gold) == 0 {
+		return ""
+	}
+	return reposAtom(t.gold)
+}
+
+// canonicalRepos ranks repos by preference for holding the canonical copy of
+// duplicate files, see SearchConfig.CanonicalRepos.
+type canonicalRepos struct {
+	patterns []*regexp.Regexp
+}
+
+func newCanonicalRepos(patterns []string) (*canonicalRepos, error) {
+	c := &canonicalRepos{}
+	for _, p := range patterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, fmt.Errorf("canonical repo pattern %q: %v", p, err)
+		}
+		c.patterns = append(c.patterns, re)
+	}
+	return c, nil
+}
+
+// rank returns the index of the first pattern matching repo, or the number of
+// patterns if none does. Lower is preferred.
+func (c *canonicalRepos) rank(repo string) int {
+	for i, re := range c.patterns {
+		if re.MatchString(repo) {
+			return i
+		}
+	}
+	return len(c.patterns)
+}
+
+// canonicalCopies picks the canonical file among sites with the same content,
+// returning its index keyed by checksum. Preferred are files of repos ranked
+// higher by SearchConfig.CanonicalRepos, then of repos not configured as
+// forks, then of higher tiers, then the earlier ones.
+func (s *Server) canonicalCopies(sites []fileSites) map[string]int {
+	res := map[string]int{}
+	type key struct {
+		rank   int
+		fork   bool
+		tier   int
+		parsed bool
+	}
+	keys := make([]key, len(sites))
+	for i, fs := range sites {
+		t, err := s.knownTicket(fs.containingFile.FileTicket)
+		if err != nil {
+			continue
+		}
+		_, fork := s.Config.Search.Forks[t.repo]
+		keys[i] = key{s.canonicalRepos.rank(t.repo), fork, s.repoTiers.tier(t.repo), true}
+	}
+	better := func(a, b key) bool {
+		switch {
+		case a.parsed != b.parsed:
+			return a.parsed
+		case a.rank != b.rank:
+			return a.rank < b.rank
+		case a.fork != b.fork:
+			return !a.fork
+		}
+		return a.tier > b.tier
+	}
+	for i, fs := range sites {
+		c := string(fs.fileChecksum)
+		if best, ok := res[c]; !ok || better(keys[i], keys[best]) {
+			res[c] = i
+		}
+	}
+	return res
+}
@@ -0,0 +1,190 @@
+package web
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Name of the profile used unless configured otherwise (see
+// Config.DefaultProfile).
+const defaultProfileName = "interactive"
+
+// SearchProfile bundles the settings of how hard searches try. Requests pick
+// one with the profile parameter. Zero fields are inherited from the built-in
+// profile of the same name, if any, or else from the default profile.
+type SearchProfile struct {
+	// Time budget of requests, like "10s". Split into deadlines of the request
+	// stages, see stageShares.
+	Budget string `json:"budget"`
+
+	// Files returned by xref searches.
+	MaxFiles int `json:"maxFiles"`
+
+	// Multiplies the per-shard and total match limits of searches, see
+	// searchLimits.
+	MatchLimitFactor float64 `json:"matchLimitFactor"`
+
+	// Ranking expression of xref results, see SearchConfig.RankExpr.
+	RankExpr string `json:"rankExpr"`
+}
+
+// builtinProfiles are the profiles available without configuration. The
+// interactive one takes its budget and ranking from Config.RequestBudget and
+// SearchConfig.RankExpr.
+var builtinProfiles = map[string]SearchProfile{
+	"interactive": {MaxFiles: 500, MatchLimitFactor: 1},
+	"thorough":    {Budget: "60s", MaxFiles: 5000, MatchLimitFactor: 10},
+	"ci":          {Budget: "30s", MaxFiles: 2000, MatchLimitFactor: 4},
+}
+
+// searchProfile is a SearchProfile with all settings resolved.
+type searchProfile struct {
+	budget           time.Duration
+	maxFiles         int
+	matchLimitFactor float64
+	// Nil for the default order.
+	rankExpr rankExpr
+}
+
+type profileKey struct{}
+
+// withProfile returns a context for requests searching with profile p.
+func withProfile(ctx context.Context, p *searchProfile) context.Context {
+	return context.WithValue(ctx, profileKey{}, p)
+}
+
+// profile returns the profile of the request of ctx, or the default one.
+func (s *Server) profile(ctx context.Context) *searchProfile {
+	if p, ok := ctx.Value(profileKey{}).(*searchProfile); ok {
+		return p
+	}
+	return s.profiles[s.defaultProfile]
+}
+
+// requestProfile returns the profile selected by the profile parameter of r,
+// or the default one.
+func (s *Server) requestProfile(r *http.Request) (*searchProfile, error) {
+	ps, ok := r.URL.Query()["profile"]
+	if !ok {
+		return s.profiles[s.defaultProfile], nil
+	}
+	if p, ok := s.profiles[ps[0]]; ok {
+		return p, nil
+	}
+	return nil, errorf(ErrParamInvalid, "unknown profile %q, want one of %v", ps[0], strings.Join(s.profileNames(), ", "))
+}
+
+// requestDeadline returns the deadline_ms parameter of r, or zero if not
+// given. Clients set it to the time they are willing to wait, so searches
+// stop once the client gave up.
+func requestDeadline(r *http.Request) (time.Duration, error) {
+	ds, ok := r.URL.Query()["deadline_ms"]
+	if !ok {
+		return 0, nil
+	}
+	ms, err := strconv.Atoi(ds[0])
+	if err != nil || ms < 1 {
+		return 0, errorf(ErrParamInvalid, "expected positive integer deadline_ms, got %q", ds[0])
+	}
+	return time.Duration(ms) * time.Millisecond, nil
+}
+
+// withDeadline returns p with its budget cut to d, if that's shorter, so the
+// request stages are split within d. Zero d means no deadline.
+func (p *searchProfile) withDeadline(d time.Duration) *searchProfile {
+	if d == 0 || d >= p.budget {
+		return p
+	}
+	cut := *p
+	cut.budget = d
+	return &cut
+}
+
+func (s *Server) profileNames() []string {
+	var names []string
+	for name := range s.profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// initProfiles resolves the built-in and configured profiles.
+func (s *Server) initProfiles() error {
+	base := builtinProfiles[defaultProfileName]
+	base.Budget = s.Config.RequestBudget
+	if base.Budget == "" {
+		base.Budget = defaultRequestBudget.String()
+	}
+	base.RankExpr = s.Config.Search.RankExpr
+
+	specs := map[string]SearchProfile{}
+	for name, p := range builtinProfiles {
+		specs[name] = p
+	}
+	specs[defaultProfileName] = base
+	for name, p := range s.Config.Profiles {
+		specs[name] = inheritProfile(p, specs[name])
+	}
+	def := specs[defaultProfileName]
+	s.profiles = map[string]*searchProfile{}
+	for name, spec := range specs {
+		spec = inheritProfile(spec, def)
+		p := &searchProfile{
+			maxFiles:         spec.MaxFiles,
+			matchLimitFactor: spec.MatchLimitFactor,
+		}
+		d, err := time.ParseDuration(spec.Budget)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("budget %q of profile %q: want a positive duration like \"10s\"", spec.Budget, name)
+		}
+		p.budget = d
+		if spec.MaxFiles < 0 || spec.MatchLimitFactor < 0 {
+			return fmt.Errorf("profile %q: negative limits", name)
+		}
+		if spec.RankExpr != "" {
+			p.rankExpr, err = compileRankExpr(spec.RankExpr)
+			if err != nil {
+				return fmt.Errorf("rank expression of profile %q: %v", name, err)
+			}
+		}
+		s.profiles[name] = p
+	}
+
+	s.defaultProfile = defaultProfileName
+	if name := s.Config.DefaultProfile; name != "" {
+		if _, ok := s.profiles[name]; !ok {
+			return fmt.Errorf("unknown default profile %q, want one of %v", name, strings.Join(s.profileNames(), ", "))
+		}
+		s.defaultProfile = name
+	}
+	return nil
+}
+
+// inheritProfile fills the zero fields of p from base.
+func inheritProfile(p, base SearchProfile) SearchProfile {
+	if p.Budget == "" {
+		p.Budget = base.Budget
+	}
+	if p.MaxFiles == 0 {
+		p.MaxFiles = base.MaxFiles
+	}
+	if p.MatchLimitFactor == 0 {
+		p.MatchLimitFactor = base.MatchLimitFactor
+	}
+	if p.RankExpr == "" {
+		p.RankExpr = base.RankExpr
+	}
+	return p
+}
+
+// maxWallTime returns the Zoekt MaxWallTime for searches within the stage of
+// ctx, given the budget of the request's profile. See wallTime.
+func (s *Server) maxWallTime(ctx context.Context) time.Duration {
+	return wallTime(ctx, s.profile(ctx).budget)
+}
@@ -0,0 +1,128 @@
+package web
+
+import (
+	"fmt"
+	"regexp/syntax"
+	"strings"
+
+	"github.com/google/zoekt/query"
+)
+
+// Hints about the query construct causing a parse error, keyed by a fragment
+// of the Zoekt parse error message.
+var parseErrorHints = []struct {
+	fragment string
+	hint     string
+}{
+	{"unterminated quoted string", `a double quote (") starts a quoted phrase, which needs a closing quote`},
+	{"'-' operator needs an argument", `a "-" negates the term after it, which is missing`},
+	{"OR operator should have operand", `"or" is an operator, and needs terms on both sides`},
+	{"missing close paren", "unbalanced parenthesis"},
+	{"missing closing )", "unbalanced parenthesis"},
+	{"missing closing ]", "unbalanced bracket"},
+	{"error parsing regexp", "the text is interpreted as a regular expression"},
+	{"unknown case argument", "case: accepts yes, no or auto"},
+}
+
+// Inputs longer than this are not searched for the error position, as that
+// parses each prefix.
+const maxErrorPositionInput = 1000
+
+// parseUserQuery parses the query that build constructs from the value of the
+// request parameter param. On failure, the error refers to the user's input
+// (the first character from which on it can't be parsed, and a hint about the
+// construct at fault) instead of the internal query string.
+//
+// Returns the query string too, for logging.
+func parseUserQuery(param, value string, build func(string) string) (query.Q, string, error) {
+	rq := build(value)
+	q, err := query.Parse(rq)
+	if err == nil {
+		return q, rq, nil
+	}
+
+	hint := ""
+	for _, h := range parseErrorHints {
+		if strings.Contains(err.Error(), h.fragment) {
+			hint = "; " + h.hint
+			break
+		}
+	}
+
+	runes := []rune(value)
+	if len(runes) > maxErrorPositionInput {
+		return nil, rq, errorf(ErrQueryParse, "%v %q can't be searched: %v%v", param, value, err, hint)
+	}
+	// Find where the trouble starts: the input is fine up to some prefix, and
+	// all longer prefixes fail.
+	pos := 0
+	for i := len(runes) - 1; i >= 0; i-- {
+		if _, err := query.Parse(build(string(runes[:i]))); err == nil {
+			pos = i
+			break
+		}
+	}
+	return nil, rq, errorf(ErrQueryParse, "%v %q can't be searched, problem at character %d (%q): %v%v",
+		param, value, pos+1, string(runes[pos:min(pos+10, len(runes))]), err, hint)
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// UhSyntaxError details why a regexp can't be parsed.
+type UhSyntaxError struct {
+	// Kind of problem, a regexp/syntax error code like "missing closing )".
+	Kind string `json:"kind"`
+	// The offending part of the regexp.
+	Expr string `json:"expr"`
+	// Character offset of Expr in the regexp, or -1 if not known.
+	Offset int `json:"offset"`
+}
+
+// parseUserRegexp parses the value of the request parameter param as a
+// regexp, the way Zoekt parses regex: atoms. Failures are reported as
+// ErrRegexpSyntax, with the details in apiError.Syntax.
+func parseUserRegexp(param, value string) (*syntax.Regexp, error) {
+	re, err := syntax.Parse(value, zoektRegexpFlags)
+	if err == nil {
+		return re, nil
+	}
+	se, ok := err.(*syntax.Error)
+	if !ok {
+		return nil, errorf(ErrRegexpSyntax, "%v %q is not a valid regexp: %v", param, value, err)
+	}
+	detail := &UhSyntaxError{Kind: string(se.Code), Expr: se.Expr, Offset: -1}
+	// Expr is the rest of the pattern from the problem on for most codes, or
+	// else a fragment at the problem.
+	if i := strings.LastIndex(value, se.Expr); i >= 0 && se.Expr != "" {
+		detail.Offset = len([]rune(value[:i]))
+	}
+	return nil, &apiError{
+		Code:    ErrRegexpSyntax,
+		Message: fmt.Sprintf("%v %q is not a valid regexp: %v", param, value, err),
+		Syntax:  detail,
+	}
+}
+
+// Flags of Zoekt's query parser for regexps.
+const zoektRegexpFlags = syntax.ClassNL | syntax.PerlX | syntax.UnicodeGroups
+
+// QuoteQueryString quotes s as a Zoekt query string literal, so that it's
+// taken as-is, like the argument of a regex: atom. Needed for arguments which
+// may contain spaces or quotes, like file paths and branch names.
+func QuoteQueryString(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for _, c := range s {
+		if c == '"' || c == '\\' {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(c)
+	}
+	b.WriteByte('"')
+	return b.String()
+}
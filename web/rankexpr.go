@@ -0,0 +1,311 @@
+package web
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Ranking expressions let operators define the order of xref results without
+// code changes. The language is small: numbers, signal names, arithmetic
+// (+ - * /), comparisons and logic (< <= > >= == != && || !, yielding 1 or
+// 0), the conditional "c ? a : b", parentheses, and the functions log(x)
+// (natural log of 1+x), min(a, b) and max(a, b).
+//
+// Example: "score + 1000*same_repo - 50*test - 10*depth"
+//
+// Files are ordered by descending value, ties keep the default order.
+
+// Signals available to ranking expressions, with their descriptions.
+var rankSignals = map[string]string{
+	"score":         "Zoekt's score of the file",
+	"depth":         "number of directories in the file path",
+	"test":          "1 if the file looks like a test, else 0",
+	"generated":     "1 if the file path matches the generated config, else 0",
+	"repo_priority": "priority of the repo from its Zoekt config",
+	"tier":          "priority tier of the repo from the config: 2 gold, 1 silver, 0 bronze",
+	"matches":       "number of matching lines in the file",
+	"same_repo":     "1 if the file is in the repo of the request ticket, else 0",
+	"same_file":     "1 if the file is the one of the request ticket, else 0",
+}
+
+// rankExpr is a compiled ranking expression, evaluated over signal values.
+type rankExpr func(signals map[string]float64) float64
+
+func boolVal(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// compileRankExpr parses the expression, checking that it only refers to
+// known signals.
+func compileRankExpr(src string) (rankExpr, error) {
+	p := &rankParser{src: src}
+	p.next()
+	e, err := p.parseExpr()
+	if err != nil {
+		return nil, fmt.Errorf("rank expression %q: %v", src, err)
+	}
+	if p.tok != "" {
+		return nil, fmt.Errorf("rank expression %q: unexpected %q", src, p.tok)
+	}
+	return e, nil
+}
+
+type rankParser struct {
+	src string
+	pos int
+	// Current token, empty at end of input.
+	tok string
+}
+
+// next advances to the next token.
+func (p *rankParser) next() {
+	for p.pos < len(p.src) && unicode.IsSpace(rune(p.src[p.pos])) {
+		p.pos++
+	}
+	if p.pos >= len(p.src) {
+		p.tok = ""
+		return
+	}
+	start := p.pos
+	c := p.src[p.pos]
+	switch {
+	case c >= '0' && c <= '9' || c == '.':
+		for p.pos < len(p.src) && (p.src[p.pos] >= '0' && p.src[p.pos] <= '9' || p.src[p.pos] == '.') {
+			p.pos++
+		}
+	case c == '_' || unicode.IsLetter(rune(c)):
+		for p.pos < len(p.src) && (p.src[p.pos] == '_' || unicode.IsLetter(rune(p.src[p.pos])) || unicode.IsDigit(rune(p.src[p.pos]))) {
+			p.pos++
+		}
+	default:
+		p.pos++
+		for _, op := range []string{"<=", ">=", "==", "!=", "&&", "||"} {
+			if strings.HasPrefix(p.src[start:], op) {
+				p.pos = start + 2
+				break
+			}
+		}
+	}
+	p.tok = p.src[start:p.pos]
+}
+
+func (p *rankParser) expect(tok string) error {
+	if p.tok != tok {
+		return fmt.Errorf("expected %q, got %q", tok, p.tok)
+	}
+	p.next()
+	return nil
+}
+
+func (p *rankParser) parseExpr() (rankExpr, error) {
+	cond, err := p.parseBinary(0)
+	if err != nil {
+		return nil, err
+	}
+	if p.tok != "?" {
+		return cond, nil
+	}
+	p.next()
+	a, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect(":"); err != nil {
+		return nil, err
+	}
+	b, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+	return func(s map[string]float64) float64 {
+		if cond(s) != 0 {
+			return a(s)
+		}
+		return b(s)
+	}, nil
+}
+
+// Binary operators by precedence level, lowest first.
+var rankBinaryOps = [][]string{
+	{"||"},
+	{"&&"},
+	{"<", "<=", ">", ">=", "==", "!="},
+	{"+", "-"},
+	{"*", "/"},
+}
+
+func (p *rankParser) parseBinary(level int) (rankExpr, error) {
+	if level == len(rankBinaryOps) {
+		return p.parseUnary()
+	}
+	lhs, err := p.parseBinary(level + 1)
+	if err != nil {
+		return nil, err
+	}
+	for containsString(rankBinaryOps[level], p.tok) {
+		op := p.tok
+		p.next()
+		rhs, err := p.parseBinary(level + 1)
+		if err != nil {
+			return nil, err
+		}
+		lhs = binaryRankExpr(op, lhs, rhs)
+	}
+	return lhs, nil
+}
+
+func binaryRankExpr(op string, a, b rankExpr) rankExpr {
+	switch op {
+	case "||":
+		return func(s map[string]float64) float64 { return boolVal(a(s) != 0 || b(s) != 0) }
+	case "&&":
+		return func(s map[string]float64) float64 { return boolVal(a(s) != 0 && b(s) != 0) }
+	case "<":
+		return func(s map[string]float64) float64 { return boolVal(a(s) < b(s)) }
+	case "<=":
+		return func(s map[string]float64) float64 { return boolVal(a(s) <= b(s)) }
+	case ">":
+		return func(s map[string]float64) float64 { return boolVal(a(s) > b(s)) }
+	case ">=":
+		return func(s map[string]float64) float64 { return boolVal(a(s) >= b(s)) }
+	case "==":
+		return func(s map[string]float64) float64 { return boolVal(a(s) == b(s)) }
+	case "!=":
+		return func(s map[string]float64) float64 { return boolVal(a(s) != b(s)) }
+	case "+":
+		return func(s map[string]float64) float64 { return a(s) + b(s) }
+	case "-":
+		return func(s map[string]float64) float64 { return a(s) - b(s) }
+	case "*":
+		return func(s map[string]float64) float64 { return a(s) * b(s) }
+	default: // "/"
+		return func(s map[string]float64) float64 {
+			d := b(s)
+			if d == 0 {
+				return 0
+			}
+			return a(s) / d
+		}
+	}
+}
+
+func (p *rankParser) parseUnary() (rankExpr, error) {
+	switch p.tok {
+	case "-":
+		p.next()
+		e, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return func(s map[string]float64) float64 { return -e(s) }, nil
+	case "!":
+		p.next()
+		e, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return func(s map[string]float64) float64 { return boolVal(e(s) == 0) }, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *rankParser) parsePrimary() (rankExpr, error) {
+	tok := p.tok
+	switch {
+	case tok == "":
+		return nil, fmt.Errorf("unexpected end of expression")
+	case tok == "(":
+		p.next()
+		e, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		return e, p.expect(")")
+	case tok[0] >= '0' && tok[0] <= '9' || tok[0] == '.':
+		v, err := strconv.ParseFloat(tok, 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad number %q", tok)
+		}
+		p.next()
+		return func(map[string]float64) float64 { return v }, nil
+	case tok == "log" || tok == "min" || tok == "max":
+		p.next()
+		return p.parseCall(tok)
+	case tok[0] == '_' || unicode.IsLetter(rune(tok[0])):
+		if _, ok := rankSignals[tok]; !ok {
+			return nil, fmt.Errorf("unknown signal %q", tok)
+		}
+		p.next()
+		return func(s map[string]float64) float64 { return s[tok] }, nil
+	}
+	return nil, fmt.Errorf("unexpected %q", tok)
+}
+
+func (p *rankParser) parseCall(fn string) (rankExpr, error) {
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+	args := []rankExpr{}
+	for {
+		e, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, e)
+		if p.tok != "," {
+			break
+		}
+		p.next()
+	}
+	if err := p.expect(")"); err != nil {
+		return nil, err
+	}
+	switch {
+	case fn == "log" && len(args) == 1:
+		return func(s map[string]float64) float64 { return math.Log1p(args[0](s)) }, nil
+	case fn == "min" && len(args) == 2:
+		return func(s map[string]float64) float64 { return math.Min(args[0](s), args[1](s)) }, nil
+	case fn == "max" && len(args) == 2:
+		return func(s map[string]float64) float64 { return math.Max(args[0](s), args[1](s)) }, nil
+	}
+	return nil, fmt.Errorf("wrong number of arguments to %v", fn)
+}
+
+// rankFileSites orders the file sites by the ranking expression, keeping the
+// existing order for ties. queryTicket is the ticket of the request.
+func (s *Server) rankFileSites(sites []fileSites, queryTicket ticket, rank rankExpr) {
+	values := make([]float64, len(sites))
+	for i, fs := range sites {
+		t, _ := s.knownTicket(fs.containingFile.FileTicket)
+		values[i] = rank(map[string]float64{
+			"score":         fs.score,
+			"depth":         float64(strings.Count(t.path, "/")),
+			"test":          boolVal(s.tests.match(t.path)),
+			"generated":     boolVal(s.generated.matchPath(t.path)),
+			"repo_priority": fs.repoPriority,
+			"tier":          float64(s.repoTiers.tier(t.repo)),
+			"matches":       float64(fs.totalMatches),
+			"same_repo":     boolVal(t.repo == queryTicket.repo),
+			"same_file":     boolVal(t.repo == queryTicket.repo && t.path == queryTicket.path),
+		})
+	}
+	idx := make([]int, len(sites))
+	for i := range idx {
+		idx[i] = i
+	}
+	sort.SliceStable(idx, func(i, j int) bool {
+		return values[idx[i]] > values[idx[j]]
+	})
+	sorted := make([]fileSites, len(sites))
+	for i, k := range idx {
+		sorted[i] = sites[k]
+	}
+	copy(sites, sorted)
+}
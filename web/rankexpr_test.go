@@ -0,0 +1,70 @@
+package web
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestCompileRankExpr(t *testing.T) {
+	signals := map[string]float64{"score": 10, "depth": 2, "test": 1, "same_repo": 0}
+	for _, tc := range []struct {
+		src  string
+		want float64
+	}{
+		{"score", 10},
+		{"1.5", 1.5},
+		{"score + 1000*same_repo - 50*test - 10*depth", -60},
+		{"(score + 2) * 2", 24},
+		{"score / 0", 0},
+		{"-depth", -2},
+		{"!test", 0},
+		{"!same_repo", 1},
+		{"depth < 3 && test", 1},
+		{"depth > 3 || same_repo", 0},
+		{"depth == 2", 1},
+		{"depth != 2", 0},
+		{"test ? score : 0", 10},
+		{"same_repo ? score : depth", 2},
+		{"min(score, depth)", 2},
+		{"max(score, depth)", 10},
+		{"log(score)", math.Log1p(10)},
+		{"  score\t+ 1 ", 11},
+	} {
+		t.Run(tc.src, func(t *testing.T) {
+			e, err := compileRankExpr(tc.src)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := e(signals); got != tc.want {
+				t.Errorf("got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestCompileRankExprErrors(t *testing.T) {
+	for _, tc := range []struct {
+		src     string
+		wantErr string
+	}{
+		{"", "unexpected end of expression"},
+		{"score +", "unexpected end of expression"},
+		{"nope", `unknown signal "nope"`},
+		{"(score", `expected ")"`},
+		{"score score", `unexpected "score"`},
+		{"min(score)", "wrong number of arguments to min"},
+		{"log(score, depth)", "wrong number of arguments to log"},
+		{"1.2.3", `bad number "1.2.3"`},
+	} {
+		t.Run(tc.src, func(t *testing.T) {
+			_, err := compileRankExpr(tc.src)
+			if err == nil {
+				t.Fatalf("got no error, want %q", tc.wantErr)
+			}
+			if !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("got error %q, want %q", err, tc.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,220 @@
+package web
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+
+	"github.com/google/zoekt"
+	"github.com/google/zoekt/query"
+)
+
+// Most referencing nodes in a reference graph. The ones with the fewest
+// references are dropped, flagged by UhRefGraph.Truncated.
+const maxRefGraphNodes = 200
+
+// Files searched for a reference graph.
+const refGraphFiles = 2000
+
+// UhRefGraph is the JSON response of /api/refgraph: the symbol node, and a
+// node per file, directory or repo referencing it, with an edge to the symbol.
+type UhRefGraph struct {
+	Symbol string        `json:"symbol"`
+	Nodes  []UhGraphNode `json:"nodes"`
+	Edges  []UhGraphEdge `json:"edges"`
+	// True if nodes with few references were dropped, or the search hit
+	// limits.
+	Truncated bool `json:"truncated"`
+}
+
+type UhGraphNode struct {
+	ID string `json:"id"`
+	// "symbol", "file", "dir" or "repo".
+	Kind  string `json:"kind"`
+	Label string `json:"label"`
+	// Of the file, directory or repo. Empty for the symbol.
+	Ticket string `json:"ticket,omitempty"`
+}
+
+type UhGraphEdge struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+	// Matches of the symbol.
+	Count int `json:"count"`
+}
+
+func (s *Server) serveRefGraph(w http.ResponseWriter, r *http.Request) {
+	if err := s.serveRefGraphErr(w, r); err != nil {
+		writeError(w, err)
+	}
+}
+
+// serveRefGraphErr builds the graph of what references the identifier of the
+// symbol parameter, as whole-word case-sensitive matches. Referencing nodes
+// are files, or with group=dir their directories (packages, in many
+// languages) or with group=repo their repos. Returned as JSON, or as Graphviz
+// DOT with format=dot. Like for search-xref, scope and exclude parameters
+// restrict the search.
+func (s *Server) serveRefGraphErr(w http.ResponseWriter, r *http.Request) error {
+	log.Printf("request: %v", r.URL)
+	symbols, ok := r.URL.Query()["symbol"]
+	if !ok {
+		return errorf(ErrParamMissing, "Expected symbol parameter")
+	}
+	symbol := symbols[0]
+	if identifierRE.FindString(symbol) != symbol {
+		return errorf(ErrParamInvalid, "symbol %q is not an identifier", symbol)
+	}
+	group := "file"
+	if gs, ok := r.URL.Query()["group"]; ok {
+		group = gs[0]
+		if group != "file" && group != "dir" && group != "repo" {
+			return errorf(ErrParamInvalid, "unknown group %q, want one of file, dir, repo", group)
+		}
+	}
+	format := "json"
+	if fs, ok := r.URL.Query()["format"]; ok {
+		format = fs[0]
+		if format != "json" && format != "dot" {
+			return errorf(ErrParamInvalid, "unknown format %q, want one of json, dot", format)
+		}
+	}
+
+	rq := "case:yes \\b" + symbol + "\\b"
+	queryTicket := ticket{}
+	if tickets, ok := r.URL.Query()["ticket"]; ok {
+		t, err := s.parseTicket(r.Context(), tickets[0])
+		if err != nil {
+			return err
+		}
+		queryTicket = t
+	}
+	if atoms, err := xrefScopeAtoms(r, queryTicket); err != nil {
+		return err
+	} else if atoms != "" {
+		rq += " " + atoms
+	}
+	excludes, err := s.xrefExcludes(r)
+	if err != nil {
+		return err
+	}
+	if atoms := excludeAtoms(excludes); atoms != "" {
+		rq += " " + atoms
+	}
+	log.Printf("query: %v", rq)
+	q, err := query.Parse(rq)
+	if err != nil {
+		return errorf(ErrQueryParse, "%v (query: %v)", err, rq)
+	}
+	q = exactBranches(q)
+
+	ctx, done := s.stage(r.Context(), stageSearch)
+	lim, err := s.searchLimits(ctx, q, true, refGraphFiles)
+	if err != nil {
+		done()
+		return err
+	}
+	var result *zoekt.SearchResult
+	if lim.name != limitsEmptyCorpus {
+		result, err = s.search(ctx, q, &lim.opts)
+	}
+	done()
+	if err != nil {
+		return err
+	}
+
+	// Not a ticket, so it can't clash with the other nodes.
+	symbolID := "#" + symbol
+	res := UhRefGraph{
+		Symbol: symbol,
+		Nodes:  []UhGraphNode{{ID: symbolID, Kind: "symbol", Label: symbol}},
+		Edges:  []UhGraphEdge{},
+	}
+	counts := map[string]int{}
+	nodes := map[string]UhGraphNode{}
+	if result != nil {
+		st := result.Stats
+		res.Truncated = st.FilesSkipped > 0 || st.ShardsSkipped > 0 || len(result.Files) < st.FileCount
+		for _, f := range result.Files {
+			n := UhGraphNode{Kind: group}
+			switch group {
+			case "file":
+				n.Ticket = s.fileTicket(f.Repository, "", f.FileName)
+				n.Label = s.displayNamer.name(f.Repository, "", f.FileName)
+			case "dir":
+				dir := path.Dir(f.FileName)
+				if dir == "." {
+					dir = ""
+				}
+				n.Ticket = s.dirTicket(f.Repository, "", dir)
+				n.Label = path.Join(f.Repository, dir)
+			case "repo":
+				n.Ticket = s.dirTicket(f.Repository, "", "")
+				n.Label = f.Repository
+			}
+			n.ID = n.Ticket
+			nodes[n.ID] = n
+			for _, l := range f.LineMatches {
+				if !l.FileName {
+					counts[n.ID] += len(l.LineFragments)
+				}
+			}
+		}
+	}
+
+	ids := make([]string, 0, len(nodes))
+	for id := range nodes {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		if counts[ids[i]] != counts[ids[j]] {
+			return counts[ids[i]] > counts[ids[j]]
+		}
+		return ids[i] < ids[j]
+	})
+	if len(ids) > maxRefGraphNodes {
+		ids = ids[:maxRefGraphNodes]
+		res.Truncated = true
+	}
+	for _, id := range ids {
+		res.Nodes = append(res.Nodes, nodes[id])
+		res.Edges = append(res.Edges, UhGraphEdge{From: id, To: symbolID, Count: counts[id]})
+	}
+
+	if format == "dot" {
+		w.Header().Set("Content-Type", "text/vnd.graphviz; charset=UTF-8")
+		w.WriteHeader(http.StatusOK)
+		_, err := w.Write(refGraphDOT(res))
+		return err
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	return json.NewEncoder(w).Encode(res)
+}
+
+// refGraphDOT renders a reference graph in the Graphviz DOT language.
+func refGraphDOT(g UhRefGraph) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "digraph refgraph {\n")
+	fmt.Fprintf(&b, "  rankdir=LR;\n")
+	if g.Truncated {
+		fmt.Fprintf(&b, "  label=%s;\n", strconv.Quote("truncated"))
+	}
+	for _, n := range g.Nodes {
+		shape := "ellipse"
+		if n.Kind == "symbol" {
+			shape = "box"
+		}
+		fmt.Fprintf(&b, "  %s [label=%s, shape=%s];\n", strconv.Quote(n.ID), strconv.Quote(n.Label), shape)
+	}
+	for _, e := range g.Edges {
+		fmt.Fprintf(&b, "  %s -> %s [label=%d, weight=%d];\n", strconv.Quote(e.From), strconv.Quote(e.To), e.Count, e.Count)
+	}
+	fmt.Fprintf(&b, "}\n")
+	return b.Bytes()
+}
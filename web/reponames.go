@@ -0,0 +1,210 @@
+package web
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/google/zoekt"
+	"github.com/google/zoekt/query"
+)
+
+// Separates the namespace of a repo from its name in the file tree.
+const namespaceSeparator = " / "
+
+// The repo list is fetched at most this often to resolve repo names of
+// tickets, see repoNamer.raw.
+const repoNamesRefresh = 10 * time.Second
+
+type repoNameRule struct {
+	pattern *regexp.Regexp
+	RepoNameRule
+}
+
+// repoNamer maps the repo names of Zoekt to the ones shown, by the rules of
+// DisplayConfig.RepoNames.
+type repoNamer struct {
+	rules []repoNameRule
+	// Lists the repos of the index.
+	list func(ctx context.Context) ([]string, error)
+
+	mu sync.Mutex
+	// Zoekt repo name of each ticket name seen, to resolve incoming tickets.
+	raws map[string]string
+	// Zoekt repo names seen, which resolve to themselves.
+	known       map[string]bool
+	lastRefresh time.Time
+	// Closed when the running refresh is done, nil if none is.
+	refreshing chan struct{}
+}
+
+func newRepoNamer(rules []RepoNameRule, list func(ctx context.Context) ([]string, error)) (*repoNamer, error) {
+	n := &repoNamer{list: list, raws: map[string]string{}, known: map[string]bool{}}
+	for _, r := range rules {
+		p, err := regexp.Compile(r.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("repo name pattern %q: %v", r.Pattern, err)
+		}
+		if r.Name == "" {
+			return nil, fmt.Errorf("repo name pattern %q: name is required", r.Pattern)
+		}
+		n.rules = append(n.rules, repoNameRule{p, r})
+	}
+	return n, nil
+}
+
+// names returns the namespace (empty if none) and name of repo, by the
+// first matching rule. Without one, the name is repo.
+func (n *repoNamer) names(repo string) (string, string) {
+	for _, r := range n.rules {
+		m := r.pattern.FindStringSubmatchIndex(repo)
+		if m == nil {
+			continue
+		}
+		ns := string(r.pattern.ExpandString(nil, r.Namespace, repo, m))
+		name := string(r.pattern.ExpandString(nil, r.Name, repo, m))
+		return ns, name
+	}
+	return "", repo
+}
+
+// display returns the name of repo shown in the file tree and by display
+// templates, like "org / project".
+func (n *repoNamer) display(repo string) string {
+	ns, name := n.names(repo)
+	if ns == "" {
+		return name
+	}
+	return ns + namespaceSeparator + name
+}
+
+// ticketName returns the name of repo in tickets, like "org/project", and
+// remembers it for raw.
+func (n *repoNamer) ticketName(repo string) string {
+	if len(n.rules) == 0 {
+		return repo
+	}
+	name := n.joined(repo)
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.remember(name, repo)
+	return name
+}
+
+// joined returns the namespace and name of repo joined by a slash.
+func (n *repoNamer) joined(repo string) string {
+	ns, name := n.names(repo)
+	if ns == "" {
+		return name
+	}
+	return ns + "/" + name
+}
+
+// remember records the ticket name of repo. Names of several repos are left
+// to resolve to the first one, so the others are only reachable by their
+// Zoekt names. Callers hold mu.
+func (n *repoNamer) remember(name, repo string) {
+	n.known[repo] = true
+	if name == repo {
+		return
+	}
+	if other, ok := n.raws[name]; ok && other != repo {
+		return
+	}
+	n.raws[name] = repo
+}
+
+// raw returns the Zoekt repo name of a repo name of a ticket, which can be
+// either the ticket name or the Zoekt name. Unknown names are looked up in
+// the repo list (if not fetched recently), as tickets can outlive the server
+// that made them.
+func (n *repoNamer) raw(ctx context.Context, name string) string {
+	if len(n.rules) == 0 || name == "" {
+		return name
+	}
+	if repo, ok := n.rawKnown(name); ok {
+		return repo
+	}
+	n.refresh(ctx)
+	if repo, ok := n.rawKnown(name); ok {
+		return repo
+	}
+	return name
+}
+
+// rawKnown is like raw, but only resolves names of repos seen, without
+// fetching the repo list.
+func (n *repoNamer) rawKnown(name string) (string, bool) {
+	if len(n.rules) == 0 || name == "" {
+		return name, true
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.lookup(name)
+}
+
+// refresh fetches the repo list to remember their names, unless fetched
+// recently. Concurrent calls wait for the one fetching (or their ctx).
+func (n *repoNamer) refresh(ctx context.Context) {
+	n.mu.Lock()
+	if wait := n.refreshing; wait != nil {
+		n.mu.Unlock()
+		select {
+		case <-wait:
+		case <-ctx.Done():
+		}
+		return
+	}
+	if time.Since(n.lastRefresh) < repoNamesRefresh {
+		n.mu.Unlock()
+		return
+	}
+	n.lastRefresh = time.Now()
+	done := make(chan struct{})
+	n.refreshing = done
+	n.mu.Unlock()
+
+	repos, err := n.list(ctx)
+	names := make([]string, len(repos))
+	for i, repo := range repos {
+		names[i] = n.joined(repo)
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.refreshing = nil
+	close(done)
+	if err != nil {
+		log.Printf("listing repos to resolve repo names: %v", err)
+		return
+	}
+	for i, repo := range repos {
+		n.remember(names[i], repo)
+	}
+}
+
+// lookup resolves name by the repos seen. Zoekt names win over ticket names.
+// Callers hold mu.
+func (n *repoNamer) lookup(name string) (string, bool) {
+	if n.known[name] {
+		return name, true
+	}
+	repo, ok := n.raws[name]
+	return repo, ok
+}
+
+// listRepoNames returns the names of the repos of the index.
+func (s *Server) listRepoNames(ctx context.Context) ([]string, error) {
+	result, err := s.Searcher.List(ctx, &query.Const{Value: true}, &zoekt.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(result.Repos))
+	for _, re := range result.Repos {
+		names = append(names, re.Repository.Name)
+	}
+	return names, nil
+}
@@ -0,0 +1,107 @@
+package web
+
+import (
+	"net/http"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/google/zoekt/query"
+)
+
+// xrefScopeAtoms returns the query atoms restricting an xref search to the
+// repos of the scope parameter, or "" if not restricted. The scope is one of:
+//
+//	all               the whole index (the default)
+//	current-repo      the repo (and branch) of the request's ticket
+//	repos=a,b,c       the listed repos
+//	dir               the directory of the request's ticket, without its
+//	                  subdirectories
+//	dir=N             the directory and N levels of subdirectories
+//	dir=any           the directory and all its subdirectories
+//
+// The ticket of dir scopes is a file (the one viewed, typically), of which
+// the directory is taken.
+func xrefScopeAtoms(r *http.Request, queryTicket ticket) (string, error) {
+	scopes, ok := r.URL.Query()["scope"]
+	if !ok {
+		return "", nil
+	}
+	scope := scopes[0]
+	switch {
+	case scope == "all":
+		return "", nil
+	case scope == "current-repo":
+		if queryTicket.repo == "" {
+			return "", errorf(ErrParamMissing, "scope=current-repo needs a ticket")
+		}
+		return branchAtoms(queryTicket), nil
+	case scope == "dir" || strings.HasPrefix(scope, "dir="):
+		if queryTicket.repo == "" {
+			return "", errorf(ErrParamMissing, "scope=dir needs a ticket")
+		}
+		depth := 0
+		if d := strings.TrimPrefix(scope, "dir"); d == "=any" {
+			depth = -1
+		} else if d != "" {
+			n, err := strconv.Atoi(d[1:])
+			if err != nil || n < 0 {
+				return "", errorf(ErrParamInvalid, "scope %q: want dir=N with N >= 0, or dir=any", scope)
+			}
+			depth = n
+		}
+		return branchAtoms(queryTicket) + " " + dirAtom(path.Dir(queryTicket.path), depth), nil
+	case strings.HasPrefix(scope, "repos="):
+		var repos []string
+		for _, repo := range strings.Split(strings.TrimPrefix(scope, "repos="), ",") {
+			if repo = strings.TrimSpace(repo); repo != "" {
+				repos = append(repos, repo)
+			}
+		}
+		if len(repos) == 0 {
+			return "", errorf(ErrParamInvalid, "scope=repos= needs at least one repo")
+		}
+		return reposAtom(repos), nil
+	}
+	return "", errorf(ErrParamInvalid, "unknown scope %q, want one of all, current-repo, repos=a,b,c, dir, dir=N, dir=any", scope)
+}
+
+// branchAtoms returns the query atoms matching the repo and branch (if any)
+// of t. Zoekt matches branches by substring, see exactBranches.
+func branchAtoms(t ticket) string {
+	atoms := exactRepoAtom(t.repo)
+	if t.branch != "" {
+		atoms += " branch:" + QuoteQueryString(t.branch)
+	}
+	return atoms
+}
+
+// exactBranches makes the branch atoms of q match whole branch names, as
+// Zoekt's query syntax only matches them by substring ("main" matching
+// "main-old" too). Meant for xref searches, whose branch atoms come from
+// tickets (see xrefScopeAtoms), or the query itself in Raw mode.
+func exactBranches(q query.Q) query.Q {
+	return query.Map(q, func(q query.Q) query.Q {
+		if b, ok := q.(*query.Branch); ok && !b.Exact {
+			return &query.Branch{Pattern: b.Pattern, Exact: true}
+		}
+		return q
+	})
+}
+
+// dirAtom returns the query atom matching the files in dir ("." for the repo
+// root), and depth levels of its subdirectories. Negative depth means all.
+func dirAtom(dir string, depth int) string {
+	re := "^"
+	if dir != "." && dir != "/" {
+		re += regexp.QuoteMeta(strings.TrimSuffix(dir, "/") + "/")
+	}
+	switch {
+	case depth == 0:
+		re += "[^/]+$"
+	case depth > 0:
+		re += "(?:[^/]+/){0," + strconv.Itoa(depth) + "}[^/]+$"
+	}
+	return "f:" + QuoteQueryString(re)
+}
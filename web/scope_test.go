@@ -0,0 +1,133 @@
+package web
+
+import (
+	"net/http/httptest"
+	"regexp"
+	"testing"
+
+	"github.com/google/zoekt/query"
+)
+
+func TestXrefScopeAtoms(t *testing.T) {
+	tk := ticket{repo: "a.b/repo", branch: "main", path: "src/x.go"}
+	for _, tc := range []struct {
+		url    string
+		ticket ticket
+		want   string
+		code   ErrorCode
+	}{
+		{url: "/xrefs", ticket: tk, want: ""},
+		{url: "/xrefs?scope=all", ticket: tk, want: ""},
+		{url: "/xrefs?scope=current-repo", ticket: tk, want: `r:"^a\\.b/repo$" branch:"main"`},
+		{url: "/xrefs?scope=current-repo", ticket: ticket{repo: "repo"}, want: `r:"^repo$"`},
+		{url: "/xrefs?scope=current-repo", code: ErrParamMissing},
+		{url: "/xrefs?scope=repos=a,+b.c,", want: `r:"^(?:a|b\\.c)$"`},
+		{url: "/xrefs?scope=repos=,", code: ErrParamInvalid},
+		{url: "/xrefs?scope=dir", ticket: tk, want: `r:"^a\\.b/repo$" branch:"main" f:"^src/[^/]+$"`},
+		{url: "/xrefs?scope=dir=2", ticket: tk, want: `r:"^a\\.b/repo$" branch:"main" f:"^src/(?:[^/]+/){0,2}[^/]+$"`},
+		{url: "/xrefs?scope=dir=any", ticket: tk, want: `r:"^a\\.b/repo$" branch:"main" f:"^src/"`},
+		{url: "/xrefs?scope=dir", code: ErrParamMissing},
+		{url: "/xrefs?scope=dir=-1", ticket: tk, code: ErrParamInvalid},
+		{url: "/xrefs?scope=dirs", ticket: tk, code: ErrParamInvalid},
+		{url: "/xrefs?scope=nearby", ticket: tk, code: ErrParamInvalid},
+	} {
+		t.Run(tc.url, func(t *testing.T) {
+			got, err := xrefScopeAtoms(httptest.NewRequest("GET", tc.url, nil), tc.ticket)
+			if tc.code != "" {
+				if e, ok := err.(*apiError); !ok || e.Code != tc.code {
+					t.Fatalf("xrefScopeAtoms() error = %v, want code %s", err, tc.code)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tc.want {
+				t.Errorf("xrefScopeAtoms() = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestDirAtom(t *testing.T) {
+	for _, tc := range []struct {
+		dir   string
+		depth int
+		want  string
+		match []string
+		skip  []string
+	}{
+		{
+			dir: ".", depth: 0, want: `f:"^[^/]+$"`,
+			match: []string{"main.go"},
+			skip:  []string{"dir/main.go"},
+		},
+		{
+			dir: "src/pkg", depth: 0, want: `f:"^src/pkg/[^/]+$"`,
+			match: []string{"src/pkg/a.go"},
+			skip:  []string{"src/pkg/sub/a.go", "src/pkgx/a.go", "a.go"},
+		},
+		{
+			dir: "src/pkg", depth: 1, want: `f:"^src/pkg/(?:[^/]+/){0,1}[^/]+$"`,
+			match: []string{"src/pkg/a.go", "src/pkg/sub/a.go"},
+			skip:  []string{"src/pkg/sub/deeper/a.go"},
+		},
+		{
+			dir: "src/pkg", depth: -1, want: `f:"^src/pkg/"`,
+			match: []string{"src/pkg/a.go", "src/pkg/sub/deeper/a.go"},
+			skip:  []string{"src/pkgx/a.go"},
+		},
+		{
+			dir: "a.b+c", depth: -1, want: `f:"^a\\.b\\+c/"`,
+			match: []string{"a.b+c/x"},
+			skip:  []string{"aXbbc/x"},
+		},
+		{
+			dir: "my docs/a\"b", depth: 0, want: `f:"^my docs/a\"b/[^/]+$"`,
+			match: []string{`my docs/a"b/x.md`},
+			skip:  []string{"my/x.md", "docs/x.md"},
+		},
+	} {
+		t.Run(tc.want, func(t *testing.T) {
+			got := dirAtom(tc.dir, tc.depth)
+			if got != tc.want {
+				t.Fatalf("dirAtom(%q, %d) = %q, want %q", tc.dir, tc.depth, got, tc.want)
+			}
+			q, err := query.Parse(got)
+			if err != nil {
+				t.Fatal(err)
+			}
+			fq, ok := q.(*query.Regexp)
+			if !ok || !fq.FileName {
+				t.Fatalf("%q parses to %v, want a file name regexp", got, q)
+			}
+			re := regexp.MustCompile(fq.Regexp.String())
+			for _, p := range tc.match {
+				if !re.MatchString(p) {
+					t.Errorf("%q doesn't match %q", got, p)
+				}
+			}
+			for _, p := range tc.skip {
+				if re.MatchString(p) {
+					t.Errorf("%q matches %q", got, p)
+				}
+			}
+		})
+	}
+}
+
+func TestExactBranches(t *testing.T) {
+	q, err := query.Parse(branchAtoms(ticket{repo: "repo", branch: "release 1"}) + " foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var branches []*query.Branch
+	query.VisitAtoms(exactBranches(q), func(q query.Q) {
+		if b, ok := q.(*query.Branch); ok {
+			branches = append(branches, b)
+		}
+	})
+	if len(branches) != 1 || branches[0].Pattern != "release 1" || !branches[0].Exact {
+		t.Errorf("got branch atoms %v, want exactly release 1", branches)
+	}
+}
@@ -0,0 +1,172 @@
+package web
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/zoekt"
+	"github.com/google/zoekt/query"
+)
+
+// Default and max number of files returned by /api/search-files.
+const (
+	defaultSearchFilesLimit = 50
+	maxSearchFilesLimit     = 500
+)
+
+type UhFileSearchReply struct {
+	Files []UhFileHit `json:"files"`
+}
+
+type UhFileHit struct {
+	File UhDisplayedFile `json:"file"`
+	// Higher is better. Only meaningful relative to other hits of the reply.
+	Score float64 `json:"score"`
+}
+
+func (s *Server) serveSearchFiles(w http.ResponseWriter, r *http.Request) {
+	if err := s.serveSearchFilesErr(w, r); err != nil {
+		writeError(w, err)
+	}
+}
+
+// serveSearchFilesErr finds files by name. Whitespace-separated terms of the
+// q parameter must all appear in the path, and files are ranked by how well
+// the terms match path components (base name first).
+func (s *Server) serveSearchFilesErr(w http.ResponseWriter, r *http.Request) error {
+	log.Printf("request: %v", r.URL)
+	qs, ok := r.URL.Query()["q"]
+	if !ok || len(qs) > 1 {
+		return errorf(ErrParamMissing, "expected q parameter")
+	}
+	terms := strings.Fields(qs[0])
+	if len(terms) == 0 {
+		return errorf(ErrParamInvalid, "expected non-empty q parameter")
+	}
+	limit, err := intParam(r, "limit", defaultSearchFilesLimit)
+	if err != nil {
+		return err
+	}
+	if limit > maxSearchFilesLimit {
+		return errorf(ErrLimitExceeded, "limit %d is above max %d", limit, maxSearchFilesLimit)
+	}
+
+	rq := "case:auto"
+	for _, t := range terms {
+		rq += " f:" + escapeLiteralQuery(t)
+	}
+	hits, err := s.searchFileNames(r, rq, limit, func(p string) (float64, bool) {
+		return pathMatchScore(p, terms), true
+	})
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	return json.NewEncoder(w).Encode(UhFileSearchReply{
+		Files: hits,
+	})
+}
+
+// searchFileNames runs a file name query, and returns up to limit files,
+// ranked by score (files score rejects are dropped). Uses smaller limits than
+// content search, since only names are needed.
+func (s *Server) searchFileNames(r *http.Request, rq string, limit int, score func(string) (float64, bool)) ([]UhFileHit, error) {
+	log.Printf("query: %v", rq)
+	q, err := query.Parse(rq)
+	if err != nil {
+		return nil, errorf(ErrQueryParse, "%v (query: %v)", err, rq)
+	}
+
+	// Fetch more candidates than returned, so our own ranking has some
+	// choice.
+	candidates := limit * 10
+	sOpts := zoekt.SearchOptions{
+		MaxWallTime:            3 * time.Second,
+		ShardMaxMatchCount:     candidates,
+		TotalMaxMatchCount:     candidates * 10,
+		ShardMaxImportantMatch: candidates,
+		TotalMaxImportantMatch: candidates * 10,
+		MaxDocDisplayCount:     candidates,
+	}
+
+	result, err := s.Searcher.Search(r.Context(), q, &sOpts)
+	if err != nil {
+		return nil, err
+	}
+
+	hits := []UhFileHit{}
+	seen := map[string]bool{}
+	for i := range result.Files {
+		f := &result.Files[i]
+		ticket := f.Repository + ":" + f.FileName
+		if seen[ticket] {
+			continue
+		}
+		seen[ticket] = true
+		sc, ok := score(f.FileName)
+		if !ok {
+			continue
+		}
+		hits = append(hits, UhFileHit{
+			File:  s.displayedFile(result, f),
+			Score: sc,
+		})
+	}
+	sort.SliceStable(hits, func(i, j int) bool {
+		if hits[i].Score != hits[j].Score {
+			return hits[i].Score > hits[j].Score
+		}
+		return hits[i].File.FileTicket < hits[j].File.FileTicket
+	})
+	if len(hits) > limit {
+		hits = hits[:limit]
+	}
+	return hits, nil
+}
+
+// pathMatchScore ranks how well the terms match path components. Matches of
+// the whole base name rank highest, then base name prefixes, then other
+// occurrences in the base name, then whole directory names. Shallower paths
+// are slightly preferred.
+func pathMatchScore(p string, terms []string) float64 {
+	lp := strings.ToLower(p)
+	base := path.Base(lp)
+	dirs := strings.Split(path.Dir(lp), "/")
+	score := 0.0
+	for _, t := range terms {
+		t = strings.ToLower(t)
+		// Also try against base name without extension.
+		stem := strings.TrimSuffix(base, path.Ext(base))
+		switch {
+		case base == t || stem == t:
+			score += 100
+		case strings.HasPrefix(base, t):
+			score += 60
+		case strings.Contains(base, t):
+			score += 40
+		case containsString(dirs, t):
+			score += 20
+		default:
+			score += 10
+		}
+	}
+	score -= float64(strings.Count(p, "/"))
+	score -= float64(len(p)) / 100
+	return score
+}
+
+func containsString(ss []string, s string) bool {
+	for _, x := range ss {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
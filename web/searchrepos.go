@@ -0,0 +1,182 @@
+package web
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/google/zoekt"
+	"github.com/google/zoekt/query"
+)
+
+// Default and max number of repos returned by /api/search-repos.
+const (
+	defaultSearchReposLimit = 20
+	maxSearchReposLimit     = 200
+)
+
+// RepoMetadata describes a repo for /api/search-repos.
+type RepoMetadata struct {
+	Description string   `json:"description"`
+	Tags        []string `json:"tags"`
+}
+
+type UhRepoSearchReply struct {
+	Repos []UhRepoHit `json:"repos"`
+}
+
+type UhRepoHit struct {
+	// Ticket of the repo root, for /api/filetree.
+	Ticket      string   `json:"ticket"`
+	Name        string   `json:"name"`
+	Description string   `json:"description,omitempty"`
+	Tags        []string `json:"tags,omitempty"`
+	Branches    []string `json:"branches,omitempty"`
+	UpstreamURL string   `json:"upstreamUrl,omitempty"`
+	// Higher is better. Only meaningful relative to other hits of the reply.
+	Score float64 `json:"score"`
+}
+
+func (s *Server) serveSearchRepos(w http.ResponseWriter, r *http.Request) {
+	if err := s.serveSearchReposErr(w, r); err != nil {
+		writeError(w, err)
+	}
+}
+
+// serveSearchReposErr finds repos by name, alias, description and tags.
+// Whitespace-separated terms of the q parameter must all match one of them,
+// case-insensitively, and repos are ranked by where they match (name first).
+func (s *Server) serveSearchReposErr(w http.ResponseWriter, r *http.Request) error {
+	log.Printf("request: %v", r.URL)
+	qs, ok := r.URL.Query()["q"]
+	if !ok || len(qs) > 1 {
+		return errorf(ErrParamMissing, "expected q parameter")
+	}
+	terms := strings.Fields(strings.ToLower(qs[0]))
+	if len(terms) == 0 {
+		return errorf(ErrParamInvalid, "expected non-empty q parameter")
+	}
+	limit, err := intParam(r, "limit", defaultSearchReposLimit)
+	if err != nil {
+		return err
+	}
+	if limit > maxSearchReposLimit {
+		return errorf(ErrLimitExceeded, "limit %d is above max %d", limit, maxSearchReposLimit)
+	}
+
+	q, err := query.Parse("r:")
+	if err != nil {
+		return errorf(ErrQueryParse, "%v (query: r:)", err)
+	}
+	result, err := s.Searcher.List(r.Context(), q, &zoekt.ListOptions{})
+	if err != nil {
+		return err
+	}
+
+	hits := []UhRepoHit{}
+	seen := map[string]bool{}
+	for _, re := range result.Repos {
+		repo := &re.Repository
+		if seen[repo.Name] {
+			// Listed per shard.
+			continue
+		}
+		seen[repo.Name] = true
+		md := s.repoMetadata(repo)
+		score, ok := repoMatchScore(repo.Name, s.Config.Display.Aliases[repo.Name], md, terms)
+		if !ok {
+			continue
+		}
+		hit := UhRepoHit{
+			Ticket:      s.dirTicket(repo.Name, "", ""),
+			Name:        repo.Name,
+			Description: md.Description,
+			Tags:        md.Tags,
+			UpstreamURL: repo.URL,
+			Score:       score,
+		}
+		for _, b := range repo.Branches {
+			hit.Branches = append(hit.Branches, b.Name)
+		}
+		hits = append(hits, hit)
+	}
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].Score != hits[j].Score {
+			return hits[i].Score > hits[j].Score
+		}
+		return hits[i].Name < hits[j].Name
+	})
+	if len(hits) > limit {
+		hits = hits[:limit]
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	return json.NewEncoder(w).Encode(UhRepoSearchReply{Repos: hits})
+}
+
+// repoMetadata returns the metadata of a repo: the configured one (see
+// Config.RepoMetadata), or else the zoekt.description and zoekt.tags
+// (comma-separated) git config of the indexed repo.
+func (s *Server) repoMetadata(repo *zoekt.Repository) RepoMetadata {
+	if md, ok := s.Config.RepoMetadata[repo.Name]; ok {
+		return md
+	}
+	md := RepoMetadata{Description: repo.RawConfig["description"]}
+	for _, t := range strings.Split(repo.RawConfig["tags"], ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			md.Tags = append(md.Tags, t)
+		}
+	}
+	return md
+}
+
+// repoMatchScore scores how well lowercase terms match a repo. Each term must
+// match the name, alias, a tag or the description, and scores by the best of
+// them. Returns false if a term doesn't match.
+func repoMatchScore(name, alias string, md RepoMetadata, terms []string) (float64, bool) {
+	name = strings.ToLower(name)
+	alias = strings.ToLower(alias)
+	desc := strings.ToLower(md.Description)
+	total := 0.0
+	for _, t := range terms {
+		best := 0.0
+		// Last component, like "zoekt" of "github.com/google/zoekt".
+		base := name[strings.LastIndexByte(name, '/')+1:]
+		switch {
+		case base == t || alias == t:
+			best = 10
+		case strings.HasPrefix(base, t) || strings.HasPrefix(alias, t):
+			best = 6
+		case strings.Contains(name, t) || strings.Contains(alias, t):
+			best = 4
+		}
+		for _, tag := range md.Tags {
+			tag = strings.ToLower(tag)
+			if tag == t && best < 5 {
+				best = 5
+			} else if strings.HasPrefix(tag, t) && best < 3 {
+				best = 3
+			}
+		}
+		if best < 2 {
+			for _, w := range strings.FieldsFunc(desc, func(r rune) bool {
+				return !(r == '-' || r == '_' || r >= '0' && r <= '9' || r >= 'a' && r <= 'z' || r > 0x7f)
+			}) {
+				if w == t {
+					best = 2
+					break
+				} else if strings.HasPrefix(w, t) {
+					best = 1
+				}
+			}
+		}
+		if best == 0 {
+			return 0, false
+		}
+		total += best
+	}
+	return total, true
+}
@@ -2,14 +2,20 @@ package web
 
 import (
 	"crypto/sha1"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	//"html"
 	"log"
 	"net/http"
+	"regexp"
+	"runtime"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
+	"unicode/utf8"
 
 	"golang.org/x/net/context"
 
@@ -30,43 +36,246 @@ type Server struct {
 	// Version string for this server.
 	Version string
 
+	// Deployment-specific settings. If nil, defaults are used.
+	Config *Config
+
+	// Format of tickets in requests and responses. If nil, the one selected by
+	// Config.TicketScheme is used.
+	TicketCodec TicketCodec
+
+	// Directory the shards are loaded from. Used to notice index updates, so
+	// cached data can be dropped. If empty, cached data is never invalidated.
+	IndexDir string
+
+	// Files added to the file tree, along with Config.VirtualFiles. Unlike
+	// configured ones, these can have content.
+	VirtualFiles []VirtualFile
+
+	// Transformers of format=rendered source requests, taking precedence
+	// over the built-in ones.
+	Transformers []ContentTransformer
+
 	startTime time.Time
+	// Keyed by name, see SearchProfile.
+	profiles       map[string]*searchProfile
+	defaultProfile string
+
+	treeCache    *treeCache
+	xrefCache    *xrefCache
+	shardCheck   *shardChecker
+	indexWatcher *indexWatcher
+	displayNamer *displayNamer
+	repoNamer    *repoNamer
+	generated    *generatedMatcher
+	tests        *testMatcher
+
+	repoTiers      *repoTiers
+	canonicalRepos *canonicalRepos
+	// Nil if format=html is disabled.
+	highlighter  *highlighter
+	transformers *transformers
+	// Nil if Kythe is not configured.
+	kythe *kytheClient
+	// See buildOpenAPI.
+	openAPI []byte
+
+	endpoints []endpoint
+	// Keyed by endpoint or feature name.
+	disabled map[string]bool
+
+	interactions interactions
+	usage        *usageStats
+	urlTemplates *urlTemplates
+	repoDirs     *repoDirs
+	virtualFiles *virtualFiles
 }
 
 func NewMux(s *Server) (*http.ServeMux, error) {
 	s.startTime = time.Now()
+	if s.Config == nil {
+		s.Config = &Config{}
+	}
+	if s.TicketCodec == nil {
+		codec, err := newTicketCodec(s.Config.TicketScheme)
+		if err != nil {
+			return nil, err
+		}
+		s.TicketCodec = codec
+	}
+	if err := s.initProfiles(); err != nil {
+		return nil, err
+	}
+	// Shared, so the index directory is read once per shardStampInterval.
+	stamper := newShardStamper(s.IndexDir)
+	s.treeCache = newTreeCache(stamper)
+	xrefCache, err := newXrefCache(stamper, s.Config.Search)
+	if err != nil {
+		return nil, err
+	}
+	s.xrefCache = xrefCache
+	s.shardCheck = newShardChecker(s.IndexDir, stamper)
+	s.indexWatcher = newIndexWatcher(s.IndexDir)
+	// Logs the shards the searcher won't load.
+	if _, err := s.shardCheck.check(); err != nil {
+		return nil, err
+	}
+	s.urlTemplates = newURLTemplates()
+	s.repoNamer, err = newRepoNamer(s.Config.Display.RepoNames, s.listRepoNames)
+	if err != nil {
+		return nil, err
+	}
+	displayNamer, err := newDisplayNamer(s.Config.Display, s.fileTicket, s.repoNamer.display)
+	if err != nil {
+		return nil, err
+	}
+	s.displayNamer = displayNamer
+	generated, err := newGeneratedMatcher(s.Config.Generated)
+	if err != nil {
+		return nil, err
+	}
+	s.generated = generated
+	s.highlighter, err = newHighlighter(s.Config.Source.HighlightStyle)
+	if err != nil {
+		return nil, err
+	}
+	s.repoTiers, err = newRepoTiers(s.Config.Search.RepoPriorities)
+	if err != nil {
+		return nil, err
+	}
+	s.canonicalRepos, err = newCanonicalRepos(s.Config.Search.CanonicalRepos)
+	if err != nil {
+		return nil, err
+	}
+
+	s.usage = newUsageStats(s.knownTicket)
+	if c := s.Config.Usage; c.SummaryFile != "" {
+		interval := time.Hour
+		if c.SummaryInterval != "" {
+			interval, err = time.ParseDuration(c.SummaryInterval)
+			if err != nil || interval <= 0 {
+				return nil, fmt.Errorf("usage summary interval %q: want a positive duration like \"1h\"", c.SummaryInterval)
+			}
+		}
+		go s.writeUsageSummaries(c.SummaryFile, interval)
+	}
+
+	s.endpoints = []endpoint{
+		{"filetree", "/api/filetree", s.serveFileTree},
+		{"source", "/api/source", s.serveSource},
+		{"decor", "/api/decor", s.serveDecors},
+		{"search-xref", "/api/search-xref", s.serveSearchXref},
+		{"live-search", "/api/live-search", s.serveLiveSearch},
+		{"suggest", "/api/suggest", s.serveSuggest},
+		{"events", "/api/events", s.serveEvents},
+		{"file-matches", "/api/file-matches", s.serveFileMatches},
+		{"search-files", "/api/search-files", s.serveSearchFiles},
+		{"search-repos", "/api/search-repos", s.serveSearchRepos},
+		{"filesearch", "/api/filesearch", s.serveFileSearch},
+		{"archive", "/api/archive", s.serveArchive},
+		{"outline", "/api/outline", s.serveOutline},
+		{"blame", "/api/blame", s.serveBlame},
+		{"diff-refs", "/api/diff-refs", s.serveDiffRefs},
+		{"refgraph", "/api/refgraph", s.serveRefGraph},
+		{"resolve", "/api/resolve", s.serveResolve},
+		{"zoekt", "/api/zoekt", s.serveZoekt},
+		{"grep", "/api/grep", s.serveGrep},
+		{"admin/usage-summary", "/api/admin/usage-summary", s.serveUsageSummary},
+		{"admin/index", "/api/admin/index", s.serveIndexStatus},
+	}
+	disabled := s.Config.Disabled
+	s.repoDirs = newRepoDirs(s.Config.Blame)
+	if s.repoDirs.empty() {
+		disabled = append(disabled[:len(disabled):len(disabled)], "blame")
+	}
+	s.tests, err = newTestMatcher(s.Config.Search.TestPaths)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkSavedQueries(s.Config.SavedQueries); err != nil {
+		return nil, err
+	}
+	s.virtualFiles, err = newVirtualFiles(append(s.Config.VirtualFiles[:len(s.Config.VirtualFiles):len(s.Config.VirtualFiles)], s.VirtualFiles...))
+	if err != nil {
+		return nil, err
+	}
+	s.transformers, err = newTransformers(s.Transformers, s.Config.Source)
+	if err != nil {
+		return nil, err
+	}
+	s.kythe, err = newKytheClient(s.Config.Kythe)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.setDisabled(s.endpoints, disabled); err != nil {
+		return nil, err
+	}
+	if err := s.checkSearchDefaults(); err != nil {
+		return nil, err
+	}
+	s.openAPI, err = s.buildOpenAPI()
+	if err != nil {
+		return nil, err
+	}
 
 	mux := http.NewServeMux()
-	mux.HandleFunc("/api/filetree", s.serveFileTree)
-	mux.HandleFunc("/api/source", s.serveSource)
-	mux.HandleFunc("/api/decor", s.serveDecors)
-	mux.HandleFunc("/api/search-xref", s.serveSearchXref)
+	for _, e := range s.endpoints {
+		s.handle(mux, e)
+	}
+	mux.HandleFunc("/api/capabilities", s.serveCapabilities)
+	mux.HandleFunc("/api/openapi.json", s.serveOpenAPI)
 
 	return mux, nil
 }
 
 type FileTree struct {
-	// For now we use repo:path format. Name for backwards compatibility.
+	// Ticket in the format of the TicketCodec. Name for backwards compatibility.
 	// Should be unique.
 	KytheUri string `json:"kytheUri"`
 
 	// The name displayed in the tree - either a repository, or a path component.
 	Display string `json:"display"`
 
-	// Usually generated files are not indexed in Zoekt, only source.
+	// Usually generated files are not indexed in Zoekt, only source. But if
+	// they are, they are recognized based on the Generated config. True for
+	// directories holding only generated files.
 	OnlyGenerated bool `json:"onlyGenerated"`
 
 	// True if file, false if directory.
 	IsFile bool `json:"isFile"`
 
+	// Link to the repo, directory or file on the code host, if the repo has
+	// URL templates.
+	UpstreamURL string `json:"upstreamUrl,omitempty"`
+
 	// nil means unknown, client should make a further request to discover.
 	// only meaningful for directories.
 	Children *[]FileTree `json:"children"`
+
+	// Below only set for files.
+
+	// Size in bytes. Missing if unknown, which happens for listings with too
+	// many files.
+	Size *int `json:"size,omitempty"`
+	// As detected by Zoekt at indexing.
+	Language string `json:"language,omitempty"`
+	// Only set for repos with branches.
+	Branch string `json:"branch,omitempty"`
+	// Commit the file is from, if the repo has versions.
+	Version string `json:"version,omitempty"`
+	// True for files not in the index, see VirtualFile.
+	Virtual bool `json:"virtual,omitempty"`
+
+	// Matches of the badge_query in the file, or below the directory or repo.
+	// Only set for requests with badge_query.
+	BadgeCount *int `json:"badgeCount,omitempty"`
+	// True if the badge_query hit limits, so badge counts are lower bounds.
+	// Only set on the toplevel node.
+	BadgesIncomplete bool `json:"badgesIncomplete,omitempty"`
 }
 
 func (s *Server) serveFileTree(w http.ResponseWriter, r *http.Request) {
 	if err := s.serveFileTreeErr(w, r); err != nil {
-		http.Error(w, err.Error(), http.StatusTeapot)
+		writeError(w, err)
 	}
 }
 
@@ -77,55 +286,55 @@ func (s *Server) serveFileTreeErr(w http.ResponseWriter, r *http.Request) error
 	if tops, ok := r.URL.Query()["top"]; ok {
 		top = tops[0]
 	}
-	ticket, err := parseTicket(top)
+	ticket, err := s.parseTicket(r.Context(), top)
 	if err != nil {
 		return err
 	}
 	topRepo := ticket.repo
 	topPath := ticket.path
 
-	sOpts := zoekt.SearchOptions{
-		MaxWallTime: 10 * time.Second,
+	// Number of levels to return Children for. Only applies within a repo, on
+	// the top level repos are always returned with unknown children.
+	depth := 1
+	if fulls, ok := r.URL.Query()["full"]; ok && fulls[0] == "1" {
+		depth = unlimitedDepth
+	} else if depths, ok := r.URL.Query()["depth"]; ok {
+		d, err := strconv.Atoi(depths[0])
+		if err != nil || d < 1 {
+			return errorf(ErrParamInvalid, "expected positive integer depth, got %q", depths[0])
+		}
+		depth = d
+	}
+
+	// Restricts the files returned, and prunes dirs without matching files.
+	filter, err := parsePathFilter(r.URL.Query()["filter"])
+	if err != nil {
+		return errorf(ErrParamInvalid, "%v", err)
 	}
-	sOpts.SetDefaults()
-	// TODO get num estimate etc
 
 	ctx := r.Context()
 
-	rq := "r:"
-	if topRepo != "" {
-		// TODO: [repo filter] in Zoekt is substring-match now, and pinning with
-		//     regexp is not supported. So we must filter for the exact repo when
-		//     iterating the results later.
-		//
-		//     But this would be better to support explicitly in Zoekt search API.
-		//
-		rq += topRepo
-
-		if topPath == "" {
-			// Well, zoekt obviously doesn't return dir matches. So something like
-			//
-			//     rq += " f:^[^/]*$"
-			//
-			// wouldn't work. So fetch all files from repo now, and post-process
-			// to filter the relevant ones only.
-			//
-			// Note: we rely on getting back all files, so we can harvest the
-			// top-level dirs. Need to check the num estimates above to be sure.
-			rq += " f:^.*$"
-		} else {
-			rq += " f:^" + topPath + "/.*$"
+	// Match counts of a saved query, keyed like badgeCounts.
+	var badges map[string]int
+	badgesIncomplete := false
+	if ids, ok := r.URL.Query()["badge_query"]; ok {
+		searchCtx, done := s.stage(ctx, stageSearch)
+		badges, badgesIncomplete, err = s.badgeCounts(searchCtx, ids[0], ticket, filter)
+		done()
+		if err != nil {
+			return err
 		}
 	}
-	log.Printf("query: %v", rq)
-
-	q, err := query.Parse(rq)
-	if err != nil {
-		return err
-	}
 
 	subtrees := []FileTree{}
 	if topRepo == "" {
+		rq := "r:"
+		log.Printf("query: %v", rq)
+		q, err := query.Parse(rq)
+		if err != nil {
+			return errorf(ErrQueryParse, "%v (query: %v)", err, rq)
+		}
+
 		opts := zoekt.ListOptions{
 			Minimal: false, // maybe?
 		}
@@ -134,86 +343,44 @@ func (s *Server) serveFileTreeErr(w http.ResponseWriter, r *http.Request) error
 			return err
 		}
 
-		for _, re := range result.Repos {
-			r := re.Repository
-			if len(r.Branches) == 0 {
-				// A non-git-like repo. For example plain dir.
-				t := FileTree{
-					KytheUri:      r.Name,
-					Display:       r.Name,
-					OnlyGenerated: false,
-					IsFile:        false,
-					Children:      nil,
-				}
-				subtrees = append(subtrees, t)
-
-			} else {
-				for _, b := range r.Branches {
-					ticketId := r.Name + "@" + b.Name
-					t := FileTree{
-						KytheUri:      ticketId,
-						Display:       ticketId,
-						OnlyGenerated: false,
-						IsFile:        false,
-						Children:      nil,
-					}
-					subtrees = append(subtrees, t)
-				}
-			}
-		}
+		subtrees = s.repoTrees(result.Repos, badges)
 	} else {
-		result, err := s.Searcher.Search(ctx, q, &sOpts)
+		root, err := s.treeCache.get(ticket.repoSpec(), func() (*pathNode, error) {
+			return s.loadPathTrie(ctx, ticket)
+		})
 		if err != nil {
 			return err
 		}
+		node := root.lookup(topPath)
+		if node == nil || node.isFile {
+			return errorf(ErrNotFound, "Not a directory: %v", top)
+		}
+		if !filter.empty() {
+			node = node.filtered(topPath, filter)
+		}
 
-		seen := map[string]bool{}
-		for _, f := range result.Files {
-			if f.Repository != topRepo {
-				// See [repo filter]
-				continue
-			}
-			prefix := ""
-			if topPath != "" {
-				prefix = topPath + "/"
+		if node != nil {
+			sizes, err := s.fileSizes(ctx, ticket, node, depth)
+			if err != nil {
+				return err
 			}
-			relative := strings.TrimPrefix(f.FileName, prefix)
-			relParts := strings.Split(relative, "/")
-			currentPart := relParts[0]
-			// Note: Zoekt won't return a sole directory as a match, only some files
-			// within a directory. This also implies that any directory we encounter
-			// will be non-empty.
-			isFile := len(relParts) == 1
-			if _, exists := seen[currentPart]; !exists {
-				seen[currentPart] = true
-				t := FileTree{
-					KytheUri:      f.Repository + ":" + prefix + currentPart,
-					Display:       currentPart,
-					OnlyGenerated: false,
-					IsFile:        isFile,
-					// Note: as we query all files below 'top' now, we could as well
-					// eagerly build the full subtree. That might be a future option.
-					Children: nil,
-				}
-				subtrees = append(subtrees, t)
+			fileURL := func(path, version string) string {
+				return s.urlTemplates.fileURL(root.fileURLTemplate, ticket.branch, version, path)
 			}
+			subtrees = s.fileTrees(node, ticket, topPath, depth, sizes, badges, fileURL)
 		}
 	}
-	sort.Slice(subtrees, func(i, j int) bool {
-		if subtrees[i].IsFile != subtrees[j].IsFile {
-			return subtrees[j].IsFile
-		}
-		return subtrees[i].Display < subtrees[j].Display
-	})
+	sortFileTrees(subtrees)
 
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 	w.WriteHeader(http.StatusOK)
 	if err = json.NewEncoder(w).Encode(FileTree{
-		KytheUri:      "toplevel",
-		Display:       "wontshow",
-		OnlyGenerated: false,
-		IsFile:        false,
-		Children:      &subtrees,
+		KytheUri:         "toplevel",
+		Display:          "wontshow",
+		OnlyGenerated:    false,
+		IsFile:           false,
+		Children:         &subtrees,
+		BadgesIncomplete: badgesIncomplete,
 	}); err != nil {
 		return err
 	}
@@ -221,9 +388,388 @@ func (s *Server) serveFileTreeErr(w http.ResponseWriter, r *http.Request) error
 	return nil
 }
 
+// Below this many repos, the top level trees are built serially.
+const parallelRepoTreesMin = 256
+
+// Repos a worker of repoTrees takes at a time.
+const repoTreesChunk = 64
+
+// repoTrees returns the top level FileTree entries of the repos: one per
+// branch of git-like repos, one of the repo otherwise. With many repos, these
+// are built by a pool of workers. The entries are unsorted.
+func (s *Server) repoTrees(repos []*zoekt.RepoListEntry, badges map[string]int) []FileTree {
+	// Of each repo, so the workers don't need to coordinate.
+	perRepo := make([][]FileTree, len(repos))
+	workers := runtime.GOMAXPROCS(0)
+	if len(repos) < parallelRepoTreesMin || workers < 2 {
+		for i, re := range repos {
+			perRepo[i] = s.branchTrees(&re.Repository, badges)
+		}
+	} else {
+		var wg sync.WaitGroup
+		next := make(chan int)
+		for w := 0; w < workers; w++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for start := range next {
+					for i := start; i < len(repos) && i < start+repoTreesChunk; i++ {
+						perRepo[i] = s.branchTrees(&repos[i].Repository, badges)
+					}
+				}
+			}()
+		}
+		for start := 0; start < len(repos); start += repoTreesChunk {
+			next <- start
+		}
+		close(next)
+		wg.Wait()
+	}
+	n := 0
+	for _, ts := range perRepo {
+		n += len(ts)
+	}
+	trees := make([]FileTree, 0, n)
+	for _, ts := range perRepo {
+		trees = append(trees, ts...)
+	}
+	return trees
+}
+
+// branchTrees returns the top level FileTree entries of a repo, see
+// repoTrees.
+func (s *Server) branchTrees(r *zoekt.Repository, badges map[string]int) []FileTree {
+	if len(r.Branches) == 0 {
+		// A non-git-like repo. For example plain dir.
+		t := FileTree{
+			KytheUri:      s.dirTicket(r.Name, "", ""),
+			Display:       s.repoNamer.display(r.Name),
+			OnlyGenerated: false,
+			IsFile:        false,
+			UpstreamURL:   r.URL,
+			Children:      nil,
+		}
+		setBadge(&t, badges, r.Name)
+		return []FileTree{t}
+	}
+	trees := make([]FileTree, 0, len(r.Branches))
+	for _, b := range r.Branches {
+		t := FileTree{
+			KytheUri:      s.dirTicket(r.Name, b.Name, ""),
+			Display:       s.repoNamer.display(r.Name) + "@" + b.Name,
+			OnlyGenerated: false,
+			IsFile:        false,
+			UpstreamURL:   r.URL,
+			Children:      nil,
+		}
+		setBadge(&t, badges, r.Name+"@"+b.Name)
+		trees = append(trees, t)
+	}
+	return trees
+}
+
+// Depth value for fileTrees meaning no limit.
+const unlimitedDepth = -1
+
+// fileTrees returns the FileTree entries of the children of node, which is the
+// directory at path within the repo of the ticket. Children of directories are
+// populated depth-1 levels further, or all the way for unlimitedDepth. File
+// sizes are looked up in sizes by sizeKey, and badge counts (if non-nil) in
+// badges by path. fileURL renders upstream URLs, given the path and the
+// version of files.
+func (s *Server) fileTrees(node *pathNode, repo ticket, path string, depth int, sizes, badges map[string]int, fileURL func(path, version string) string) []FileTree {
+	prefix := ""
+	if path != "" {
+		prefix = path + "/"
+	}
+	res := []FileTree{}
+	for name, child := range node.children {
+		t := FileTree{
+			KytheUri:      s.TicketCodec.Encode(TicketParts{Repo: s.repoNamer.ticketName(repo.repo), Branch: repo.branch, Path: prefix + name, Dir: !child.isFile}),
+			Display:       name,
+			OnlyGenerated: child.generated,
+			IsFile:        child.isFile,
+			Children:      nil,
+		}
+		version := ""
+		if child.meta != nil {
+			version = child.meta.version
+		}
+		t.UpstreamURL = fileURL(prefix+name, version)
+		if child.meta != nil && child.meta.virtual != nil {
+			t.Virtual = true
+			t.UpstreamURL = child.meta.virtual.upstreamURL(repo.repo, repo.branch)
+		}
+		setBadge(&t, badges, prefix+name)
+		if child.isFile {
+			if sz, ok := sizes[sizeKey(repo, prefix+name)]; ok {
+				t.Size = &sz
+			}
+			t.Branch = repo.branch
+			if child.meta != nil {
+				t.Language = child.meta.language
+				t.Version = child.meta.version
+			}
+		} else if depth == unlimitedDepth || depth > 1 {
+			nextDepth := depth
+			if depth != unlimitedDepth {
+				nextDepth--
+			}
+			cs := s.fileTrees(child, repo, prefix+name, nextDepth, sizes, badges, fileURL)
+			t.Children = &cs
+		}
+		res = append(res, t)
+	}
+	sortFileTrees(res)
+	return res
+}
+
+// setBadge sets the badge count of t to badges[key], unless badges is nil.
+func setBadge(t *FileTree, badges map[string]int, key string) {
+	if badges == nil {
+		return
+	}
+	n := badges[key]
+	t.BadgeCount = &n
+}
+
+// sortFileTrees orders directories first, then by display name.
+func sortFileTrees(ts []FileTree) {
+	sort.Slice(ts, func(i, j int) bool {
+		if ts[i].IsFile != ts[j].IsFile {
+			return ts[j].IsFile
+		}
+		return ts[i].Display < ts[j].Display
+	})
+}
+
+// loadPathTrie fetches all file paths of the ticket's repo (and branch) from
+// Zoekt, and builds a path trie from them.
+func (s *Server) loadPathTrie(ctx context.Context, t ticket) (*pathNode, error) {
+	// Zoekt obviously doesn't return dir matches. So fetch all file names of the
+	// repo, and harvest the dirs from their paths.
+	//
+	// Note: we rely on getting back all files, so the match limits are derived
+	// from the number of documents in the repo, instead of the usual content
+	// search caps. A bare repo query matches every file of the repo once, by
+	// name, without looking at the content.
+	numDocs, err := s.repoDocCount(ctx, t.repo)
+	if err != nil {
+		return nil, err
+	}
+	n := numDocs + 1
+	sOpts := zoekt.SearchOptions{
+		MaxWallTime:            10 * time.Second,
+		ShardMaxMatchCount:     n,
+		TotalMaxMatchCount:     n,
+		ShardMaxImportantMatch: n,
+		TotalMaxImportantMatch: n,
+	}
+
+	rq := branchAtoms(t)
+	log.Printf("query: %v", rq)
+
+	q, err := query.Parse(rq)
+	if err != nil {
+		return nil, errorf(ErrQueryParse, "%v (query: %v)", err, rq)
+	}
+
+	result, err := s.Searcher.Search(ctx, q, &sOpts)
+	if err != nil {
+		return nil, err
+	}
+
+	root := newPathTrie()
+	root.fileURLTemplate = result.RepoURLs[t.repo]
+	for i := range result.Files {
+		f := &result.Files[i]
+		if !t.matchesFile(f) {
+			// Branch filter is substring match too.
+			continue
+		}
+		root.insert(f.FileName, &fileMeta{
+			language: f.Language,
+			version:  f.Version,
+		})
+	}
+
+	marked := map[string]bool{}
+	if mq := s.generated.markerQuery(); mq != nil {
+		// Markers are usually a single line per file, but allow for some more.
+		mOpts := sOpts
+		mOpts.ShardMaxMatchCount = 10 * n
+		mOpts.TotalMaxMatchCount = 10 * n
+		log.Printf("query: %v %v", rq, mq)
+		result, err := s.Searcher.Search(ctx, query.NewAnd(q, mq), &mOpts)
+		if err != nil {
+			return nil, err
+		}
+		for i := range result.Files {
+			f := &result.Files[i]
+			if t.matchesFile(f) {
+				marked[f.FileName] = true
+			}
+		}
+	}
+	root.markGenerated("", func(p string) bool {
+		return marked[p] || s.generated.matchPath(p)
+	})
+	// Inserted last, so indexed files win.
+	for _, v := range s.virtualFiles.forRepo(t.repo) {
+		root.insert(v.Path, &fileMeta{virtual: v})
+	}
+	return root, nil
+}
+
+// Max number of files in a listing to return sizes for. Sizes need the file
+// contents to be fetched, which is too costly above this.
+const maxSizedFiles = 2000
+
+// fileSizes returns the sizes of files that a listing of node (which is at the
+// ticket's path) with the given depth would return, keyed by file ticket.
+// Returns nil if there are too many files.
+func (s *Server) fileSizes(ctx context.Context, t ticket, node *pathNode, depth int) (map[string]int, error) {
+	paths := node.files(t.path, depth)
+	if len(paths) == 0 || len(paths) > maxSizedFiles {
+		return nil, nil
+	}
+	tickets := []string{}
+	for _, p := range paths {
+		tickets = append(tickets, sizeKey(t, p))
+	}
+	sizes, ok := s.treeCache.getSizes(tickets)
+	if ok {
+		return sizes, nil
+	}
+	stamp := s.treeCache.currentStamp()
+
+	// Fetch the contents of only the listed files not cached yet, not of all
+	// below path, which can be many more if the listing is filtered.
+	names := []string{}
+	for _, p := range paths {
+		if _, ok := sizes[sizeKey(t, p)]; !ok {
+			names = append(names, regexp.QuoteMeta(p))
+		}
+	}
+	rq := "case:yes " + branchAtoms(t) + " f:" + QuoteQueryString("^(?:"+strings.Join(names, "|")+")$")
+	log.Printf("query: %v", rq)
+	q, err := query.Parse(rq)
+	if err != nil {
+		return nil, errorf(ErrQueryParse, "%v (query: %v)", err, rq)
+	}
+	// With exact branches, each name matches a single file.
+	q = exactBranches(q)
+	n := len(names)
+	sOpts := zoekt.SearchOptions{
+		MaxWallTime:            10 * time.Second,
+		Whole:                  true,
+		ShardMaxMatchCount:     n,
+		TotalMaxMatchCount:     n,
+		ShardMaxImportantMatch: n,
+		TotalMaxImportantMatch: n,
+	}
+	result, err := s.Searcher.Search(ctx, q, &sOpts)
+	if err != nil {
+		return nil, err
+	}
+	for i := range result.Files {
+		f := &result.Files[i]
+		if t.matchesFile(f) {
+			sizes[sizeKey(t, f.FileName)] = len(f.Content)
+		}
+	}
+	s.treeCache.putSizes(stamp, sizes)
+	return sizes, nil
+}
+
+// indexedFile looks up the file of the ticket in the index, with its content
+// if whole.
+func (s *Server) indexedFile(ctx context.Context, t ticket, whole bool) (*zoekt.FileMatch, error) {
+	rq := "case:yes " + fileAtoms(t)
+	log.Printf("query: %v", rq)
+	q, err := query.Parse(rq)
+	if err != nil {
+		return nil, errorf(ErrQueryParse, "%v (query: %v)", err, rq)
+	}
+	sOpts := zoekt.SearchOptions{
+		MaxWallTime: s.maxWallTime(ctx),
+	}
+	sOpts.SetDefaults()
+	sOpts.Whole = whole
+	result, err := s.Searcher.Search(ctx, q, &sOpts)
+	if err != nil {
+		return nil, err
+	}
+	for i := range result.Files {
+		if f := &result.Files[i]; t.matchesFile(f) && f.FileName == t.path {
+			return f, nil
+		}
+	}
+	return nil, errorf(ErrNotFound, "No such file: %v", t.path)
+}
+
+// repoDocCount returns the number of documents indexed for repo, summed over
+// all branches.
+func (s *Server) repoDocCount(ctx context.Context, repo string) (int, error) {
+	st, err := s.repoStats(ctx, repo)
+	if err != nil {
+		return 0, err
+	}
+	return st.Documents, nil
+}
+
+// repoStats returns the index stats of repo, summed over its shards.
+func (s *Server) repoStats(ctx context.Context, repo string) (zoekt.RepoStats, error) {
+	rq := exactRepoAtom(repo)
+	q, err := query.Parse(rq)
+	if err != nil {
+		return zoekt.RepoStats{}, errorf(ErrQueryParse, "%v (query: %v)", err, rq)
+	}
+	result, err := s.Searcher.List(ctx, q, &zoekt.ListOptions{})
+	if err != nil {
+		return zoekt.RepoStats{}, err
+	}
+	found := false
+	st := zoekt.RepoStats{}
+	for _, re := range result.Repos {
+		if re.Repository.Name == repo {
+			found = true
+			st.Add(&re.Stats)
+		}
+	}
+	if !found {
+		return zoekt.RepoStats{}, errorf(ErrNotFound, "No such repo: %v", repo)
+	}
+	return st, nil
+}
+
+// reposAtom returns a query atom matching exactly the given repos.
+func reposAtom(repos []string) string {
+	quoted := make([]string, len(repos))
+	for i, r := range repos {
+		quoted[i] = regexp.QuoteMeta(r)
+	}
+	return "r:" + QuoteQueryString("^(?:"+strings.Join(quoted, "|")+")$")
+}
+
+// exactRepoAtom returns a query atom matching only the given repo.
+//
+// Note: the repo atom is a regexp in the Zoekt version we use, so pinning works
+// after all. Older code still filters results, see [repo filter].
+func exactRepoAtom(repo string) string {
+	return "r:" + QuoteQueryString("^"+regexp.QuoteMeta(repo)+"$")
+}
+
+// fileAtoms returns the query atoms matching the file of a complete ticket.
+// Zoekt matches branches by substring, so results still need to be checked
+// with matchesFile.
+func fileAtoms(t ticket) string {
+	return branchAtoms(t) + " f:" + QuoteQueryString("^"+regexp.QuoteMeta(t.path)+"$")
+}
+
 func (s *Server) serveSource(w http.ResponseWriter, r *http.Request) {
 	if err := s.serveSourceErr(w, r); err != nil {
-		http.Error(w, err.Error(), http.StatusTeapot)
+		writeError(w, err)
 	}
 }
 
@@ -231,80 +777,169 @@ func (s *Server) serveSourceErr(w http.ResponseWriter, r *http.Request) error {
 	log.Printf("request: %v", r.URL)
 	tickets, ok := r.URL.Query()["ticket"]
 	if !ok || len(tickets) > 1 {
-		return fmt.Errorf("expected ticket parameter")
+		return errorf(ErrParamMissing, "expected ticket parameter")
 	}
 	ticket := tickets[0]
-	tick, err := parseTicket(ticket)
+	tick, err := s.parseTicket(r.Context(), ticket)
 	if err != nil {
 		return err
 	}
 	if !tick.complete() {
-		return fmt.Errorf("Expected ticket in repo:path format")
+		return errorf(ErrTicketFormat, "Expected a file ticket, with repo and path")
 	}
-	repo := tick.repo
-	path := tick.path
 
-	sOpts := zoekt.SearchOptions{
-		MaxWallTime: 10 * time.Second,
+	format := "text"
+	if fs, ok := r.URL.Query()["format"]; ok {
+		format = fs[0]
+		if format != "text" && format != "json" && format != "html" && format != "rendered" {
+			return errorf(ErrParamInvalid, "unknown format %q, want one of text, json, html, rendered", format)
+		}
+		if format == "html" && s.highlighter == nil {
+			return errorf(ErrDisabled, "format=html is not enabled on this server")
+		}
 	}
-	sOpts.SetDefaults()
-	// TODO estimate matches and set max counts to enable result to be included.
-	//   Normally there would be exactly 1 hit, but see [repo filter] comment.
-	sOpts.Whole = true
-
-	ctx := r.Context()
 
-	// Note the [repo filter].
-	rq := "r:" + repo + " f:^" + path + "$"
+	rq := fileAtoms(tick)
 	log.Printf("query: %v", rq)
-
 	q, err := query.Parse(rq)
 	if err != nil {
-		return err
+		return errorf(ErrQueryParse, "%v (query: %v)", err, rq)
+	}
+
+	ctx, done := s.stage(r.Context(), stageFetch)
+	sOpts := zoekt.SearchOptions{
+		MaxWallTime: s.maxWallTime(ctx),
 	}
+	sOpts.SetDefaults()
+	// TODO estimate matches and set max counts to enable result to be included.
+	//   Normally there would be exactly 1 hit, but see [repo filter] comment.
+	sOpts.Whole = true
 
 	result, err := s.Searcher.Search(ctx, q, &sOpts)
+	done()
 	if err != nil {
 		return err
 	}
 
-	for _, f := range result.Files {
-		if f.Repository != repo {
+	for i := range result.Files {
+		f := &result.Files[i]
+		if !tick.matchesFile(f) || f.FileName != tick.path {
 			// See [repo filter].
 			continue
 		}
+		branch := tick.branch
+		if branch == "" {
+			branch = firstBranch(f.Branches)
+		}
+		upstream := s.urlTemplates.fileURL(result.RepoURLs[f.Repository], branch, f.Version, f.FileName)
+		if format == "json" {
+			return s.writeSourceJSON(w, r, tick, f, upstream, false)
+		}
+		if isBinary(f.Content) {
+			return s.writeSourceJSON(w, r, tick, f, upstream, true)
+		}
+		if format == "html" {
+			return s.writeSourceHTML(w, r, f)
+		}
+		if format == "rendered" {
+			return s.writeSourceRendered(w, r, f)
+		}
+		etag := contentETag(f.Checksum, "")
 		w.Header().Set("Content-Type", "text/plain; charset=UTF-8")
+		w.Header().Set("ETag", etag)
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return nil
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(f.Content)))
 		w.WriteHeader(http.StatusOK)
-		w.Write(f.Content)
+		if r.Method != http.MethodHead {
+			w.Write(f.Content)
+		}
 		return nil
 	}
-	return fmt.Errorf("Requested file not in response. Query: %v", rq)
+	if v := s.virtualFiles.lookup(tick.repo, tick.path); v != nil {
+		return serveVirtualFile(w, r, v, tick)
+	}
+	return errorf(ErrNotFound, "Requested file not in response. Query: %v", rq)
+}
+
+// contentETag returns a strong ETag for file content based on its Zoekt
+// checksum. Different representations of the content (like JSON) must pass a
+// distinct variant.
+func contentETag(checksum []byte, variant string) string {
+	if variant != "" {
+		variant = "-" + variant
+	}
+	return `"` + hex.EncodeToString(checksum) + variant + `"`
+}
+
+// UhDecors is the response of /api/decor.
+type UhDecors struct {
+	Decors []UhDecor `json:"decors"`
+	// "kythe" if the decors are from Kythe, "zoekt" otherwise. Zoekt has no
+	// semantic data, so then there are none.
+	Backend string `json:"backend"`
 }
 
-// Serving decors is not supported, would need pre-calculated references.
 func (s *Server) serveDecors(w http.ResponseWriter, r *http.Request) {
+	if err := s.serveDecorsErr(w, r); err != nil {
+		writeError(w, err)
+	}
+}
+
+// serveDecorsErr returns the decors of the file of the ticket parameter, if
+// its repo is covered by Kythe. Otherwise, or if Kythe fails, the list is
+// empty.
+func (s *Server) serveDecorsErr(w http.ResponseWriter, r *http.Request) error {
+	res := UhDecors{Decors: []UhDecor{}, Backend: "zoekt"}
+	if tickets, ok := r.URL.Query()["ticket"]; ok {
+		t, err := s.parseTicket(r.Context(), tickets[0])
+		if err != nil {
+			return err
+		}
+		if t.path != "" && s.kythe.covers(t.repo) {
+			ctx, done := s.stage(r.Context(), stageFetch)
+			decors, err := s.decors(ctx, t.repo, t.path)
+			done()
+			if err != nil {
+				log.Printf("kythe decorations of %v, serving without: %v", tickets[0], err)
+			} else {
+				res = UhDecors{Decors: decors, Backend: "kythe"}
+			}
+		}
+	}
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 	w.WriteHeader(http.StatusOK)
-	// Just return an empty list of decors. string type arbitrarily chosen,
-	// doesn't matter.
-	if err := json.NewEncoder(w).Encode(struct {
-		Decors []string `json:"decors"`
-	}{
-		Decors: []string{},
-	}); err != nil {
-		http.Error(w, err.Error(), http.StatusTeapot)
-	}
+	return json.NewEncoder(w).Encode(res)
 }
 
 // Mirrors Underhood's XRefReply (though the two converged away from original
 // Kythe-only).
 type UhXRefReply struct {
-	Refs      []UhSiteGroup `json:"refs"`
+	Refs []UhSiteGroup `json:"refs"`
+	// Groups of test files, if the request had tests=separate. Otherwise
+	// these are in Refs.
+	TestRefs  []UhSiteGroup `json:"testRefs,omitempty"`
 	RefCounts UhRefCounts   `json:"refCounts"`
+	// Files defining the selection, according to the symbols of the index.
+	// Only searched for in Lax and Boundary modes.
+	Definitions []UhSiteGroup `json:"definitions"`
+	// The snippets of Refs (and TestRefs) that look like calls, see
+	// callGroups. Empty with calls=no.
+	Calls []UhSiteGroup `json:"calls"`
+	// Lines in Calls.
+	CallCount int `json:"callCount"`
+	// Set if the searches were cut short, by the time budget or the request
+	// being canceled, so the results are only what was found until then.
+	// PartialReason tells which: "timeout" or "canceled".
+	Partial       bool   `json:"partial,omitempty"`
+	PartialReason string `json:"partialReason,omitempty"`
+	// "kythe" if the request had a target, and Kythe found references to
+	// it. Then the scope, exclude and lang parameters don't apply. Empty
+	// for Zoekt results.
+	Backend string `json:"backend,omitempty"`
 	// Below unused by zoekt-underhood, populated to default values.
-	Calls        []string `json:"calls"`
-	CallCount    int      `json:"callCount"`
-	Definitions  []string `json:"definitions"`
 	Declarations []string `json:"declarations"`
 }
 
@@ -316,6 +951,11 @@ type UhRefCounts struct {
 	// The lines found in a given file are the same (other lines can differ).
 	// Greater than or equal to DupFiles.
 	DupMatches int `json:"rcDupMatches"`
+	// Files of forks collapsed under the canonical repo's file. Not included
+	// in Files.
+	CollapsedForks int `json:"rcCollapsedForks"`
+	// Files classified as tests, included in Files.
+	TestFiles int `json:"rcTestFiles"`
 }
 
 type UhSiteGroup struct {
@@ -327,27 +967,67 @@ type UhSiteGroup struct {
 type fileSites struct {
 	containingFile UhDisplayedFile
 	snippets       []UhSnippet
+	// Number of matching lines, even if not all are in snippets.
+	totalMatches int
+	// Zoekt's score of the file.
+	score float64
+	// From the repo's Zoekt config.
+	repoPriority float64
 	// For deduping on file content.
 	fileChecksum []byte
 	// Hash of line content of snippets, for grouping.
 	snippetsHash []byte
+	// Same files in forks, see collapseForks.
+	forkFiles []UhDisplayedFile
+	// See testMatcher.
+	isTest bool
+	// Zoekt's (linguist) language name, like "Go".
+	language string
 }
 
 type UhFileSites struct {
 	ContainingFile UhDisplayedFile  `json:"sContainingFile"`
 	IsDupOf        *UhDisplayedFile `json:"sDupOfFile"`
 	Snippets       []UhSnippet      `json:"sSnippets"`
+	// Number of matching lines in the file. If more than the snippets, the
+	// rest can be fetched from /api/file-matches.
+	TotalMatches int `json:"sTotalMatches"`
+	// The same file in forks of the repo, if these were collapsed.
+	ForkFiles []UhDisplayedFile `json:"sForkFiles,omitempty"`
+	// Classified as a test file, see SearchConfig.TestPaths.
+	IsTest bool `json:"sIsTest"`
+	// Zoekt's score of the file. Higher is better, only meaningful relative to
+	// other files of the reply.
+	Score float64 `json:"sScore"`
 }
 
 type UhDisplayedFile struct {
 	FileTicket  string `json:"dfFileTicket"`
 	DisplayName string `json:"dfDisplayName"`
+	// Link to the file on the code host, if the repo has a URL template.
+	UpstreamURL string `json:"dfUpstreamUrl,omitempty"`
 }
 
 type UhSnippet struct {
-	Text           string  `json:"snippetText"`
-	FullSpan       CmRange `json:"snippetFullSpan"`
+	Text     string  `json:"snippetText"`
+	FullSpan CmRange `json:"snippetFullSpan"`
+	// The first occurrence in the line. Kept for older clients, which only
+	// highlight one.
 	OccurrenceSpan CmRange `json:"snippetOccurrenceSpan"`
+	// All occurrences in the line, in order.
+	OccurrenceSpans []CmRange `json:"snippetOccurrenceSpans"`
+	// True if Text is only a part of a long line, around the first
+	// occurrence. Then spans are relative to Text, which is marked with
+	// clipMarker where cut. Occurrences outside the part are left out.
+	IsClipped bool `json:"snippetIsClipped"`
+	// True if the line isn't valid UTF-8, so Text has U+FFFD in place of
+	// the invalid bytes. Spans are relative to Text.
+	IsLossy bool `json:"snippetIsLossy,omitempty"`
+	// Link to the line on the code host, if the repo has a URL template.
+	UpstreamURL string `json:"snippetUpstreamUrl,omitempty"`
+	// Token for /api/resolve, which finds the line again after the file
+	// changed.
+	Permalink string `json:"snippetPermalink"`
 }
 
 type CmRange struct {
@@ -362,7 +1042,7 @@ type CmPoint struct {
 
 func (s *Server) serveSearchXref(w http.ResponseWriter, r *http.Request) {
 	if err := s.serveSearchXrefErr(w, r); err != nil {
-		http.Error(w, err.Error(), http.StatusTeapot)
+		writeError(w, err)
 	}
 }
 
@@ -379,71 +1059,152 @@ func (s *Server) serveSearchXrefErr(w http.ResponseWriter, r *http.Request) erro
 	// be done, but in the mean time, correct line fragment spans are only
 	// returned for plain-text code.
 	log.Printf("request: %v", r.URL)
-	selections, ok := r.URL.Query()["selection"]
-	if !ok || len(selections) > 1 {
-		return fmt.Errorf("expected selection parameter")
+	rq, err := s.xrefQuery(r)
+	if err != nil {
+		return err
 	}
-	selection := selections[0]
-
-	casings, ok := r.URL.Query()["casing"]
-	casing := "auto"
-	if ok {
-		c := casings[0]
-		if c == "yes" || c == "no" || c == "auto" {
-			casing = c
-		}
+	dq, err := s.definitionsQuery(r)
+	if err != nil {
+		return err
 	}
-
-	modes, ok := r.URL.Query()["mode"]
-	mode := "Lax"
-	if ok {
-		m := modes[0]
-		if m == "Lax" || m == "Boundary" || m == "Raw" {
-			mode = m
+	// Restricts both queries. Parenthesized, so a Raw mode query can't
+	// escape them.
+	restrict := func(atoms string) {
+		rq = "(" + rq + ") " + atoms
+		if dq != "" {
+			dq = "(" + dq + ") " + atoms
 		}
 	}
+	excludes, err := s.xrefExcludes(r)
+	if err != nil {
+		return err
+	}
+	if atoms := excludeAtoms(excludes); atoms != "" {
+		restrict(atoms)
+	}
 
-	tickets, ok := r.URL.Query()["ticket"]
-	if !ok {
-		// Make up a dummy ticket, in case one was not supplied.
-		tickets = []string{"nosuchrepo:nosuchfile"}
+	// Empty if a ticket was not supplied, matching no file.
+	queryTicket := ticket{}
+	if tickets, ok := r.URL.Query()["ticket"]; ok {
+		if len(tickets) > 1 {
+			return errorf(ErrParamMissing, "expected single ticket parameter")
+		}
+		queryTicket, err = s.parseTicket(r.Context(), tickets[0])
+		if err != nil {
+			return err
+		}
 	}
-	if len(tickets) > 1 {
-		return fmt.Errorf("expected single ticket parameter")
+	if atoms, err := xrefScopeAtoms(r, queryTicket); err != nil {
+		return err
+	} else if atoms != "" {
+		restrict(atoms)
 	}
-	ticket := tickets[0]
-	queryTicket, err := parseTicket(ticket)
-	if err != nil {
+	if atoms, err := xrefLangAtoms(r); err != nil {
 		return err
+	} else if atoms != "" {
+		restrict(atoms)
 	}
 
 	ctx := r.Context()
 
 	fileSites := []fileSites{}
 
-	var rq string
-	if mode == "Raw" {
-		rq = selection
-	} else {
-		// See https://github.com/google/zoekt/issues/139 for not wrapping in quotes
-		moddedSelection := escapeLiteralQuery(selection)
-		if mode == "Boundary" {
-			moddedSelection = "\\b" + moddedSelection + "\\b"
+	// Whether to run the doc count estimate pre-search, see appendSearches.
+	estimate := !s.Config.Search.SkipEstimate
+	if es, ok := r.URL.Query()["estimate"]; ok {
+		switch es[0] {
+		case "yes":
+			estimate = true
+		case "no":
+			estimate = false
+		default:
+			return errorf(ErrParamInvalid, "unknown estimate %q, want one of yes, no", es[0])
 		}
-		rq = "case:" + casing + " " + moddedSelection
 	}
 
-	if err := s.appendSearches(rq, ctx, &fileSites); err != nil {
+	// Whether to collapse files of forks, see collapseForks.
+	collapse := true
+	if fs, ok := r.URL.Query()["forks"]; ok {
+		switch fs[0] {
+		case "collapse":
+			collapse = true
+		case "expand":
+			collapse = false
+		default:
+			return errorf(ErrParamInvalid, "unknown forks %q, want one of collapse, expand", fs[0])
+		}
+	}
+
+	// Whether to return test files in their own groups.
+	separateTests := false
+	if ts, ok := r.URL.Query()["tests"]; ok {
+		switch ts[0] {
+		case "mixed":
+			separateTests = false
+		case "separate":
+			separateTests = true
+		default:
+			return errorf(ErrParamInvalid, "unknown tests %q, want one of mixed, separate", ts[0])
+		}
+	}
+
+	// Order of results, if not the default.
+	order, err := xrefSort(r)
+	if err != nil {
+		return err
+	}
+	detectCalls, err := xrefCalls(r)
+	if err != nil {
+		return err
+	}
+
+	searchCtx, done := s.stage(ctx, stageSearch)
+	// Why the results are partial, if they are.
+	var partial string
+	definitions := []UhSiteGroup{}
+	// Set if Kythe served the request.
+	backend := ""
+	if targets, ok := r.URL.Query()["target"]; ok && s.kythe.covers(queryTicket.repo) {
+		defs, refs, kerr := s.kytheXrefs(searchCtx, targets[0], s.profile(ctx).maxFiles)
+		if kerr != nil {
+			log.Printf("kythe xrefs of %v, searching Zoekt instead: %v", targets[0], kerr)
+		} else if len(refs.Files)+len(defs.Files) == 0 {
+			log.Printf("kythe has no xrefs of %v, searching Zoekt instead", targets[0])
+		} else {
+			backend = "kythe"
+			for i := range refs.Files {
+				fileSites = append(fileSites, s.toFileSites(refs, &refs.Files[i], false))
+			}
+			definitions = s.kytheDefinitions(defs)
+		}
+	}
+	if backend == "" {
+		partial, err = s.cachedSearches(rq, searchCtx, estimate, &fileSites)
+	}
+	if err == nil && backend == "" && dq != "" {
+		var defPartial string
+		definitions, defPartial, err = s.definitions(searchCtx, dq)
+		if partial == "" {
+			partial = defPartial
+		}
+	}
+	done()
+	if err != nil {
 		return err
 	}
+	if partial != "" {
+		metricXrefPartial.WithLabelValues(partial).Inc()
+	}
+
+	_, done = s.stage(ctx, stageProcess)
 	// Note: if the [repo filter] was more precise, we could shoot multiple
 	// well-crafted queries and just concat them. But for now resort to sorting.
 	sort.SliceStable(fileSites, func(i, j int) bool {
-		ti, err := parseTicket(fileSites[i].containingFile.FileTicket)
+		ti, err := s.knownTicket(fileSites[i].containingFile.FileTicket)
 		if err != nil {
 			return false
 		}
-		tj, err := parseTicket(fileSites[j].containingFile.FileTicket)
+		tj, err := s.knownTicket(fileSites[j].containingFile.FileTicket)
 		if err != nil {
 			return false
 		}
@@ -454,6 +1215,9 @@ func (s *Server) serveSearchXrefErr(w http.ResponseWriter, r *http.Request) erro
 			if tj.repo == queryTicket.repo {
 				return false
 			}
+			if pi, pj := s.repoTiers.tier(ti.repo), s.repoTiers.tier(tj.repo); pi != pj {
+				return pi > pj
+			}
 		}
 		// Same repo from now on.
 		if ti.repo == queryTicket.repo && ti.path != tj.path {
@@ -466,33 +1230,64 @@ func (s *Server) serveSearchXrefErr(w http.ResponseWriter, r *http.Request) erro
 		}
 		return false // Keep original order
 	})
+	if rank := s.profile(ctx).rankExpr; rank != nil {
+		s.rankFileSites(fileSites, queryTicket, rank)
+	}
+	if order != "" {
+		// Ties keep the default order.
+		s.sortFileSites(fileSites, order)
+	}
+	collapsedCnt := 0
+	if collapse {
+		fileSites, collapsedCnt = s.collapseForks(fileSites, s.forkMap(fileSites, queryTicket.repo))
+	}
+
+	calls, callCnt := []UhSiteGroup{}, 0
+	if detectCalls {
+		calls, callCnt = callGroups(fileSites)
+	}
 
-	// keyed by file content hash (fileChecksum)
-	seenTickets := map[string]UhDisplayedFile{}
+	// Index of the canonical copy of files, keyed by file content hash
+	// (fileChecksum). The others are marked as its duplicates.
+	canonical := s.canonicalCopies(fileSites)
 
 	// keyed by match content hash (snippetsHash)
 	contentGroups := map[string][]UhFileSites{}
 	contentGroupOrder := []string{}
+	// Keys of groups of test files, with tests=separate.
+	testGroups := map[string]bool{}
 
 	snipCnt := 0
+	testCnt := 0
 	fileCnt := 0
 	fileDupCnt := 0
 	matchDupCnt := 0
-	for _, fs := range fileSites {
+	for i, fs := range fileSites {
 		// Dedup
 		var dupTick *UhDisplayedFile = nil
-		if seenTick, ok := seenTickets[string(fs.fileChecksum)]; ok {
-			dupTick = &seenTick
+		if c := canonical[string(fs.fileChecksum)]; c != i {
+			canonicalFile := fileSites[c].containingFile
+			dupTick = &canonicalFile
 			fileDupCnt += 1
-		} else {
-			seenTickets[string(fs.fileChecksum)] = fs.containingFile
 		}
 		// To content group
 		h := string(fs.snippetsHash)
+		if fs.isTest {
+			testCnt += 1
+			if separateTests {
+				// Grouped apart from production files with the same lines.
+				h = "test\x00" + h
+				testGroups[h] = true
+			}
+		}
 		s := UhFileSites{
 			ContainingFile: fs.containingFile,
 			IsDupOf:        dupTick,
 			Snippets:       fs.snippets,
+			TotalMatches:   fs.totalMatches,
+			ForkFiles:      fs.forkFiles,
+			IsTest:         fs.isTest,
+			Score:          fs.score,
 		}
 		if _, ok := contentGroups[h]; ok {
 			contentGroups[h] = append(contentGroups[h], s)
@@ -502,59 +1297,301 @@ func (s *Server) serveSearchXrefErr(w http.ResponseWriter, r *http.Request) erro
 			contentGroupOrder = append(contentGroupOrder, h)
 		}
 		fileCnt += 1
-		snipCnt += len(fs.snippets)
+		snipCnt += fs.totalMatches
 	}
 
 	gs := []UhSiteGroup{}
+	var testGs []UhSiteGroup
+	if separateTests {
+		testGs = []UhSiteGroup{}
+	}
 	for _, h := range contentGroupOrder {
-		gs = append(gs, UhSiteGroup{
+		g := UhSiteGroup{
 			Files: contentGroups[h],
-		})
+		}
+		if testGroups[h] {
+			testGs = append(testGs, g)
+		} else {
+			gs = append(gs, g)
+		}
 	}
 
-	if err := json.NewEncoder(w).Encode(UhXRefReply{
-		Refs: gs,
+	done()
+
+	// Written as it's encoded, so the encode stage is not in the
+	// Server-Timing header.
+	_, done = s.stage(ctx, stageEncode)
+	defer done()
+	return writeXrefReply(w, &UhXRefReply{
+		Refs:     gs,
+		TestRefs: testGs,
 		RefCounts: UhRefCounts{
-			Lines:      snipCnt,
-			Files:      fileCnt,
-			DupFiles:   fileDupCnt,
-			DupMatches: matchDupCnt,
+			Lines:          snipCnt,
+			Files:          fileCnt,
+			DupFiles:       fileDupCnt,
+			DupMatches:     matchDupCnt,
+			CollapsedForks: collapsedCnt,
+			TestFiles:      testCnt,
 		},
-		Calls:        []string{},
-		CallCount:    0,
-		Definitions:  []string{},
-		Declarations: []string{},
-	}); err != nil {
-		return err
+		Calls:         calls,
+		CallCount:     callCnt,
+		Definitions:   definitions,
+		Partial:       partial != "",
+		PartialReason: partial,
+		Backend:       backend,
+		Declarations:  []string{},
+	})
+}
+
+// Values of the casing and mode parameters of xref searches.
+var (
+	xrefCasings = []string{"yes", "no", "auto"}
+	xrefModes   = []string{"Lax", "Boundary", "Regexp", "Raw"}
+)
+
+// xrefQuery builds the Zoekt query from the selection, casing and mode
+// parameters of the request. Lax mode searches the selection as a literal
+// string, Boundary mode as a whole word, and Regexp mode as a regexp. Raw
+// mode passes it to Zoekt as a query. Omitted parameters default to
+// SearchConfig.DefaultCasing and DefaultMode.
+func (s *Server) xrefQuery(r *http.Request) (string, error) {
+	selection, casing, mode, err := s.xrefParams(r)
+	if err != nil {
+		return "", err
+	}
+
+	if mode == "Raw" && s.disabled[featureRawSearch] {
+		return "", errorf(ErrDisabled, "Raw mode is disabled on this server")
+	}
+	if mode == "Regexp" {
+		// Checked up front, as Zoekt's parse error wouldn't tell what's wrong
+		// with the pattern.
+		if _, err := parseUserRegexp("selection", selection); err != nil {
+			return "", err
+		}
+	}
+
+	build := func(sel string) string {
+		switch mode {
+		case "Raw":
+			return sel
+		case "Regexp":
+			return "case:" + casing + " regex:" + QuoteQueryString(sel)
+		}
+		// See https://github.com/google/zoekt/issues/139 for not wrapping in quotes
+		moddedSelection := escapeLiteralQuery(sel)
+		if mode == "Boundary" {
+			moddedSelection = "\\b" + moddedSelection + "\\b"
+		}
+		return "case:" + casing + " " + moddedSelection
+	}
+	// Parsed here for the error reporting, callers parse again.
+	_, rq, err := parseUserQuery("selection", selection, build)
+	return rq, err
+}
+
+// xrefParams returns the selection, casing and mode parameters of the
+// request, with the defaults for missing ones.
+func (s *Server) xrefParams(r *http.Request) (selection, casing, mode string, err error) {
+	selections, ok := r.URL.Query()["selection"]
+	if !ok || len(selections) > 1 {
+		return "", "", "", errorf(ErrParamMissing, "expected selection parameter")
+	}
+	selection = selections[0]
+
+	casing = s.defaultCasing()
+	if casings, ok := r.URL.Query()["casing"]; ok {
+		casing = casings[0]
+		if !containsString(xrefCasings, casing) {
+			return "", "", "", errorf(ErrCasingInvalid, "unknown casing %q, want one of %v", casing, strings.Join(xrefCasings, ", "))
+		}
+	}
+
+	mode = s.defaultMode()
+	if modes, ok := r.URL.Query()["mode"]; ok {
+		mode = modes[0]
+		if !containsString(xrefModes, mode) {
+			return "", "", "", errorf(ErrModeInvalid, "unknown mode %q, want one of %v", mode, strings.Join(xrefModes, ", "))
+		}
+	}
+	return selection, casing, mode, nil
+}
+
+// defaultCasing returns the casing of xref searches not asking for one.
+func (s *Server) defaultCasing() string {
+	if c := s.Config.Search.DefaultCasing; c != "" {
+		return c
+	}
+	return "auto"
+}
+
+// defaultMode returns the mode of xref searches not asking for one.
+func (s *Server) defaultMode() string {
+	if m := s.Config.Search.DefaultMode; m != "" {
+		return m
+	}
+	return "Lax"
+}
+
+// checkSearchDefaults checks the configured default casing and mode.
+func (s *Server) checkSearchDefaults() error {
+	if c := s.Config.Search.DefaultCasing; c != "" && !containsString(xrefCasings, c) {
+		return fmt.Errorf("unknown default casing %q, want one of %v", c, strings.Join(xrefCasings, ", "))
+	}
+	if m := s.Config.Search.DefaultMode; m != "" && !containsString(xrefModes, m) {
+		return fmt.Errorf("unknown default mode %q, want one of %v", m, strings.Join(xrefModes, ", "))
+	}
+	if s.defaultMode() == "Raw" && s.disabled[featureRawSearch] {
+		return fmt.Errorf("default mode Raw needs the %v feature, which is disabled", featureRawSearch)
 	}
 	return nil
 }
 
-func (s *Server) appendSearches(rq string, ctx context.Context, manyFileSites *[]fileSites) error {
+// appendSearches runs the xref query rq, and appends the results to
+// manyFileSites. Match limits are chosen by searchLimits. Returns the stats
+// of the searches, and why they were cut short if they were, in which case
+// the results are partial.
+//
+// If gold repos are configured, they are searched separately with larger
+// per-shard match budgets, and their results come first.
+//
+// Searches are memoized for the request (see Server.search), so later passes
+// over the same files can reuse them.
+func (s *Server) appendSearches(rq string, ctx context.Context, estimate bool, manyFileSites *[]fileSites) (zoekt.Stats, string, error) {
 	log.Printf("query: %v", rq)
 	q, err := query.Parse(rq)
 	if err != nil {
-		return err
+		return zoekt.Stats{}, "", errorf(ErrQueryParse, "%v (query: %v)", err, rq)
 	}
+	q = exactBranches(q)
 
+	// Number of files to return.
+	num := s.profile(ctx).maxFiles
+	lim, err := s.searchLimits(ctx, q, estimate, num)
+	if err != nil {
+		if reason := ctxCutShort(ctx); reason != "" {
+			return zoekt.Stats{}, reason, nil
+		}
+		return zoekt.Stats{}, "", err
+	}
+	if lim.name == limitsEmptyCorpus {
+		// Nothing in scope (like a repo filter not matching), so the search
+		// would come back empty.
+		recordSearchLimits(lim.name, lim.numdocs, &lim.estimateStats)
+		return lim.estimateStats, "", nil
+	}
+	sOpts := lim.opts
+	budget := s.replySnippetBytes()
+
+	var stats zoekt.Stats
+	var partial string
+	if gold := s.repoTiers.goldAtom(); gold != "" {
+		goldOpts := sOpts
+		goldOpts.ShardMaxMatchCount *= goldBudgetFactor
+		goldOpts.ShardMaxImportantMatch *= goldBudgetFactor
+		// The rest is only searched for the files the gold repos leave of
+		// num.
+		restOpts := sOpts
+		for i, sub := range []struct {
+			rq   string
+			opts *zoekt.SearchOptions
+		}{
+			{"(" + rq + ") " + gold, &goldOpts},
+			{"(" + rq + ") -" + gold, &restOpts},
+		} {
+			if i > 0 && sub.opts.MaxDocDisplayCount <= 0 {
+				break
+			}
+			log.Printf("query: %v", sub.rq)
+			q, err := query.Parse(sub.rq)
+			if err != nil {
+				return zoekt.Stats{}, "", errorf(ErrQueryParse, "%v (query: %v)", err, sub.rq)
+			}
+			q = exactBranches(q)
+			before := len(*manyFileSites)
+			st, reason, err := s.searchFileSites(ctx, q, sub.opts, budget, manyFileSites)
+			if err != nil {
+				return zoekt.Stats{}, "", err
+			}
+			stats.Add(st)
+			if reason != "" {
+				// The gold results are still worth returning.
+				partial = reason
+				break
+			}
+			restOpts.MaxDocDisplayCount -= len(*manyFileSites) - before
+		}
+	} else {
+		stats, partial, err = s.searchFileSites(ctx, q, &sOpts, budget, manyFileSites)
+		if err != nil {
+			return zoekt.Stats{}, "", err
+		}
+	}
+	recordSearchLimits(lim.name, lim.numdocs, &stats)
+	return stats, partial, nil
+}
+
+// Default of SearchConfig.MaxSnippetBytesPerReply.
+const defaultReplySnippetBytes = 32 << 20
+
+// replySnippetBytes returns a new snippet budget for an xref reply, see
+// searchFileSites, or nil if unlimited.
+func (s *Server) replySnippetBytes() *int {
+	n := s.Config.Search.MaxSnippetBytesPerReply
+	if n < 0 {
+		return nil
+	}
+	if n == 0 {
+		n = defaultReplySnippetBytes
+	}
+	return &n
+}
+
+// Names of the match limits chosen by searchLimits, for metrics.
+const (
+	limitsDefault     = "default"
+	limitsEmptyCorpus = "empty-corpus"
+	limitsLargeCorpus = "large-corpus"
+	limitsSmallCorpus = "small-corpus"
+)
+
+// searchLimit is the options chosen to search for a number of files.
+type searchLimit struct {
+	opts zoekt.SearchOptions
+	// One of the limits* names.
+	name string
+	// Estimated documents in scope, zero if not estimated.
+	numdocs int
+	// Of the estimate pre-search, if any.
+	estimateStats zoekt.Stats
+}
+
+// searchLimits returns the options to search q for num files with. If
+// estimate is set, a cheap pre-search estimates the number of documents to
+// consider, and match limits are tuned based on that. If nothing is in scope,
+// the limits are limitsEmptyCorpus, and the search can be skipped.
+func (s *Server) searchLimits(ctx context.Context, q query.Q, estimate bool, num int) (searchLimit, error) {
 	sOpts := zoekt.SearchOptions{
-		MaxWallTime: 10 * time.Second,
+		MaxWallTime: s.maxWallTime(ctx),
 	}
 	sOpts.SetDefaults()
 
-	// Number of files to return - fixed for now. TODO: expose as param
-	num := 500
-
+	lim := searchLimit{name: limitsDefault}
 	// BEGIN cargo-cult limiting from zoekt:web/server.go
-	if result, err := s.Searcher.Search(ctx, q, &zoekt.SearchOptions{EstimateDocCount: true}); err != nil {
-		return err
-	} else if numdocs := result.ShardFilesConsidered; numdocs > 10000 {
+	if !estimate {
+		// Keep the default limits set above.
+	} else if result, err := s.search(ctx, q, &zoekt.SearchOptions{EstimateDocCount: true, MaxWallTime: sOpts.MaxWallTime}); err != nil {
+		return searchLimit{}, err
+	} else if lim.estimateStats, lim.numdocs = result.Stats, result.ShardFilesConsidered; lim.numdocs == 0 {
+		lim.name = limitsEmptyCorpus
+	} else if numdocs := lim.numdocs; numdocs > 10000 {
 		// If the search touches many shards and many files, we
 		// have to limit the number of matches.  This setting
 		// is based on the number of documents eligible after
 		// considering reponames, so large repos (both
 		// android, chromium are about 500k files) aren't
 		// covered fairly.
+		lim.name = limitsLargeCorpus
 
 		// 10k docs, 50 num -> max match = (250 + 250 / 10)
 		sOpts.ShardMaxMatchCount = num*5 + (5*num)/(numdocs/1000)
@@ -564,103 +1601,333 @@ func (s *Server) appendSearches(rq string, ctx context.Context, manyFileSites *[
 	} else {
 		// Virtually no limits for a small corpus; important
 		// matches are just as expensive as normal matches.
+		lim.name = limitsSmallCorpus
 		n := numdocs + num*100
 		sOpts.ShardMaxImportantMatch = n
 		sOpts.ShardMaxMatchCount = n
 		sOpts.TotalMaxMatchCount = n
 		sOpts.TotalMaxImportantMatch = n
 	}
+	if f := s.profile(ctx).matchLimitFactor; f != 1 {
+		for _, l := range []*int{&sOpts.ShardMaxMatchCount, &sOpts.TotalMaxMatchCount, &sOpts.ShardMaxImportantMatch, &sOpts.TotalMaxImportantMatch} {
+			*l = int(float64(*l) * f)
+		}
+	}
 	sOpts.MaxDocDisplayCount = num
+	lim.opts = sOpts
+	return lim, nil
+}
 
-	result, err := s.Searcher.Search(ctx, q, &sOpts)
+// searchFileSites runs a search, and appends the matching files to
+// manyFileSites. Returns the search stats, and why the search was cut short
+// (see cutShort) if it was. Searches failing due to ctx being done append
+// nothing, but aren't an error either.
+//
+// Unless budget is nil, it's the bytes of snippets left for the reply. Files
+// after it's used up come without snippets, to bound the memory of huge
+// replies. Clients can fetch these from /api/file-matches.
+func (s *Server) searchFileSites(ctx context.Context, q query.Q, sOpts *zoekt.SearchOptions, budget *int, manyFileSites *[]fileSites) (zoekt.Stats, string, error) {
+	result, err := s.search(ctx, q, sOpts)
 	if err != nil {
-		return err
+		if reason := ctxCutShort(ctx); reason != "" {
+			return zoekt.Stats{}, reason, nil
+		}
+		return zoekt.Stats{}, "", err
 	}
-
-	for _, f := range result.Files {
-		ticket := f.Repository + ":" + f.FileName
-		inFile := UhDisplayedFile{
-			FileTicket:  ticket,
-			DisplayName: ticket,
-		}
-		snippets := []UhSnippet{}
-		snippetsHash := sha1.New()
-		for _, l := range f.LineMatches {
-			// For now we only return first fragment match in line for bolding.
-			firstFrag := l.LineFragments[0]
-			lineNum := l.LineNumber - 1
-			snippetsHash.Write(l.Line)
-			// TODO handle if non-UTF8 etc?
-			clippedLine := string(l.Line)
-			if len(clippedLine) > 250 {
-				// TODO adjust returned line/ch values? or otherwise indicate clip?
-				clippedLine = clippedLine[:30] + "...line too long, clipped..." + clippedLine[len(clippedLine)-30:]
+	// Decided up front, as files are converted concurrently.
+	noSnippets := make([]bool, len(result.Files))
+	if budget != nil {
+		for i := range result.Files {
+			if *budget <= 0 {
+				noSnippets[i] = true
+				continue
 			}
-			snippet := UhSnippet{
-				Text: clippedLine,
-				// Inventing one based on approximation.
-				FullSpan: CmRange{
-					From: CmPoint{
-						Line: lineNum,
-						Ch:   0,
-					},
-					To: CmPoint{
-						Line: lineNum,
-						// TODO: Zoekt supplies range in bytes, while we need chars.
-						//       Would need to convert based on observing line content.
-						Ch: l.LineEnd - l.LineStart,
-					},
-				},
-				OccurrenceSpan: CmRange{
-					From: CmPoint{
-						Line: lineNum,
-						Ch:   firstFrag.LineOffset, // TODO convert from bytes to chars
-					},
-					To: CmPoint{
-						Line: lineNum,
-						Ch:   firstFrag.LineOffset + firstFrag.MatchLength, // TODO convert
-					},
-				},
+			for _, l := range result.Files[i].LineMatches {
+				*budget -= min(len(l.Line), maxSnippetLineBytes)
 			}
-			snippets = append(snippets, snippet)
 		}
-		*manyFileSites = append(*manyFileSites, fileSites{
-			containingFile: inFile,
-			snippets:       snippets,
-			fileChecksum:   f.Checksum,
-			snippetsHash:   snippetsHash.Sum(nil),
+	}
+	sites := make([]fileSites, len(result.Files))
+	workers := runtime.GOMAXPROCS(0)
+	if len(result.Files) < parallelFileSitesMin || workers < 2 {
+		for i := range result.Files {
+			sites[i] = s.toFileSites(result, &result.Files[i], noSnippets[i])
+		}
+	} else {
+		// Converting takes a good part of the time of large results, with
+		// snippets, URLs and permalinks rendered for each line.
+		var wg sync.WaitGroup
+		next := make(chan int)
+		for w := 0; w < workers; w++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := range next {
+					sites[i] = s.toFileSites(result, &result.Files[i], noSnippets[i])
+				}
+			}()
+		}
+		for i := range result.Files {
+			next <- i
+		}
+		close(next)
+		wg.Wait()
+	}
+	*manyFileSites = append(*manyFileSites, sites...)
+	return result.Stats, cutShort(ctx, sOpts, &result.Stats), nil
+}
+
+// Results with at least this many files are converted to fileSites
+// concurrently.
+const parallelFileSitesMin = 64
+
+// toFileSites converts a file of the search result, without snippets if
+// noSnippets is set.
+func (s *Server) toFileSites(result *zoekt.SearchResult, f *zoekt.FileMatch, noSnippets bool) fileSites {
+	snippets := []UhSnippet{}
+	snippetBytes := 0
+	snippetsHash := sha1.New()
+	for _, l := range f.LineMatches {
+		// Note: all lines take part in grouping, even if not returned.
+		snippetsHash.Write(l.Line)
+		if noSnippets || s.snippetQuotaReached(len(snippets), snippetBytes) {
+			continue
+		}
+		snippet := lineSnippet(l)
+		snippet.UpstreamURL = s.snippetURL(result, f, l)
+		snippet.Permalink = s.snippetPermalink(f, l)
+		snippets = append(snippets, snippet)
+		snippetBytes += len(snippet.Text)
+	}
+	return fileSites{
+		containingFile: s.displayedFile(result, f),
+		snippets:       snippets,
+		totalMatches:   len(f.LineMatches),
+		score:          f.Score,
+		repoPriority:   f.RepositoryPriority,
+		fileChecksum:   f.Checksum,
+		snippetsHash:   snippetsHash.Sum(nil),
+		isTest:         s.tests.match(f.FileName),
+		language:       f.Language,
+	}
+}
+
+// snippetQuotaReached tells if no more snippets should be returned for a file,
+// given the count and text size of the ones already collected.
+func (s *Server) snippetQuotaReached(count, bytes int) bool {
+	c := s.Config.Search
+	if c.MaxSnippetsPerFile > 0 && count >= c.MaxSnippetsPerFile {
+		return true
+	}
+	// Always return at least one snippet, even if it is long on its own.
+	return c.MaxSnippetBytesPerFile > 0 && count > 0 && bytes >= c.MaxSnippetBytesPerFile
+}
+
+// Lines longer than this are clipped in snippets.
+const maxSnippetLineBytes = 250
+
+// Line content kept before the first occurrence when clipping.
+const snippetClipContextBytes = 60
+
+// Marks where a clipped line was cut.
+const clipMarker = "…"
+
+// lineSnippet converts a Zoekt line match to a snippet.
+func lineSnippet(l zoekt.LineMatch) UhSnippet {
+	lineNum := l.LineNumber - 1
+	frags := make([]zoekt.LineFragmentMatch, len(l.LineFragments))
+	copy(frags, l.LineFragments)
+	sort.SliceStable(frags, func(i, j int) bool {
+		return frags[i].LineOffset < frags[j].LineOffset
+	})
+
+	text := string(l.Line)
+	// Byte offset of text in the line, negative if prefixed by clipMarker.
+	shift := 0
+	clipped := false
+	if len(l.Line) > maxSnippetLineBytes {
+		start, end := clipWindow(l.Line, frags[0].LineOffset, frags[0].LineOffset+frags[0].MatchLength)
+		text = string(l.Line[start:end])
+		shift = start
+		if start > 0 {
+			text = clipMarker + text
+			shift -= len(clipMarker)
+		}
+		if end < len(l.Line) {
+			text += clipMarker
+		}
+		clipped = true
+	}
+
+	// Invalid UTF-8 would end up replaced in the JSON anyway, but then the
+	// spans wouldn't match the text.
+	rawLen := len(text)
+	text, offsets := toValidUTF8(text)
+	if offsets != nil {
+		metricLossySnippets.Inc()
+	}
+
+	spans := []CmRange{}
+	for _, frag := range frags {
+		from, to := frag.LineOffset-shift, frag.LineOffset+frag.MatchLength-shift
+		if clipped && (from < 0 || to > rawLen) {
+			continue
+		}
+		if offsets != nil {
+			from, to = offsets[from], offsets[to]
+		}
+		spans = append(spans, CmRange{
+			From: CmPoint{
+				Line: lineNum,
+				Ch:   from, // TODO convert from bytes to chars
+			},
+			To: CmPoint{
+				Line: lineNum,
+				Ch:   to, // TODO convert
+			},
 		})
 	}
-	return nil
+	return UhSnippet{
+		Text: text,
+		// Inventing one based on approximation.
+		FullSpan: CmRange{
+			From: CmPoint{
+				Line: lineNum,
+				Ch:   0,
+			},
+			To: CmPoint{
+				Line: lineNum,
+				// TODO: Zoekt supplies range in bytes, while we need chars.
+				//       Would need to convert based on observing line content.
+				Ch: len(text),
+			},
+		},
+		OccurrenceSpan:  spans[0],
+		OccurrenceSpans: spans,
+		IsClipped:       clipped,
+		IsLossy:         offsets != nil,
+	}
+}
+
+// toValidUTF8 replaces each byte of s not part of a valid UTF-8 sequence with
+// U+FFFD, like encoding/json does. If s was invalid, also returns the
+// positions in the result of the byte offsets 0..len(s) of s, nil otherwise.
+func toValidUTF8(s string) (string, []int) {
+	if utf8.ValidString(s) {
+		return s, nil
+	}
+	var b strings.Builder
+	offsets := make([]int, 0, len(s)+1)
+	for i := 0; i < len(s); {
+		r, size := utf8.DecodeRuneInString(s[i:])
+		for j := 0; j < size; j++ {
+			offsets = append(offsets, b.Len())
+		}
+		if r == utf8.RuneError && size == 1 {
+			b.WriteRune(utf8.RuneError)
+		} else {
+			b.WriteString(s[i : i+size])
+		}
+		i += size
+	}
+	offsets = append(offsets, b.Len())
+	return b.String(), offsets
+}
+
+// clipWindow returns the byte range of line to keep in a clipped snippet,
+// including the occurrence at [occStart, occEnd) and some context before it.
+// The range doesn't split UTF-8 sequences.
+func clipWindow(line []byte, occStart, occEnd int) (int, int) {
+	start := occStart - snippetClipContextBytes
+	if start < 0 {
+		start = 0
+	}
+	end := start + maxSnippetLineBytes
+	if end < occEnd {
+		end = occEnd
+	}
+	if end > len(line) {
+		end = len(line)
+	}
+	for start > 0 && !utf8.RuneStart(line[start]) {
+		start--
+	}
+	for end < len(line) && !utf8.RuneStart(line[end]) {
+		end++
+	}
+	return start, end
 }
 
 type ticket struct {
 	// Any param is empty if not present in ticket.
-	repo string
-	path string
+	repo   string
+	branch string
+	path   string
 }
 
-func parseTicket(t string) (ticket, error) {
-	// TODO: [ticket escaping] would be needed, in case it can contain colon.
-	//   But, it seems Zoekt doesn't escape either internally (see ResultID), so
-	//   maby we can live with assuming colon won't be part of filenames.
-	parts := strings.SplitN(t, ":", 2)
-	res := ticket{}
-	if len(parts) > 0 {
-		res.repo = parts[0]
+// parseTicket decodes a ticket of a request with the ticket codec.
+func (s *Server) parseTicket(ctx context.Context, t string) (ticket, error) {
+	p, err := s.TicketCodec.Decode(t)
+	if err != nil {
+		return ticket{}, errorf(ErrTicketFormat, "Malformed ticket %q: %v", t, err)
 	}
-	if len(parts) > 1 {
-		res.path = parts[1]
+	return ticket{repo: s.repoNamer.raw(ctx, p.Repo), branch: p.Branch, path: p.Path}, nil
+}
+
+// knownTicket is like parseTicket, but doesn't fetch the repo list to resolve
+// unknown repo names. For tickets this server made, like those of file
+// sites, and where a fetch isn't worth it.
+func (s *Server) knownTicket(t string) (ticket, error) {
+	p, err := s.TicketCodec.Decode(t)
+	if err != nil {
+		return ticket{}, errorf(ErrTicketFormat, "Malformed ticket %q: %v", t, err)
 	}
-	return res, nil
+	repo, _ := s.repoNamer.rawKnown(p.Repo)
+	return ticket{repo: repo, branch: p.Branch, path: p.Path}, nil
+}
+
+// fileTicket returns the ticket of a file for responses.
+func (s *Server) fileTicket(repo, branch, path string) string {
+	return s.TicketCodec.Encode(TicketParts{Repo: s.repoNamer.ticketName(repo), Branch: branch, Path: path})
+}
+
+// dirTicket returns the ticket of a directory (or the repo for an empty path)
+// for responses.
+func (s *Server) dirTicket(repo, branch, path string) string {
+	return s.TicketCodec.Encode(TicketParts{Repo: s.repoNamer.ticketName(repo), Branch: branch, Path: path, Dir: true})
 }
 
 func (t *ticket) complete() bool {
 	return t.repo != "" && t.path != ""
 }
 
+// repoSpec returns the repo part of the ticket, including the branch if any.
+func (t *ticket) repoSpec() string {
+	if t.branch == "" {
+		return t.repo
+	}
+	return t.repo + "@" + t.branch
+}
+
+// matchesFile tells if a Zoekt result file belongs to the repo (and branch)
+// of the ticket. See [repo filter].
+func (t *ticket) matchesFile(f *zoekt.FileMatch) bool {
+	if f.Repository != t.repo {
+		return false
+	}
+	if t.branch == "" {
+		return true
+	}
+	for _, b := range f.Branches {
+		if b == t.branch {
+			return true
+		}
+	}
+	return false
+}
+
 func escapeLiteralQuery(s string) string {
-	toEscape := ":()[]\\.*?^$+{}, "
+	toEscape := ":()[]\\.*?^$+{}, \""
 	var r strings.Builder
 	for _, c := range s {
 		if strings.ContainsAny(string(c), toEscape) {
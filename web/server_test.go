@@ -0,0 +1,97 @@
+package web
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/google/zoekt"
+	"github.com/google/zoekt/query"
+)
+
+// fakeSearcher returns the same result for every search.
+type fakeSearcher struct {
+	result *zoekt.SearchResult
+}
+
+func (f *fakeSearcher) Search(ctx context.Context, q query.Q, opts *zoekt.SearchOptions) (*zoekt.SearchResult, error) {
+	return f.result, nil
+}
+
+func (f *fakeSearcher) List(ctx context.Context, q query.Q, opts *zoekt.ListOptions) (*zoekt.RepoList, error) {
+	return &zoekt.RepoList{}, nil
+}
+
+func (f *fakeSearcher) Close() {}
+
+func (f *fakeSearcher) String() string { return "fakeSearcher" }
+
+// syntheticResult returns a result of files with lines each, every line
+// matching once.
+func syntheticResult(files, lines int) *zoekt.SearchResult {
+	res := &zoekt.SearchResult{
+		RepoURLs:      map[string]string{"repo": "https://example.com/repo/blob/{{.Version}}/{{.Path}}"},
+		LineFragments: map[string]string{"repo": "#L{{.LineNumber}}"},
+	}
+	for i := 0; i < files; i++ {
+		f := zoekt.FileMatch{
+			FileName:   fmt.Sprintf("dir%d/file%d.go", i%10, i),
+			Repository: "repo",
+			Branches:   []string{"HEAD"},
+			Version:    "0123456789abcdef",
+			Language:   "Go",
+			Score:      float64(files - i),
+		}
+		for l := 0; l < lines; l++ {
+			line := []byte(fmt.Sprintf("\tresult := fooBar(ctx, %d, %d) // calls fooBar", i, l))
+			f.LineMatches = append(f.LineMatches, zoekt.LineMatch{
+				Line:       line,
+				LineNumber: l + 1,
+				LineFragments: []zoekt.LineFragmentMatch{
+					{LineOffset: 11, Offset: uint32(l * 80), MatchLength: 6},
+				},
+			})
+		}
+		res.Files = append(res.Files, f)
+	}
+	return res
+}
+
+func newBenchServer(b *testing.B, result *zoekt.SearchResult) *Server {
+	s := &Server{Searcher: &fakeSearcher{result}}
+	if _, err := NewMux(s); err != nil {
+		b.Fatal(err)
+	}
+	return s
+}
+
+func BenchmarkToFileSites(b *testing.B) {
+	result := syntheticResult(1, 20)
+	s := newBenchServer(b, result)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s.toFileSites(result, &result.Files[0], false)
+	}
+}
+
+func BenchmarkSearchFileSites(b *testing.B) {
+	for _, files := range []int{10, parallelFileSitesMin, 1000} {
+		b.Run(fmt.Sprintf("files=%d", files), func(b *testing.B) {
+			s := newBenchServer(b, syntheticResult(files, 5))
+			q := &query.Substring{Pattern: "fooBar"}
+			opts := &zoekt.SearchOptions{}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				var sites []fileSites
+				if _, _, err := s.searchFileSites(context.Background(), q, opts, nil, &sites); err != nil {
+					b.Fatal(err)
+				}
+				if len(sites) != files {
+					b.Fatalf("got %d file sites, want %d", len(sites), files)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,215 @@
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/zoekt"
+)
+
+// Response header warning about shards excluded from searches.
+const warningHeader = "X-Underhood-Warning"
+
+// UhIndexStatus is the response of /api/admin/index: the shards of the index
+// directory, and the ones this server's Zoekt can't load.
+type UhIndexStatus struct {
+	// Versions of the Zoekt library the server is built with.
+	FormatVersion  int `json:"formatVersion"`
+	FeatureVersion int `json:"featureVersion"`
+
+	Shards int `json:"shards"`
+	// Shards left out of searches, sorted by file name.
+	Incompatible []UhShardProblem `json:"incompatible"`
+}
+
+type UhShardProblem struct {
+	// Relative to the index directory.
+	File string `json:"file"`
+	// Versions the shard was built with, if readable.
+	FormatVersion    int `json:"formatVersion,omitempty"`
+	FeatureVersion   int `json:"featureVersion,omitempty"`
+	MinReaderVersion int `json:"minReaderVersion,omitempty"`
+	// Repos in the shard, if readable.
+	Repos   []string `json:"repos,omitempty"`
+	Problem string   `json:"problem"`
+}
+
+// shardChecker finds the shards of an index directory that were built by an
+// incompatible Zoekt version, or are otherwise unreadable. The Zoekt shard
+// loader skips these, logging a cryptic error, so searches silently miss
+// their repos. Once the stamp of the shards changes, the new and changed
+// shards are checked again.
+type shardChecker struct {
+	// If empty, nothing is checked.
+	indexDir string
+	stamper  *shardStamper
+
+	mu      sync.Mutex
+	checked bool
+	stamp   string
+	status  UhIndexStatus
+	// Of the last check.
+	shards map[string]shardInfo
+	// Set while a check reads shards. Other checks meanwhile return the
+	// previous status, rather than waiting.
+	checking bool
+}
+
+func newShardChecker(indexDir string, stamper *shardStamper) *shardChecker {
+	return &shardChecker{indexDir: indexDir, stamper: stamper}
+}
+
+// check returns the status of the index directory.
+func (c *shardChecker) check() (UhIndexStatus, error) {
+	stamp, err := c.stamper.get()
+	if err != nil {
+		return UhIndexStatus{}, err
+	}
+	c.mu.Lock()
+	if c.checked && (stamp == c.stamp || c.checking) {
+		defer c.mu.Unlock()
+		return c.status, nil
+	}
+	c.checking = true
+	prev := c.shards
+	c.mu.Unlock()
+
+	status, shards, err := checkShards(c.indexDir, prev)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.checking = false
+	if err != nil {
+		return UhIndexStatus{}, err
+	}
+	c.checked, c.stamp, c.status, c.shards = true, stamp, status, shards
+	return status, nil
+}
+
+// warning returns the warning for responses about excluded shards, or "" if
+// there are none.
+func (c *shardChecker) warning() string {
+	status, err := c.check()
+	if err != nil || len(status.Incompatible) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%d shard(s) can't be searched, being unreadable or built by an incompatible Zoekt version; see /api/admin/index", len(status.Incompatible))
+}
+
+// checkShards reads the metadata of the shards in dir new or changed since
+// prev (see readShards), and checks their versions the way the Zoekt shard
+// loader does. Logs the problems of new or changed shards. Returns the shards too,
+// to pass as prev next time.
+func checkShards(dir string, prev map[string]shardInfo) (UhIndexStatus, map[string]shardInfo, error) {
+	status := UhIndexStatus{
+		FormatVersion:  zoekt.IndexFormatVersion,
+		FeatureVersion: zoekt.FeatureVersion,
+		Incompatible:   []UhShardProblem{},
+	}
+	if dir == "" {
+		return status, nil, nil
+	}
+	shards, err := readShards(dir, prev)
+	if err != nil {
+		return UhIndexStatus{}, nil, err
+	}
+	names := make([]string, 0, len(shards))
+	for name := range shards {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		sh := shards[name]
+		status.Shards++
+		p := UhShardProblem{File: name}
+		repos, md, err := sh.repos, sh.md, sh.err
+		if md != nil {
+			p.FormatVersion = md.IndexFormatVersion
+			p.FeatureVersion = md.IndexFeatureVersion
+			p.MinReaderVersion = md.IndexMinReaderVersion
+		}
+		for _, r := range repos {
+			p.Repos = append(p.Repos, r.Name)
+		}
+		switch {
+		case md != nil && md.IndexFormatVersion != zoekt.IndexFormatVersion && md.IndexFormatVersion != zoekt.NextIndexFormatVersion:
+			p.Problem = fmt.Sprintf("format version %d, this server reads %d and %d", md.IndexFormatVersion, zoekt.IndexFormatVersion, zoekt.NextIndexFormatVersion)
+		case err != nil:
+			p.Problem = fmt.Sprintf("unreadable: %v", err)
+		case md.IndexFeatureVersion < zoekt.ReadMinFeatureVersion:
+			p.Problem = fmt.Sprintf("feature version %d is too old, this server reads %d and up; reindex", md.IndexFeatureVersion, zoekt.ReadMinFeatureVersion)
+		case md.IndexMinReaderVersion > zoekt.FeatureVersion:
+			p.Problem = fmt.Sprintf("needs a Zoekt of feature version %d or up, this server has %d", md.IndexMinReaderVersion, zoekt.FeatureVersion)
+		default:
+			continue
+		}
+		// Unreadable shards are read again each time, but logged once.
+		if old, ok := prev[name]; !ok || !old.sameFile(sh) {
+			log.Printf("excluded shard %s: %s", p.File, p.Problem)
+		}
+		status.Incompatible = append(status.Incompatible, p)
+	}
+	return status, shards, nil
+}
+
+// shardInfo is the metadata of a shard file, see readShards.
+type shardInfo struct {
+	size  int64
+	mtime time.Time
+	repos []*zoekt.Repository
+	// Possibly set even if err is, like for shards of another format.
+	md *zoekt.IndexMetadata
+	// Set for unreadable shards, like ones being written.
+	err error
+	// Set if read by the last readShards, rather than taken from prev.
+	fresh bool
+}
+
+// sameFile tells if the shards have the same size and mtime.
+func (sh shardInfo) sameFile(o shardInfo) bool {
+	return sh.size == o.size && sh.mtime.Equal(o.mtime)
+}
+
+// readShards reads the metadata of the shards in dir, keyed by file name.
+// Shards unchanged (by size and mtime) since prev are taken from there,
+// unless they were unreadable.
+func readShards(dir string, prev map[string]shardInfo) (map[string]shardInfo, error) {
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	shards := map[string]shardInfo{}
+	for _, fi := range fis {
+		if filepath.Ext(fi.Name()) != ".zoekt" {
+			continue
+		}
+		sh := shardInfo{size: fi.Size(), mtime: fi.ModTime(), fresh: true}
+		if old, ok := prev[fi.Name()]; ok && old.err == nil && old.sameFile(sh) {
+			old.fresh = false
+			shards[fi.Name()] = old
+			continue
+		}
+		sh.repos, sh.md, sh.err = zoekt.ReadMetadataPath(filepath.Join(dir, fi.Name()))
+		shards[fi.Name()] = sh
+	}
+	return shards, nil
+}
+
+func (s *Server) serveIndexStatus(w http.ResponseWriter, r *http.Request) {
+	status, err := s.shardCheck.check()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		log.Printf("encoding index status: %v", err)
+	}
+}
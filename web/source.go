@@ -0,0 +1,130 @@
+package web
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"unicode/utf8"
+
+	"github.com/google/zoekt"
+)
+
+// UhSource is the format=json response of /api/source.
+type UhSource struct {
+	Ticket string `json:"ticket"`
+	// Encoded as per Encoding. Empty for the binary stub served in place of
+	// format=text.
+	Content string `json:"content"`
+	// "utf-8" for text, "base64" for binary content.
+	Encoding string `json:"encoding"`
+	// True if the content doesn't look like text, see isBinary.
+	Binary bool `json:"binary"`
+	// True if Content is cut at Source.MaxJSONBytes of the config.
+	Truncated bool `json:"truncated"`
+	// Size of the full content in bytes.
+	Size int `json:"size"`
+	// As detected by Zoekt at indexing.
+	Language string `json:"language"`
+	// Hex-encoded Zoekt checksum of the full content. Changes when the file
+	// is updated in the index.
+	Checksum string `json:"checksum"`
+	// Branches the file content is present on, if the repo has branches.
+	Branches []string `json:"branches"`
+	// Commit the file is from, if the repo has versions.
+	Version string `json:"version"`
+	// Link to the file on the code host, if the repo has a URL template.
+	UpstreamURL string `json:"upstreamUrl"`
+}
+
+// Sniffing the start is enough to tell binaries (similar to git's heuristic).
+const binarySniffBytes = 8000
+
+// isBinary returns true if content has a NUL byte near the start, or is
+// mostly not valid UTF-8 there.
+func isBinary(content []byte) bool {
+	if len(content) > binarySniffBytes {
+		content = content[:binarySniffBytes]
+	}
+	if bytes.IndexByte(content, 0) >= 0 {
+		return true
+	}
+	invalid, total := 0, 0
+	for len(content) > 0 {
+		r, size := utf8.DecodeRune(content)
+		if r == utf8.RuneError && size == 1 && utf8.FullRune(content) {
+			// Note: a sequence cut at the sniff limit is not counted.
+			invalid++
+		}
+		total++
+		content = content[size:]
+	}
+	// Tolerate the odd Latin-1 character in otherwise ASCII text.
+	return total > 0 && invalid*10 > total
+}
+
+// writeSourceJSON responds with f as UhSource. Binary content is base64
+// encoded, unless stub is set, in which case the content is left out. The stub
+// is served for format=text requests of binary files, so clients don't render
+// garbage - these can tell it apart by the Content-Type.
+func (s *Server) writeSourceJSON(w http.ResponseWriter, r *http.Request, t ticket, f *zoekt.FileMatch, upstreamURL string, stub bool) error {
+	binary := isBinary(f.Content)
+	variant := "json"
+	if stub {
+		variant = "binary"
+	}
+	etag := contentETag(f.Checksum, variant)
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.Header().Set("ETag", etag)
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return nil
+	}
+
+	content := f.Content
+	truncated := false
+	if stub {
+		content = nil
+	} else if max := s.Config.Source.MaxJSONBytes; max > 0 && len(content) > max {
+		// Don't cut a UTF-8 sequence in half.
+		for !binary && max > 0 && !utf8.RuneStart(content[max]) {
+			max--
+		}
+		content = content[:max]
+		truncated = true
+	}
+	encoding, encoded := "utf-8", string(content)
+	if binary {
+		encoding, encoded = "base64", base64.StdEncoding.EncodeToString(content)
+	}
+	branches := f.Branches
+	if branches == nil {
+		branches = []string{}
+	}
+
+	var b bytes.Buffer
+	if err := json.NewEncoder(&b).Encode(UhSource{
+		Ticket:    s.fileTicket(t.repo, t.branch, f.FileName),
+		Content:   encoded,
+		Encoding:  encoding,
+		Binary:    binary,
+		Truncated: truncated,
+		Size:      len(f.Content),
+		Language:  f.Language,
+		Checksum:  hex.EncodeToString(f.Checksum),
+		Branches:  branches,
+		Version:   f.Version,
+
+		UpstreamURL: upstreamURL,
+	}); err != nil {
+		return err
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(b.Len()))
+	w.WriteHeader(http.StatusOK)
+	if r.Method != http.MethodHead {
+		w.Write(b.Bytes())
+	}
+	return nil
+}
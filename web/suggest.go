@@ -0,0 +1,207 @@
+package web
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/google/zoekt"
+	"github.com/google/zoekt/query"
+)
+
+// Suggestions returned unless the limit parameter says otherwise, and the
+// most it can ask for.
+const (
+	defaultSuggestions = 10
+	maxSuggestions     = 100
+)
+
+// Symbol matches counted for suggestions at most. Frequent names show up
+// well before that.
+const maxSuggestMatches = 5000
+
+// UhSuggestions is the response of /api/suggest.
+type UhSuggestions struct {
+	Prefix string `json:"prefix"`
+	// Most frequent first.
+	Suggestions []UhSuggestion `json:"suggestions"`
+	// True if the search stopped at its match or time limit, so the counts
+	// are of a sample.
+	Incomplete bool `json:"incomplete"`
+}
+
+type UhSuggestion struct {
+	Name string `json:"name"`
+	// The most common kind of the symbols of the name, like "function".
+	// Empty if the index lacks ctags data.
+	Kind string `json:"kind"`
+	// Symbols of the name found, that is definitions.
+	Count int `json:"count"`
+}
+
+func (s *Server) serveSuggest(w http.ResponseWriter, r *http.Request) {
+	if err := s.serveSuggestErr(w, r); err != nil {
+		writeError(w, err)
+	}
+}
+
+// serveSuggestErr completes the prefix parameter to symbol names, for the
+// search box. Names are found by a symbol search, so the index needs to have
+// symbols, and ranked by how many symbols have them. Casing, scope
+// (with ticket) and lang parameters work like for search-xref.
+func (s *Server) serveSuggestErr(w http.ResponseWriter, r *http.Request) error {
+	log.Printf("request: %v", r.URL)
+	prefixes, ok := r.URL.Query()["prefix"]
+	if !ok || len(prefixes) > 1 || prefixes[0] == "" {
+		return errorf(ErrParamMissing, "expected single non-empty prefix parameter")
+	}
+	prefix := prefixes[0]
+	for _, c := range prefix {
+		if !isSuggestRune(c) {
+			return errorf(ErrParamInvalid, "prefix %q has %q, want identifier characters", prefix, c)
+		}
+	}
+	limit := defaultSuggestions
+	if ls, ok := r.URL.Query()["limit"]; ok {
+		n, err := strconv.Atoi(ls[0])
+		if err != nil || n < 1 {
+			return errorf(ErrParamInvalid, "expected positive integer limit, got %q", ls[0])
+		}
+		if n > maxSuggestions {
+			return errorf(ErrLimitExceeded, "limit %d is above the maximum %d", n, maxSuggestions)
+		}
+		limit = n
+	}
+	casing := s.defaultCasing()
+	if cs, ok := r.URL.Query()["casing"]; ok {
+		casing = cs[0]
+		if !containsString(xrefCasings, casing) {
+			return errorf(ErrCasingInvalid, "unknown casing %q, want one of %v", casing, strings.Join(xrefCasings, ", "))
+		}
+	}
+
+	// Matches whole symbol names, as symbols are matched one by one.
+	rq := "case:" + casing + " sym:^" + escapeLiteralQuery(prefix) + ".*"
+	queryTicket := ticket{}
+	if tickets, ok := r.URL.Query()["ticket"]; ok {
+		var err error
+		queryTicket, err = s.parseTicket(r.Context(), tickets[0])
+		if err != nil {
+			return err
+		}
+	}
+	if atoms, err := xrefScopeAtoms(r, queryTicket); err != nil {
+		return err
+	} else if atoms != "" {
+		rq += " " + atoms
+	}
+	if atoms, err := xrefLangAtoms(r); err != nil {
+		return err
+	} else if atoms != "" {
+		rq += " " + atoms
+	}
+	log.Printf("query: %v", rq)
+	q, err := query.Parse(rq)
+	if err != nil {
+		return errorf(ErrQueryParse, "%v (query: %v)", err, rq)
+	}
+	q = exactBranches(q)
+
+	ctx, done := s.stage(r.Context(), stageSearch)
+	sOpts := zoekt.SearchOptions{
+		MaxWallTime:            s.maxWallTime(ctx),
+		ShardMaxMatchCount:     maxSuggestMatches,
+		TotalMaxMatchCount:     maxSuggestMatches,
+		ShardMaxImportantMatch: maxSuggestMatches,
+		TotalMaxImportantMatch: maxSuggestMatches,
+	}
+	result, err := s.search(ctx, q, &sOpts)
+	incomplete := false
+	if err == nil {
+		incomplete = result.Stats.FilesSkipped > 0 || cutShort(ctx, &sOpts, &result.Stats) != ""
+	}
+	done()
+	if err != nil {
+		return err
+	}
+
+	res := UhSuggestions{
+		Prefix:      prefix,
+		Suggestions: suggestions(result, limit),
+		Incomplete:  incomplete,
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	return json.NewEncoder(w).Encode(res)
+}
+
+// isSuggestRune tells if c can be part of a prefix. Besides the usual
+// identifier characters, allows those joining the names of some languages,
+// like "Foo::bar", "foo.bar" or "foo-bar".
+func isSuggestRune(c rune) bool {
+	return unicode.IsLetter(c) || unicode.IsDigit(c) || strings.ContainsRune("_$.:-", c)
+}
+
+// suggestions counts the symbols of result by name, and returns the limit
+// most frequent. Ties go to the shorter name, then alphabetically.
+func suggestions(result *zoekt.SearchResult, limit int) []UhSuggestion {
+	counts := map[string]int{}
+	// Keyed by name, then kind.
+	kinds := map[string]map[string]int{}
+	for _, f := range result.Files {
+		for _, l := range f.LineMatches {
+			for _, frag := range l.LineFragments {
+				// Without ctags data at indexing, symbols lack the info,
+				// and the match is the name.
+				name, kind := "", ""
+				if sym := frag.SymbolInfo; sym != nil {
+					name, kind = sym.Sym, sym.Kind
+				} else if end := frag.LineOffset + frag.MatchLength; end <= len(l.Line) {
+					name = string(l.Line[frag.LineOffset:end])
+				}
+				if name == "" {
+					continue
+				}
+				counts[name]++
+				if kinds[name] == nil {
+					kinds[name] = map[string]int{}
+				}
+				kinds[name][kind]++
+			}
+		}
+	}
+	ss := make([]UhSuggestion, 0, len(counts))
+	for name, n := range counts {
+		ss = append(ss, UhSuggestion{Name: name, Kind: mostCommon(kinds[name]), Count: n})
+	}
+	sort.Slice(ss, func(i, j int) bool {
+		a, b := ss[i], ss[j]
+		if a.Count != b.Count {
+			return a.Count > b.Count
+		}
+		if len(a.Name) != len(b.Name) {
+			return len(a.Name) < len(b.Name)
+		}
+		return a.Name < b.Name
+	})
+	if len(ss) > limit {
+		ss = ss[:limit]
+	}
+	return ss
+}
+
+// mostCommon returns the key with the highest count, the first one
+// alphabetically on ties.
+func mostCommon(counts map[string]int) string {
+	best, bestN := "", 0
+	for k, n := range counts {
+		if n > bestN || n == bestN && k < best {
+			best, bestN = k, n
+		}
+	}
+	return best
+}
@@ -0,0 +1,56 @@
+package web
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Java-style test class names, like TestFoo.java or FooTest.java.
+var javaTestRE = regexp.MustCompile(`^(Test[A-Z0-9_].*|.*Tests?)\.[A-Za-z]+$`)
+
+// testMatcher classifies files as tests, by the configured path globs or by
+// common naming conventions.
+type testMatcher struct {
+	// Nil to use isTestPath.
+	paths *pathFilter
+}
+
+func newTestMatcher(globs []string) (*testMatcher, error) {
+	if len(globs) == 0 {
+		return &testMatcher{}, nil
+	}
+	paths, err := parsePathFilter(globs)
+	if err != nil {
+		return nil, fmt.Errorf("test paths: %v", err)
+	}
+	return &testMatcher{paths: paths}, nil
+}
+
+func (m *testMatcher) match(p string) bool {
+	if m.paths == nil {
+		return isTestPath(p)
+	}
+	return m.paths.match(p)
+}
+
+// isTestPath tells if the path looks like a test file, by common naming
+// conventions.
+func isTestPath(p string) bool {
+	base := p[strings.LastIndex(p, "/")+1:]
+	if javaTestRE.MatchString(base) {
+		return true
+	}
+	lp := strings.ToLower(p)
+	lbase := strings.ToLower(base)
+	return strings.Contains(lbase, "_test.") ||
+		strings.Contains(lbase, ".test.") ||
+		strings.Contains(lbase, ".spec.") ||
+		strings.HasPrefix(lbase, "test_") ||
+		hasPathDir(lp, "test") || hasPathDir(lp, "tests") || hasPathDir(lp, "spec")
+}
+
+// hasPathDir tells if a directory of the path is named dir.
+func hasPathDir(p, dir string) bool {
+	return strings.HasPrefix("/"+p, "/"+dir+"/") || strings.Contains(p, "/"+dir+"/")
+}
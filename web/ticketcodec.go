@@ -0,0 +1,195 @@
+package web
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// TicketParts identify a repo (Path empty), directory or file in the index.
+type TicketParts struct {
+	Repo string
+	// Empty for repos without branches, or to mean any branch.
+	Branch string
+	// Relative to the repo root, slash-separated.
+	Path string
+	// True for repos and directories. Only some formats tell these apart, so
+	// decoders may leave it false.
+	Dir bool
+}
+
+// TicketCodec converts between tickets, the strings identifying repos,
+// directories and files in the API, and their parts. Clients only pass around
+// tickets they got from the API, but can also construct them if they know the
+// format.
+type TicketCodec interface {
+	// Decode returns the parts of the ticket, or an error if it is not in the
+	// expected format. The empty ticket must decode to empty parts (meaning the
+	// top level of the file tree).
+	Decode(ticket string) (TicketParts, error)
+	Encode(p TicketParts) string
+}
+
+// newTicketCodec returns the codec of the named scheme, see
+// Config.TicketScheme.
+func newTicketCodec(scheme string) (TicketCodec, error) {
+	switch scheme {
+	case "", "default":
+		return DefaultTicketCodec{}, nil
+	case "kythe":
+		return KytheTicketCodec{}, nil
+	case "sourcegraph":
+		return SourcegraphTicketCodec{}, nil
+	default:
+		return nil, fmt.Errorf("unknown ticket scheme %q, want one of default, kythe, sourcegraph", scheme)
+	}
+}
+
+// DefaultTicketCodec uses the repo:path format, with repo@branch as repo for
+// branches.
+type DefaultTicketCodec struct{}
+
+func (DefaultTicketCodec) Decode(t string) (TicketParts, error) {
+	// TODO: [ticket escaping] would be needed, in case it can contain colon.
+	//   But, it seems Zoekt doesn't escape either internally (see ResultID), so
+	//   maby we can live with assuming colon won't be part of filenames.
+	parts := strings.SplitN(t, ":", 2)
+	res := TicketParts{}
+	if len(parts) > 0 {
+		res.Repo = parts[0]
+		// The file tree hands out repo@branch tickets for git-like repos.
+		if i := strings.LastIndex(res.Repo, "@"); i >= 0 {
+			res.Branch = res.Repo[i+1:]
+			res.Repo = res.Repo[:i]
+		}
+	}
+	if len(parts) > 1 {
+		res.Path = parts[1]
+	}
+	return res, nil
+}
+
+func (DefaultTicketCodec) Encode(p TicketParts) string {
+	res := p.Repo
+	if p.Branch != "" {
+		res += "@" + p.Branch
+	}
+	if p.Path != "" {
+		res += ":" + p.Path
+	}
+	return res
+}
+
+// KytheTicketCodec uses Kythe URIs like kythe://corpus?root=branch?path=path,
+// with the repo as corpus. Kythe has no notion of branches, so these go to the
+// root field.
+type KytheTicketCodec struct{}
+
+func (KytheTicketCodec) Decode(t string) (TicketParts, error) {
+	if t == "" {
+		return TicketParts{}, nil
+	}
+	if !strings.HasPrefix(t, "kythe:") {
+		return TicketParts{}, fmt.Errorf("expected kythe: scheme")
+	}
+	rest := strings.TrimPrefix(strings.TrimPrefix(t, "kythe:"), "//")
+	if i := strings.IndexByte(rest, '#'); i >= 0 {
+		// Signature, not applicable to files.
+		rest = rest[:i]
+	}
+	fields := strings.Split(rest, "?")
+	res := TicketParts{}
+	var err error
+	if res.Repo, err = kytheUnescape(fields[0]); err != nil {
+		return TicketParts{}, err
+	}
+	for _, f := range fields[1:] {
+		kv := strings.SplitN(f, "=", 2)
+		if len(kv) != 2 {
+			return TicketParts{}, fmt.Errorf("malformed field %q", f)
+		}
+		v, err := kytheUnescape(kv[1])
+		if err != nil {
+			return TicketParts{}, err
+		}
+		switch kv[0] {
+		case "path":
+			res.Path = v
+		case "root":
+			res.Branch = v
+		case "lang":
+			// Ignored, the language is known from the index.
+		default:
+			return TicketParts{}, fmt.Errorf("unknown field %q", kv[0])
+		}
+	}
+	return res, nil
+}
+
+func (KytheTicketCodec) Encode(p TicketParts) string {
+	res := "kythe://" + kytheEscape(p.Repo)
+	if p.Branch != "" {
+		res += "?root=" + kytheEscape(p.Branch)
+	}
+	if p.Path != "" {
+		res += "?path=" + kytheEscape(p.Path)
+	}
+	return res
+}
+
+// kytheEscape percent-escapes the characters meaningful in Kythe URIs, keeping
+// slashes for readability.
+func kytheEscape(s string) string {
+	parts := strings.Split(s, "/")
+	for i, p := range parts {
+		parts[i] = url.PathEscape(p)
+	}
+	return strings.Join(parts, "/")
+}
+
+func kytheUnescape(s string) (string, error) {
+	return url.PathUnescape(s)
+}
+
+// SourcegraphTicketCodec uses Sourcegraph-style URL paths: repo@rev for repos,
+// repo@rev/-/tree/path for directories and repo@rev/-/blob/path for files. The
+// @rev part is the branch, and left out if there is none.
+type SourcegraphTicketCodec struct{}
+
+func (SourcegraphTicketCodec) Decode(t string) (TicketParts, error) {
+	repoSpec, rest := t, ""
+	if i := strings.Index(t, "/-/"); i >= 0 {
+		repoSpec, rest = t[:i], t[i+len("/-/"):]
+	}
+	res := TicketParts{Repo: repoSpec, Dir: true}
+	if i := strings.LastIndex(repoSpec, "@"); i >= 0 {
+		res.Repo, res.Branch = repoSpec[:i], repoSpec[i+1:]
+	}
+	switch {
+	case rest == "":
+	case strings.HasPrefix(rest, "blob/"):
+		res.Path, res.Dir = strings.TrimPrefix(rest, "blob/"), false
+	case strings.HasPrefix(rest, "tree/"):
+		res.Path = strings.TrimPrefix(rest, "tree/")
+	default:
+		return TicketParts{}, fmt.Errorf("expected blob/ or tree/ after /-/")
+	}
+	if res.Repo == "" && (res.Branch != "" || res.Path != "") {
+		return TicketParts{}, fmt.Errorf("missing repo")
+	}
+	return res, nil
+}
+
+func (SourcegraphTicketCodec) Encode(p TicketParts) string {
+	res := p.Repo
+	if p.Branch != "" {
+		res += "@" + p.Branch
+	}
+	if p.Path == "" {
+		return res
+	}
+	if p.Dir {
+		return res + "/-/tree/" + p.Path
+	}
+	return res + "/-/blob/" + p.Path
+}
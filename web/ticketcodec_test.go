@@ -0,0 +1,77 @@
+package web
+
+import (
+	"testing"
+)
+
+func TestTicketCodecs(t *testing.T) {
+	for _, tc := range []struct {
+		scheme string
+		ticket string
+		parts  TicketParts
+		// If the parts don't encode back to the ticket.
+		decodeOnly bool
+	}{
+		{scheme: "default", ticket: "", parts: TicketParts{}},
+		{scheme: "default", ticket: "repo", parts: TicketParts{Repo: "repo"}},
+		{scheme: "default", ticket: "repo:dir/file.go", parts: TicketParts{Repo: "repo", Path: "dir/file.go"}},
+		{scheme: "default", ticket: "repo@main:file.go", parts: TicketParts{Repo: "repo", Branch: "main", Path: "file.go"}},
+		{scheme: "default", ticket: "github.com/org/repo@v1:a/b", parts: TicketParts{Repo: "github.com/org/repo", Branch: "v1", Path: "a/b"}},
+		{scheme: "kythe", ticket: "", parts: TicketParts{}, decodeOnly: true},
+		{scheme: "kythe", ticket: "kythe://repo", parts: TicketParts{Repo: "repo"}},
+		{scheme: "kythe", ticket: "kythe://repo?path=dir/file.go", parts: TicketParts{Repo: "repo", Path: "dir/file.go"}},
+		{scheme: "kythe", ticket: "kythe://repo?root=main?path=file.go", parts: TicketParts{Repo: "repo", Branch: "main", Path: "file.go"}},
+		{scheme: "kythe", ticket: "kythe://org/repo?path=with%20space.go", parts: TicketParts{Repo: "org/repo", Path: "with space.go"}},
+		{scheme: "sourcegraph", ticket: "repo", parts: TicketParts{Repo: "repo", Dir: true}},
+		{scheme: "sourcegraph", ticket: "repo@main", parts: TicketParts{Repo: "repo", Branch: "main", Dir: true}},
+		{scheme: "sourcegraph", ticket: "repo/-/tree/dir", parts: TicketParts{Repo: "repo", Path: "dir", Dir: true}},
+		{scheme: "sourcegraph", ticket: "repo@main/-/blob/dir/file.go", parts: TicketParts{Repo: "repo", Branch: "main", Path: "dir/file.go"}},
+	} {
+		t.Run(tc.scheme+" "+tc.ticket, func(t *testing.T) {
+			codec, err := newTicketCodec(tc.scheme)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := codec.Decode(tc.ticket)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tc.parts {
+				t.Errorf("Decode() = %+v, want %+v", got, tc.parts)
+			}
+			if enc := codec.Encode(tc.parts); !tc.decodeOnly && enc != tc.ticket {
+				t.Errorf("Encode() = %q, want %q", enc, tc.ticket)
+			}
+		})
+	}
+}
+
+func TestTicketCodecErrors(t *testing.T) {
+	for _, tc := range []struct {
+		scheme string
+		ticket string
+	}{
+		{"kythe", "repo:file.go"},
+		{"kythe", "kythe://repo?path"},
+		{"kythe", "kythe://repo?lines=1"},
+		{"kythe", "kythe://repo?path=%zz"},
+		{"sourcegraph", "repo/-/raw/file.go"},
+		{"sourcegraph", "@main/-/blob/file.go"},
+	} {
+		t.Run(tc.scheme+" "+tc.ticket, func(t *testing.T) {
+			codec, err := newTicketCodec(tc.scheme)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, err := codec.Decode(tc.ticket); err == nil {
+				t.Errorf("Decode() = %+v, want an error", got)
+			}
+		})
+	}
+}
+
+func TestNewTicketCodecUnknown(t *testing.T) {
+	if _, err := newTicketCodec("nope"); err == nil {
+		t.Error("got no error for an unknown scheme")
+	}
+}
@@ -0,0 +1,157 @@
+package web
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Time budget of a request, unless configured otherwise (see
+// Config.RequestBudget).
+const defaultRequestBudget = 10 * time.Second
+
+// Request stages, which get their own deadline and are reported in the
+// Server-Timing header.
+const (
+	// Finding matches.
+	stageSearch = "search"
+	// Fetching file content.
+	stageFetch = "fetch"
+	// Ranking, grouping and converting results.
+	stageProcess = "process"
+	// Serializing the response.
+	stageEncode = "encode"
+)
+
+// Share of the request budget each stage may take. Endpoints usually either
+// search or fetch. A stage never runs past the end of the budget, even if
+// earlier stages took long.
+var stageShares = map[string]float64{
+	stageSearch:  0.6,
+	stageFetch:   0.6,
+	stageProcess: 0.2,
+	stageEncode:  0.2,
+}
+
+type stageTimingsKey struct{}
+
+// stageTimings records the durations of the stages of a request.
+type stageTimings struct {
+	start  time.Time
+	budget time.Duration
+
+	mu     sync.Mutex
+	stages []stageTiming
+}
+
+type stageTiming struct {
+	name string
+	took time.Duration
+}
+
+// withStageTimings returns a context recording stages started with
+// Server.stage.
+func withStageTimings(ctx context.Context, start time.Time, budget time.Duration) (context.Context, *stageTimings) {
+	t := &stageTimings{start: start, budget: budget}
+	return context.WithValue(ctx, stageTimingsKey{}, t), t
+}
+
+// stage starts the named stage of the request. The returned context has the
+// deadline of the stage, and done must be called when the stage ends.
+func (s *Server) stage(ctx context.Context, name string) (context.Context, func()) {
+	t, ok := ctx.Value(stageTimingsKey{}).(*stageTimings)
+	if !ok {
+		return ctx, func() {}
+	}
+	start := time.Now()
+	deadline := start.Add(time.Duration(stageShares[name] * float64(t.budget)))
+	if end := t.start.Add(t.budget); deadline.After(end) {
+		deadline = end
+	}
+	ctx, cancel := context.WithDeadline(ctx, deadline)
+	return ctx, func() {
+		cancel()
+		t.mu.Lock()
+		t.stages = append(t.stages, stageTiming{name, time.Since(start)})
+		t.mu.Unlock()
+	}
+}
+
+// wallTime returns the Zoekt MaxWallTime to use within the stage of ctx: def,
+// or less if the stage deadline is closer. Zoekt then returns what it found
+// in time, rather than failing on the canceled context.
+func wallTime(ctx context.Context, def time.Duration) time.Duration {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return def
+	}
+	// Leave some time to collect the results.
+	if left := time.Until(deadline) * 9 / 10; left < def {
+		if left <= 0 {
+			// Zoekt takes zero as no limit.
+			return time.Millisecond
+		}
+		return left
+	}
+	return def
+}
+
+// header renders the Server-Timing header value, with a "total" entry for the
+// time since the request start.
+func (t *stageTimings) header() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var parts []string
+	for _, st := range t.stages {
+		parts = append(parts, serverTimingEntry(st.name, st.took))
+	}
+	parts = append(parts, serverTimingEntry("total", time.Since(t.start)))
+	return strings.Join(parts, ", ")
+}
+
+func serverTimingEntry(name string, d time.Duration) string {
+	return fmt.Sprintf("%s;dur=%.3f", name, float64(d)/float64(time.Millisecond))
+}
+
+// timingWriter adds the Server-Timing header when the response header is
+// written, covering the stages done by then.
+type timingWriter struct {
+	http.ResponseWriter
+	timings     *stageTimings
+	wroteHeader bool
+}
+
+func (w *timingWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		w.Header().Set("Server-Timing", w.timings.header())
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *timingWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *timingWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack passes through to the underlying writer, for WebSocket endpoints.
+func (w *timingWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("response writer %T can't be hijacked", w.ResponseWriter)
+	}
+	return h.Hijack()
+}
@@ -0,0 +1,387 @@
+package web
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/zoekt"
+)
+
+// ContentTransformer renders file content of some type in a readable form,
+// served by /api/source with format=rendered. Like a notebook as code with
+// the outputs in comments.
+type ContentTransformer struct {
+	// Identifies the transformer, sent in the transformerHeader of responses.
+	Name string
+	// Path globs (see parsePathFilter) of the files transformed, like
+	// "*.ipynb".
+	Paths []string
+	// Returns the rendered content. Should give up once ctx is done, see
+	// transformers.run.
+	Transform func(ctx context.Context, content []byte) ([]byte, error)
+}
+
+// builtinTransformers are available without configuration, after the ones of
+// Server.Transformers.
+var builtinTransformers = []ContentTransformer{
+	{"notebook", []string{"*.ipynb"}, renderNotebook},
+	{"json-lockfile", []string{"*.bazel.lock", "package-lock.json", "composer.lock"}, renderIndentedJSON},
+	{"minified", []string{"*.min.js", "*.min.css"}, renderMinified},
+}
+
+// Response header naming the transformer of format=rendered responses.
+const transformerHeader = "X-Underhood-Transformer"
+
+// Default of SourceConfig.RenderTimeout.
+const defaultRenderTimeout = 2 * time.Second
+
+// Rendered content above this is an error, guarding against transformers
+// blowing up small inputs.
+const maxRenderedBytes = 64 << 20
+
+type transformer struct {
+	ContentTransformer
+	paths *pathFilter
+}
+
+// transformers picks the transformer of files by their path.
+type transformers struct {
+	ts      []transformer
+	timeout time.Duration
+}
+
+func newTransformers(custom []ContentTransformer, c SourceConfig) (*transformers, error) {
+	t := &transformers{timeout: defaultRenderTimeout}
+	if c.RenderTimeout != "" {
+		d, err := time.ParseDuration(c.RenderTimeout)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("render timeout %q: want a positive duration like \"2s\"", c.RenderTimeout)
+		}
+		t.timeout = d
+	}
+	for _, ct := range append(custom[:len(custom):len(custom)], builtinTransformers...) {
+		if ct.Name == "" || ct.Transform == nil || len(ct.Paths) == 0 {
+			return nil, fmt.Errorf("content transformer %q: name, paths and function are required", ct.Name)
+		}
+		paths, err := parsePathFilter(ct.Paths)
+		if err != nil {
+			return nil, fmt.Errorf("content transformer %q: %v", ct.Name, err)
+		}
+		t.ts = append(t.ts, transformer{ct, paths})
+	}
+	return t, nil
+}
+
+// lookup returns the first transformer of the path, or nil if none applies.
+func (t *transformers) lookup(p string) *transformer {
+	for i := range t.ts {
+		if t.ts[i].paths.match(p) {
+			return &t.ts[i]
+		}
+	}
+	return nil
+}
+
+// names returns the names of the transformers, in lookup order.
+func (t *transformers) names() []string {
+	ns := []string{}
+	for _, tr := range t.ts {
+		ns = append(ns, tr.Name)
+	}
+	return ns
+}
+
+// run transforms content, keeping the server safe from a misbehaving
+// transformer: panics are recovered, and the request doesn't wait longer than
+// the timeout. A transformer ignoring its context keeps running in the
+// background until done, but its result is dropped.
+func (t *transformers) run(ctx context.Context, tr *transformer, content []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, t.timeout)
+	defer cancel()
+	type result struct {
+		out []byte
+		err error
+	}
+	// Buffered, so an abandoned transformer doesn't block forever.
+	done := make(chan result, 1)
+	go func() {
+		defer func() {
+			if e := recover(); e != nil {
+				log.Printf("transformer %s crashed: %v, %s", tr.Name, e, debug.Stack())
+				done <- result{err: fmt.Errorf("crashed")}
+			}
+		}()
+		out, err := tr.Transform(ctx, content)
+		done <- result{out, err}
+	}()
+	select {
+	case res := <-done:
+		if res.err != nil {
+			return nil, errorf(ErrRenderFailed, "Rendering with %s failed: %v", tr.Name, res.err)
+		}
+		if len(res.out) > maxRenderedBytes {
+			return nil, errorf(ErrRenderFailed, "Rendering with %s failed: output above %d bytes", tr.Name, maxRenderedBytes)
+		}
+		return res.out, nil
+	case <-ctx.Done():
+		metricRenderTimeouts.WithLabelValues(tr.Name).Inc()
+		return nil, errorf(ErrRenderFailed, "Rendering with %s took longer than %v", tr.Name, t.timeout)
+	}
+}
+
+// writeSourceRendered responds with f rendered by its transformer, as plain
+// text.
+func (s *Server) writeSourceRendered(w http.ResponseWriter, r *http.Request, f *zoekt.FileMatch) error {
+	tr := s.transformers.lookup(f.FileName)
+	if tr == nil {
+		return errorf(ErrParamInvalid, "No transformer renders %s, format=rendered supports: %s", f.FileName, strings.Join(s.transformers.names(), ", "))
+	}
+	etag := contentETag(f.Checksum, "rendered-"+tr.Name)
+	if r.Header.Get("If-None-Match") == etag {
+		w.Header().Set("ETag", etag)
+		w.WriteHeader(http.StatusNotModified)
+		return nil
+	}
+	out, err := s.transformers.run(r.Context(), tr, f.Content)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Content-Type", "text/plain; charset=UTF-8")
+	w.Header().Set(transformerHeader, tr.Name)
+	w.Header().Set("Content-Length", strconv.Itoa(len(out)))
+	w.WriteHeader(http.StatusOK)
+	if r.Method != http.MethodHead {
+		w.Write(out)
+	}
+	return nil
+}
+
+// renderNotebook renders a Jupyter notebook in the "percent" format of
+// Jupytext: code cells as-is, markdown cells and text outputs as comments,
+// each cell starting with a "# %%" line.
+func renderNotebook(ctx context.Context, content []byte) ([]byte, error) {
+	var nb struct {
+		Cells []struct {
+			CellType string          `json:"cell_type"`
+			Source   json.RawMessage `json:"source"`
+			Outputs  []struct {
+				OutputType string                     `json:"output_type"`
+				Text       json.RawMessage            `json:"text"`
+				Data       map[string]json.RawMessage `json:"data"`
+				EName      string                     `json:"ename"`
+				EValue     string                     `json:"evalue"`
+			} `json:"outputs"`
+		} `json:"cells"`
+		Metadata struct {
+			LanguageInfo struct {
+				Name string `json:"name"`
+			} `json:"language_info"`
+		} `json:"metadata"`
+	}
+	if err := json.Unmarshal(content, &nb); err != nil {
+		return nil, fmt.Errorf("not a notebook: %v", err)
+	}
+	// Jupytext uses the comment syntax of the kernel language, but "#" suits
+	// the usual Python, R and Julia notebooks.
+	comment := "#"
+	switch nb.Metadata.LanguageInfo.Name {
+	case "javascript", "typescript", "c++", "java", "scala", "go", "rust":
+		comment = "//"
+	}
+	var b bytes.Buffer
+	for i, c := range nb.Cells {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if i > 0 {
+			b.WriteByte('\n')
+		}
+		src, err := notebookText(c.Source)
+		if err != nil {
+			return nil, fmt.Errorf("cell %d: %v", i+1, err)
+		}
+		switch c.CellType {
+		case "code":
+			fmt.Fprintf(&b, "%s %%%%\n", comment)
+			writeLines(&b, "", src)
+		default:
+			fmt.Fprintf(&b, "%s %%%% [%s]\n", comment, c.CellType)
+			writeLines(&b, comment+" ", src)
+		}
+		for _, o := range c.Outputs {
+			var text string
+			switch o.OutputType {
+			case "stream":
+				text, err = notebookText(o.Text)
+			case "execute_result", "display_data":
+				if d, ok := o.Data["text/plain"]; ok {
+					text, err = notebookText(d)
+				} else {
+					// Like images, named by the first MIME type.
+					mimes := []string{}
+					for mime := range o.Data {
+						mimes = append(mimes, mime)
+					}
+					if len(mimes) > 0 {
+						sort.Strings(mimes)
+						text = "<" + mimes[0] + ">"
+					}
+				}
+			case "error":
+				text = o.EName + ": " + o.EValue
+			}
+			if err != nil {
+				return nil, fmt.Errorf("cell %d output: %v", i+1, err)
+			}
+			if text != "" {
+				writeLines(&b, comment+" > ", text)
+			}
+		}
+	}
+	return b.Bytes(), nil
+}
+
+// notebookText decodes the multiline strings of notebooks, which are either a
+// string or a list of lines.
+func notebookText(m json.RawMessage) (string, error) {
+	if len(m) == 0 {
+		return "", nil
+	}
+	var s string
+	if err := json.Unmarshal(m, &s); err == nil {
+		return s, nil
+	}
+	var lines []string
+	if err := json.Unmarshal(m, &lines); err != nil {
+		return "", err
+	}
+	return strings.Join(lines, ""), nil
+}
+
+// writeLines writes the lines of text, each with the prefix.
+func writeLines(b *bytes.Buffer, prefix, text string) {
+	for _, l := range strings.Split(strings.TrimSuffix(text, "\n"), "\n") {
+		b.WriteString(strings.TrimRight(prefix+l, " "))
+		b.WriteByte('\n')
+	}
+}
+
+// renderIndentedJSON indents JSON, like lockfiles written on a single line.
+func renderIndentedJSON(ctx context.Context, content []byte) ([]byte, error) {
+	var b bytes.Buffer
+	if err := json.Indent(&b, bytes.TrimSpace(content), "", "  "); err != nil {
+		return nil, err
+	}
+	b.WriteByte('\n')
+	return b.Bytes(), nil
+}
+
+// renderMinified breaks minified JavaScript or CSS into lines after "{", ";"
+// and "}", indenting by brace depth. Strings and comments are left alone, but
+// regexp literals are not recognized, so those containing these characters
+// can come out broken up. Good enough for reading.
+func renderMinified(ctx context.Context, content []byte) ([]byte, error) {
+	var b bytes.Buffer
+	depth := 0
+	// Open string or comment: a quote character, '/' for a line comment or
+	// '*' for a block one.
+	var in byte
+	// Of the '*' opening the block comment, which can't also close it.
+	commentStart := 0
+	newline := func() {
+		b.WriteByte('\n')
+		b.WriteString(strings.Repeat("  ", depth))
+	}
+	// Parentheses, within which ";" separates for-loop clauses.
+	parens := 0
+	for i := 0; i < len(content); i++ {
+		if i%(1<<16) == 0 && ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		c := content[i]
+		switch {
+		case in == '/':
+			b.WriteByte(c)
+			if c == '\n' {
+				in = 0
+			}
+			continue
+		case in == '*':
+			b.WriteByte(c)
+			if c == '/' && i-1 > commentStart && content[i-1] == '*' {
+				in = 0
+			}
+			continue
+		case in != 0:
+			b.WriteByte(c)
+			if c == '\\' && i+1 < len(content) {
+				i++
+				b.WriteByte(content[i])
+			} else if c == in {
+				in = 0
+			}
+			continue
+		}
+		switch c {
+		case '"', '\'', '`':
+			in = c
+			b.WriteByte(c)
+		case '/':
+			b.WriteByte(c)
+			if i+1 < len(content) && (content[i+1] == '/' || content[i+1] == '*') {
+				i++
+				in = content[i]
+				commentStart = i
+				b.WriteByte(in)
+			}
+		case '(':
+			parens++
+			b.WriteByte(c)
+		case ')':
+			if parens > 0 {
+				parens--
+			}
+			b.WriteByte(c)
+		case '{':
+			b.WriteByte(c)
+			depth++
+			newline()
+		case '}':
+			if depth > 0 {
+				depth--
+			}
+			// Drop the indent written after the last line break.
+			b.Truncate(len(bytes.TrimRight(b.Bytes(), " ")))
+			if bs := b.Bytes(); len(bs) > 0 && bs[len(bs)-1] != '\n' {
+				newline()
+			} else {
+				b.WriteString(strings.Repeat("  ", depth))
+			}
+			b.WriteByte(c)
+			if i+1 < len(content) && content[i+1] != ';' && content[i+1] != ',' && content[i+1] != ')' {
+				newline()
+			}
+		case ';':
+			b.WriteByte(c)
+			if parens == 0 {
+				newline()
+			}
+		case '\n':
+			newline()
+		default:
+			b.WriteByte(c)
+		}
+	}
+	out := bytes.TrimRight(b.Bytes(), " \n")
+	return append(out, '\n'), nil
+}
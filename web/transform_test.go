@@ -0,0 +1,34 @@
+package web
+
+import (
+	"context"
+	"testing"
+)
+
+func TestRenderMinified(t *testing.T) {
+	for _, tc := range []struct {
+		name, in, want string
+	}{
+		{"block", "a{b;c}", "a{\n  b;\n  c\n}\n"},
+		{"nested", "f(){if(x){y()}else{z()}}", "f(){\n  if(x){\n    y()\n  }\n  else{\n    z()\n  }\n}\n"},
+		{"empty block", "x{}", "x{\n}\n"},
+		{"comma after block", "a{b},c{d}", "a{\n  b\n},c{\n  d\n}\n"},
+		{"for clauses", "for(i=0;i<n;i++){x()}", "for(i=0;i<n;i++){\n  x()\n}\n"},
+		{"string", `s="{;}";t=1`, "s=\"{;}\";\nt=1\n"},
+		{"escaped quote", `a="\"{";b`, "a=\"\\\"{\";\nb\n"},
+		{"block comment", "/* a;{ */b;c", "/* a;{ */b;\nc\n"},
+		{"line comment", "// x;y\nz;w", "// x;y\nz;\nw\n"},
+		{"block comment opening with slash", "/*/ a;{ */b;c", "/*/ a;{ */b;\nc\n"},
+		{"empty block comment", "/**/a;b", "/**/a;\nb\n"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := renderMinified(context.Background(), []byte(tc.in))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tc.want {
+				t.Errorf("renderMinified(%q) = %q, want %q", tc.in, got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,345 @@
+package web
+
+import (
+	"container/list"
+	"crypto/sha1"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Bounds of treeCache: the path tries of this many repos (or branches) are
+// kept, dropping the least recently used, and all file sizes are dropped once
+// there are this many.
+const (
+	treeCacheEntries = 100
+	treeCacheSizes   = 100000
+)
+
+// The shard stamp of the index directory is computed at most this often, see
+// shardStamper.
+const shardStampInterval = 2 * time.Second
+
+// pathNode is a node of a per-repo path trie. The root node stands for the
+// repository itself.
+type pathNode struct {
+	// Keyed by path component. Nil for files.
+	children map[string]*pathNode
+	isFile   bool
+	// For directories, true if all files below are generated.
+	generated bool
+	// Only set for files.
+	meta *fileMeta
+	// Only set for the root: the repo's URL template, see urlTemplates.
+	fileURLTemplate string
+}
+
+// fileMeta is file metadata that comes for free with the path listing.
+type fileMeta struct {
+	language string
+	// Commit the file is from.
+	version string
+	// Set for virtual files, which have no other metadata.
+	virtual *virtualFile
+}
+
+func newPathTrie() *pathNode {
+	return &pathNode{children: map[string]*pathNode{}}
+}
+
+// insert adds a file path (slash-separated, relative to repo root), creating
+// intermediate directory nodes as needed.
+func (n *pathNode) insert(path string, meta *fileMeta) {
+	parts := strings.Split(path, "/")
+	cur := n
+	for i, p := range parts {
+		child, ok := cur.children[p]
+		if !ok {
+			child = &pathNode{}
+			if i == len(parts)-1 {
+				child.isFile = true
+				child.meta = meta
+			} else {
+				child.children = map[string]*pathNode{}
+			}
+			cur.children[p] = child
+		}
+		cur = child
+		if cur.isFile {
+			// Shouldn't happen with sane paths (a file being a dir prefix).
+			return
+		}
+	}
+}
+
+// lookup returns the node at path, or nil if not present. Empty path means
+// the root.
+func (n *pathNode) lookup(path string) *pathNode {
+	if path == "" {
+		return n
+	}
+	cur := n
+	for _, p := range strings.Split(path, "/") {
+		if cur.isFile {
+			return nil
+		}
+		next, ok := cur.children[p]
+		if !ok {
+			return nil
+		}
+		cur = next
+	}
+	return cur
+}
+
+// sizeKey returns the key of a file size in treeCache.
+func sizeKey(t ticket, path string) string {
+	return t.repoSpec() + ":" + path
+}
+
+// treeCache is an LRU cache of path tries of repositories, keyed by repo (and
+// branch, if any). All entries are dropped once the set of shards in the
+// index directory changes, since we can't easily tell which repos a shard
+// update affected.
+//
+// It also holds file sizes, which are fetched lazily since they need the
+// content. These are keyed by sizeKey.
+type treeCache struct {
+	stamper *shardStamper
+
+	mu    sync.Mutex
+	stamp string
+	// Of *treeCacheEntry, most recently used first.
+	lru     *list.List
+	entries map[string]*list.Element
+	sizes   map[string]int
+}
+
+type treeCacheEntry struct {
+	key  string
+	root *pathNode
+}
+
+// newTreeCache returns a cache of the tries of the index stamped by stamper.
+// If its directory is empty, entries are never invalidated.
+func newTreeCache(stamper *shardStamper) *treeCache {
+	return &treeCache{
+		stamper: stamper,
+		lru:     list.New(),
+		entries: map[string]*list.Element{},
+		sizes:   map[string]int{},
+	}
+}
+
+// getSizes returns the cached sizes of the given files (by sizeKey), and
+// whether all of them were present.
+func (c *treeCache) getSizes(tickets []string) (map[string]int, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	res := map[string]int{}
+	for _, t := range tickets {
+		if sz, ok := c.sizes[t]; ok {
+			res[t] = sz
+		}
+	}
+	return res, len(res) == len(tickets)
+}
+
+// putSizes caches file sizes keyed by sizeKey. Stamp must be the one current
+// when the sizes were fetched, to not cache stale data.
+func (c *treeCache) putSizes(stamp string, sizes map[string]int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.stamp != stamp {
+		return
+	}
+	if len(c.sizes)+len(sizes) > treeCacheSizes {
+		c.sizes = map[string]int{}
+	}
+	for t, sz := range sizes {
+		c.sizes[t] = sz
+	}
+}
+
+// currentStamp returns the shard stamp the cache contents belong to.
+func (c *treeCache) currentStamp() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stamp
+}
+
+// get returns the cached trie for key, calling load to build it on a miss.
+//
+// Note: concurrent misses for the same key will each call load. That is
+// wasteful, but harmless.
+func (c *treeCache) get(key string, load func() (*pathNode, error)) (*pathNode, error) {
+	stamp, err := c.stamper.get()
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	if stamp != c.stamp {
+		c.lru.Init()
+		c.entries = map[string]*list.Element{}
+		c.sizes = map[string]int{}
+		c.stamp = stamp
+	}
+	if el, ok := c.entries[key]; ok {
+		c.lru.MoveToFront(el)
+		c.mu.Unlock()
+		return el.Value.(*treeCacheEntry).root, nil
+	}
+	c.mu.Unlock()
+
+	n, err := load()
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.stamp != stamp {
+		return n, nil
+	}
+	if el, ok := c.entries[key]; ok {
+		c.lru.Remove(el)
+	}
+	c.entries[key] = c.lru.PushFront(&treeCacheEntry{key: key, root: n})
+	for c.lru.Len() > treeCacheEntries {
+		el := c.lru.Back()
+		c.lru.Remove(el)
+		delete(c.entries, el.Value.(*treeCacheEntry).key)
+	}
+	return n, nil
+}
+
+// shardStamper computes the shardStamp of an index directory, reusing it for
+// shardStampInterval, so requests don't each read the directory. Changes of
+// the shards are noticed that much later.
+type shardStamper struct {
+	dir string
+
+	mu    sync.Mutex
+	at    time.Time
+	stamp string
+}
+
+func newShardStamper(dir string) *shardStamper {
+	return &shardStamper{dir: dir}
+}
+
+// get returns the current stamp.
+func (s *shardStamper) get() (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.at.IsZero() && time.Since(s.at) < shardStampInterval {
+		return s.stamp, nil
+	}
+	stamp, err := shardStamp(s.dir)
+	if err != nil {
+		return "", err
+	}
+	s.at, s.stamp = time.Now(), stamp
+	return stamp, nil
+}
+
+// shardStamp returns a fingerprint of the shard files in dir, which changes
+// whenever a shard is added, removed or rewritten.
+func shardStamp(dir string) (string, error) {
+	if dir == "" {
+		return "", nil
+	}
+	// Note: ReadDir returns entries sorted by name.
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return "", err
+	}
+	h := sha1.New()
+	for _, fi := range fis {
+		if filepath.Ext(fi.Name()) != ".zoekt" {
+			continue
+		}
+		fmt.Fprintf(h, "%s %d %d\n", fi.Name(), fi.Size(), fi.ModTime().UnixNano())
+	}
+	return string(h.Sum(nil)), nil
+}
+
+// filtered returns a copy of the subtree at n (which is at path in the repo),
+// keeping only files selected by f, and directories having such files below.
+// Returns nil if nothing is left.
+func (n *pathNode) filtered(path string, f *pathFilter) *pathNode {
+	if n.isFile {
+		if f.match(path) {
+			return n
+		}
+		return nil
+	}
+	prefix := ""
+	if path != "" {
+		prefix = path + "/"
+	}
+	res := &pathNode{children: map[string]*pathNode{}, generated: true}
+	for name, c := range n.children {
+		if fc := c.filtered(prefix+name, f); fc != nil {
+			res.children[name] = fc
+			res.generated = res.generated && fc.generated
+		}
+	}
+	if len(res.children) == 0 {
+		return nil
+	}
+	return res
+}
+
+// markGenerated sets the generated flag of files in the subtree at n (which is
+// at path in the repo) using isGenerated, and of directories based on their
+// contents. Returns the flag of n.
+func (n *pathNode) markGenerated(path string, isGenerated func(string) bool) bool {
+	if n.isFile {
+		n.generated = isGenerated(path)
+		return n.generated
+	}
+	prefix := ""
+	if path != "" {
+		prefix = path + "/"
+	}
+	n.generated = len(n.children) > 0
+	for name, c := range n.children {
+		if !c.markGenerated(prefix+name, isGenerated) {
+			n.generated = false
+		}
+	}
+	return n.generated
+}
+
+// files returns the paths of files in the subtree at n (which is at path in
+// the repo), at most depth levels down (or all for unlimitedDepth). Virtual
+// files are skipped, as they aren't in the index.
+func (n *pathNode) files(path string, depth int) []string {
+	if n.isFile {
+		if n.meta != nil && n.meta.virtual != nil {
+			return nil
+		}
+		return []string{path}
+	}
+	if depth == 0 {
+		return nil
+	}
+	prefix := ""
+	if path != "" {
+		prefix = path + "/"
+	}
+	nextDepth := depth
+	if depth != unlimitedDepth {
+		nextDepth--
+	}
+	res := []string{}
+	for name, c := range n.children {
+		res = append(res, c.files(prefix+name, nextDepth)...)
+	}
+	return res
+}
@@ -0,0 +1,97 @@
+package web
+
+import (
+	"bytes"
+	"log"
+	"strconv"
+	"sync"
+	"text/template"
+
+	"github.com/google/zoekt"
+)
+
+// urlTemplates renders the per-repo URL templates of Zoekt (see
+// zoekt.Repository.FileURLTemplate), which link to the code host the repo was
+// indexed from. Parsed templates are cached by their text.
+type urlTemplates struct {
+	mu    sync.Mutex
+	cache map[string]*template.Template
+}
+
+func newURLTemplates() *urlTemplates {
+	return &urlTemplates{cache: map[string]*template.Template{}}
+}
+
+// render executes the template text with data. Returns "" if text is empty or
+// fails, so these just don't get a link.
+func (u *urlTemplates) render(text string, data map[string]string) string {
+	if text == "" {
+		return ""
+	}
+	u.mu.Lock()
+	t, ok := u.cache[text]
+	if !ok {
+		var err error
+		t, err = template.New("url").Parse(text)
+		if err != nil {
+			log.Printf("url template %q: %v", text, err)
+		}
+		u.cache[text] = t
+	}
+	u.mu.Unlock()
+	if t == nil {
+		return ""
+	}
+	var b bytes.Buffer
+	if err := t.Execute(&b, data); err != nil {
+		log.Printf("url template %q: %v", text, err)
+		return ""
+	}
+	return b.String()
+}
+
+// fileURL renders the upstream URL of a file (or directory, which code hosts
+// usually redirect).
+func (u *urlTemplates) fileURL(fileTpl, branch, version, path string) string {
+	return u.render(fileTpl, map[string]string{
+		"Branch":  branch,
+		"Version": version,
+		"Path":    path,
+	})
+}
+
+// lineURL renders the upstream URL of a line (1-based) of a file. Returns ""
+// if there is no file URL, and the file URL if there is no fragment template.
+func (u *urlTemplates) lineURL(fileTpl, fragmentTpl, branch, version, path string, line int) string {
+	f := u.fileURL(fileTpl, branch, version, path)
+	if f == "" {
+		return ""
+	}
+	return f + u.render(fragmentTpl, map[string]string{
+		"LineNumber": strconv.Itoa(line),
+	})
+}
+
+// displayedFile returns the UhDisplayedFile of a file in the search result.
+func (s *Server) displayedFile(result *zoekt.SearchResult, f *zoekt.FileMatch) UhDisplayedFile {
+	return UhDisplayedFile{
+		FileTicket:  s.fileTicket(f.Repository, "", f.FileName),
+		DisplayName: s.displayNamer.name(f.Repository, "", f.FileName),
+		UpstreamURL: s.urlTemplates.fileURL(result.RepoURLs[f.Repository], firstBranch(f.Branches), f.Version, f.FileName),
+	}
+}
+
+// snippetURL returns the upstream URL of the line of a file in the search
+// result.
+func (s *Server) snippetURL(result *zoekt.SearchResult, f *zoekt.FileMatch, l zoekt.LineMatch) string {
+	return s.urlTemplates.lineURL(result.RepoURLs[f.Repository], result.LineFragments[f.Repository],
+		firstBranch(f.Branches), f.Version, f.FileName, l.LineNumber)
+}
+
+// firstBranch returns the branch to link to for a file on the given branches.
+func firstBranch(branches []string) string {
+	if len(branches) == 0 {
+		return ""
+	}
+	return branches[0]
+}
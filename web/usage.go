@@ -0,0 +1,233 @@
+package web
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Days of usage kept for the summary.
+const usageDays = 30
+
+// Max distinct repos and features counted per day, since their names come
+// from requests. Further ones are counted as "other".
+const maxUsageKeys = 1000
+
+// Repos listed in the summary.
+const usageTopRepos = 20
+
+// Endpoints whose requests count as queries.
+var queryEndpoints = map[string]bool{
+	"search-xref":  true,
+	"file-matches": true,
+	"search-files": true,
+	"search-repos": true,
+	"filesearch":   true,
+	"diff-refs":    true,
+	"refgraph":     true,
+	"zoekt":        true,
+	"grep":         true,
+}
+
+// Parameters whose values are counted as feature usage, like "source:format=json".
+var usageParams = []string{"format", "mode", "forks", "estimate", "tests", "exclude_defaults", "scope", "badge_query", "lang", "sort", "profile", "calls"}
+
+// usageStats aggregates API usage per UTC day. Only counts are kept, nothing
+// identifying users or their queries.
+type usageStats struct {
+	// Decodes tickets, to tell the repo.
+	parseTicket func(string) (ticket, error)
+
+	mu sync.Mutex
+	// Keyed by date like "2006-01-02".
+	days map[string]*dayUsage
+}
+
+type dayUsage struct {
+	requests int
+	queries  int
+	// Views keyed by repo name, from the ticket (or top) parameter.
+	repos map[string]int
+	// Counts keyed by endpoint name, or endpoint name and parameter value.
+	features map[string]int
+}
+
+func newUsageStats(parseTicket func(string) (ticket, error)) *usageStats {
+	return &usageStats{
+		parseTicket: parseTicket,
+		days:        map[string]*dayUsage{},
+	}
+}
+
+// inc increments m[k], or m["other"] if m already has too many keys.
+func inc(m map[string]int, k string) {
+	if _, ok := m[k]; !ok && len(m) >= maxUsageKeys {
+		k = "other"
+	}
+	m[k]++
+}
+
+// record counts a request to the named endpoint.
+func (u *usageStats) record(endpoint string, r *http.Request, now time.Time) {
+	if strings.HasPrefix(endpoint, "admin/") {
+		return
+	}
+	params := r.URL.Query()
+	repo := ""
+	for _, p := range []string{"ticket", "top"} {
+		if vs, ok := params[p]; ok {
+			if t, err := u.parseTicket(vs[0]); err == nil {
+				repo = t.repo
+			}
+			break
+		}
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	date := now.UTC().Format("2006-01-02")
+	d, ok := u.days[date]
+	if !ok {
+		d = &dayUsage{repos: map[string]int{}, features: map[string]int{}}
+		u.days[date] = d
+		u.expire(now)
+	}
+	d.requests++
+	if queryEndpoints[endpoint] {
+		d.queries++
+	}
+	if repo != "" {
+		inc(d.repos, repo)
+	}
+	inc(d.features, endpoint)
+	for _, p := range usageParams {
+		if vs, ok := params[p]; ok {
+			inc(d.features, endpoint+":"+p+"="+vs[0])
+		}
+	}
+}
+
+// expire drops days older than the window. Must hold mu.
+func (u *usageStats) expire(now time.Time) {
+	oldest := now.UTC().AddDate(0, 0, -usageDays+1).Format("2006-01-02")
+	for date := range u.days {
+		if date < oldest {
+			delete(u.days, date)
+		}
+	}
+}
+
+// UsageSummary is the response of /api/admin/usage-summary, covering the last
+// days of usage (in memory, so since the server start at most).
+type UsageSummary struct {
+	Generated time.Time `json:"generated"`
+	// Sorted by date.
+	Days []UsageDay `json:"days"`
+	// Most viewed repos over all days, by descending views.
+	TopRepos []RepoViews `json:"topRepos"`
+	// Summed over all days. Keyed by endpoint name, or endpoint name and
+	// parameter value like "source:format=json".
+	Features map[string]int `json:"features"`
+}
+
+type UsageDay struct {
+	Date     string `json:"date"`
+	Requests int    `json:"requests"`
+	// Requests to search endpoints.
+	Queries int `json:"queries"`
+}
+
+type RepoViews struct {
+	Repo  string `json:"repo"`
+	Views int    `json:"views"`
+}
+
+func (u *usageStats) summary(now time.Time) UsageSummary {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.expire(now)
+	res := UsageSummary{
+		Generated: now.UTC(),
+		Days:      []UsageDay{},
+		TopRepos:  []RepoViews{},
+		Features:  map[string]int{},
+	}
+	repos := map[string]int{}
+	for date, d := range u.days {
+		res.Days = append(res.Days, UsageDay{
+			Date:     date,
+			Requests: d.requests,
+			Queries:  d.queries,
+		})
+		for r, n := range d.repos {
+			repos[r] += n
+		}
+		for f, n := range d.features {
+			res.Features[f] += n
+		}
+	}
+	sort.Slice(res.Days, func(i, j int) bool {
+		return res.Days[i].Date < res.Days[j].Date
+	})
+	for r, n := range repos {
+		res.TopRepos = append(res.TopRepos, RepoViews{Repo: r, Views: n})
+	}
+	sort.Slice(res.TopRepos, func(i, j int) bool {
+		a, b := res.TopRepos[i], res.TopRepos[j]
+		if a.Views != b.Views {
+			return a.Views > b.Views
+		}
+		return a.Repo < b.Repo
+	})
+	if len(res.TopRepos) > usageTopRepos {
+		res.TopRepos = res.TopRepos[:usageTopRepos]
+	}
+	return res
+}
+
+func (s *Server) serveUsageSummary(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(s.usage.summary(time.Now())); err != nil {
+		log.Printf("encoding usage summary: %v", err)
+	}
+}
+
+// writeUsageSummaries writes the usage summary to path every interval, until
+// the process exits.
+func (s *Server) writeUsageSummaries(path string, interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := writeUsageSummary(path, s.usage.summary(time.Now())); err != nil {
+			log.Printf("writing usage summary: %v", err)
+		}
+	}
+}
+
+// writeUsageSummary replaces the file at path atomically, so readers never see
+// a partial summary.
+func writeUsageSummary(path string, sum UsageSummary) error {
+	b, err := json.MarshalIndent(sum, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
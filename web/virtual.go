@@ -0,0 +1,113 @@
+package web
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"text/template"
+)
+
+// VirtualFile is a file shown in the file tree of repos without being
+// indexed, like a generated API index page or a link to a coverage report.
+// Indexed files take precedence over virtual ones at the same path.
+type VirtualFile struct {
+	// Path within the repo, like "API.md" or ".reports/coverage". Directories
+	// on the way are added to the tree as needed.
+	Path string `json:"path"`
+
+	// Repos to show the file in. Empty means all repos.
+	Repos []string `json:"repos"`
+
+	// Go text/template of the link to the file (see FileTree.UpstreamURL),
+	// given .Repo and .Branch. Optional.
+	URL string `json:"url"`
+
+	// Writes the content for /api/source, ignoring the format parameter. Nil
+	// for link-only files, for which /api/source returns ERR_NOT_FOUND. Can't
+	// be configured in Config.VirtualFiles.
+	Handler VirtualFileHandler `json:"-"`
+}
+
+// VirtualFileHandler writes the content of a virtual file of the repo (and
+// branch, if any). Returned errors are written like those of the endpoints.
+type VirtualFileHandler func(w http.ResponseWriter, r *http.Request, repo, branch string) error
+
+// virtualFiles holds the virtual files of the config and the Server.
+type virtualFiles struct {
+	files []*virtualFile
+}
+
+type virtualFile struct {
+	VirtualFile
+	// Nil if no URL.
+	url   *template.Template
+	repos map[string]bool
+}
+
+func newVirtualFiles(vs []VirtualFile) (*virtualFiles, error) {
+	res := &virtualFiles{}
+	for _, v := range vs {
+		if v.Path == "" || path.Clean(v.Path) != v.Path || strings.HasPrefix(v.Path, "/") || strings.HasPrefix(v.Path, "../") {
+			return nil, fmt.Errorf("virtual file path %q: want a clean relative path", v.Path)
+		}
+		vf := &virtualFile{VirtualFile: v}
+		if v.URL != "" {
+			t, err := template.New(v.Path).Parse(v.URL)
+			if err != nil {
+				return nil, fmt.Errorf("virtual file %q URL: %v", v.Path, err)
+			}
+			vf.url = t
+		}
+		if len(v.Repos) > 0 {
+			vf.repos = map[string]bool{}
+			for _, r := range v.Repos {
+				vf.repos[r] = true
+			}
+		}
+		res.files = append(res.files, vf)
+	}
+	return res, nil
+}
+
+// forRepo returns the virtual files shown in repo.
+func (vs *virtualFiles) forRepo(repo string) []*virtualFile {
+	var res []*virtualFile
+	for _, v := range vs.files {
+		if v.repos == nil || v.repos[repo] {
+			res = append(res, v)
+		}
+	}
+	return res
+}
+
+// lookup returns the virtual file at path in repo, or nil.
+func (vs *virtualFiles) lookup(repo, path string) *virtualFile {
+	for _, v := range vs.forRepo(repo) {
+		if v.Path == path {
+			return v
+		}
+	}
+	return nil
+}
+
+// upstreamURL renders the link of the file in the repo and branch. Empty if
+// the file has no URL, or the template fails.
+func (v *virtualFile) upstreamURL(repo, branch string) string {
+	if v.url == nil {
+		return ""
+	}
+	var b strings.Builder
+	if err := v.url.Execute(&b, struct{ Repo, Branch string }{repo, branch}); err != nil {
+		return ""
+	}
+	return b.String()
+}
+
+// serveVirtualFile serves /api/source of a virtual file.
+func serveVirtualFile(w http.ResponseWriter, r *http.Request, v *virtualFile, t ticket) error {
+	if v.Handler == nil {
+		return errorf(ErrNotFound, "Virtual file %v has no content, see its upstreamUrl", t.path)
+	}
+	return v.Handler(w, r, t.repo, t.branch)
+}
@@ -0,0 +1,144 @@
+package web
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Defaults of SearchConfig.XrefCacheEntries and XrefCacheTTL.
+const (
+	defaultXrefCacheEntries = 200
+	defaultXrefCacheTTL     = 5 * time.Minute
+)
+
+// xrefCache is an LRU cache of the searched files of xref requests, keyed by
+// xrefCacheKey. Like treeCache, all entries are dropped once the shards in
+// the index directory change.
+type xrefCache struct {
+	stamper    *shardStamper
+	maxEntries int
+	ttl        time.Duration
+
+	mu    sync.Mutex
+	stamp string
+	// Of *xrefCacheEntry, most recently used first.
+	lru     *list.List
+	entries map[string]*list.Element
+}
+
+type xrefCacheEntry struct {
+	key   string
+	added time.Time
+	sites []fileSites
+}
+
+// newXrefCache returns the cache configured by c, or nil if disabled. If the
+// directory of stamper is empty, entries are only invalidated by age.
+func newXrefCache(stamper *shardStamper, c SearchConfig) (*xrefCache, error) {
+	entries := c.XrefCacheEntries
+	if entries == 0 {
+		entries = defaultXrefCacheEntries
+	}
+	if entries < 0 {
+		return nil, nil
+	}
+	ttl := defaultXrefCacheTTL
+	if c.XrefCacheTTL != "" {
+		var err error
+		ttl, err = time.ParseDuration(c.XrefCacheTTL)
+		if err != nil || ttl <= 0 {
+			return nil, fmt.Errorf("xref cache TTL %q: want a positive duration like \"5m\"", c.XrefCacheTTL)
+		}
+	}
+	return &xrefCache{
+		stamper:    stamper,
+		maxEntries: entries,
+		ttl:        ttl,
+		lru:        list.New(),
+		entries:    map[string]*list.Element{},
+	}, nil
+}
+
+// xrefCacheKey identifies the searches of the xref query rq. The query
+// already carries the selection, casing, mode and scope. The profile's limits
+// change what's found, so they are part of the key too.
+func xrefCacheKey(rq string, estimate bool, p *searchProfile) string {
+	return fmt.Sprintf("%s\x00%v\x00%d\x00%v", rq, estimate, p.maxFiles, p.matchLimitFactor)
+}
+
+// get returns the cached files for key. Stamp is the current shard stamp.
+func (c *xrefCache) get(key, stamp string, now time.Time) ([]fileSites, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if stamp != c.stamp {
+		c.lru.Init()
+		c.entries = map[string]*list.Element{}
+		c.stamp = stamp
+	}
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	e := el.Value.(*xrefCacheEntry)
+	if now.Sub(e.added) > c.ttl {
+		c.lru.Remove(el)
+		delete(c.entries, key)
+		return nil, false
+	}
+	c.lru.MoveToFront(el)
+	return e.sites, true
+}
+
+// put caches files for key, unless the shards changed since get was called
+// with stamp. The files must not be modified afterwards.
+func (c *xrefCache) put(key, stamp string, sites []fileSites, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if stamp != c.stamp {
+		return
+	}
+	if el, ok := c.entries[key]; ok {
+		c.lru.Remove(el)
+	}
+	c.entries[key] = c.lru.PushFront(&xrefCacheEntry{key: key, added: now, sites: sites})
+	for c.lru.Len() > c.maxEntries {
+		el := c.lru.Back()
+		c.lru.Remove(el)
+		delete(c.entries, el.Value.(*xrefCacheEntry).key)
+	}
+}
+
+// cachedSearches is appendSearches, with the files cached across requests.
+// Partial results, cut short by the time budget, are not cached.
+func (s *Server) cachedSearches(rq string, ctx context.Context, estimate bool, manyFileSites *[]fileSites) (string, error) {
+	if s.xrefCache == nil {
+		_, partial, err := s.appendSearches(rq, ctx, estimate, manyFileSites)
+		return partial, err
+	}
+	stamp, err := s.xrefCache.stamper.get()
+	if err != nil {
+		_, partial, err := s.appendSearches(rq, ctx, estimate, manyFileSites)
+		return partial, err
+	}
+	key := xrefCacheKey(rq, estimate, s.profile(ctx))
+	if sites, ok := s.xrefCache.get(key, stamp, time.Now()); ok {
+		metricXrefCacheRequests.WithLabelValues("hit").Inc()
+		// Callers reorder the slice, but don't modify the files.
+		*manyFileSites = append(*manyFileSites, sites...)
+		return "", nil
+	}
+	metricXrefCacheRequests.WithLabelValues("miss").Inc()
+	sites := []fileSites{}
+	_, partial, err := s.appendSearches(rq, ctx, estimate, &sites)
+	if err != nil {
+		return "", err
+	}
+	if partial == "" {
+		s.xrefCache.put(key, stamp, sites, time.Now())
+	}
+	*manyFileSites = append(*manyFileSites, sites...)
+	return partial, nil
+}